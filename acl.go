@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// folderACLFileName is the name of the file in a media folder that
+// limits which users may access it, see readFolderACL
+const folderACLFileName = ".mediaweb-acl"
+
+// readFolderACL returns the users allowed to access a media folder
+// according to its ACL file, which has one user name per line. Empty
+// lines and lines starting with # are ignored. Returns false if the folder
+// has no ACL file, i.e. it is open to all users.
+func readFolderACL(fullFolderPath string) (map[string]bool, bool) {
+	content, err := os.ReadFile(filepath.Join(fullFolderPath, folderACLFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			// Better to deny everyone than to silently open the folder
+			log.Warnf("Unable to read %s in %s. Reason: %s", folderACLFileName, fullFolderPath, err)
+			return map[string]bool{}, true
+		}
+		return nil, false // No ACL file is normal
+	}
+	users := map[string]bool{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			users[line] = true
+		}
+	}
+	return users, true
+}
+
+// isPermitted returns true if the user may access the media file or
+// folder, i.e. if the user is listed in the ACL files of all folders from
+// the media path down to it. Folders without ACL file inherit the access
+// of their parent folder, and a sub folder can only limit the access
+// further. Invalid paths are left to the caller to reject.
+func (m *Media) isPermitted(relativePath, user string) bool {
+	return m.newACLChecker(user).isPermitted(relativePath)
+}
+
+// aclChecker checks the access of a user to media files and folders, see
+// Media.isPermitted. The result of each folder is kept, so that many files
+// (e.g. search results) can be checked without reading the same ACL files
+// again. It shall only be used during one request.
+type aclChecker struct {
+	media   *Media
+	user    string
+	folders map[string]bool // Relative folder path -> permitted
+}
+
+// newACLChecker returns an aclChecker for the user
+func (m *Media) newACLChecker(user string) *aclChecker {
+	return &aclChecker{media: m, user: user, folders: map[string]bool{}}
+}
+
+// isPermitted returns true if the user may access the media file or
+// folder, see Media.isPermitted
+func (a *aclChecker) isPermitted(relativePath string) bool {
+	relativePath = strings.Trim(path.Clean("/"+filepath.ToSlash(relativePath)), "/")
+	fullPath, err := a.media.getFullMediaPath(relativePath)
+	if err != nil {
+		return true
+	}
+	if relativePath != "" && !isDir(fullPath) {
+		relativePath = parentFolder(relativePath) // Files have the access of their folder
+	}
+	return a.isFolderPermitted(relativePath)
+}
+
+// isFolderPermitted returns true if the user is listed in the ACL files of
+// the folder and all its parent folders (if they have ACL files)
+func (a *aclChecker) isFolderPermitted(relativeFolderPath string) bool {
+	if permitted, ok := a.folders[relativeFolderPath]; ok {
+		return permitted
+	}
+	permitted := relativeFolderPath == "" || a.isFolderPermitted(parentFolder(relativeFolderPath))
+	if permitted {
+		fullFolderPath, err := a.media.getFullMediaPath(relativeFolderPath)
+		if err != nil {
+			permitted = false
+		} else if users, ok := readFolderACL(fullFolderPath); ok && !users[a.user] {
+			permitted = false
+		}
+	}
+	a.folders[relativeFolderPath] = permitted
+	return permitted
+}
+
+// parentFolder returns the relative path of the folder of a relative
+// media path ("" for the media path itself)
+func parentFolder(relativePath string) string {
+	folder := path.Dir(relativePath)
+	if folder == "." || folder == "/" {
+		return ""
+	}
+	return folder
+}
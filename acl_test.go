@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReadFolderACL(t *testing.T) {
+	mediaPath := "tmpout/TestReadFolderACL"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+
+	_, ok := readFolderACL(mediaPath)
+	assertFalse(t, "No ACL file", ok)
+
+	content := "# Family only\nanna\r\n\n  bert  \n"
+	assertExpectNoErr(t, "", os.WriteFile(mediaPath+"/"+folderACLFileName, []byte(content), 0644))
+	users, ok := readFolderACL(mediaPath)
+	assertTrue(t, "", ok)
+	assertEqualsInt(t, "", 2, len(users))
+	assertTrue(t, "", users["anna"])
+	assertTrue(t, "", users["bert"])
+
+	// Empty file means nobody
+	assertExpectNoErr(t, "", os.WriteFile(mediaPath+"/"+folderACLFileName, []byte(""), 0644))
+	users, ok = readFolderACL(mediaPath)
+	assertTrue(t, "", ok)
+	assertEqualsInt(t, "", 0, len(users))
+}
+
+func TestIsPermitted(t *testing.T) {
+	mediaPath := "tmpout/TestIsPermitted"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/family/private/deeper", os.ModePerm)
+	os.MkdirAll(mediaPath+"/public", os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/family/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/family/private/deeper/png.png")
+	os.WriteFile(mediaPath+"/family/"+folderACLFileName, []byte("anna\nbert\n"), 0644)
+	os.WriteFile(mediaPath+"/family/private/"+folderACLFileName, []byte("anna\ncarl\n"), 0644)
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	// Unlisted folders are open to all users
+	for _, path := range []string{"", "/", "png.png", "public", "/public/"} {
+		assertTrue(t, path, media.isPermitted(path, "carl"))
+	}
+
+	// Inherited by sub folders and files
+	for _, path := range []string{"family", "family/png.png", "family/private", "family/private/deeper/png.png"} {
+		assertTrue(t, path, media.isPermitted(path, "anna"))
+		assertFalse(t, path, media.isPermitted(path, "dave"))
+		assertFalse(t, path, media.isPermitted(path, ""))
+	}
+	assertTrue(t, "", media.isPermitted("family/png.png", "bert"))
+
+	// A sub folder can only limit the access further
+	assertFalse(t, "", media.isPermitted("family/private", "bert"))
+	assertFalse(t, "", media.isPermitted("family/private/deeper/png.png", "bert"))
+	assertFalse(t, "Not in family", media.isPermitted("family/private/deeper", "carl"))
+	assertFalse(t, "", media.isPermitted("family/../family/png.png", "dave"))
+}
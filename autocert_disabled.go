@@ -0,0 +1,15 @@
+//go:build !autocert
+
+// Placeholder used when building without Let's Encrypt support
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// configureAutocert always fails since Let's Encrypt support is not
+// included in the build
+func configureAutocert(server *http.Server, domains []string, cacheDir string, httpAddr string) error {
+	return fmt.Errorf("autocert not supported. Build with -tags autocert")
+}
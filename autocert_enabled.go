@@ -0,0 +1,49 @@
+//go:build autocert
+
+// Let's Encrypt (ACME) support. Only included when building with the
+// autocert tag (go build -tags autocert).
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// configureAutocert makes server get its TLS certificates for domains
+// from Let's Encrypt. The certificates are stored in cacheDir, which is
+// created with access only for the owner since it also contains the
+// private keys. An HTTP server is started on httpAddr (e.g. :80) to
+// answer the HTTP-01 challenges (other requests are redirected to
+// HTTPS). Fails if httpAddr can't be listened on, since no certificates
+// can be fetched then.
+func configureAutocert(server *http.Server, domains []string, cacheDir string, httpAddr string) error {
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return fmt.Errorf("unable to create autocert cache directory: %w", err)
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir)}
+	server.TLSConfig.GetCertificate = manager.GetCertificate
+
+	listener, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		return fmt.Errorf("unable to listen for ACME HTTP-01 challenges: %w", err)
+	}
+	challengeServer := &http.Server{
+		Handler:           manager.HTTPHandler(nil),
+		ReadHeaderTimeout: server.ReadHeaderTimeout}
+	server.RegisterOnShutdown(func() { challengeServer.Close() })
+	go func() {
+		log.Info("Serving ACME HTTP-01 challenges on ", listener.Addr())
+		if err := challengeServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error("Unable to serve ACME HTTP-01 challenges: ", err)
+		}
+	}()
+	return nil
+}
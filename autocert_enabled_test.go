@@ -0,0 +1,34 @@
+//go:build autocert
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestConfigureAutocert(t *testing.T) {
+	cacheDir := "tmpcache/TestConfigureAutocert"
+	os.RemoveAll(cacheDir)
+
+	// Address in use
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertExpectNoErr(t, "", err)
+	defer listener.Close()
+	server := &http.Server{TLSConfig: &tls.Config{}}
+	err = configureAutocert(server, []string{"photos.example.com"}, cacheDir, listener.Addr().String())
+	assertExpectErr(t, "", err)
+
+	server = &http.Server{TLSConfig: &tls.Config{}}
+	err = configureAutocert(server, []string{"photos.example.com"}, cacheDir, "127.0.0.1:0")
+	assertExpectNoErr(t, "", err)
+	defer server.Shutdown(context.Background())
+	assertTrue(t, "", server.TLSConfig.GetCertificate != nil)
+	info, err := os.Stat(cacheDir)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 0700, int(info.Mode().Perm()))
+}
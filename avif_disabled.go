@@ -0,0 +1,18 @@
+//go:build !avif
+
+// Placeholder used when building without AVIF support
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// avifSupported is true when AVIF previews can be encoded
+const avifSupported = false
+
+// encodeAVIF always fails since AVIF support is not included in the build
+func encodeAVIF(w io.Writer, img image.Image) error {
+	return fmt.Errorf("AVIF not supported. Build with -tags avif")
+}
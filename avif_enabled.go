@@ -0,0 +1,21 @@
+//go:build avif
+
+// AVIF encoding support. Only included when building with the avif tag
+// (go build -tags avif) since the encoder increases the size of the
+// executable considerably.
+package main
+
+import (
+	"image"
+	"io"
+
+	"github.com/gen2brain/avif"
+)
+
+// avifSupported is true when AVIF previews can be encoded
+const avifSupported = true
+
+// encodeAVIF encodes img in AVIF format and writes it to w
+func encodeAVIF(w io.Writer, img image.Image) error {
+	return avif.Encode(w, img)
+}
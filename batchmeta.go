@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxBatchMetaPaths is the max number of paths in one batch meta data
+// request
+const maxBatchMetaPaths = 500
+
+// MetaData is the meta data of a media file needed by clients showing a
+// grid of thumbnails
+type MetaData struct {
+	Path         string    // Relative path of the media file
+	Type         string    // image or video ("" if not a media file)
+	Width        int       // Width as displayed (0 if unknown)
+	Height       int       // Height as displayed (0 if unknown)
+	HasThumbnail bool      // Thumbnail exist in the cache
+	HasPreview   bool      // Preview exist in the cache
+	Date         time.Time // EXIF date if available, otherwise modification time
+	Error        string    `json:",omitempty"` // Why the meta data is missing, e.g. file not found
+}
+
+// getBatchMeta returns the meta data of several media files, in the same
+// order as the paths. Files that don't exist or aren't media files get an
+// entry with Error set. An error is returned if there are too many paths
+// or any of them is outside the media path.
+func (m *Media) getBatchMeta(relativeFilePaths []string) ([]MetaData, error) {
+	if len(relativeFilePaths) > maxBatchMetaPaths {
+		return nil, fmt.Errorf("too many paths (%d), max is %d", len(relativeFilePaths), maxBatchMetaPaths)
+	}
+	for _, relativeFilePath := range relativeFilePaths {
+		if _, err := m.getFullMediaPath(relativeFilePath); err != nil {
+			return nil, err
+		}
+	}
+	result := make([]MetaData, 0, len(relativeFilePaths))
+	for _, relativeFilePath := range relativeFilePaths {
+		meta := MetaData{Path: relativeFilePath, Type: m.getFileType(relativeFilePath)}
+		if meta.Type == "" {
+			meta.Error = "not a media file"
+			result = append(result, meta)
+			continue
+		}
+		date, err := m.getDate(File{Type: meta.Type, Path: relativeFilePath})
+		if err != nil {
+			meta.Error = err.Error()
+			result = append(result, meta)
+			continue
+		}
+		meta.Date = date
+		if dimensions, err := m.getDimensions(relativeFilePath); err == nil {
+			meta.Width = dimensions.Width
+			meta.Height = dimensions.Height
+		}
+		if m.cache != nil {
+			meta.HasThumbnail = m.cache.hasThumbnail(relativeFilePath)
+			meta.HasPreview = m.cache.hasPreview(relativeFilePath)
+		}
+		result = append(result, meta)
+	}
+	return result, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGetBatchMeta(t *testing.T) {
+	mediaPath := "tmpout/TestGetBatchMeta"
+	cachePath := "tmpcache/TestGetBatchMeta"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/jpeg.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/txt.txt")
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 100, true, false, false, false, mediaOptions{})
+	_, err := media.cache.generateThumbnail(media, "png.png")
+	assertExpectNoErr(t, "", err)
+
+	metaData, err := media.getBatchMeta([]string{"jpeg.jpg", "png.png", "txt.txt", "dont_exist.jpg"})
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 4, len(metaData))
+
+	jpeg := metaData[0]
+	assertEqualsStr(t, "", "jpeg.jpg", jpeg.Path)
+	assertEqualsStr(t, "", "image", jpeg.Type)
+	assertEqualsInt(t, "", 4128, jpeg.Width)
+	assertEqualsInt(t, "", 2322, jpeg.Height)
+	assertFalse(t, "", jpeg.HasThumbnail) // EXIF thumbnail used
+	assertFalse(t, "", jpeg.HasPreview)
+	assertFalse(t, "", jpeg.Date.IsZero())
+	assertEqualsStr(t, "", "", jpeg.Error)
+
+	png := metaData[1]
+	assertEqualsStr(t, "", "png.png", png.Path)
+	assertTrue(t, "", png.HasThumbnail)
+	assertTrue(t, "", png.Width > 0)
+	stat, _ := os.Stat(mediaPath + "/png.png")
+	assertTrue(t, "", png.Date.Equal(stat.ModTime()))
+
+	assertEqualsStr(t, "", "", metaData[2].Type)
+	assertTrue(t, "", metaData[2].Error != "")
+	assertEqualsStr(t, "", "image", metaData[3].Type)
+	assertTrue(t, "", metaData[3].Error != "")
+
+	// Outside the media path
+	_, err = media.getBatchMeta([]string{"png.png", "../../testmedia/jpeg.jpg"})
+	assertExpectErr(t, "", err)
+
+	// Too many paths
+	_, err = media.getBatchMeta(make([]string, maxBatchMetaPaths+1))
+	assertExpectErr(t, "", err)
+	metaData, err = media.getBatchMeta([]string{})
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 0, len(metaData))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	log "github.com/sirupsen/logrus"
+)
+
+// BlurHash parameters, see https://blurha.sh
+const (
+	blurHashSampleSide  = 32 // Images are downscaled to fit this size before the hash is calculated
+	blurHashXComponents = 4  // Default number of horizontal components
+	blurHashYComponents = 3  // Default number of vertical components
+	blurHashCharacters  = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// blurHashCache is a cached BlurHash of a media file. It is only valid as
+// long as the modification time is the same.
+type blurHashCache struct {
+	modTime time.Time
+	hash    string
+}
+
+// blurHash returns the (cached) BlurHash of an image or video, a short
+// string that clients can decode to a blurred placeholder while the
+// thumbnail is loading. It is calculated from the thumbnail since it is
+// much faster to decode than the media file itself.
+func (m *Media) blurHash(relativeFilePath string) (string, error) {
+	fileType := m.getFileType(relativeFilePath)
+	if fileType != "image" && fileType != "video" {
+		return "", fmt.Errorf("not an image or video: %s", relativeFilePath)
+	}
+	fullPath, err := m.getFullMediaPath(relativeFilePath)
+	if err != nil {
+		return "", err
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return "", err
+	}
+	m.blurHashMutex.Lock()
+	cached, ok := m.blurHashes[relativeFilePath]
+	m.blurHashMutex.Unlock()
+	if ok && cached.modTime.Equal(stat.ModTime()) {
+		return cached.hash, nil
+	}
+
+	img, err := m.getThumbnailImage(relativeFilePath)
+	if err != nil {
+		if fileType != "image" {
+			return "", err
+		}
+		log.Debugf("No thumbnail for BlurHash of %s, using the image. Reason: %s", relativeFilePath, err)
+		img, err = openImage(fullPath, m.maxImagePixels, m.forceRotate)
+		if err != nil {
+			return "", err
+		}
+	}
+	hash := encodeBlurHash(imaging.Fit(img, blurHashSampleSide, blurHashSampleSide, imaging.Box),
+		m.blurHashXComponents, m.blurHashYComponents)
+
+	m.blurHashMutex.Lock()
+	m.blurHashes[relativeFilePath] = blurHashCache{modTime: stat.ModTime(), hash: hash}
+	m.blurHashMutex.Unlock()
+	return hash, nil
+}
+
+// addBlurHashes sets BlurHash of the images and videos. Files without a
+// BlurHash (e.g. when the thumbnail can't be generated) are left as is.
+func (m *Media) addBlurHashes(files []File) {
+	for i := range files {
+		if files[i].Type != "image" && files[i].Type != "video" {
+			continue
+		}
+		hash, err := m.blurHash(files[i].Path)
+		if err != nil {
+			log.Debugf("No BlurHash of %s. Reason: %s", files[i].Path, err)
+			continue
+		}
+		files[i].BlurHash = hash
+	}
+}
+
+// encodeBlurHash calculates the BlurHash of an image with xComponents x
+// yComponents (1 - 9 each) cosine components. More components gives more
+// details but a longer string.
+func encodeBlurHash(img image.Image, xComponents, yComponents int) string {
+	nrgba := imaging.Clone(img)
+	width, height := nrgba.Bounds().Dx(), nrgba.Bounds().Dy()
+
+	// Linear RGB of each pixel, calculated once instead of per component
+	linear := make([][3]float64, width*height)
+	for i := range linear {
+		for c := 0; c < 3; c++ {
+			linear[i][c] = srgbToLinear(nrgba.Pix[i*4+c])
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalization := 2.0
+			if i == 0 && j == 0 {
+				normalization = 1.0
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * linear[y*width+x][c]
+					}
+				}
+			}
+			scale := normalization / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, factor := range factors[1:] {
+			for c := 0; c < 3; c++ {
+				actualMax = math.Max(actualMax, math.Abs(factor[c]))
+			}
+		}
+		quantisedMax := max(0, min(82, int(math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+	for _, factor := range factors[1:] {
+		value := 0
+		for c := 0; c < 3; c++ {
+			quantised := int(math.Floor(signPow(factor[c]/maxValue, 0.5)*9 + 9.5))
+			value = value*19 + max(0, min(18, quantised))
+		}
+		hash.WriteString(encodeBase83(value, 2))
+	}
+	return hash.String()
+}
+
+// encodeBase83 encodes value with length BlurHash base 83 characters
+func encodeBase83(value, length int) string {
+	result := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		result[i] = blurHashCharacters[value%83]
+		value /= 83
+	}
+	return string(result)
+}
+
+// srgbToLinear converts an sRGB channel value to linear light (0.0 - 1.0)
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSrgb converts a linear light value (clamped to 0.0 - 1.0) to an
+// sRGB channel value
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(math.Round(v * 12.92 * 255))
+	}
+	return int(math.Round((1.055*math.Pow(v, 1/2.4) - 0.055) * 255))
+}
+
+// signPow raises the absolute value to exp, keeping the sign
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestEncodeBlurHash(t *testing.T) {
+	// Size flag, max AC value, DC (4 characters) and 2 characters per AC
+	white := imaging.New(32, 32, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+	hash := encodeBlurHash(white, 4, 3)
+	assertEqualsInt(t, "", 28, len(hash))
+	assertEqualsStr(t, "", "L", hash[:1])
+	assertEqualsStr(t, "", "TSUA", hash[2:6])
+
+	hash = encodeBlurHash(white, 1, 1)
+	assertEqualsStr(t, "", "00TSUA", hash)
+	hash = encodeBlurHash(imaging.New(32, 32, color.NRGBA{A: 255}), 1, 1)
+	assertEqualsStr(t, "", "000000", hash)
+
+	// Left half red and right half blue differs from a uniform image
+	img := imaging.New(32, 32, color.NRGBA{R: 255, A: 255})
+	img = imaging.Paste(img, imaging.New(16, 32, color.NRGBA{B: 255, A: 255}), image.Pt(16, 0))
+	hash = encodeBlurHash(img, 9, 9)
+	assertEqualsInt(t, "", 166, len(hash))
+	assertEqualsStr(t, "", "|", hash[:1])
+	assertTrue(t, "", hash != encodeBlurHash(white, 9, 9))
+}
+
+func TestEncodeBase83(t *testing.T) {
+	assertEqualsStr(t, "", "0", encodeBase83(0, 1))
+	assertEqualsStr(t, "", "~", encodeBase83(82, 1))
+	assertEqualsStr(t, "", "10", encodeBase83(83, 2))
+	assertEqualsStr(t, "", "00~~", encodeBase83(83*83-1, 4))
+}
+
+func TestBlurHash(t *testing.T) {
+	mediaPath := "tmpout/TestBlurHash"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	imaging.Save(imaging.New(300, 200, color.NRGBA{R: 255, G: 255, B: 255, A: 255}), mediaPath+"/white.png")
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/txt.txt")
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{blurHashXComponents: 2, blurHashYComponents: 2})
+	hash, err := media.blurHash("white.png")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "2x2 components", 12, len(hash))
+	assertEqualsStr(t, "", "TSUA", hash[2:6])
+
+	// Cached until the image is modified
+	imaging.Save(imaging.New(300, 200, color.NRGBA{A: 255}), mediaPath+"/white.png")
+	os.Chtimes(mediaPath+"/white.png", media.blurHashes["white.png"].modTime, media.blurHashes["white.png"].modTime)
+	cached, _ := media.blurHash("white.png")
+	assertEqualsStr(t, "", hash, cached)
+	modTime := time.Now().Add(time.Hour)
+	os.Chtimes(mediaPath+"/white.png", modTime, modTime)
+	hash, _ = media.blurHash("white.png")
+	assertEqualsStr(t, "", "0000", hash[2:6])
+
+	_, err = media.blurHash("txt.txt")
+	assertExpectErr(t, "", err)
+	_, err = media.blurHash("dont_exist.jpg")
+	assertExpectErr(t, "", err)
+
+	// Only images and videos get a BlurHash, invalid components gives default
+	media = createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{blurHashXComponents: 10, blurHashYComponents: 2})
+	files := []File{{Type: "image", Name: "white.png", Path: "white.png"}, {Type: "folder", Name: "sub", Path: "sub"}}
+	media.addBlurHashes(files)
+	assertEqualsInt(t, "4x3 components", 28, len(files[0].BlurHash))
+	assertEqualsStr(t, "", "", files[1].BlurHash)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Supported granularities of the date view and the corresponding
+// bucket name layouts
+var dateGranularities = map[string]string{
+	"year":  "2006",
+	"month": "2006-01",
+	"day":   "2006-01-02",
+}
+
+// DateBucket is a group of media files taken the same year, month or day
+type DateBucket struct {
+	Name  string // E.g. 2021, 2021-05 or 2021-05-17
+	Count int    // Number of media files
+}
+
+// datedFile is a media file with the date used by the date view
+type datedFile struct {
+	file File
+	date time.Time
+}
+
+// dateCache is a cached date of a media file. It is only valid as long
+// as the modification time is the same.
+type dateCache struct {
+	modTime time.Time
+	date    time.Time
+}
+
+// getDateBuckets returns the date buckets of all media files with the
+// provided granularity (year, month or day), newest first. Only permitted
+// files are counted (nil means all).
+func (m *Media) getDateBuckets(granularity string, permitted func(string) bool) ([]DateBucket, error) {
+	layout, ok := dateGranularities[granularity]
+	if !ok {
+		return nil, fmt.Errorf("invalid granularity: %s", granularity)
+	}
+	counts := make(map[string]int)
+	for _, datedFile := range m.getDateIndex() {
+		if permitted == nil || permitted(datedFile.file.Path) {
+			counts[datedFile.date.Format(layout)]++
+		}
+	}
+	buckets := make([]DateBucket, 0, len(counts))
+	for name, count := range counts {
+		buckets = append(buckets, DateBucket{Name: name, Count: count})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Name > buckets[j].Name
+	})
+	return buckets, nil
+}
+
+// getDateBucketFiles returns the media files in the bucket, sorted on
+// date. The granularity is given by the format of the bucket name, see
+// dateGranularities.
+func (m *Media) getDateBucketFiles(bucket string) ([]File, error) {
+	layout := ""
+	for _, granularityLayout := range dateGranularities {
+		if len(granularityLayout) == len(bucket) {
+			layout = granularityLayout
+		}
+	}
+	if _, err := time.Parse(layout, bucket); layout == "" || err != nil {
+		return nil, fmt.Errorf("invalid date bucket: %s", bucket)
+	}
+	files := []File{}
+	for _, datedFile := range m.getDateIndex() {
+		if datedFile.date.Format(layout) == bucket {
+			files = append(files, datedFile.file)
+		}
+	}
+	return files, nil
+}
+
+// getDateIndex returns all media files sorted on date. The index is
+// cached until invalidateDateIndex is called (by the watcher). Without
+// a watcher it is rebuilt on each call, which still is fairly fast since
+// the dates of unmodified files are cached.
+func (m *Media) getDateIndex() []datedFile {
+	m.dateMutex.Lock()
+	index := m.dateIndex
+	version := m.dateIndexVersion
+	m.dateMutex.Unlock()
+	if index != nil {
+		return index
+	}
+
+	index = m.getDatedFiles("")
+	sort.SliceStable(index, func(i, j int) bool {
+		return index[i].date.Before(index[j].date)
+	})
+	m.dateMutex.Lock()
+	if m.watcher != nil && version == m.dateIndexVersion {
+		// Not invalidated while building
+		m.dateIndex = index
+	}
+	m.dateMutex.Unlock()
+	return index
+}
+
+// invalidateDateIndex makes the next getDateIndex call rebuild the index
+func (m *Media) invalidateDateIndex() {
+	m.dateMutex.Lock()
+	m.dateIndex = nil
+	m.dateIndexVersion++
+	m.dateMutex.Unlock()
+}
+
+// getDatedFiles returns the media files in relativePath and its sub
+// folders together with their dates
+func (m *Media) getDatedFiles(relativePath string) []datedFile {
+	files, err := m.getFiles(relativePath)
+	if err != nil {
+		log.Warnf("Unable to read folder %s. Reason: %s", relativePath, err)
+		return nil
+	}
+	datedFiles := make([]datedFile, 0, len(files))
+	for _, file := range files {
+		if file.Type == "folder" {
+			datedFiles = append(datedFiles, m.getDatedFiles(file.Path)...) // Recursive
+			continue
+		}
+		date, err := m.getDate(file)
+		if err != nil {
+			log.Debugf("Unable to get date of %s. Reason: %s", file.Path, err)
+			continue
+		}
+		datedFiles = append(datedFiles, datedFile{file: file, date: date})
+	}
+	return datedFiles
+}
+
+// getDate returns the (cached) date of a media file. Images use the
+// EXIF date if available, otherwise (and for videos) the modification
+// time is used.
+func (m *Media) getDate(file File) (time.Time, error) {
+	fullPath, err := m.getFullMediaPath(file.Path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	m.dateMutex.Lock()
+	cached, ok := m.dates[file.Path]
+	m.dateMutex.Unlock()
+	if ok && cached.modTime.Equal(stat.ModTime()) {
+		return cached.date, nil
+	}
+
+	date := stat.ModTime()
+	if file.Type == "image" {
+		if ex := m.extractEXIF(file.Path); ex != nil {
+			if exifDate, err := ex.DateTime(); err == nil {
+				date = exifDate
+			}
+		}
+	}
+
+	m.dateMutex.Lock()
+	m.dates[file.Path] = dateCache{modTime: stat.ModTime(), date: date}
+	m.dateMutex.Unlock()
+	return date, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDateBuckets(t *testing.T) {
+	mediaPath := "tmpout/TestDateBuckets"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/a.jpg")             // EXIF date 2018-04-06 18:23:51
+	copyFile(t, "testmedia/jpeg_rotated.jpg", mediaPath+"/sub/b.jpg") // EXIF date 2018-04-06 09:26:55
+	copyFile(t, "testmedia/png.png", mediaPath+"/sub/png.png")        // No EXIF
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/video.mp4")        // Videos use modification time
+	march := time.Date(2019, 3, 4, 12, 0, 0, 0, time.Local)
+	os.Chtimes(mediaPath+"/sub/png.png", march, march)
+	may := time.Date(2019, 5, 1, 12, 0, 0, 0, time.Local)
+	os.Chtimes(mediaPath+"/video.mp4", may, may)
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	buckets, err := media.getDateBuckets("month", nil)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 3, len(buckets))
+	assertEqualsStr(t, "", "2019-05", buckets[0].Name)
+	assertEqualsInt(t, "", 1, buckets[0].Count)
+	assertEqualsStr(t, "", "2019-03", buckets[1].Name)
+	assertEqualsInt(t, "", 1, buckets[1].Count)
+	assertEqualsStr(t, "", "2018-04", buckets[2].Name)
+	assertEqualsInt(t, "", 2, buckets[2].Count)
+
+	buckets, err = media.getDateBuckets("year", nil)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2, len(buckets))
+	assertEqualsStr(t, "", "2019", buckets[0].Name)
+	assertEqualsInt(t, "", 2, buckets[0].Count)
+
+	_, err = media.getDateBuckets("week", nil)
+	assertExpectErr(t, "", err)
+
+	// Files shall be sorted on date
+	files, err := media.getDateBucketFiles("2018-04-06")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2, len(files))
+	assertEqualsStr(t, "", "sub/b.jpg", files[0].Path)
+	assertEqualsStr(t, "", "a.jpg", files[1].Path)
+	files, err = media.getDateBucketFiles("2019")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2, len(files))
+	assertEqualsStr(t, "", "sub/png.png", files[0].Path)
+	assertEqualsStr(t, "", "video.mp4", files[1].Path)
+	assertEqualsStr(t, "", "video", files[1].Type)
+	files, err = media.getDateBucketFiles("2017")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 0, len(files))
+
+	for _, bucket := range []string{"", "2019-13", "abcd", "2019-03-04T12"} {
+		_, err = media.getDateBucketFiles(bucket)
+		assertExpectErr(t, bucket, err)
+	}
+
+	// Index shall not be cached without a watcher
+	assertTrue(t, "", media.dateIndex == nil)
+
+	// With a watcher the index shall be cached until invalidated
+	media.watcher = createWatcher(media, false, false, 0, 0, nil)
+	_, err = media.getDateBuckets("year", nil)
+	assertExpectNoErr(t, "", err)
+	copyFile(t, "testmedia/png.png", mediaPath+"/new.png")
+	buckets, _ = media.getDateBuckets("year", nil)
+	assertEqualsInt(t, "", 2, len(buckets))
+	media.invalidateDateIndex()
+	buckets, _ = media.getDateBuckets("year", nil)
+	assertEqualsInt(t, "", 3, len(buckets))
+	assertEqualsStr(t, "", time.Now().Format("2006"), buckets[0].Name)
+}
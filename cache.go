@@ -2,16 +2,27 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/fnv"
 	"image"
 	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/disintegration/imaging"
@@ -21,86 +32,479 @@ import (
 // Cache keeps information about all known cache items
 type Cache struct {
 	cachepath                string // Top level path for thumbnails and previews
+	mediaPath                string // Top level path for media files, see mediaDirCache
+	mediaDirCache            string // Cache folder in each media folder, see parseMediaDirCachePath ("" means all in cachepath)
 	previewMaxSide           int
+	previewSizes             []int // Additional allowed preview sizes, see previewSizeOf
+	previewMinSide           int   // Images not larger than this are too small for a preview, see generatePreviewSize
 	genPreviewForSmallImages bool
 	genAlbumThumbs           bool
-	thumbnails               map[string]time.Time // Key: relativePath of thumbnail to cachepath, Value: time of last update
-	previews                 map[string]time.Time // Key: relativePath of preview to cachepath, Value: time of last update
-	albumThumbnails          map[string]time.Time // Key: relativePath of preview to cachepath, Value: time of last update
+	previewFormat            string                   // previewFormatJPEG or previewFormatAVIF
+	previewKeepFormat        bool                     // PNG previews of PNG images, see previewFormatOf
+	videoPreviewFrames       int                      // Number of frames in animated video previews
+	maxImagePixels           int                      // Max number of pixels of images to decode (negative means no limit)
+	forceRotate              bool                     // Use the orientation in .orientation files, see readForcedOrientation
+	allowNoExtension         bool                     // Allow media files without extension (content sniffing enabled)
+	includeExtension         bool                     // Keep the media file extension in cache file names, see cacheFileName
+	vidExtensions            []string                 // File extensions of videos
+	videoIconOverlay         bool                     // Add a video icon to video thumbnails
+	videoThumbFallback       bool                     // Generate a film strip thumbnail if ffmpeg fails, see generateFallbackVideoThumbnail
+	gifAnimatedThumbs        bool                     // Animated thumbnails of GIF images, see hasAnimatedThumbnail
+	videoContactSheet        bool                     // Contact sheets of videos, see generateVideoContactSheet
+	contactColumns           int                      // Number of frames horizontally in video contact sheets
+	contactRows              int                      // Number of frames vertically in video contact sheets
+	ffmpegPath               string                   // ffmpeg command, name in PATH or path to the binary
+	ffmpegArgs               []string                 // Extra ffmpeg arguments, added before the input file
+	ffmpegVersion            string                   // First line of ffmpeg -version ("" if unknown), see probeFFmpeg
+	ffmpegProbeErr           error                    // Why the ffmpeg probe failed (nil if ok or not probed)
+	watermark                image.Image              // Watermark added to image previews (nil means no watermark)
+	watermarkPosition        string                   // Where to place the watermark, see watermarkPositions
+	watermarkOpacity         float64                  // Opacity of the watermark (0.0 - 1.0)
+	scaledWatermark          image.Image              // Watermark scaled to the last used size
+	enhancePreviews          bool                     // Sharpen (and adjust contrast of) image previews
+	sharpenSigma             float64                  // Sigma of the sharpening of enhanced previews
+	contrast                 float64                  // Contrast adjustment of enhanced previews in percent (0 means none)
+	watermarkMutex           sync.Mutex               // For thread safety of scaledWatermark
+	resampleFilter           imaging.ResampleFilter   // Filter used when downscaling thumbnails and previews
+	thumbBackground          color.Color              // Background of thumbnails and JPEG previews, where images are transparent
+	retryDelay               time.Duration            // Delay before first retry of a failed generation (doubled for each attempt)
+	maxRetries               int                      // Max number of retries of a failed generation (0 means never retry)
+	checkStale               bool                     // Regenerate cache files older than the media file
+	dirMode                  os.FileMode              // Permissions of created directories (restricted by umask)
+	fileMode                 os.FileMode              // Permissions of created files (restricted by umask)
+	atomicWrite              bool                     // Write cache files via a temporary file, see writeCacheFile
+	entryTTL                 time.Duration            // Max time since last access before entry is evicted (0 means never)
+	expireThumbnails         bool                     // Evict thumbnails older than entryTTL
+	expirePreviews           bool                     // Evict previews older than entryTTL
+	maxAge                   time.Duration            // Max time since last access of any entry (0 means no limit)
+	maxSize                  int64                    // Max total size of thumbnails and previews in bytes (0 means no limit)
+	thumbnails               map[string]time.Time     // Key: relativePath of thumbnail to cachepath, Value: time of last update/access
+	previews                 map[string]time.Time     // Key: relativePath of preview to cachepath, Value: time of last update/access
+	albumThumbnails          map[string]time.Time     // Key: relativePath of preview to cachepath, Value: time of last update
+	inProgress               map[string]chan struct{} // Key: full path of cache file being generated, closed when done
+	mutex                    sync.Mutex               // For thread safety of the maps
+	available                bool                     // False if the cache path was missing at last check, see isAvailable
+	slowGenThreshold         time.Duration            // Warn if a thumbnail generation takes longer (0 means never)
+	slowGenerations          []SlowGeneration         // The slowest thumbnail generations, slowest first
+	slowMutex                sync.Mutex               // For thread safety of slowGenerations
 }
 
-func createCache(cachepath string, previewMaxSide int, genPreviewForSmallImages bool, genAlbumThumbs bool) *Cache {
+// resampleFilters are the supported filters for downscaling thumbnails
+// and previews. Box is fastest, Lanczos gives the sharpest result but is
+// considerably slower.
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"box":        imaging.Box,
+	"linear":     imaging.Linear,
+	"catmullrom": imaging.CatmullRom,
+	"lanczos":    imaging.Lanczos}
+
+// watermarkPositions are the supported positions of the watermark
+var watermarkPositions = []string{"topleft", "topright", "bottomleft", "bottomright", "center"}
+
+// errCacheUnavailable is returned when a thumbnail or preview can't be
+// generated since the cache path is missing, see isAvailable
+var errCacheUnavailable = errors.New("cache path unavailable")
+
+// Supported preview formats
+const (
+	previewFormatJPEG = "jpeg"
+	previewFormatAVIF = "avif"
+	previewFormatGIF  = "gif" // Only used for animated video previews
+	previewFormatPNG  = "png" // Only used for PNG images when previewKeepFormat is enabled
+)
+
+func createCache(mediaPath, cachepath string, previewMaxSide int, genPreviewForSmallImages bool, genAlbumThumbs bool,
+	options mediaOptions) *Cache {
+	previewFormat := options.previewFormat
+	if previewFormat == "" {
+		previewFormat = previewFormatJPEG
+	} else if previewFormat == previewFormatAVIF && !avifSupported {
+		log.Warn("AVIF previews not supported by this build (build with -tags avif). Using JPEG previews.")
+		previewFormat = previewFormatJPEG
+	}
+	log.Info("Preview format: ", previewFormat)
+	videoPreviewFrames := options.videoPreviewFrames
+	if videoPreviewFrames <= 0 {
+		videoPreviewFrames = 5
+	}
+	resampleFilter, ok := resampleFilters[options.resampleFilter]
+	if !ok {
+		resampleFilter = imaging.Box
+	}
+	dirMode := options.cacheDirMode
+	if dirMode == 0 {
+		dirMode = os.ModePerm
+	}
+	fileMode := options.cacheFileMode
+	if fileMode == 0 {
+		fileMode = 0666
+	}
+	var watermark image.Image
+	if options.watermarkFile != "" {
+		var err error
+		watermark, err = imaging.Open(options.watermarkFile)
+		if err != nil {
+			log.Warnf("Unable to open watermark %s. Reason: %s", options.watermarkFile, err)
+			log.Info("Previews will not be watermarked")
+		} else {
+			log.Infof("Preview watermark: %s (%s)", options.watermarkFile, options.watermarkPosition)
+		}
+	}
+	sharpenSigma := options.sharpenSigma
+	if sharpenSigma <= 0 {
+		sharpenSigma = 0.5
+	}
+	if options.enhancePreviews {
+		log.Infof("Enhanced previews (sharpen: %g, contrast: %g%%)", sharpenSigma, options.contrast)
+	}
+	ffmpegPath := options.ffmpegPath
+	if ffmpegPath == "" {
+		ffmpegPath = ffmpegCmd
+	}
+	thumbBackground := color.Color(color.White)
+	if options.thumbBackground != "" {
+		background, err := parseHexColor(options.thumbBackground)
+		if err != nil {
+			log.Warnf("Invalid thumbnail background. Reason: %s", err)
+		} else {
+			thumbBackground = background
+		}
+	}
+	contactColumns, contactRows := options.contactColumns, options.contactRows
+	if contactColumns <= 0 || contactRows <= 0 {
+		contactColumns, contactRows = 4, 3
+	}
+	previewMinSide := options.previewMinSide
+	if previewMinSide <= 0 {
+		previewMinSide = previewMaxSide
+	}
+	watermarkOpacity := options.watermarkOpacity
+	if watermarkOpacity <= 0 || watermarkOpacity > 1 {
+		watermarkOpacity = 0.5
+	}
+	mediaDirCache, err := parseMediaDirCachePath(cachepath)
+	if err != nil {
+		log.Warnf("Invalid cache path %s. Reason: %s", cachepath, err)
+	}
 	c := &Cache{
 		cachepath:                cachepath,
+		mediaPath:                mediaPath,
+		mediaDirCache:            mediaDirCache,
 		previewMaxSide:           previewMaxSide,
+		previewSizes:             options.previewSizes,
+		previewMinSide:           previewMinSide,
 		genPreviewForSmallImages: genPreviewForSmallImages,
 		genAlbumThumbs:           genAlbumThumbs,
+		previewFormat:            previewFormat,
+		previewKeepFormat:        options.previewKeepFormat,
+		videoPreviewFrames:       videoPreviewFrames,
+		maxImagePixels:           options.maxImagePixels,
+		forceRotate:              options.forceRotate,
+		allowNoExtension:         options.sniffContent,
+		includeExtension:         !options.cacheStripExt,
+		vidExtensions:            options.videoExtensions,
+		videoIconOverlay:         !options.noVideoIconOverlay,
+		videoThumbFallback:       options.videoThumbFallback,
+		gifAnimatedThumbs:        options.gifAnimatedThumbs,
+		videoContactSheet:        options.videoContactSheet,
+		contactColumns:           contactColumns,
+		contactRows:              contactRows,
+		ffmpegPath:               ffmpegPath,
+		ffmpegArgs:               options.ffmpegArgs,
+		watermark:                watermark,
+		watermarkPosition:        options.watermarkPosition,
+		watermarkOpacity:         watermarkOpacity,
+		enhancePreviews:          options.enhancePreviews,
+		sharpenSigma:             sharpenSigma,
+		contrast:                 options.contrast,
+		resampleFilter:           resampleFilter,
+		thumbBackground:          thumbBackground,
+		retryDelay:               options.thumbRetryDelay,
+		maxRetries:               options.thumbMaxRetries,
+		checkStale:               !options.noCheckStale,
+		dirMode:                  dirMode,
+		fileMode:                 fileMode,
+		atomicWrite:              !options.cacheWriteInPlace,
+		entryTTL:                 options.cacheEntryTTL,
+		expireThumbnails:         options.cacheExpireThumbnails,
+		expirePreviews:           options.cacheExpirePreviews,
+		maxAge:                   options.cacheMaxAge,
+		maxSize:                  options.cacheMaxSize,
 		thumbnails:               map[string]time.Time{},
-		previews:                 map[string]time.Time{}}
+		previews:                 map[string]time.Time{},
+		albumThumbnails:          map[string]time.Time{},
+		inProgress:               map[string]chan struct{}{},
+		available:                true,
+		slowGenThreshold:         options.slowGenThreshold}
+	if mediaDirCache != "" {
+		log.Infof("Cache in each media folder (%s)", mediaDirCache)
+	} else if err := os.MkdirAll(cachepath, dirMode); err != nil {
+		log.Warnf("Unable to create cache path %s. Reason: %s", cachepath, err)
+	}
+	c.probeFFmpeg(options.ffmpegSelfTest)
 	c.loadCache("", true)
+	if c.isEvictionEnabled() {
+		log.Infof("Cache entry TTL: %s (thumbnails: %t, previews: %t)", c.entryTTL,
+			c.expireThumbnails, c.expirePreviews)
+		log.Infof("Cache max age: %s, max size: %d bytes", c.maxAge, c.maxSize)
+		interval := options.cacheEvictionInterval
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		go c.evictionThread(interval)
+	}
 	return c
 }
 
 func (c *Cache) loadCache(relativePath string, recursive bool) {
-	fullCachePath, err := c.getFullCachePath(relativePath)
+	fullCachePath, err := c.getFullCacheFolderPath(relativePath)
 	if err != nil {
 		return
 	}
 
-	cacheFiles, err := getFiles(fullCachePath, relativePath)
-	if err != nil {
+	// A media folder without cache folder may still have sub folders
+	// with cache folders (mediaDirCache)
+	dirEntries, err := os.ReadDir(fullCachePath)
+	if err != nil && c.mediaDirCache == "" {
 		return
 	}
 
-	for _, file := range cacheFiles {
-		if file.Type == "folder" {
-			if recursive {
-				c.loadCache(file.Path, true) // Recursive
-			}
-		} else if file.Type == "image" {
-			if strings.HasSuffix(file.Name, ".preview.jpg") {
-				c.previews[file.Path] = time.Now()
-			} else if strings.HasSuffix(file.Name, ".thumb.jpg") {
-				c.thumbnails[file.Path] = time.Now()
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		path := filepath.ToSlash(filepath.Join(relativePath, name))
+		if dirEntry.IsDir() {
+			continue // Sub folders below
+		} else if previewFileRegexp.MatchString(name) {
+			c.setEntry(c.previews, path, modTime(dirEntry))
+			if albumThumbnailRegexp.MatchString(name) {
+				albumPath := strings.TrimSuffix(strings.TrimSuffix(path, ".preview.jpg"), ".jpg") + ".jpg"
+				c.setEntry(c.albumThumbnails, albumPath, modTime(dirEntry))
 			}
+		} else if strings.HasSuffix(name, ".thumb.jpg") || strings.HasSuffix(name, ".thumb.gif") ||
+			strings.HasSuffix(name, ".contact.jpg") {
+			c.setEntry(c.thumbnails, path, modTime(dirEntry))
+		}
+	}
+	if recursive {
+		for _, subFolder := range c.cacheSubFolders(relativePath, dirEntries) {
+			c.loadCache(subFolder, true) // Recursive
 		}
 	}
 }
 
+// isAvailable returns true if the cache path exist. It might be missing
+// if it is located on a removable drive that has been unmounted. Changes
+// of the availability are logged (once).
+func (c *Cache) isAvailable() bool {
+	rootPath := c.cachepath
+	if c.mediaDirCache != "" {
+		rootPath = c.mediaPath // The cache folders are created when needed
+	}
+	_, err := os.Stat(rootPath)
+	available := err == nil
+	c.mutex.Lock()
+	changed := available != c.available
+	c.available = available
+	c.mutex.Unlock()
+	if changed && !available {
+		log.Errorf("Cache path unavailable, no thumbnails or previews will be generated until it is available again. Reason: %s", err)
+	} else if changed {
+		log.Infof("Cache path %s available again", c.cachepath)
+	}
+	return available
+}
+
 func (c *Cache) hasThumbnail(relativeMediaPath string) bool {
 	path, err := c.relativeThumbnailPath(relativeMediaPath)
 	if err != nil {
 		log.Warn(err)
 		return false
 	}
-	_, ok := c.thumbnails[path]
-	return ok
+	return c.hasEntry(c.thumbnails, path)
 }
 
 func (c *Cache) hasPreview(relativeMediaPath string) bool {
-	path, err := c.relativePreviewPath(relativeMediaPath)
+	return c.hasPreviewFormat(relativeMediaPath, c.previewFormatOf(relativeMediaPath))
+}
+
+func (c *Cache) hasPreviewFormat(relativeMediaPath string, format string) bool {
+	path, err := c.relativePreviewPathFormat(relativeMediaPath, format)
 	if err != nil {
 		log.Warn(err)
 		return false
 	}
-	_, ok := c.previews[path]
-	return ok
+	return c.hasEntry(c.previews, path)
 }
 
 func (c *Cache) hasAlbumThumbnail(relativeAlbumPreviewPath string) bool {
-	_, ok := c.albumThumbnails[relativeAlbumPreviewPath]
+	return c.hasEntry(c.albumThumbnails, relativeAlbumPreviewPath)
+}
+
+// latestAlbumThumbnail returns the relative path of the most recent album
+// thumbnail of a folder. Returns false if the folder has no album thumbnail.
+func (c *Cache) latestAlbumThumbnail(relativeFolderPath string) (string, bool) {
+	relativeFolderPath = strings.Trim(filepath.ToSlash(relativeFolderPath), "/")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	latestPath := ""
+	var latestTime time.Time
+	for albumPath, t := range c.albumThumbnails {
+		folder := path.Dir(albumPath)
+		if folder == "." {
+			folder = ""
+		}
+		if folder == relativeFolderPath && (latestPath == "" || t.After(latestTime)) {
+			latestPath = albumPath
+			latestTime = t
+		}
+	}
+	return latestPath, latestPath != ""
+}
+
+// isUpToDate returns true if the cache file exist and, if checkStale is
+// enabled, the media file has not been modified after the cache file was
+// generated. entries is the cache map of the cache file. Its time (when
+// the cache file was generated or last found up to date) is used instead
+// of the modification time of the cache file, so that a cache hit only
+// requires the media file to be checked.
+func (c *Cache) isUpToDate(m *Media, relativeMediaPath string, entries map[string]time.Time, relativeCachePath string) bool {
+	fullCachePath, err := c.getFullCachePath(relativeCachePath)
+	if err != nil {
+		return false
+	}
+	if !c.checkStale {
+		_, err := os.Stat(fullCachePath)
+		return err == nil
+	}
+	generated, ok := c.entryTime(entries, relativeCachePath)
+	if !ok {
+		cacheStat, err := os.Stat(fullCachePath)
+		if err != nil {
+			return false
+		}
+		generated = cacheStat.ModTime()
+	}
+	fullMediaPath, err := m.getFullMediaPath(relativeMediaPath)
+	if err != nil {
+		return true
+	}
+	mediaStat, err := os.Stat(fullMediaPath)
+	if err != nil {
+		return true // Nothing to regenerate from
+	}
+	if mediaStat.ModTime().After(generated) {
+		log.Info("Media file modified after cache file was generated: ", relativeMediaPath)
+		return false
+	}
+	return true
+}
+
+// isThumbnailStale returns true if checkStale is enabled and the
+// thumbnail is missing or older than the media file
+func (c *Cache) isThumbnailStale(m *Media, relativeMediaPath string) bool {
+	if !c.checkStale {
+		return false
+	}
+	relativeThumbPath, err := c.relativeThumbnailPath(relativeMediaPath)
+	return err == nil && !c.isUpToDate(m, relativeMediaPath, c.thumbnails, relativeThumbPath)
+}
+
+// isPreviewStale returns true if checkStale is enabled and the preview
+// is missing or older than the media file
+func (c *Cache) isPreviewStale(m *Media, relativeMediaPath string) bool {
+	if !c.checkStale {
+		return false
+	}
+	relativePreviewPath, err := c.relativePreviewPath(relativeMediaPath)
+	return err == nil && !c.isUpToDate(m, relativeMediaPath, c.previews, relativePreviewPath)
+}
+
+// hasEntry returns true if path exist in the provided cache map.
+func (c *Cache) hasEntry(entries map[string]time.Time, path string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, ok := entries[path]
 	return ok
 }
 
+// entryTime returns the time of path in the provided cache map, and false
+// if it doesn't exist
+func (c *Cache) entryTime(entries map[string]time.Time, path string) (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t, ok := entries[path]
+	return t, ok
+}
+
+// setEntry adds path to the provided cache map, or updates its time if
+// it already exist.
+func (c *Cache) setEntry(entries map[string]time.Time, path string, t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entries[path] = t
+}
+
+// lockGeneration makes sure that a cache file is only generated by one
+// goroutine at a time. If the file is being generated it waits until
+// that generation is done, so the caller can use its result instead of
+// generating the file again. unlockGeneration must be called when done.
+func (c *Cache) lockGeneration(fullCachePath string) {
+	c.mutex.Lock()
+	for {
+		done, ok := c.inProgress[fullCachePath]
+		if !ok {
+			break
+		}
+		c.mutex.Unlock()
+		<-done
+		c.mutex.Lock()
+	}
+	c.inProgress[fullCachePath] = make(chan struct{})
+	c.mutex.Unlock()
+}
+
+// unlockGeneration releases a lock taken with lockGeneration
+func (c *Cache) unlockGeneration(fullCachePath string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	close(c.inProgress[fullCachePath])
+	delete(c.inProgress, fullCachePath)
+}
+
+// modTime returns the modification time of a directory entry, or the
+// current time if it is unknown.
+func modTime(dirEntry os.DirEntry) time.Time {
+	info, err := dirEntry.Info()
+	if err != nil {
+		return time.Now()
+	}
+	return info.ModTime()
+}
+
 // getFullCachePath returns the full path of the provided path, i.e:
 // thumb path + relative path.
 func (c *Cache) getFullCachePath(relativePath string) (string, error) {
+	if c.mediaDirCache != "" {
+		// In the cache folder of the media folder
+		folder, file := path.Split(filepath.ToSlash(relativePath))
+		fullFolderPath, err := c.getFullCacheFolderPath(folder)
+		if err != nil {
+			return "", err
+		}
+		return filepath.ToSlash(filepath.Join(fullFolderPath, file)), nil
+	}
 	return getFullPath(c.cachepath, relativePath)
 }
 
 // thumbnailPath returns the absolute thumbnail file path from a
-// media path. Thumbnails are always stored in JPEG format (.jpg
-// extension) and starts with '_'.
+// media path. Thumbnails are stored in JPEG format (.jpg extension),
+// except animated thumbnails of GIF images (.gif extension), see
+// hasAnimatedThumbnail.
 // Returns error if the media path is invalid.
 func (c *Cache) thumbnailPath(relativeMediaPath string) (string, error) {
 	relativePath, err := c.relativeThumbnailPath(relativeMediaPath)
@@ -112,21 +516,33 @@ func (c *Cache) thumbnailPath(relativeMediaPath string) (string, error) {
 
 func (c *Cache) relativeThumbnailPath(relativeMediaPath string) (string, error) {
 	path, file := filepath.Split(relativeMediaPath)
-	// Replace extension with .thumb.jpg
+	// Replace extension with .thumb.jpg (or .thumb.gif)
 	ext := filepath.Ext(file)
-	if ext == "" {
+	if ext == "" && !c.allowNoExtension {
 		return "", fmt.Errorf("File has no extension: %s", file)
 	}
-	file = strings.Replace(file, ext, ".thumb.jpg", -1)
-	return filepath.ToSlash(filepath.Join(path, file)), nil
+	if c.hasAnimatedThumbnail(file) {
+		file = c.cacheFileName(file, ".thumb.gif")
+	} else {
+		file = c.cacheFileName(file, ".thumb.jpg")
+	}
+	// Paths from the Web API starts with /. Remove it to get the same
+	// key as when the cache is loaded from disk.
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Join(path, file)), "/"), nil
 }
 
 // previewPath returns the absolute preview file path from a
-// media path. Previews are always stored in JPEG format (.jpg
-// extension) and starts with 'view_'.
+// media path. Previews are stored in the configured preview
+// format, i.e. JPEG (.preview.jpg extension) or AVIF (.preview.avif
+// extension). Video previews are always animated GIFs (.preview.gif
+// extension).
 // Returns error if the media path is invalid.
 func (c *Cache) previewPath(relativeMediaPath string) (string, error) {
-	relativePath, err := c.relativePreviewPath(relativeMediaPath)
+	return c.previewPathFormat(relativeMediaPath, c.previewFormatOf(relativeMediaPath))
+}
+
+func (c *Cache) previewPathFormat(relativeMediaPath string, format string) (string, error) {
+	relativePath, err := c.relativePreviewPathFormat(relativeMediaPath, format)
 	if err != nil {
 		return "", err
 	}
@@ -134,18 +550,110 @@ func (c *Cache) previewPath(relativeMediaPath string) (string, error) {
 }
 
 func (c *Cache) relativePreviewPath(relativeMediaPath string) (string, error) {
+	return c.relativePreviewPathFormat(relativeMediaPath, c.previewFormatOf(relativeMediaPath))
+}
+
+// previewFormatOf returns the preview format for a media file. PNG
+// images (typically screenshots and diagrams) get lossless PNG previews
+// if previewKeepFormat is enabled.
+func (c *Cache) previewFormatOf(relativeMediaPath string) string {
+	if hasExtension(relativeMediaPath, c.vidExtensions) {
+		return previewFormatGIF
+	}
+	if c.previewKeepFormat && strings.EqualFold(filepath.Ext(relativeMediaPath), ".png") {
+		return previewFormatPNG
+	}
+	return c.previewFormat
+}
+
+func (c *Cache) relativePreviewPathFormat(relativeMediaPath string, format string) (string, error) {
+	return c.relativePreviewPathSize(relativeMediaPath, format, 0)
+}
+
+// relativePreviewPathSize is similar to relativePreviewPathFormat but
+// for a preview of another size than previewMaxSide, which has the size
+// in the extension, e.g. .preview-800.jpg. 0 means previewMaxSide.
+func (c *Cache) relativePreviewPathSize(relativeMediaPath string, format string, maxSide int) (string, error) {
 	path, file := filepath.Split(relativeMediaPath)
-	// Replace extension with .preview.jpg
+	// Replace extension with .preview.jpg, .preview.avif, .preview.gif or
+	// .preview.png
 	ext := filepath.Ext(file)
-	if ext == "" {
+	if ext == "" && !c.allowNoExtension {
 		return "", fmt.Errorf("file has no extension: %s", file)
 	}
-	file = strings.Replace(file, ext, ".preview.jpg", -1)
-	return filepath.ToSlash(filepath.Join(path, file)), nil
+	previewExt := ".preview"
+	if maxSide > 0 && maxSide != c.previewMaxSide && format != previewFormatGIF {
+		previewExt += fmt.Sprintf("-%d", maxSide)
+	}
+	if format == previewFormatAVIF {
+		previewExt += ".avif"
+	} else if format == previewFormatGIF {
+		previewExt += ".gif"
+	} else if format == previewFormatPNG {
+		previewExt += ".png"
+	} else {
+		previewExt += ".jpg"
+	}
+	file = c.cacheFileName(file, previewExt)
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Join(path, file)), "/"), nil
+}
+
+// cacheFileName returns the name of a cache file of a media file, i.e.
+// the media file name with the extension replaced with cacheExt (e.g.
+// photo.thumb.jpg). If includeExtension is enabled the extension is kept
+// (e.g. photo.jpg.thumb.jpg), so that media files with the same base name
+// don't share cache files.
+func (c *Cache) cacheFileName(mediaFileName, cacheExt string) string {
+	ext := filepath.Ext(mediaFileName)
+	if ext == "" || c.includeExtension {
+		return mediaFileName + cacheExt
+	}
+	return strings.Replace(mediaFileName, ext, cacheExt, -1)
+}
+
+// relativePreviewPaths returns the relative paths of all previews that
+// may exist of a media file, i.e. of all formats and sizes
+func (c *Cache) relativePreviewPaths(relativeMediaPath string) []string {
+	paths := []string{}
+	for _, format := range []string{previewFormatJPEG, previewFormatAVIF, previewFormatGIF, previewFormatPNG} {
+		for _, maxSide := range append([]int{0}, c.previewSizes...) {
+			path, err := c.relativePreviewPathSize(relativeMediaPath, format, maxSide)
+			if err == nil && !contains(paths, path) {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// previewSizeOf returns the smallest allowed preview size (previewMaxSide
+// or any of previewSizes) that is at least maxSide, or the largest allowed
+// size if maxSide is larger than all of them
+func (c *Cache) previewSizeOf(maxSide int) int {
+	size := 0
+	largest := 0
+	for _, allowed := range append([]int{c.previewMaxSide}, c.previewSizes...) {
+		if allowed >= maxSide && (size == 0 || allowed < size) {
+			size = allowed
+		}
+		largest = max(largest, allowed)
+	}
+	if size == 0 {
+		return largest
+	}
+	return size
 }
 
 var fnvHash hash.Hash64
 
+// albumThumbnailRegexp matches the file name of a stored album thumbnail,
+// i.e. the preview of the fnv hash named album thumbnail path (including
+// its .jpg extension if includeExtension is enabled)
+var albumThumbnailRegexp = regexp.MustCompile(`^\d+(\.jpg)?\.preview\.jpg$`)
+
+// previewFileRegexp matches the file name of a stored preview of any size
+var previewFileRegexp = regexp.MustCompile(`\.preview(-\d+)?\.(jpg|avif|gif|png)$`)
+
 func (c *Cache) relativeAlbumThumbnailPath(relativeAlbumPath string, files []string) string {
 	if fnvHash == nil {
 		fnvHash = fnv.New64()
@@ -155,22 +663,70 @@ func (c *Cache) relativeAlbumThumbnailPath(relativeAlbumPath string, files []str
 
 	fnvHash.Reset()
 	fnvHash.Write([]byte(folder + strings.Join(files, "")))
-	return filepath.Join(relativeAlbumPath, strconv.FormatUint(fnvHash.Sum64(), 10)) + ".jpg"
+	albumThumbnailPath := filepath.Join(relativeAlbumPath, strconv.FormatUint(fnvHash.Sum64(), 10)) + ".jpg"
+	// Same key as when the cache is loaded from disk
+	return strings.TrimPrefix(filepath.ToSlash(albumThumbnailPath), "/")
 }
 
+// errorIndicationExt is the extension of error indication files
+const errorIndicationExt = ".err.txt"
+
 // errorIndicationPath returns the file path with the extension
 // replaced with err.
 func (c *Cache) errorIndicationPath(anyPath string) string {
 	path, file := filepath.Split(anyPath)
-	ext := filepath.Ext(file)
-	file = strings.Replace(file, ext, ".err.txt", -1)
+	file = strings.TrimSuffix(file, filepath.Ext(file)) + errorIndicationExt
 	return filepath.Join(path, file)
 }
 
+// clearErrorIndications removes the error indication files in the cache
+// folder of relativePath (and optionally its sub folders), so that the
+// generation of failed thumbnails and previews is retried.
+// Returns number of removed files.
+func (c *Cache) clearErrorIndications(relativePath string, recursive bool) (int, error) {
+	fullCachePath, err := c.getFullCacheFolderPath(relativePath)
+	if err != nil {
+		return 0, err
+	}
+	dirEntries, err := os.ReadDir(fullCachePath)
+	if os.IsNotExist(err) && c.mediaDirCache == "" {
+		return 0, nil // Nothing generated (or failed) yet
+	} else if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	nbrRemovedFiles := 0
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			continue // Sub folders below
+		}
+		if strings.HasSuffix(dirEntry.Name(), errorIndicationExt) {
+			fullPath := filepath.Join(fullCachePath, dirEntry.Name())
+			if err := os.Remove(fullPath); err != nil {
+				return nbrRemovedFiles, err
+			}
+			log.Debug("Removed ", fullPath)
+			nbrRemovedFiles++
+		}
+	}
+	if recursive {
+		for _, subFolder := range c.cacheSubFolders(relativePath, dirEntries) {
+			n, err := c.clearErrorIndications(subFolder, true) // Recursive
+			nbrRemovedFiles += n
+			if err != nil {
+				return nbrRemovedFiles, err
+			}
+		}
+	}
+	return nbrRemovedFiles, nil
+}
+
 // generateTumbnail generates a thumbnail for an image or video
 // and returns the file name of the thumbnail. If a thumbnail already
 // exist the file name will be returned.
 func (c *Cache) generateThumbnail(m *Media, relativeFilePath string) (string, error) {
+	if !m.cacheAvailable() {
+		return "", errCacheUnavailable
+	}
 	relativeThumbPath, err := c.relativeThumbnailPath(relativeFilePath)
 	if err != nil {
 		log.Warn(err)
@@ -181,15 +737,26 @@ func (c *Cache) generateThumbnail(m *Media, relativeFilePath string) (string, er
 		log.Warn(err)
 		return "", err
 	}
-	_, err = os.Stat(thumbFileName) // Check if file exist
-	if err == nil {
+	if c.isUpToDate(m, relativeFilePath, c.thumbnails, relativeThumbPath) {
+		c.setEntry(c.thumbnails, relativeThumbPath, time.Now()) // Accessed
+		appMetrics.countCache("thumbnail", true)
 		return thumbFileName, nil // Thumb already generated
 	}
+
+	// Only one generation at a time. Check again since it might have been
+	// generated (or failed) while waiting.
+	c.lockGeneration(thumbFileName)
+	defer c.unlockGeneration(thumbFileName)
+	if c.isUpToDate(m, relativeFilePath, c.thumbnails, relativeThumbPath) {
+		c.setEntry(c.thumbnails, relativeThumbPath, time.Now())
+		appMetrics.countCache("thumbnail", true)
+		return thumbFileName, nil
+	}
+	appMetrics.countCache("thumbnail", false)
 	errorIndicationFile := c.errorIndicationPath(thumbFileName)
-	_, err = os.Stat(errorIndicationFile) // Check if file exist
-	if err == nil {
+	if c.isFailedBefore(errorIndicationFile) {
 		// File has failed to be generated before, don't bother
-		// trying to re-generate it.
+		// trying to re-generate it (yet).
 		msg := fmt.Sprintf("skipping generate thumbnail for %s since it has failed before,", relativeFilePath)
 		log.Trace(msg)
 		return "", fmt.Errorf(msg)
@@ -203,28 +770,53 @@ func (c *Cache) generateThumbnail(m *Media, relativeFilePath string) (string, er
 		log.Warn(err)
 		return "", err
 	}
-	if isVideo(fullMediaPath) {
+	if m.isVideo(relativeFilePath) {
 		err = c.generateVideoThumbnail(fullMediaPath, thumbFileName)
+	} else if c.hasAnimatedThumbnail(relativeFilePath) {
+		err = c.generateAnimatedGIFThumbnail(fullMediaPath, thumbFileName)
 	} else {
 		err = c.generateImageThumbnail(fullMediaPath, thumbFileName)
 	}
+	duration := time.Duration(time.Now().UnixNano() - startTime)
+	appMetrics.countGeneration("thumbnail", duration, err)
 	if err != nil {
 		// To avoid generate the file again, create an error indication file
 		c.generateErrorIndicationFile(errorIndicationFile, err)
 		return "", err
 	}
 
-	c.thumbnails[relativeThumbPath] = time.Now()
+	c.setEntry(c.thumbnails, relativeThumbPath, time.Now())
+	os.Remove(errorIndicationFile) // In case of a successful retry
 
-	deltaTime := (time.Now().UnixNano() - startTime) / int64(time.Millisecond)
-	log.Infof("Thumbnail done for %s (conversion time: %d ms)", relativeFilePath, deltaTime)
+	c.recordThumbnailTime(m, relativeFilePath, duration)
+	log.Infof("Thumbnail done for %s (conversion time: %d ms)", relativeFilePath, duration.Milliseconds())
 	return thumbFileName, nil
 }
 
-// generatePreview generates a preview image and returns the file name of the
-// preview. If a preview file already exist the file name will be returned.
+// generatePreview generates a preview image in the configured preview format
+// (or an animated GIF for videos) and returns the file name of the preview.
+// If a preview file already exist the file name will be returned.
 func (c *Cache) generatePreview(m *Media, relativeFilePath string) (string, bool, error) {
-	relativePreviewPath, err := c.relativePreviewPath(relativeFilePath)
+	return c.generatePreviewFormat(m, relativeFilePath, c.previewFormatOf(relativeFilePath))
+}
+
+// generatePreviewFormat is similar to generatePreview but generates the
+// preview in the provided format.
+func (c *Cache) generatePreviewFormat(m *Media, relativeFilePath string, format string) (string, bool, error) {
+	return c.generatePreviewSize(m, relativeFilePath, format, 0)
+}
+
+// generatePreviewSize is similar to generatePreviewFormat but generates a
+// preview with another max width/height than previewMaxSide (0 means
+// previewMaxSide). Not applicable to video previews.
+func (c *Cache) generatePreviewSize(m *Media, relativeFilePath string, format string, maxSide int) (string, bool, error) {
+	if !m.cacheAvailable() {
+		return "", false, errCacheUnavailable
+	}
+	if maxSide <= 0 {
+		maxSide = c.previewMaxSide
+	}
+	relativePreviewPath, err := c.relativePreviewPathSize(relativeFilePath, format, maxSide)
 	if err != nil {
 		log.Warn(err)
 		return "", false, err
@@ -234,16 +826,27 @@ func (c *Cache) generatePreview(m *Media, relativeFilePath string) (string, bool
 		log.Warn(err)
 		return "", false, err
 	}
-	_, err = os.Stat(previewFileName) // Check if file exist
-	if err == nil {
+	if c.isUpToDate(m, relativeFilePath, c.previews, relativePreviewPath) {
+		c.setEntry(c.previews, relativePreviewPath, time.Now()) // Accessed
+		appMetrics.countCache("preview", true)
 		return previewFileName, false, nil // Preview already generated
 	}
 
+	// Only one generation at a time. Check again since it might have been
+	// generated (or failed) while waiting.
+	c.lockGeneration(previewFileName)
+	defer c.unlockGeneration(previewFileName)
+	if c.isUpToDate(m, relativeFilePath, c.previews, relativePreviewPath) {
+		c.setEntry(c.previews, relativePreviewPath, time.Now())
+		appMetrics.countCache("preview", true)
+		return previewFileName, false, nil
+	}
+	appMetrics.countCache("preview", false)
+
 	errorIndicationFile := c.errorIndicationPath(previewFileName)
-	_, err = os.Stat(errorIndicationFile) // Check if file exist
-	if err == nil {
+	if c.isFailedBefore(errorIndicationFile) {
 		// File has failed to be generated before, don't bother
-		// trying to re-generate it.
+		// trying to re-generate it (yet).
 		msg := fmt.Sprintf("Skipping generate preview for %s since it has failed before.",
 			relativeFilePath)
 		log.Trace(msg)
@@ -256,6 +859,28 @@ func (c *Cache) generatePreview(m *Media, relativeFilePath string) (string, bool
 		return "", false, err
 	}
 
+	if m.isVideo(relativeFilePath) {
+		if !c.hasVideoThumbnailSupport() {
+			// Don't create any error indication file since ffmpeg might be
+			// installed later on
+			return "", false, fmt.Errorf("video previews not supported. ffmpeg not installed")
+		}
+		log.Info("Creating new video preview file for ", relativeFilePath)
+		startTime := time.Now().UnixNano()
+		err = c.generateVideoPreview(fullMediaPath, previewFileName)
+		appMetrics.countGeneration("preview", time.Duration(time.Now().UnixNano()-startTime), err)
+		if err != nil {
+			// To avoid generate the file again, create an error indication file
+			c.generateErrorIndicationFile(errorIndicationFile, err)
+			return "", false, err
+		}
+		c.setEntry(c.previews, relativePreviewPath, time.Now())
+		os.Remove(errorIndicationFile) // In case of a successful retry
+		deltaTime := (time.Now().UnixNano() - startTime) / int64(time.Millisecond)
+		log.Infof("Video preview done for %s (conversion time: %d ms)", relativeFilePath, deltaTime)
+		return previewFileName, false, nil
+	}
+
 	width, height, err := m.getImageWidthAndHeight(fullMediaPath)
 	if err != nil {
 		// To avoid generate the file again, create an error indication file
@@ -263,7 +888,10 @@ func (c *Cache) generatePreview(m *Media, relativeFilePath string) (string, bool
 		return "", false, err
 	}
 
-	if !c.genPreviewForSmallImages && width <= c.previewMaxSide && height <= c.previewMaxSide {
+	// Smaller images are shown as is. A smaller requested size than
+	// previewMinSide is still generated if the image is larger than it.
+	minSide := min(maxSide, c.previewMinSide)
+	if !c.genPreviewForSmallImages && width <= minSide && height <= minSide {
 		msg := fmt.Sprintf("Image %s too small to generate preview", relativeFilePath)
 		log.Trace(msg)
 		return "", true, fmt.Errorf(msg)
@@ -272,14 +900,16 @@ func (c *Cache) generatePreview(m *Media, relativeFilePath string) (string, bool
 	// No preview exist. Create it
 	log.Info("Creating new preview file for ", relativeFilePath)
 	startTime := time.Now().UnixNano()
-	err = c.generateImagePreview(fullMediaPath, previewFileName)
+	err = c.generateImagePreviewSize(fullMediaPath, previewFileName, maxSide)
+	appMetrics.countGeneration("preview", time.Duration(time.Now().UnixNano()-startTime), err)
 	if err != nil {
 		// To avoid generate the file again, create an error indication file
 		c.generateErrorIndicationFile(errorIndicationFile, err)
 		return "", false, err
 	}
 
-	c.previews[relativePreviewPath] = time.Now()
+	c.setEntry(c.previews, relativePreviewPath, time.Now())
+	os.Remove(errorIndicationFile) // In case of a successful retry
 
 	deltaTime := (time.Now().UnixNano() - startTime) / int64(time.Millisecond)
 	log.Infof("Preview done for %s (conversion time: %d ms)", relativeFilePath, deltaTime)
@@ -287,7 +917,10 @@ func (c *Cache) generatePreview(m *Media, relativeFilePath string) (string, bool
 }
 
 func (c *Cache) generateAlbumThumbnail(m *Media, relativeAlbumPreviewPath string, albumPath string, files []string) error {
-	relativePreviewPath, err := c.relativePreviewPath(relativeAlbumPreviewPath)
+	if !m.cacheAvailable() {
+		return errCacheUnavailable
+	}
+	relativePreviewPath, err := c.relativePreviewPathFormat(relativeAlbumPreviewPath, previewFormatJPEG)
 	if err != nil {
 		log.Warn(err)
 		return err
@@ -299,6 +932,7 @@ func (c *Cache) generateAlbumThumbnail(m *Media, relativeAlbumPreviewPath string
 	}
 	_, err = os.Stat(previewFileName) // Check if file exist
 	if err == nil {
+		c.setEntry(c.albumThumbnails, relativeAlbumPreviewPath, time.Now())
 		return nil // Preview already generated
 	}
 
@@ -311,20 +945,21 @@ func (c *Cache) generateAlbumThumbnail(m *Media, relativeAlbumPreviewPath string
 
 	// Create subdirectories if needed
 	directory := filepath.Dir(previewFileName)
-	err = os.MkdirAll(directory, os.ModePerm)
+	err = os.MkdirAll(directory, c.dirMode)
 	if err != nil {
 		return fmt.Errorf("unable to create directories in %s for creating thumbnail, reason %s", previewFileName, err)
 	}
 
 	// Write thumbnail to file
-	outFile, err := os.Create(previewFileName)
+	err = c.writeCacheFile(previewFileName, "thumbnail", func(w io.Writer) error {
+		return imaging.Encode(w, thumbImg, imaging.JPEG)
+	})
 	if err != nil {
-		return fmt.Errorf("unable to open %s for creating thumbnail, reason %s", previewFileName, err)
+		return err
 	}
-	defer outFile.Close()
-	err = imaging.Encode(outFile, thumbImg, imaging.JPEG)
-
-	return err
+	c.setEntry(c.albumThumbnails, relativeAlbumPreviewPath, time.Now())
+	c.setEntry(c.previews, relativePreviewPath, time.Now())
+	return nil
 }
 
 func (c *Cache) generateAlbumThumbnail_4x4(m *Media, albumPath string, files []string) image.Image {
@@ -335,7 +970,7 @@ func (c *Cache) generateAlbumThumbnail_4x4(m *Media, albumPath string, files []s
 
 	var err error
 	var thumbImg image.Image
-	thumbImg = imaging.New(size_org, size_org, color.Black)
+	thumbImg = imaging.New(size_org, size_org, c.thumbBackground)
 
 	index := 0
 	for _, file := range files {
@@ -360,7 +995,7 @@ func (c *Cache) generateAlbumThumbnail_9x9(m *Media, albumPath string, files []s
 
 	var err error
 	var thumbImg image.Image
-	thumbImg = imaging.New(size_org, size_org, color.Black)
+	thumbImg = imaging.New(size_org, size_org, c.thumbBackground)
 
 	index := 0
 	for _, file := range files {
@@ -387,75 +1022,187 @@ func (c *Cache) placeImageThumbnail(m *Media, thumb image.Image, relativeMediaPa
 	if err != nil {
 		return nil, err
 	}
-	smallImg := imaging.Resize(img, size, size, imaging.Box)
+	smallImg := imaging.Resize(img, size, size, c.resampleFilter)
 	return imaging.Paste(thumb, smallImg, image.Point{X: positionX * size, Y: positionY * size}), nil
 }
 
-// generateErrorIndication creates a text file including the error reason.
+// errorIndication is the content of an error indication file
+type errorIndication struct {
+	attempts int       // Number of failed attempts
+	last     time.Time // Time of last failed attempt
+}
+
+// readErrorIndicationFile reads the number of failed attempts and the
+// time of the last attempt from an error indication file. Files without
+// this information (created by older versions) count as one attempt at
+// the time the file was modified.
+func readErrorIndicationFile(errorIndicationFile string) (errorIndication, error) {
+	stat, err := os.Stat(errorIndicationFile)
+	if err != nil {
+		return errorIndication{}, err
+	}
+	result := errorIndication{attempts: 1, last: stat.ModTime()}
+	content, err := os.ReadFile(errorIndicationFile)
+	if err != nil {
+		return result, nil
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), ": ")
+		if key == "attempts" {
+			if attempts, err := strconv.Atoi(value); err == nil && attempts > 0 {
+				result.attempts = attempts
+			}
+		} else if key == "last" {
+			if last, err := time.Parse(time.RFC3339, value); err == nil {
+				result.last = last
+			}
+		}
+	}
+	return result, nil
+}
+
+// isFailedBefore returns true if there is an error indication file and
+// the generation shall not be retried. A retry is allowed when less than
+// maxRetries retries have been made and the retry delay has elapsed. The
+// retry delay is doubled for each failed attempt (backoff).
+func (c *Cache) isFailedBefore(errorIndicationFile string) bool {
+	indication, err := readErrorIndicationFile(errorIndicationFile)
+	if err != nil {
+		return false // No error indication file
+	}
+	if indication.attempts > c.maxRetries {
+		return true // Retries exhausted, skip forever
+	}
+	delay := c.retryDelay * time.Duration(1<<min(indication.attempts-1, 16))
+	if time.Since(indication.last) < delay {
+		return true
+	}
+	log.Infof("Retrying (attempt %d) after %s", indication.attempts+1, errorIndicationFile)
+	return false
+}
+
+// generateErrorIndication creates a text file including the number of
+// failed attempts, the time of the last attempt and the error reason.
 func (c *Cache) generateErrorIndicationFile(errorIndicationFile string, err error) {
 	log.Warn(err)
-	errorFile, err2 := os.Create(errorIndicationFile)
+	attempts := 1
+	if indication, err2 := readErrorIndicationFile(errorIndicationFile); err2 == nil {
+		attempts = indication.attempts + 1
+	}
+	os.MkdirAll(filepath.Dir(errorIndicationFile), c.dirMode) // The folder might not exist yet
+	errorFile, err2 := c.createFile(errorIndicationFile)
 	if err2 == nil {
 		defer errorFile.Close()
-		errorFile.WriteString(err.Error())
+		fmt.Fprintf(errorFile, "attempts: %d\nlast: %s\n%s", attempts, time.Now().Format(time.RFC3339), err.Error())
 		log.Info("Created: ", errorIndicationFile)
 	} else {
 		log.Warnf("Unable to create %s. Reason: %s", errorIndicationFile, err2)
 	}
 }
 
+// createFile creates or truncates a cache file using the configured file
+// mode (only applies to new files)
+func (c *Cache) createFile(fullPath string) (*os.File, error) {
+	return os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, c.fileMode)
+}
+
+// tempFileCounter makes the names of temporary files unique
+var tempFileCounter atomic.Uint64
+
+// writeCacheFile creates a cache file and writes its content using write.
+// If atomicWrite is enabled the content is first written to a temporary
+// file in the same directory, which is renamed when complete. A partially
+// written file, e.g. if the process is killed, is then never mistaken for
+// a complete cache file. what is used in error messages, e.g. thumbnail.
+func (c *Cache) writeCacheFile(fullPath, what string, write func(w io.Writer) error) error {
+	if !c.atomicWrite {
+		outFile, err := c.createFile(fullPath)
+		if err != nil {
+			return fmt.Errorf("unable to open %s for creating %s, reason %s", fullPath, what, err)
+		}
+		defer outFile.Close()
+		return write(outFile)
+	}
+	tempPath := fmt.Sprintf("%s.%d-%d.tmp", fullPath, os.Getpid(), tempFileCounter.Add(1))
+	tempFile, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, c.fileMode)
+	if err != nil {
+		return fmt.Errorf("unable to open %s for creating %s, reason %s", tempPath, what, err)
+	}
+	err = write(tempFile)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, fullPath)
+	}
+	if err != nil {
+		os.Remove(tempPath) // Never leave partial files
+	}
+	return err
+}
+
 // generateImageThumbnail generates a thumbnail from any of the supported
 // images. Will create necessary subdirectories in the thumbpath.
 func (c *Cache) generateImageThumbnail(fullMediaPath, fullThumbPath string) error {
-	img, err := imaging.Open(fullMediaPath, imaging.AutoOrientation(true))
+	img, err := openImage(fullMediaPath, c.maxImagePixels, c.forceRotate)
 	if err != nil {
 		return fmt.Errorf("unable to open image %s, reason: %s", fullMediaPath, err)
 	}
-	thumbImg := imaging.Thumbnail(img, 256, 256, imaging.Box)
+	var thumbImg image.Image = imaging.Thumbnail(img, 256, 256, c.resampleFilter)
+	if hasAlpha(img) {
+		// JPEG has no alpha channel, transparent parts would become black
+		thumbImg = flatten(thumbImg, c.thumbBackground)
+	}
 
 	// Create subdirectories if needed
 	directory := filepath.Dir(fullThumbPath)
-	err = os.MkdirAll(directory, os.ModePerm)
+	err = os.MkdirAll(directory, c.dirMode)
 	if err != nil {
 		return fmt.Errorf("unable to create directories in %s for creating thumbnail, reason %s", fullThumbPath, err)
 	}
 
 	// Write thumbnail to file
-	outFile, err := os.Create(fullThumbPath)
-	if err != nil {
-		return fmt.Errorf("unable to open %s for creating thumbnail, reason %s", fullThumbPath, err)
-	}
-	defer outFile.Close()
-	err = imaging.Encode(outFile, thumbImg, imaging.JPEG)
-
-	return err
+	return c.writeCacheFile(fullThumbPath, "thumbnail", func(w io.Writer) error {
+		return imaging.Encode(w, thumbImg, imaging.JPEG)
+	})
 }
 
 // generateImagePreview generates a preview from any of the supported
 // images. Will create necessary subdirectories in the PreviewPath.
+// The preview is encoded in AVIF or PNG format if fullPreviewPath has the
+// .avif or .png extension, otherwise JPEG.
 func (c *Cache) generateImagePreview(fullMediaPath, fullPreviewPath string) error {
-	img, err := imaging.Open(fullMediaPath, imaging.AutoOrientation(true))
+	return c.generateImagePreviewSize(fullMediaPath, fullPreviewPath, c.previewMaxSide)
+}
+
+// generateImagePreviewSize is similar to generateImagePreview but with
+// the provided max width/height
+func (c *Cache) generateImagePreviewSize(fullMediaPath, fullPreviewPath string, maxSide int) error {
+	img, err := openImage(fullMediaPath, c.maxImagePixels, c.forceRotate)
 	if err != nil {
 		return fmt.Errorf("unable to open image %s, reason: %s", fullMediaPath, err)
 	}
-	previewImg := imaging.Fit(img, c.previewMaxSide, c.previewMaxSide, imaging.Box)
+	previewImg := c.addWatermark(c.enhance(imaging.Fit(img, maxSide, maxSide, c.resampleFilter)))
 
 	// Create subdirectories if needed
 	directory := filepath.Dir(fullPreviewPath)
-	err = os.MkdirAll(directory, os.ModePerm)
+	err = os.MkdirAll(directory, c.dirMode)
 	if err != nil {
 		return fmt.Errorf("unable to create directories in %s for creating preview, reason %s", fullPreviewPath, err)
 	}
 
 	// Write thumbnail to file
-	outFile, err := os.Create(fullPreviewPath)
-	if err != nil {
-		return fmt.Errorf("unable to open %s for creating preview, reason %s", fullPreviewPath, err)
-	}
-	defer outFile.Close()
-	err = imaging.Encode(outFile, previewImg, imaging.JPEG)
-
-	return err
+	return c.writeCacheFile(fullPreviewPath, "preview", func(w io.Writer) error {
+		if strings.EqualFold(filepath.Ext(fullPreviewPath), ".avif") {
+			return encodeAVIF(w, previewImg)
+		} else if strings.EqualFold(filepath.Ext(fullPreviewPath), ".png") {
+			return imaging.Encode(w, previewImg, imaging.PNG)
+		}
+		if hasAlpha(img) {
+			previewImg = flatten(previewImg, c.thumbBackground)
+		}
+		return imaging.Encode(w, previewImg, imaging.JPEG)
+	})
 }
 
 // generateVideoThumbnail generates a thumbnail from any of the supported
@@ -467,6 +1214,11 @@ func (c *Cache) generateVideoThumbnail(fullMediaPath, fullThumbPath string) erro
 	// Extract the screenshot
 	err := c.extractVideoScreenshot(fullMediaPath, screenShot)
 	if err != nil {
+		if c.videoThumbFallback && c.hasVideoThumbnailSupport() {
+			// ffmpeg is installed but unable to handle this video
+			log.Infof("Using fallback thumbnail for %s. Reason: %s", fullMediaPath, err)
+			return c.generateFallbackVideoThumbnail(fullMediaPath, fullThumbPath)
+		}
 		return err
 	}
 	defer os.Remove(screenShot) // Remove temporary file
@@ -476,82 +1228,246 @@ func (c *Cache) generateVideoThumbnail(fullMediaPath, fullThumbPath string) erro
 	if err != nil {
 		return fmt.Errorf("unable to open screenshot image %s, reason: %s", screenShot, err)
 	}
-	thumbImg := imaging.Thumbnail(img, 256, 256, imaging.Box)
+	var thumbImg image.Image = imaging.Thumbnail(img, 256, 256, c.resampleFilter)
 
 	// Add small video icon i upper right corner to indicate that this is
 	// a video
-	iconVideoImg, err := c.getVideoIcon()
+	thumbImg, err = c.addVideoIcon(thumbImg)
 	if err != nil {
 		return err
 	}
-	thumbImg = imaging.Overlay(thumbImg, iconVideoImg, image.Pt(155, 11), 1.0)
 
 	// Write thumbnail to file
-	outFile, err := os.Create(fullThumbPath)
-	if err != nil {
-		return fmt.Errorf("unable to open %s for creating thumbnail, reason %s", fullThumbPath, err)
+	return c.writeCacheFile(fullThumbPath, "thumbnail", func(w io.Writer) error {
+		return imaging.Encode(w, thumbImg, imaging.JPEG)
+	})
+}
+
+// generateVideoPreview generates an animated GIF from a number of frames
+// (videoPreviewFrames) evenly spread over the video. The frames are
+// cropped to the thumbnail size.
+func (c *Cache) generateVideoPreview(fullMediaPath, fullPreviewPath string) error {
+	duration := c.getVideoDuration(fullMediaPath)
+	if duration <= 0 {
+		// Unknown duration, take a frame every second
+		duration = time.Duration(c.videoPreviewFrames) * time.Second
 	}
-	defer outFile.Close()
-	err = imaging.Encode(outFile, thumbImg, imaging.JPEG)
 
-	return err
+	animation := &gif.GIF{}
+	for i := 0; i < c.videoPreviewFrames; i++ {
+		// The temporary file for the frame
+		frameFile := fmt.Sprintf("%s.%d.sh.jpg", fullPreviewPath, i)
+		position := duration * time.Duration(2*i+1) / time.Duration(2*c.videoPreviewFrames)
+		err := c.extractVideoFrame(fullMediaPath, frameFile, position)
+		if err != nil {
+			if i > 0 {
+				break // Use the frames extracted so far
+			}
+			return err
+		}
+		img, err := imaging.Open(frameFile, imaging.AutoOrientation(true))
+		os.Remove(frameFile) // Remove temporary file
+		if err != nil {
+			return fmt.Errorf("unable to open frame image %s, reason: %s", frameFile, err)
+		}
+		frameImg := imaging.Thumbnail(img, 256, 256, c.resampleFilter)
+		palettedImg := image.NewPaletted(frameImg.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(palettedImg, frameImg.Bounds(), frameImg, image.Point{})
+		animation.Image = append(animation.Image, palettedImg)
+		animation.Delay = append(animation.Delay, 50) // 100ths of a second
+	}
+
+	// Write preview to file
+	return c.writeCacheFile(fullPreviewPath, "preview", func(w io.Writer) error {
+		return gif.EncodeAll(w, animation)
+	})
+}
+
+// hasVideoThumbnailSupport returns true if the configured ffmpeg is
+// installed, and thus video thumbnails and previews are supported
+func (c *Cache) hasVideoThumbnailSupport() bool {
+	return isFFmpegInstalled(c.ffmpegPath)
+}
+
+var durationRegexp = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+(?:\.\d+)?)`)
+
+// getVideoDuration returns the duration of a video by parsing the
+// ffmpeg output. Returns 0 if the duration could not be determined.
+func (c *Cache) getVideoDuration(inFilePath string) time.Duration {
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.ffmpegPath, "-i", inFilePath)
+	cmd.Stderr = &stderr
+	cmd.Run() // Will fail since no output file is given, but duration is still printed
+	match := durationRegexp.FindStringSubmatch(stderr.String())
+	if match == nil {
+		return 0
+	}
+	hours, _ := strconv.Atoi(match[1])
+	minutes, _ := strconv.Atoi(match[2])
+	seconds, _ := strconv.ParseFloat(match[3], 64)
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(seconds*float64(time.Second))
 }
 
 // extractVideoScreenshot extracts a screenshot from a video using external
 // ffmpeg software. Will create necessary directories in the outFilePath
 func (c *Cache) extractVideoScreenshot(inFilePath, outFilePath string) error {
-	if !hasVideoThumbnailSupport() {
+	return c.extractVideoFrame(inFilePath, outFilePath, 5*time.Second) // 5 seconds into movie
+}
+
+// extractVideoFrame extracts a frame at the provided position from a video
+// using external ffmpeg software. Will create necessary directories in the
+// outFilePath
+func (c *Cache) extractVideoFrame(inFilePath, outFilePath string, position time.Duration) error {
+	if !c.hasVideoThumbnailSupport() {
 		return fmt.Errorf("video thumbnails not supported. ffmpeg not installed")
 	}
 
 	// Create subdirectories if needed
 	directory := filepath.Dir(outFilePath)
-	err := os.MkdirAll(directory, os.ModePerm)
+	err := os.MkdirAll(directory, c.dirMode)
 	if err != nil {
 		return fmt.Errorf("unable to create directories in %s for extracting screenshot, reason %s", outFilePath, err)
 	}
 
-	// Define argments for ffmpeg
-	ffmpegArgs := []string{
+	// Define argments for ffmpeg (extra arguments first, since e.g.
+	// hardware acceleration options must be before the input file)
+	ffmpegArgs := append(slices.Clone(c.ffmpegArgs),
 		"-i",
 		inFilePath,
 		"-ss",
-		"00:00:05", // 5 seconds into movie
+		fmt.Sprintf("%.3f", position.Seconds()),
 		"-vframes",
 		"1",
-		outFilePath}
+		outFilePath)
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
-	//cmd := exec.Command(ffmpegCmd, ffmpegArg)
-	cmd := exec.Command(ffmpegCmd, ffmpegArgs...)
+	cmd := exec.Command(c.ffmpegPath, ffmpegArgs...)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	err = cmd.Run()
 	_, outFileErr := os.Stat(outFilePath)
 	if err != nil || outFileErr != nil {
-		return fmt.Errorf("%s %s\nStdout: %s\nStderr: %s",
-			ffmpegCmd, strings.Join(ffmpegArgs, " "), stdout.String(), stderr.String())
+		reason := "ffmpeg present but screenshot extraction failed, check codecs"
+		if c.ffmpegProbeErr != nil {
+			reason = fmt.Sprintf("ffmpeg not working (%s)", c.ffmpegProbeErr)
+		}
+		return fmt.Errorf("%s: %s %s\nStdout: %s\nStderr: %s",
+			reason, c.ffmpegPath, strings.Join(ffmpegArgs, " "), stdout.String(), stderr.String())
 	}
 	return nil
 }
 
-// Cache to avoid regenerate icon each time (do it once)
-var videoIcon image.Image
+// Size and margin of the video icon in video thumbnails, relative to the
+// thumbnail side (i.e. a 90x90 icon 11 pixels from the upper right corner
+// of a 256x256 thumbnail).
+const (
+	videoIconScale  = 0.35
+	videoIconMargin = 0.043
+)
 
-func (c *Cache) getVideoIcon() (image.Image, error) {
-	if videoIcon != nil {
+// addVideoIcon adds the video icon to the upper right corner of a
+// thumbnail. The icon size and position are relative to the thumbnail.
+// The thumbnail is returned as is if the video icon overlay is disabled.
+func (c *Cache) addVideoIcon(thumbImg image.Image) (image.Image, error) {
+	if !c.videoIconOverlay {
+		return thumbImg, nil
+	}
+	bounds := thumbImg.Bounds()
+	side := max(bounds.Dx(), bounds.Dy())
+	iconVideoImg, err := c.getVideoIcon(int(float64(side)*videoIconScale + 0.5))
+	if err != nil {
+		return nil, err
+	}
+	margin := int(float64(side)*videoIconMargin + 0.5)
+	position := image.Pt(bounds.Max.X-margin-iconVideoImg.Bounds().Dx(), bounds.Min.Y+margin)
+	return imaging.Overlay(thumbImg, iconVideoImg, position, 1.0), nil
+}
+
+// Cache to avoid regenerate icon each time (do it once per size). Keyed
+// by side, since thumbnails of different sizes are generated concurrently.
+var videoIcons sync.Map
+
+func (c *Cache) getVideoIcon(side int) (image.Image, error) {
+	if videoIcon, ok := videoIcons.Load(side); ok {
 		// To avoid re-generate
-		return videoIcon, nil
+		return videoIcon.(image.Image), nil
 	}
-	var err error
-	videoIcon, err = imaging.Decode(bytes.NewReader(embedVideoIconBytes))
+	icon, err := imaging.Decode(bytes.NewReader(embedVideoIconBytes))
 	if err != nil {
 		return nil, err
 	}
-	videoIcon = imaging.Resize(videoIcon, 90, 90, imaging.Box)
-	return videoIcon, nil
+	videoIcon, _ := videoIcons.LoadOrStore(side, imaging.Resize(icon, side, side, imaging.Box))
+	return videoIcon.(image.Image), nil
+}
+
+// Size and margin of the watermark in previews, relative to the longest
+// side of the preview
+const (
+	watermarkScale  = 0.25
+	watermarkMargin = 0.02
+)
+
+// enhance sharpens and adjusts the contrast of a downscaled preview if
+// enhancePreviews is enabled, otherwise the image is returned unchanged
+func (c *Cache) enhance(previewImg image.Image) image.Image {
+	if !c.enhancePreviews {
+		return previewImg
+	}
+	enhanced := imaging.Sharpen(previewImg, c.sharpenSigma)
+	if c.contrast != 0 {
+		enhanced = imaging.AdjustContrast(enhanced, c.contrast)
+	}
+	return enhanced
+}
+
+// addWatermark adds the watermark to a preview at the configured position
+// and opacity. The preview is returned as is if there is no watermark.
+func (c *Cache) addWatermark(previewImg image.Image) image.Image {
+	if c.watermark == nil {
+		return previewImg
+	}
+	bounds := previewImg.Bounds()
+	side := max(bounds.Dx(), bounds.Dy())
+	watermarkImg := c.getScaledWatermark(int(float64(side)*watermarkScale + 0.5))
+	margin := int(float64(side)*watermarkMargin + 0.5)
+	left := bounds.Min.X + margin
+	right := bounds.Max.X - margin - watermarkImg.Bounds().Dx()
+	top := bounds.Min.Y + margin
+	bottom := bounds.Max.Y - margin - watermarkImg.Bounds().Dy()
+	var position image.Point
+	switch c.watermarkPosition {
+	case "topleft":
+		position = image.Pt(left, top)
+	case "topright":
+		position = image.Pt(right, top)
+	case "bottomleft":
+		position = image.Pt(left, bottom)
+	case "center":
+		position = image.Pt((left+right)/2, (top+bottom)/2)
+	default:
+		position = image.Pt(right, bottom)
+	}
+	return imaging.Overlay(previewImg, watermarkImg, position, c.watermarkOpacity)
+}
+
+// getScaledWatermark returns the watermark scaled so that its longest
+// side is side pixels. The scaled watermark is cached since all previews
+// typically have the same size.
+func (c *Cache) getScaledWatermark(side int) image.Image {
+	c.watermarkMutex.Lock()
+	defer c.watermarkMutex.Unlock()
+	if c.scaledWatermark != nil && max(c.scaledWatermark.Bounds().Dx(), c.scaledWatermark.Bounds().Dy()) == side {
+		return c.scaledWatermark
+	}
+	if c.watermark.Bounds().Dx() >= c.watermark.Bounds().Dy() {
+		c.scaledWatermark = imaging.Resize(c.watermark, side, 0, c.resampleFilter)
+	} else {
+		c.scaledWatermark = imaging.Resize(c.watermark, 0, side, c.resampleFilter)
+	}
+	return c.scaledWatermark
 }
 
 // cleanupCache removes all files and directories in the cache directory
@@ -561,10 +1477,98 @@ func (c *Cache) getVideoIcon() (image.Image, error) {
 // as thumbs, preview or error files in the cache.
 // Returns number of removed files and directories
 func (c *Cache) cleanupCache(relativePath string, expectedMediaFiles []File) int {
-	fullCachePath, _ := c.getFullCachePath(relativePath)
+	fullCachePath, _ := c.getFullCacheFolderPath(relativePath)
 	log.Debug("Cleaning up directory: ", fullCachePath)
+	cacheFileNames := c.cacheFileNames(expectedMediaFiles)
+
+	// Compare the files in cache path with expected files
+	fileInfos, _ := os.ReadDir(fullCachePath)
+	nbrRemovedFiles := 0
+	for _, fileInfo := range fileInfos {
+		if !contains(cacheFileNames, fileInfo.Name()) {
+			filePath := filepath.Join(fullCachePath, fileInfo.Name())
+			relativeCachePath := filepath.ToSlash(filepath.Join(relativePath, fileInfo.Name()))
+			if c.migrateCacheFile(relativePath, fileInfo.Name(), expectedMediaFiles, cacheFileNames) {
+				continue
+			}
+			log.Debug("Removing ", filePath)
+			os.RemoveAll(filePath)
+			c.mutex.Lock()
+			delete(c.thumbnails, relativeCachePath)
+			delete(c.previews, relativeCachePath)
+			delete(c.albumThumbnails, relativeCachePath)
+			c.mutex.Unlock()
+			nbrRemovedFiles++
+		}
+	}
+	return nbrRemovedFiles
+}
+
+// migrateCacheFile renames a cache file named without the media file
+// extension (e.g. photo.thumb.jpg), i.e. from before includeExtension
+// was enabled, to its name with the extension (photo.jpg.thumb.jpg).
+// Returns false if it isn't such a file, or if it can't be renamed since
+// media files with the same base name (e.g. photo.jpg and photo.png)
+// shared it. It is then removed by the caller and generated again.
+func (c *Cache) migrateCacheFile(relativePath, cacheFileName string, expectedMediaFiles []File, cacheFileNames []string) bool {
+	if !c.includeExtension {
+		return false
+	}
+	newNames := []string{}
+	mediaNames := []string{}
+	for _, file := range expectedMediaFiles {
+		_, mediaName := filepath.Split(file.Name)
+		ext := filepath.Ext(mediaName)
+		if file.Type == "folder" || ext == "" {
+			continue
+		}
+		cacheExt, ok := strings.CutPrefix(cacheFileName, strings.TrimSuffix(mediaName, ext))
+		if ok && strings.HasPrefix(cacheExt, ".") && contains(cacheFileNames, mediaName+cacheExt) {
+			newNames = append(newNames, mediaName+cacheExt)
+			mediaNames = append(mediaNames, mediaName)
+		}
+	}
+	if len(newNames) > 1 {
+		log.Warnf("Cache file %s was shared by media files with the same name (%s). Generating them again.",
+			filepath.ToSlash(filepath.Join(relativePath, cacheFileName)), strings.Join(mediaNames, ", "))
+		return false
+	}
+	if len(newNames) == 0 {
+		return false
+	}
 
-	// Figure possible directories, thumb, preview and error file names
+	from := filepath.ToSlash(filepath.Join(relativePath, cacheFileName))
+	to := filepath.ToSlash(filepath.Join(relativePath, newNames[0]))
+	fromFullPath, err := c.getFullCachePath(from)
+	if err != nil {
+		return false
+	}
+	toFullPath, err := c.getFullCachePath(to)
+	if err != nil {
+		return false
+	}
+	if _, err := os.Stat(toFullPath); err == nil {
+		return false // Already generated with the new name
+	}
+	if !c.moveCacheFile(fromFullPath, toFullPath) {
+		return false
+	}
+	log.Debugf("Renamed cache file %s to %s", from, to)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, entries := range []map[string]time.Time{c.thumbnails, c.previews} {
+		if t, ok := entries[from]; ok {
+			delete(entries, from)
+			entries[to] = t
+		}
+	}
+	return true
+}
+
+// cacheFileNames returns the names of the possible directories, thumb,
+// preview and error files in a cache directory given the media files
+// (including directories) of the corresponding media folder.
+func (c *Cache) cacheFileNames(expectedMediaFiles []File) []string {
 	cacheFileNames := make([]string, 0, len(expectedMediaFiles)*5)
 	for _, file := range expectedMediaFiles {
 		_, fileName := filepath.Split(file.Name)
@@ -579,8 +1583,10 @@ func (c *Cache) cleanupCache(relativePath string, expectedMediaFiles []File) int
 				_, errorIndicationName = filepath.Split(errorIndicationName)
 				cacheFileNames = append(cacheFileNames, errorIndicationName)
 			}
-			previewName, err := c.previewPath(fileName)
-			if err == nil {
+			if sheetName, err := c.relativeContactSheetPath(fileName); err == nil {
+				cacheFileNames = append(cacheFileNames, sheetName, c.errorIndicationPath(sheetName))
+			}
+			for _, previewName := range c.relativePreviewPaths(fileName) {
 				_, previewName = filepath.Split(previewName)
 				cacheFileNames = append(cacheFileNames, previewName)
 				errorIndicationName := c.errorIndicationPath(previewName)
@@ -589,17 +1595,259 @@ func (c *Cache) cleanupCache(relativePath string, expectedMediaFiles []File) int
 			}
 		}
 	}
+	return cacheFileNames
+}
+
+// removeCacheFiles removes the thumbnail, all previews and their error
+// indication files for a media file.
+// Returns number of removed files.
+func (c *Cache) removeCacheFiles(relativeMediaPath string) int {
+	relativePaths := c.relativeCachePaths(relativeMediaPath)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	// Compare the files in cache path with expected files
-	fileInfos, _ := os.ReadDir(fullCachePath)
 	nbrRemovedFiles := 0
-	for _, fileInfo := range fileInfos {
-		if !contains(cacheFileNames, fileInfo.Name()) {
-			filePath := filepath.Join(fullCachePath, fileInfo.Name())
-			log.Debug("Removing ", filePath)
-			os.RemoveAll(filePath)
+	for _, relativePath := range relativePaths {
+		delete(c.thumbnails, relativePath)
+		delete(c.previews, relativePath)
+		fullPath, err := c.getFullCachePath(relativePath)
+		if err != nil {
+			continue
+		}
+		for _, path := range []string{fullPath, c.errorIndicationPath(fullPath)} {
+			if os.Remove(path) == nil {
+				log.Debug("Removed ", path)
+				nbrRemovedFiles++
+			}
+		}
+	}
+	return nbrRemovedFiles
+}
+
+// moveCacheFiles moves the cache files of a media file, or all cache
+// files of a folder, so that they correspond to the new media path.
+// Missing cache files are ignored.
+func (c *Cache) moveCacheFiles(fromRelativePath, toRelativePath string, isFolder bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if isFolder {
+		fromFullPath, err := c.getFullCachePath(fromRelativePath)
+		if err != nil {
+			return
+		}
+		toFullPath, err := c.getFullCachePath(toRelativePath)
+		if err != nil {
+			return
+		}
+		// Cache folders in media folders are moved with the media
+		if c.mediaDirCache != "" || c.moveCacheFile(fromFullPath, toFullPath) {
+			for _, entries := range []map[string]time.Time{c.thumbnails, c.previews} {
+				for path, t := range entries {
+					if strings.HasPrefix(path, fromRelativePath+"/") {
+						delete(entries, path)
+						entries[toRelativePath+path[len(fromRelativePath):]] = t
+					}
+				}
+			}
+		}
+		return
+	}
+
+	type pathPair struct{ from, to string }
+	pairs := make([]pathPair, 0, 4)
+	fromThumbPath, errFrom := c.relativeThumbnailPath(fromRelativePath)
+	toThumbPath, errTo := c.relativeThumbnailPath(toRelativePath)
+	if errFrom == nil && errTo == nil {
+		pairs = append(pairs, pathPair{fromThumbPath, toThumbPath})
+	}
+	fromSheetPath, errFrom := c.relativeContactSheetPath(fromRelativePath)
+	toSheetPath, errTo := c.relativeContactSheetPath(toRelativePath)
+	if errFrom == nil && errTo == nil {
+		pairs = append(pairs, pathPair{fromSheetPath, toSheetPath})
+	}
+	fromPreviewPaths := c.relativePreviewPaths(fromRelativePath)
+	toPreviewPaths := c.relativePreviewPaths(toRelativePath)
+	if len(fromPreviewPaths) == len(toPreviewPaths) {
+		for i := range fromPreviewPaths {
+			pairs = append(pairs, pathPair{fromPreviewPaths[i], toPreviewPaths[i]})
+		}
+	}
+
+	for _, pair := range pairs {
+		fromFullPath, err := c.getFullCachePath(pair.from)
+		if err != nil {
+			continue
+		}
+		toFullPath, err := c.getFullCachePath(pair.to)
+		if err != nil {
+			continue
+		}
+		c.moveCacheFile(c.errorIndicationPath(fromFullPath), c.errorIndicationPath(toFullPath))
+		if !c.moveCacheFile(fromFullPath, toFullPath) {
+			continue
+		}
+		for _, entries := range []map[string]time.Time{c.thumbnails, c.previews} {
+			if t, ok := entries[pair.from]; ok {
+				delete(entries, pair.from)
+				entries[pair.to] = t
+			}
+		}
+	}
+}
+
+// moveCacheFile moves a file or directory in the cache. Returns
+// true if it was moved.
+func (c *Cache) moveCacheFile(fromFullPath, toFullPath string) bool {
+	if _, err := os.Stat(fromFullPath); err != nil {
+		return false // Nothing to move
+	}
+	err := os.MkdirAll(filepath.Dir(toFullPath), c.dirMode)
+	if err == nil {
+		err = os.Rename(fromFullPath, toFullPath)
+	}
+	if err != nil {
+		log.Warnf("Unable to move %s to %s. Reason: %s", fromFullPath, toFullPath, err)
+		return false
+	}
+	log.Debugf("Moved %s to %s", fromFullPath, toFullPath)
+	return true
+}
+
+// isEvictionEnabled returns true if any eviction limit is configured
+func (c *Cache) isEvictionEnabled() bool {
+	return c.entryTTL > 0 && (c.expireThumbnails || c.expirePreviews) || c.maxAge > 0 || c.maxSize > 0
+}
+
+// evict removes cache files according to the configured limits, i.e.
+// entryTTL (see evictExpired), maxAge and maxSize. When the cache is
+// larger than maxSize the least recently used files are removed first.
+//
+// Note that evicted files are regenerated when requested again (or on
+// the next pre-cache), so a too small maxSize causes the same files to
+// be generated over and over again.
+// Returns number of removed files.
+func (c *Cache) evict() int {
+	nbrRemovedFiles := c.evictExpired()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.maxAge > 0 {
+		nbrRemovedFiles += c.evictExpiredEntries(c.thumbnails, c.maxAge)
+		nbrRemovedFiles += c.evictExpiredEntries(c.previews, c.maxAge)
+	}
+	if c.maxSize > 0 {
+		nbrRemovedFiles += c.evictLeastRecentlyUsed()
+	}
+	return nbrRemovedFiles
+}
+
+// evictExpired removes all thumbnails and/or previews (depending on
+// configuration) that have not been updated or accessed within entryTTL.
+// Returns number of removed files.
+func (c *Cache) evictExpired() int {
+	if c.entryTTL <= 0 {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	nbrRemovedFiles := 0
+	if c.expireThumbnails {
+		nbrRemovedFiles += c.evictExpiredEntries(c.thumbnails, c.entryTTL)
+	}
+	if c.expirePreviews {
+		nbrRemovedFiles += c.evictExpiredEntries(c.previews, c.entryTTL)
+	}
+	return nbrRemovedFiles
+}
+
+// evictExpiredEntries removes the entries, and their files, that are
+// older than maxAge from the provided map. The mutex shall be locked by
+// the caller.
+func (c *Cache) evictExpiredEntries(entries map[string]time.Time, maxAge time.Duration) int {
+	nbrRemovedFiles := 0
+	for path, t := range entries {
+		if time.Since(t) > maxAge && c.evictEntry(entries, path) {
 			nbrRemovedFiles++
 		}
 	}
 	return nbrRemovedFiles
 }
+
+// evictLeastRecentlyUsed removes the least recently used thumbnails
+// and previews until the total size is below maxSize. The mutex shall
+// be locked by the caller.
+func (c *Cache) evictLeastRecentlyUsed() int {
+	type cacheEntry struct {
+		entries map[string]time.Time
+		path    string
+		time    time.Time
+		size    int64
+	}
+	var cacheEntries []cacheEntry
+	var totalSize int64
+	for _, entries := range []map[string]time.Time{c.thumbnails, c.previews} {
+		for path, t := range entries {
+			fullPath, err := c.getFullCachePath(path)
+			if err != nil {
+				continue
+			}
+			fileInfo, err := os.Stat(fullPath)
+			if err != nil {
+				continue
+			}
+			cacheEntries = append(cacheEntries, cacheEntry{entries, path, t, fileInfo.Size()})
+			totalSize += fileInfo.Size()
+		}
+	}
+	if totalSize <= c.maxSize {
+		return 0
+	}
+
+	sort.Slice(cacheEntries, func(i, j int) bool {
+		return cacheEntries[i].time.Before(cacheEntries[j].time)
+	})
+	nbrRemovedFiles := 0
+	for _, entry := range cacheEntries {
+		if totalSize <= c.maxSize {
+			break
+		}
+		if c.evictEntry(entry.entries, entry.path) {
+			totalSize -= entry.size
+			nbrRemovedFiles++
+		}
+	}
+	return nbrRemovedFiles
+}
+
+// evictEntry removes a cache file and its entry in the provided map.
+// The mutex shall be locked by the caller.
+func (c *Cache) evictEntry(entries map[string]time.Time, path string) bool {
+	fullPath, err := c.getFullCachePath(path)
+	if err != nil {
+		log.Warn(err)
+		return false
+	}
+	log.Debug("Evicting ", fullPath)
+	err = os.Remove(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Unable to evict %s. Reason: %s", fullPath, err)
+		return false
+	}
+	delete(entries, path)
+	return true
+}
+
+// evictionThread periodically evicts cache entries.
+func (c *Cache) evictionThread(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		nbrRemovedFiles := c.evict()
+		if nbrRemovedFiles > 0 {
+			log.Infof("Evicted %d cache files", nbrRemovedFiles)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// mediaDirToken in the cache path is replaced with the folder of each
+// media file, i.e. the cache files are stored in a sub folder of each
+// media folder instead of in a separate cache path. This keeps the cache
+// together with the media, e.g. when media is on several drives.
+const mediaDirToken = "{mediadir}"
+
+// parseMediaDirCachePath returns the cache folder relative each media
+// folder if the cache path contains mediaDirToken, e.g. .mediaweb-cache
+// for {mediadir}/.mediaweb-cache. Returns "" if it doesn't contain the
+// token. The cache folder must be a sub folder, so that cache files never
+// collide with media files.
+func parseMediaDirCachePath(cachePath string) (string, error) {
+	if !strings.Contains(cachePath, mediaDirToken) {
+		return "", nil
+	}
+	subFolder, ok := strings.CutPrefix(filepath.ToSlash(cachePath), mediaDirToken+"/")
+	if !ok {
+		return "", fmt.Errorf("%s shall be followed by a sub folder, e.g. %s/.mediaweb-cache", mediaDirToken, mediaDirToken)
+	}
+	subFolder = path.Clean(subFolder)
+	if subFolder == "." || subFolder == ".." || strings.HasPrefix(subFolder, "../") || path.IsAbs(subFolder) ||
+		strings.Contains(subFolder, mediaDirToken) {
+		return "", fmt.Errorf("%s is not a sub folder of %s", subFolder, mediaDirToken)
+	}
+	return subFolder, nil
+}
+
+// getFullCacheFolderPath returns the full path of the cache folder of a
+// media folder. With mediaDirCache it is the cache sub folder of the media
+// folder, otherwise it is the same as getFullCachePath.
+func (c *Cache) getFullCacheFolderPath(relativeFolderPath string) (string, error) {
+	if c.mediaDirCache == "" {
+		return c.getFullCachePath(relativeFolderPath)
+	}
+	fullMediaPath, err := getFullPath(c.mediaPath, relativeFolderPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(filepath.Join(fullMediaPath, c.mediaDirCache)), nil
+}
+
+// cacheSubFolders returns the relative paths of the folders to continue
+// with when walking the cache recursively from the folder relativePath,
+// given the entries in its cache folder. With mediaDirCache these are
+// the media sub folders (except the cache folder itself), since each of
+// them has its own cache folder.
+func (c *Cache) cacheSubFolders(relativePath string, dirEntries []os.DirEntry) []string {
+	if c.mediaDirCache != "" {
+		fullMediaPath, err := getFullPath(c.mediaPath, relativePath)
+		if err != nil {
+			return nil
+		}
+		dirEntries, err = os.ReadDir(fullMediaPath)
+		if err != nil {
+			return nil
+		}
+	}
+	cacheFolderName, _, _ := strings.Cut(c.mediaDirCache, "/")
+	subFolders := []string{}
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() && (c.mediaDirCache == "" || dirEntry.Name() != cacheFolderName) {
+			subFolders = append(subFolders, filepath.ToSlash(filepath.Join(relativePath, dirEntry.Name())))
+		}
+	}
+	return subFolders
+}
+
+// isInCache returns true if the full path is a cache folder in a media
+// folder, or anything in it. These are not part of the media.
+func (m *Media) isInCache(fullPath string) bool {
+	if m.cache == nil || m.cache.mediaDirCache == "" {
+		return false
+	}
+	relativePath, err := m.getRelativeMediaPath(fullPath)
+	if err != nil {
+		return false
+	}
+	cacheFolderName, _, _ := strings.Cut(m.cache.mediaDirCache, "/")
+	return contains(strings.Split(relativePath, "/"), cacheFolderName)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseMediaDirCachePath(t *testing.T) {
+	subFolder, err := parseMediaDirCachePath("/tmp/cache")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "No token", "", subFolder)
+	subFolder, err = parseMediaDirCachePath("{mediadir}/.mediaweb-cache")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", ".mediaweb-cache", subFolder)
+	subFolder, err = parseMediaDirCachePath("{mediadir}/cache/thumbs/")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "cache/thumbs", subFolder)
+
+	// Cache files could collide with media files
+	for _, cachePath := range []string{"{mediadir}", "{mediadir}/", "{mediadir}/.", "{mediadir}/../cache",
+		"{mediadir}/a/../..", "/tmp/{mediadir}/cache", "{mediadir}/{mediadir}"} {
+		_, err = parseMediaDirCachePath(cachePath)
+		assertExpectErr(t, cachePath, err)
+	}
+}
+
+func TestMediaDirCache(t *testing.T) {
+	mediaPath := "tmpout/TestMediaDirCache"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/sub/subsub", os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/sub/subsub/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/sub/subsub/removed.png")
+
+	media := createMedia(mediaPath, "{mediadir}/.cache", true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{showHidden: true})
+	for _, path := range []string{"png.png", "sub/subsub/png.png", "sub/subsub/removed.png"} {
+		_, err := media.cache.generateThumbnail(media, path)
+		assertExpectNoErr(t, path, err)
+	}
+	assertFileExist(t, "", mediaPath+"/.cache/png.png.thumb.jpg")
+	assertFileExist(t, "", mediaPath+"/sub/subsub/.cache/png.png.thumb.jpg")
+
+	// The cache folders are not media
+	files, err := media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2, len(files))
+	_, err = media.getFullMediaPath(".cache/png.png.thumb.jpg")
+	assertExpectErr(t, "", err)
+	_, err = media.getFullMediaPath("sub/subsub/.cache")
+	assertExpectErr(t, "", err)
+
+	// Found when the cache is loaded
+	media = createMedia(mediaPath, "{mediadir}/.cache", true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{})
+	assertTrue(t, "", media.cache.hasThumbnail("png.png"))
+	assertTrue(t, "", media.cache.hasThumbnail("sub/subsub/png.png"))
+	assertFileNotExist(t, "No cache path created", "tmpout/TestMediaDirCache/{mediadir}")
+
+	// Recursive clearing of error indications
+	os.WriteFile(mediaPath+"/sub/subsub/.cache/invalid.thumb.err.txt", []byte("error"), 0644)
+	cleared, err := media.clearErrors("", true)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, cleared.NbrOfClearedErrors)
+
+	// Orphans are pruned, cache folders are kept
+	os.Remove(mediaPath + "/sub/subsub/removed.png")
+	result, err := media.pruneCache()
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, result.NbrRemovedFiles)
+	assertFileNotExist(t, "", mediaPath+"/sub/subsub/.cache/removed.png.thumb.jpg")
+	assertFileExist(t, "", mediaPath+"/sub/subsub/.cache/png.png.thumb.jpg")
+
+	// The cache folder is moved with the media folder
+	assertExpectNoErr(t, "", media.moveMedia("sub", "moved"))
+	assertTrue(t, "", media.cache.hasThumbnail("moved/subsub/png.png"))
+	assertFileExist(t, "", mediaPath+"/moved/subsub/.cache/png.png.thumb.jpg")
+	assertExpectNoErr(t, "", media.moveMedia("png.png", "moved/png.png"))
+	assertFileExist(t, "", mediaPath+"/moved/.cache/png.png.thumb.jpg")
+	assertFileNotExist(t, "", mediaPath+"/.cache/png.png.thumb.jpg")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"image"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSlowGenerations is the number of slowest thumbnail generations kept
+// in memory, see recordThumbnailTime
+const maxSlowGenerations = 20
+
+// SlowGeneration is a thumbnail generation that took long time
+type SlowGeneration struct {
+	Path     string    // Relative path of the media file
+	Duration int64     // Generation time in milliseconds
+	Width    int       // Width of the media file (0 if unknown)
+	Height   int       // Height of the media file (0 if unknown)
+	Size     int64     // Size of the media file in bytes
+	Time     time.Time // When the thumbnail was generated
+}
+
+// CacheStats is the content of the cache and its slowest thumbnail
+// generations since startup (slowest first)
+type CacheStats struct {
+	NbrOfThumbnails      int
+	NbrOfPreviews        int
+	NbrOfAlbumThumbnails int
+	SlowGenerations      []SlowGeneration
+}
+
+// recordThumbnailTime keeps track of the slowest thumbnail generations and
+// warns if the generation took longer than slowGenThreshold (if set). The
+// dimensions and size of the media file are included to make it easier to
+// identify problem files.
+func (c *Cache) recordThumbnailTime(m *Media, relativeFilePath string, duration time.Duration) {
+	slow := c.slowGenThreshold > 0 && duration > c.slowGenThreshold
+	c.slowMutex.Lock()
+	slowest := len(c.slowGenerations) < maxSlowGenerations ||
+		duration.Milliseconds() > c.slowGenerations[len(c.slowGenerations)-1].Duration
+	c.slowMutex.Unlock()
+	if !slow && !slowest {
+		return
+	}
+
+	// Paths from the Web API starts with /
+	relativeFilePath = strings.TrimPrefix(relativeFilePath, "/")
+	generation := SlowGeneration{Path: relativeFilePath, Duration: duration.Milliseconds(), Time: time.Now()}
+	if fullPath, err := m.getFullMediaPath(relativeFilePath); err == nil {
+		if stat, err := os.Stat(fullPath); err == nil {
+			generation.Size = stat.Size()
+		}
+		generation.Width, generation.Height = mediaWidthAndHeight(m, relativeFilePath, fullPath)
+	}
+	if slow {
+		log.Warnf("Slow thumbnail generation of %s: %d ms (%dx%d pixels, %d bytes)", relativeFilePath,
+			generation.Duration, generation.Width, generation.Height, generation.Size)
+	}
+
+	c.slowMutex.Lock()
+	defer c.slowMutex.Unlock()
+	c.slowGenerations = append(c.slowGenerations, generation)
+	sort.SliceStable(c.slowGenerations, func(i, j int) bool {
+		return c.slowGenerations[i].Duration > c.slowGenerations[j].Duration
+	})
+	if len(c.slowGenerations) > maxSlowGenerations {
+		c.slowGenerations = c.slowGenerations[:maxSlowGenerations]
+	}
+}
+
+// mediaWidthAndHeight returns the stored width and height of a media
+// file, or 0, 0 if unknown. Only the image header is decoded, i.e. EXIF
+// orientation is not applied.
+func mediaWidthAndHeight(m *Media, relativeFilePath, fullPath string) (int, int) {
+	if m.isVideo(relativeFilePath) {
+		dimensions, err := m.getDimensions(relativeFilePath)
+		if err != nil {
+			return 0, 0
+		}
+		return dimensions.Width, dimensions.Height
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return 0, 0
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+// getCacheStats returns the number of cache entries and the slowest
+// thumbnail generations
+func (c *Cache) getCacheStats() CacheStats {
+	c.mutex.Lock()
+	stats := CacheStats{
+		NbrOfThumbnails:      len(c.thumbnails),
+		NbrOfPreviews:        len(c.previews),
+		NbrOfAlbumThumbnails: len(c.albumThumbnails)}
+	c.mutex.Unlock()
+	c.slowMutex.Lock()
+	stats.SlowGenerations = append([]SlowGeneration{}, c.slowGenerations...)
+	c.slowMutex.Unlock()
+	return stats
+}
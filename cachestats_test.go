@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordThumbnailTime(t *testing.T) {
+	mediaPath := "tmpout/TestRecordThumbnailTime"
+	cachePath := "tmpcache/TestRecordThumbnailTime"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/jpeg.jpg")
+	logs := captureLog(t)
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{slowGenThreshold: time.Second})
+	media.cache.recordThumbnailTime(media, "jpeg.jpg", 1500*time.Millisecond)
+	assertTrue(t, "", strings.Contains(logs.String(), "Slow thumbnail generation of jpeg.jpg: 1500 ms (4128x2322 pixels"))
+	stats := media.cache.getCacheStats()
+	assertEqualsInt(t, "", 1, len(stats.SlowGenerations))
+	slow := stats.SlowGenerations[0]
+	assertEqualsStr(t, "", "jpeg.jpg", slow.Path)
+	assertEqualsInt(t, "", 1500, int(slow.Duration))
+	assertEqualsInt(t, "", 4128, slow.Width)
+	assertEqualsInt(t, "", 2322, slow.Height)
+	stat, _ := os.Stat(mediaPath + "/jpeg.jpg")
+	assertEqualsInt(t, "", int(stat.Size()), int(slow.Size))
+
+	// Below the threshold, only kept as one of the slowest
+	media.cache.recordThumbnailTime(media, "other.jpg", 500*time.Millisecond)
+	assertFalse(t, "", strings.Contains(logs.String(), "other.jpg"))
+
+	// Only the slowest are kept, slowest first
+	for i := 1; i <= maxSlowGenerations; i++ {
+		media.cache.recordThumbnailTime(media, "dont_exist.jpg", time.Duration(i)*100*time.Millisecond)
+	}
+	stats = media.cache.getCacheStats()
+	assertEqualsInt(t, "", maxSlowGenerations, len(stats.SlowGenerations))
+	assertEqualsInt(t, "", 2000, int(stats.SlowGenerations[0].Duration))
+	assertEqualsStr(t, "", "jpeg.jpg", stats.SlowGenerations[5].Path)
+	assertEqualsInt(t, "", 300, int(stats.SlowGenerations[maxSlowGenerations-1].Duration))
+	assertEqualsInt(t, "", 0, stats.SlowGenerations[0].Width)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	log "github.com/sirupsen/logrus"
+)
+
+// Color extraction parameters
+const (
+	colorSampleSide  = 32 // Images are downscaled to this size before the colors are counted
+	colorPaletteSize = 5  // Max number of colors in the palette
+)
+
+// Colors is the dominant color and a palette of the most common colors
+// (most common first) of an image as hex strings, e.g. #a0b1c2
+type Colors struct {
+	Dominant string
+	Palette  []string
+}
+
+// colorsCache is cached colors of an image. It is only valid as long as
+// the modification time is the same.
+type colorsCache struct {
+	modTime time.Time
+	colors  Colors
+}
+
+// getColors returns the (cached) dominant color and palette of an image.
+// The colors are calculated from the thumbnail if there is one, since it
+// is much faster to decode than the image itself.
+func (m *Media) getColors(relativeFilePath string) (Colors, error) {
+	if !m.isImage(relativeFilePath) {
+		return Colors{}, fmt.Errorf("not an image: %s", relativeFilePath)
+	}
+	fullPath, err := m.getFullMediaPath(relativeFilePath)
+	if err != nil {
+		return Colors{}, err
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return Colors{}, err
+	}
+	m.colorsMutex.Lock()
+	cached, ok := m.colors[relativeFilePath]
+	m.colorsMutex.Unlock()
+	if ok && cached.modTime.Equal(stat.ModTime()) {
+		return cached.colors, nil
+	}
+
+	img, err := m.getThumbnailImage(relativeFilePath)
+	if err != nil {
+		log.Debugf("No thumbnail for colors of %s, using the image. Reason: %s", relativeFilePath, err)
+		img, err = openImage(fullPath, m.maxImagePixels, m.forceRotate)
+		if err != nil {
+			return Colors{}, err
+		}
+	}
+	colors := extractColors(img)
+
+	m.colorsMutex.Lock()
+	m.colors[relativeFilePath] = colorsCache{modTime: stat.ModTime(), colors: colors}
+	m.colorsMutex.Unlock()
+	return colors, nil
+}
+
+// parseHexColor parses a color on the format rrggbb or #rrggbb
+func parseHexColor(hex string) (color.NRGBA, error) {
+	hex = strings.TrimPrefix(strings.TrimSpace(hex), "#")
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return color.NRGBA{}, fmt.Errorf("invalid color '%s', expected #rrggbb", hex)
+	}
+	return color.NRGBA{R: uint8(value >> 16), G: uint8(value >> 8), B: uint8(value), A: 255}, nil
+}
+
+// hasAlpha returns true if the color model of an image has an alpha
+// channel, i.e. it may have transparent parts. Paletted images only have
+// alpha if any of the palette colors isn't opaque.
+func hasAlpha(img image.Image) bool {
+	switch model := img.ColorModel().(type) {
+	case color.Palette:
+		for _, c := range model {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+		return false
+	}
+	switch img.ColorModel() {
+	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model,
+		color.AlphaModel, color.Alpha16Model:
+		return true
+	}
+	return false
+}
+
+// flatten draws an image on a solid background, i.e. removes its
+// transparency
+func flatten(img image.Image, background color.Color) image.Image {
+	flat := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), background)
+	return imaging.Overlay(flat, img, image.Point{}, 1.0)
+}
+
+// extractColors downscales the image and groups similar colors (3 bits
+// per channel). The average color of each of the largest groups is the
+// palette, and the dominant color is the average of the largest group.
+// Transparent pixels are ignored.
+func extractColors(img image.Image) Colors {
+	type colorGroup struct {
+		r, g, b, count int
+	}
+	groups := map[int]*colorGroup{}
+	sample := imaging.Resize(img, colorSampleSide, colorSampleSide, imaging.Box)
+	for i := 0; i < len(sample.Pix); i += 4 {
+		r, g, b, a := int(sample.Pix[i]), int(sample.Pix[i+1]), int(sample.Pix[i+2]), sample.Pix[i+3]
+		if a < 128 {
+			continue
+		}
+		key := (r>>5)<<6 | (g>>5)<<3 | b>>5
+		group, ok := groups[key]
+		if !ok {
+			group = &colorGroup{}
+			groups[key] = group
+		}
+		group.r += r
+		group.g += g
+		group.b += b
+		group.count++
+	}
+	type paletteColor struct {
+		hex   string
+		count int
+	}
+	palette := make([]paletteColor, 0, len(groups))
+	for _, group := range groups {
+		palette = append(palette, paletteColor{
+			hex:   fmt.Sprintf("#%02x%02x%02x", group.r/group.count, group.g/group.count, group.b/group.count),
+			count: group.count})
+	}
+	sort.Slice(palette, func(i, j int) bool {
+		if palette[i].count == palette[j].count {
+			return palette[i].hex < palette[j].hex // Same result each time
+		}
+		return palette[i].count > palette[j].count
+	})
+	colors := Colors{Palette: []string{}}
+	for _, color := range palette[:min(len(palette), colorPaletteSize)] {
+		colors.Palette = append(colors.Palette, color.hex)
+	}
+	if len(colors.Palette) > 0 {
+		colors.Dominant = colors.Palette[0]
+	}
+	return colors
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestExtractColors(t *testing.T) {
+	// 3/4 red and 1/4 blue
+	img := imaging.New(100, 100, color.NRGBA{R: 200, G: 10, B: 10, A: 255})
+	img = imaging.Paste(img, imaging.New(100, 25, color.NRGBA{R: 0, G: 0, B: 250, A: 255}), image.Pt(0, 75))
+	colors := extractColors(img)
+	assertEqualsStr(t, "", "#c80a0a", colors.Dominant)
+	assertEqualsInt(t, "", 2, len(colors.Palette))
+	assertEqualsStr(t, "", "#0000fa", colors.Palette[1])
+
+	// Transparent pixels are ignored
+	colors = extractColors(imaging.New(10, 10, color.NRGBA{}))
+	assertEqualsStr(t, "", "", colors.Dominant)
+	assertEqualsInt(t, "", 0, len(colors.Palette))
+}
+
+func TestParseHexColor(t *testing.T) {
+	c, err := parseHexColor("#a0b1c2")
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "", c == color.NRGBA{R: 0xa0, G: 0xb1, B: 0xc2, A: 255})
+	c, err = parseHexColor("FFFFFF")
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "", c == color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+
+	for _, invalid := range []string{"", "#fff", "#12345g", "#1234567", "white"} {
+		_, err = parseHexColor(invalid)
+		assertExpectErr(t, invalid, err)
+	}
+}
+
+func TestHasAlpha(t *testing.T) {
+	assertTrue(t, "", hasAlpha(image.NewNRGBA(image.Rect(0, 0, 1, 1))))
+	assertTrue(t, "", hasAlpha(image.NewRGBA64(image.Rect(0, 0, 1, 1))))
+	assertFalse(t, "", hasAlpha(image.NewGray(image.Rect(0, 0, 1, 1))))
+	assertFalse(t, "", hasAlpha(image.NewYCbCr(image.Rect(0, 0, 1, 1), image.YCbCrSubsampleRatio420)))
+
+	opaque := color.Palette{color.Black, color.White}
+	assertFalse(t, "", hasAlpha(image.NewPaletted(image.Rect(0, 0, 1, 1), opaque)))
+	transparent := color.Palette{color.Black, color.Transparent}
+	assertTrue(t, "", hasAlpha(image.NewPaletted(image.Rect(0, 0, 1, 1), transparent)))
+}
+
+func TestGetColors(t *testing.T) {
+	mediaPath := "tmpout/TestGetColors"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	imaging.Save(imaging.New(300, 200, color.NRGBA{R: 0, G: 128, B: 0, A: 255}), mediaPath+"/green.png")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/video.mp4")
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	colors, err := media.getColors("green.png")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "#008000", colors.Dominant)
+
+	// Cached until the image is modified
+	imaging.Save(imaging.New(300, 200, color.NRGBA{R: 255, G: 255, B: 255, A: 255}), mediaPath+"/green.png")
+	os.Chtimes(mediaPath+"/green.png", media.colors["green.png"].modTime, media.colors["green.png"].modTime)
+	colors, _ = media.getColors("green.png")
+	assertEqualsStr(t, "", "#008000", colors.Dominant)
+	modTime := time.Now().Add(time.Hour)
+	os.Chtimes(mediaPath+"/green.png", modTime, modTime)
+	colors, _ = media.getColors("green.png")
+	assertEqualsStr(t, "", "#ffffff", colors.Dominant)
+
+	_, err = media.getColors("video.mp4")
+	assertExpectErr(t, "", err)
+	_, err = media.getColors("dont_exist.jpg")
+	assertExpectErr(t, "", err)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	log "github.com/sirupsen/logrus"
+)
+
+// Size of each frame in video contact sheets
+const (
+	contactTileWidth  = 320
+	contactTileHeight = 180
+)
+
+// relativeContactSheetPath returns the relative path of the contact sheet
+// of a video (.contact.jpg extension), see generateVideoContactSheet
+func (c *Cache) relativeContactSheetPath(relativeMediaPath string) (string, error) {
+	path, file := filepath.Split(relativeMediaPath)
+	if filepath.Ext(file) == "" && !c.allowNoExtension {
+		return "", fmt.Errorf("File has no extension: %s", file)
+	}
+	file = c.cacheFileName(file, ".contact.jpg")
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Join(path, file)), "/"), nil
+}
+
+// contactSheet returns the file name of the contact sheet of a video and
+// generates it if it doesn't exist (or is stale). Failed generations are
+// not retried, see isFailedBefore.
+func (c *Cache) contactSheet(m *Media, relativeFilePath string) (string, error) {
+	if !m.cacheAvailable() {
+		return "", errCacheUnavailable
+	}
+	relativeSheetPath, err := c.relativeContactSheetPath(relativeFilePath)
+	if err != nil {
+		return "", err
+	}
+	sheetFileName, err := c.getFullCachePath(relativeSheetPath)
+	if err != nil {
+		return "", err
+	}
+
+	c.lockGeneration(sheetFileName)
+	defer c.unlockGeneration(sheetFileName)
+	if c.isUpToDate(m, relativeFilePath, c.thumbnails, relativeSheetPath) {
+		c.setEntry(c.thumbnails, relativeSheetPath, time.Now()) // Accessed
+		return sheetFileName, nil
+	}
+	errorIndicationFile := c.errorIndicationPath(sheetFileName)
+	if c.isFailedBefore(errorIndicationFile) {
+		return "", fmt.Errorf("skipping generate contact sheet for %s since it has failed before", relativeFilePath)
+	}
+
+	log.Info("Creating new contact sheet for ", relativeFilePath)
+	fullMediaPath, err := m.getFullMediaPath(relativeFilePath)
+	if err != nil {
+		return "", err
+	}
+	if err := c.generateVideoContactSheet(fullMediaPath, sheetFileName); err != nil {
+		c.generateErrorIndicationFile(errorIndicationFile, err)
+		return "", err
+	}
+	c.setEntry(c.thumbnails, relativeSheetPath, time.Now())
+	os.Remove(errorIndicationFile) // In case of a successful retry
+	return sheetFileName, nil
+}
+
+// generateVideoContactSheet generates a contact sheet of a video, i.e.
+// contactColumns x contactRows frames evenly spread over the video in a
+// grid (left to right, top to bottom). Each frame is cropped to the tile
+// size. Will create necessary subdirectories in the cache path.
+func (c *Cache) generateVideoContactSheet(fullMediaPath, fullSheetPath string) error {
+	nbrFrames := c.contactColumns * c.contactRows
+	duration := c.getVideoDuration(fullMediaPath)
+	if duration <= 0 {
+		// Unknown duration, take a frame every second
+		duration = time.Duration(nbrFrames) * time.Second
+	}
+
+	sheet := imaging.New(c.contactColumns*contactTileWidth, c.contactRows*contactTileHeight, c.thumbBackground)
+	for i := 0; i < nbrFrames; i++ {
+		// The temporary file for the frame
+		frameFile := fmt.Sprintf("%s.%d.sh.jpg", fullSheetPath, i)
+		position := duration * time.Duration(2*i+1) / time.Duration(2*nbrFrames)
+		err := c.extractVideoFrame(fullMediaPath, frameFile, position)
+		if err != nil {
+			if i > 0 {
+				break // Keep the frames extracted so far, the rest is background
+			}
+			return err
+		}
+		img, err := imaging.Open(frameFile, imaging.AutoOrientation(true))
+		os.Remove(frameFile) // Remove temporary file
+		if err != nil {
+			return fmt.Errorf("unable to open frame image %s, reason: %s", frameFile, err)
+		}
+		tile := imaging.Fill(img, contactTileWidth, contactTileHeight, imaging.Center, c.resampleFilter)
+		at := image.Pt((i%c.contactColumns)*contactTileWidth, (i/c.contactColumns)*contactTileHeight)
+		sheet = imaging.Paste(sheet, tile, at)
+	}
+
+	return c.writeCacheFile(fullSheetPath, "contact sheet", func(w io.Writer) error {
+		return imaging.Encode(w, sheet, imaging.JPEG)
+	})
+}
+
+// writeVideoContactSheet writes the contact sheet of a video to w, see
+// generateVideoContactSheet. Returns error if contact sheets are disabled
+// or ffmpeg is missing, so that the caller can use the thumbnail instead.
+func (m *Media) writeVideoContactSheet(w io.Writer, relativeFilePath string) error {
+	if !m.isVideo(relativeFilePath) {
+		return fmt.Errorf("not a video")
+	}
+	if !m.enableThumbCache || !m.cache.videoContactSheet {
+		return fmt.Errorf("contact sheets disabled")
+	}
+	if !m.cache.hasVideoThumbnailSupport() {
+		// Not an error of this video, thus no error indication file
+		return fmt.Errorf("contact sheets not supported. ffmpeg not installed")
+	}
+
+	releaseSlot := func() {}
+	if relativeSheetPath, err := m.cache.relativeContactSheetPath(relativeFilePath); err == nil {
+		releaseSlot = m.waitGenerationSlot(relativeFilePath, m.cache.thumbnails, relativeSheetPath)
+	}
+	sheetFileName, err := m.cache.contactSheet(m, relativeFilePath)
+	releaseSlot()
+	if err != nil {
+		return err
+	}
+
+	sheetFile, err := os.Open(sheetFileName)
+	if err != nil {
+		return err
+	}
+	defer sheetFile.Close()
+
+	_, err = io.Copy(w, sheetFile)
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// createFakeFFmpeg creates a script that acts as ffmpeg by copying
+// testmedia/jpeg.jpg to the output file (last argument) and returns its
+// path
+func createFakeFFmpeg(t *testing.T, folder string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake ffmpeg script not supported on Windows")
+	}
+	frame, err := filepath.Abs("testmedia/jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	os.MkdirAll(folder, os.ModePerm)
+	ffmpegPath := folder + "/ffmpeg"
+	script := "#!/bin/sh\nfor last; do :; done\ncp '" + frame + "' \"$last\"\n"
+	assertExpectNoErr(t, "", os.WriteFile(ffmpegPath, []byte(script), 0755))
+	return ffmpegPath
+}
+
+func TestContactSheetPath(t *testing.T) {
+	media := createMedia("/c/mediapath", "/d/thumbpath", true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{videoContactSheet: true})
+
+	sheetPath, err := media.cache.relativeContactSheetPath("/subdrive/video.mp4")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "subdrive/video.mp4.contact.jpg", sheetPath)
+	_, err = media.cache.relativeContactSheetPath("subdrive/video")
+	assertExpectErr(t, "", err)
+
+	// Kept by cleanup, removed with the media file
+	names := media.cache.cacheFileNames([]File{{Type: "video", Name: "video.mp4"}})
+	assertTrue(t, "", contains(names, "video.mp4.contact.jpg"))
+	assertTrue(t, "", contains(names, "video.mp4.contact.err.txt"))
+	assertTrue(t, "", contains(media.cache.relativeCachePaths("subdrive/video.mp4"), "subdrive/video.mp4.contact.jpg"))
+}
+
+func TestVideoContactSheet(t *testing.T) {
+	mediaPath := "tmpout/TestVideoContactSheet"
+	cachePath := "tmpcache/TestVideoContactSheet"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/video.mp4")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/jpeg.jpg")
+	ffmpegPath := createFakeFFmpeg(t, "tmpout/TestVideoContactSheetBin")
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{videoContactSheet: true, contactColumns: 2, contactRows: 3, ffmpegPath: ffmpegPath})
+	var buf bytes.Buffer
+	assertExpectNoErr(t, "", media.writeVideoContactSheet(&buf, "video.mp4"))
+	img, err := imaging.Decode(&buf)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2*contactTileWidth, img.Bounds().Dx())
+	assertEqualsInt(t, "", 3*contactTileHeight, img.Bounds().Dy())
+	assertFileExist(t, "", cachePath+"/video.mp4.contact.jpg")
+	assertTrue(t, "", media.cache.hasEntry(media.cache.thumbnails, "video.mp4.contact.jpg"))
+	files, _ := filepath.Glob(cachePath + "/*.sh.jpg")
+	assertEqualsInt(t, "Temporary frames removed", 0, len(files))
+
+	// Only videos
+	assertExpectErr(t, "", media.writeVideoContactSheet(&buf, "jpeg.jpg"))
+
+	// Disabled
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{ffmpegPath: ffmpegPath})
+	assertExpectErr(t, "", media.writeVideoContactSheet(&buf, "video.mp4"))
+
+	// ffmpeg missing is not a failure of the video, i.e. no error
+	// indication file
+	os.RemoveAll(cachePath)
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{videoContactSheet: true, ffmpegPath: "thiscommanddontexist"})
+	assertExpectErr(t, "", media.writeVideoContactSheet(&buf, "video.mp4"))
+	assertFileNotExist(t, "", cachePath+"/video.mp4.contact.err")
+}
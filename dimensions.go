@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// For testing purposes
+var ffprobeCmd = "ffprobe"
+
+// Dimensions is the width and height of an image or video as displayed,
+// i.e. after EXIF orientation or video rotation is applied
+type Dimensions struct {
+	Width  int
+	Height int
+}
+
+// dimensionsCache is cached dimensions of a media file. It is only
+// valid as long as the modification time is the same.
+type dimensionsCache struct {
+	modTime    time.Time
+	dimensions Dimensions
+}
+
+// getDimensions returns the (cached) dimensions of an image or video.
+// Video dimensions require ffprobe (part of ffmpeg).
+func (m *Media) getDimensions(relativeFilePath string) (Dimensions, error) {
+	fileType := m.getFileType(relativeFilePath)
+	if fileType == "" {
+		return Dimensions{}, fmt.Errorf("not a media file: %s", relativeFilePath)
+	}
+	fullPath, err := m.getFullMediaPath(relativeFilePath)
+	if err != nil {
+		return Dimensions{}, err
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return Dimensions{}, err
+	}
+	m.dimensionsMutex.Lock()
+	cached, ok := m.dimensions[relativeFilePath]
+	m.dimensionsMutex.Unlock()
+	if ok && cached.modTime.Equal(stat.ModTime()) {
+		return cached.dimensions, nil
+	}
+
+	var dimensions Dimensions
+	if fileType == "image" {
+		dimensions.Width, dimensions.Height, err = m.getImageWidthAndHeight(fullPath)
+	} else {
+		dimensions, err = getVideoDimensions(fullPath)
+	}
+	if err != nil {
+		return Dimensions{}, err
+	}
+
+	m.dimensionsMutex.Lock()
+	m.dimensions[relativeFilePath] = dimensionsCache{modTime: stat.ModTime(), dimensions: dimensions}
+	m.dimensionsMutex.Unlock()
+	return dimensions, nil
+}
+
+// ffprobeOutput is the part of the ffprobe JSON output used by
+// getVideoDimensions
+type ffprobeOutput struct {
+	Streams []struct {
+		Width        int `json:"width"`
+		Height       int `json:"height"`
+		SideDataList []struct {
+			Rotation int `json:"rotation"`
+		} `json:"side_data_list"`
+		Tags struct {
+			Rotate string `json:"rotate"` // Used by older ffmpeg versions
+		} `json:"tags"`
+	} `json:"streams"`
+}
+
+// getVideoDimensions returns the resolution of the first video stream
+// using external ffprobe software. Width and height are swapped if the
+// video is rotated 90 or 270 degrees (typical for mobile phone videos).
+func getVideoDimensions(fullPath string) (Dimensions, error) {
+	if _, err := exec.LookPath(ffprobeCmd); err != nil {
+		return Dimensions{}, fmt.Errorf("video dimensions not supported. ffprobe not installed")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(ffprobeCmd, "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height:stream_tags=rotate:stream_side_data=rotation",
+		"-of", "json", fullPath)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Dimensions{}, fmt.Errorf("ffprobe failed for %s, reason: %s %s", fullPath, err, stderr.String())
+	}
+	var output ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return Dimensions{}, fmt.Errorf("unable to parse ffprobe output for %s, reason: %s", fullPath, err)
+	}
+	if len(output.Streams) == 0 || output.Streams[0].Width == 0 || output.Streams[0].Height == 0 {
+		return Dimensions{}, fmt.Errorf("no video stream in %s", fullPath)
+	}
+	stream := output.Streams[0]
+	rotation, _ := strconv.Atoi(stream.Tags.Rotate)
+	for _, sideData := range stream.SideDataList {
+		if sideData.Rotation != 0 {
+			rotation = sideData.Rotation
+		}
+	}
+	if rotation%180 != 0 {
+		return Dimensions{Width: stream.Height, Height: stream.Width}, nil
+	}
+	return Dimensions{Width: stream.Width, Height: stream.Height}, nil
+}
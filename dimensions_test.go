@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestGetDimensions(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	dimensions, err := media.getDimensions("jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 4128, dimensions.Width)
+	assertEqualsInt(t, "", 2322, dimensions.Height)
+
+	// EXIF orientation shall be applied
+	dimensions, err = media.getDimensions("exif_rotate/rotate_90deg_cw.jpg")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2322, dimensions.Width)
+	assertEqualsInt(t, "", 4128, dimensions.Height)
+
+	// Cached
+	assertEqualsInt(t, "", 2, len(media.dimensions))
+	cached := media.dimensions["jpeg.jpg"]
+	cached.dimensions.Width = 17
+	media.dimensions["jpeg.jpg"] = cached
+	dimensions, err = media.getDimensions("jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 17, dimensions.Width)
+
+	// Invalid
+	_, err = media.getDimensions("txt.txt")
+	assertExpectErr(t, "", err)
+	_, err = media.getDimensions("dont_exist.jpg")
+	assertExpectErr(t, "", err)
+	_, err = media.getDimensions("invalid.jpg")
+	assertExpectErr(t, "", err)
+	_, err = media.getDimensions("../jpeg.jpg")
+	assertExpectErr(t, "", err)
+}
+
+func TestGetVideoDimensions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake ffprobe script not supported on Windows")
+	}
+	origCmd := ffprobeCmd
+	defer func() {
+		ffprobeCmd = origCmd
+	}()
+
+	ffprobeCmd = "thiscommanddontexist"
+	_, err := getVideoDimensions("testmedia/video.mp4")
+	assertExpectErr(t, "", err)
+
+	// Fake ffprobe printing output of a rotated mobile phone video
+	os.MkdirAll("tmpout/TestGetVideoDimensions", os.ModePerm)
+	ffprobeCmd = "tmpout/TestGetVideoDimensions/ffprobe"
+	script := "#!/bin/sh\necho '{\"streams\": [{\"width\": 1920, \"height\": 1080, " +
+		"\"side_data_list\": [{\"rotation\": -90}]}]}'\n"
+	err = os.WriteFile(ffprobeCmd, []byte(script), 0755)
+	assertExpectNoErr(t, "", err)
+	dimensions, err := getVideoDimensions("testmedia/video.mp4")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1080, dimensions.Width)
+	assertEqualsInt(t, "", 1920, dimensions.Height)
+
+	// Older ffprobe versions use a rotate tag
+	script = "#!/bin/sh\necho '{\"streams\": [{\"width\": 1920, \"height\": 1080, \"tags\": {\"rotate\": \"180\"}}]}'\n"
+	err = os.WriteFile(ffprobeCmd, []byte(script), 0755)
+	assertExpectNoErr(t, "", err)
+	dimensions, err = getVideoDimensions("testmedia/video.mp4")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1920, dimensions.Width)
+	assertEqualsInt(t, "", 1080, dimensions.Height)
+
+	// No video stream
+	err = os.WriteFile(ffprobeCmd, []byte("#!/bin/sh\necho '{}'\n"), 0755)
+	assertExpectNoErr(t, "", err)
+	_, err = getVideoDimensions("testmedia/video.mp4")
+	assertExpectErr(t, "", err)
+}
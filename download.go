@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// writeZip writes the media files in relativePath and its sub folders
+// (including grouped sidecar files) as a zip archive. Files modified
+// before since are excluded (zero time means all files). The entries are
+// ordered on path, so two downloads of an unchanged folder give the same
+// archive. The media is already compressed so the files are stored as is.
+func (m *Media) writeZip(w io.Writer, relativePath string, since time.Time, permitted func(string) bool) error {
+	namePrefix := path.Clean("/" + filepath.ToSlash(relativePath))[1:] + "/" // E.g. "sub/"
+	if namePrefix == "/" {
+		namePrefix = ""
+	}
+	zipWriter := zip.NewWriter(w)
+	err := m.writeZipFolder(zipWriter, namePrefix, relativePath, since, permitted)
+	if err != nil {
+		zipWriter.Close()
+		return err
+	}
+	return zipWriter.Close()
+}
+
+// writeZipFolder adds the files in relativePath and its sub folders to the
+// archive. namePrefix is removed from the names in the archive. Sub
+// folders are skipped if not permitted (nil means all are permitted).
+func (m *Media) writeZipFolder(zipWriter *zip.Writer, namePrefix, relativePath string, since time.Time,
+	permitted func(string) bool) error {
+	files, err := m.getFiles(relativePath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.Type == "folder" {
+			if permitted != nil && !permitted(file.Path) {
+				continue
+			}
+			err = m.writeZipFolder(zipWriter, namePrefix, file.Path, since, permitted) // Recursive
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		paths := []string{file.Path}
+		for _, ext := range file.Sidecars {
+			paths = append(paths, strings.TrimSuffix(file.Path, path.Ext(file.Path))+ext)
+		}
+		for _, filePath := range paths {
+			err = m.writeZipFile(zipWriter, namePrefix, filePath, since)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeZipFile adds one file to the archive with the modification time of
+// the source file. Files that can't be opened (e.g. removed during the
+// download) are skipped.
+func (m *Media) writeZipFile(zipWriter *zip.Writer, namePrefix, relativeFilePath string, since time.Time) error {
+	fullPath, err := m.getFullMediaPath(relativeFilePath)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		log.Debugf("Skipping %s in zip. Reason: %s", relativeFilePath, err)
+		return nil
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.ModTime().Before(since) {
+		return nil
+	}
+	header, err := zip.FileInfoHeader(stat)
+	if err != nil {
+		return err
+	}
+	header.Name = strings.TrimPrefix(relativeFilePath, namePrefix)
+	header.Method = zip.Store
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(writer, file); err != nil {
+		return fmt.Errorf("unable to add %s to zip, reason: %s", relativeFilePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteZip(t *testing.T) {
+	mediaPath := "tmpout/TestWriteZip"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/sub/deeper", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/sub/IMG_1.jpg")
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/sub/IMG_1.CR2")
+	copyFile(t, "testmedia/png.png", mediaPath+"/sub/b.png")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/sub/deeper/video.mp4")
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/sub/notes.txt")
+	old := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(mediaPath+"/sub/b.png", old, old)
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{groupSidecars: true})
+
+	var buf bytes.Buffer
+	err := media.writeZip(&buf, "sub", time.Time{}, nil)
+	assertExpectNoErr(t, "", err)
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assertExpectNoErr(t, "", err)
+	names := []string{}
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+	}
+	assertEqualsStr(t, "", "IMG_1.jpg IMG_1.CR2 b.png deeper/video.mp4", strings.Join(names, " "))
+	assertTrue(t, "", reader.File[2].Modified.Equal(old))
+
+	// Same content gives the same archive
+	var buf2 bytes.Buffer
+	assertExpectNoErr(t, "", media.writeZip(&buf2, "sub", time.Time{}, nil))
+	assertTrue(t, "", bytes.Equal(buf.Bytes(), buf2.Bytes()))
+
+	// Only files modified after since
+	buf.Reset()
+	assertExpectNoErr(t, "", media.writeZip(&buf, "", old.Add(time.Hour), nil))
+	reader, err = zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 3, len(reader.File))
+	assertEqualsStr(t, "", "sub/IMG_1.jpg", reader.File[0].Name)
+
+	assertExpectErr(t, "", media.writeZip(&buf, "dont_exist", time.Time{}, nil))
+	assertExpectErr(t, "", media.writeZip(&buf, "../TestDateBuckets", time.Time{}, nil))
+}
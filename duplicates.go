@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/disintegration/imaging"
+	log "github.com/sirupsen/logrus"
+)
+
+// partialHashSize is the number of bytes hashed in the pre-filter
+// before the full content is hashed
+const partialHashSize = 64 * 1024
+
+// contentHash is a cached content hash of a media file. It is only
+// valid as long as the modification time and size are the same.
+type contentHash struct {
+	modTime time.Time
+	size    int64
+	partial string // Hash of the first partialHashSize bytes
+	full    string // Hash of the whole file ("" if not calculated)
+}
+
+// mediaFileInfo is a media file with its size and modification time
+type mediaFileInfo struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// findDuplicates returns groups of media files (relative paths) with
+// identical content in relativePath (and its sub folders if recursive).
+//
+// To keep it fast only files with the same size are compared, and only
+// files with the same hash of the first partialHashSize bytes are fully
+// hashed. The hashes are cached until the file is modified.
+func (m *Media) findDuplicates(relativePath string, recursive bool) ([][]string, error) {
+	fileInfos, err := m.getMediaFileInfos(relativePath, recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group on size
+	sizeGroups := make(map[int64][]mediaFileInfo)
+	for _, fileInfo := range fileInfos {
+		sizeGroups[fileInfo.size] = append(sizeGroups[fileInfo.size], fileInfo)
+	}
+
+	duplicates := [][]string{}
+	for _, sizeGroup := range sizeGroups {
+		if len(sizeGroup) < 2 {
+			continue
+		}
+		// Group on partial hash, and then on full hash
+		partialGroups := make(map[string][]mediaFileInfo)
+		for _, fileInfo := range sizeGroup {
+			hash, err := m.getContentHash(fileInfo, false)
+			if err != nil {
+				log.Warnf("Unable to hash %s. Reason: %s", fileInfo.path, err)
+				continue
+			}
+			partialGroups[hash.partial] = append(partialGroups[hash.partial], fileInfo)
+		}
+		for _, partialGroup := range partialGroups {
+			if len(partialGroup) < 2 {
+				continue
+			}
+			fullGroups := make(map[string][]string)
+			for _, fileInfo := range partialGroup {
+				hash, err := m.getContentHash(fileInfo, true)
+				if err != nil {
+					log.Warnf("Unable to hash %s. Reason: %s", fileInfo.path, err)
+					continue
+				}
+				fullGroups[hash.full] = append(fullGroups[hash.full], fileInfo.path)
+			}
+			for _, fullGroup := range fullGroups {
+				if len(fullGroup) > 1 {
+					sort.Strings(fullGroup)
+					duplicates = append(duplicates, fullGroup)
+				}
+			}
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i][0] < duplicates[j][0]
+	})
+	return duplicates, nil
+}
+
+// getMediaFileInfos returns all media files in relativePath (and its
+// sub folders if recursive).
+func (m *Media) getMediaFileInfos(relativePath string, recursive bool) ([]mediaFileInfo, error) {
+	files, err := m.getFiles(relativePath)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos := make([]mediaFileInfo, 0, len(files))
+	for _, file := range files {
+		if file.Type == "folder" {
+			if recursive {
+				subFileInfos, err := m.getMediaFileInfos(file.Path, true) // Recursive
+				if err != nil {
+					log.Warnf("Unable to read folder %s. Reason: %s", file.Path, err)
+					continue
+				}
+				fileInfos = append(fileInfos, subFileInfos...)
+			}
+			continue
+		}
+		fullPath, err := m.getFullMediaPath(file.Path)
+		if err != nil {
+			continue
+		}
+		stat, err := os.Stat(fullPath)
+		if err != nil {
+			continue
+		}
+		fileInfos = append(fileInfos, mediaFileInfo{path: file.Path, size: stat.Size(), modTime: stat.ModTime()})
+	}
+	return fileInfos, nil
+}
+
+// getContentHash returns the (cached) content hash of a media file.
+// The full hash is only calculated if full is true.
+func (m *Media) getContentHash(fileInfo mediaFileInfo, full bool) (contentHash, error) {
+	m.hashMutex.Lock()
+	hash, ok := m.contentHashes[fileInfo.path]
+	m.hashMutex.Unlock()
+	if !ok || !hash.modTime.Equal(fileInfo.modTime) || hash.size != fileInfo.size {
+		hash = contentHash{modTime: fileInfo.modTime, size: fileInfo.size}
+	}
+	if hash.partial != "" && (!full || hash.full != "") {
+		return hash, nil // Cached
+	}
+
+	fullPath, err := m.getFullMediaPath(fileInfo.path)
+	if err != nil {
+		return hash, err
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return hash, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	_, err = io.CopyN(hasher, file, partialHashSize)
+	if err != nil && err != io.EOF {
+		return hash, err
+	}
+	hash.partial = hex.EncodeToString(hasher.Sum(nil))
+	if full {
+		// Continue with the rest of the file
+		_, err = io.Copy(hasher, file)
+		if err != nil {
+			return hash, err
+		}
+		hash.full = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	m.hashMutex.Lock()
+	m.contentHashes[fileInfo.path] = hash
+	m.hashMutex.Unlock()
+	return hash, nil
+}
+
+// perceptualHashCache is a cached perceptual hash of an image. It is
+// only valid as long as the modification time is the same.
+type perceptualHashCache struct {
+	modTime time.Time
+	hash    uint64
+}
+
+// SimilarImage is an image similar to another image
+type SimilarImage struct {
+	Path     string // Relative path of the image
+	Distance int    // Number of differing bits of the perceptual hashes (0 means very similar)
+}
+
+// Supported scopes when searching for similar images
+const (
+	similarScopeFolder  = "folder"  // The folder of the image and its sub folders
+	similarScopeLibrary = "library" // All media files
+)
+
+// perceptualHash returns a 64 bit difference hash (dHash) of an image.
+// The image is downscaled to 9x8 gray scale pixels and each bit tells
+// if a pixel is brighter than its right neighbour. Resized or re-encoded
+// images get the same, or almost the same, hash.
+func (m *Media) perceptualHash(relativeFilePath string) (uint64, error) {
+	if !m.isImage(relativeFilePath) {
+		return 0, fmt.Errorf("not an image: %s", relativeFilePath)
+	}
+	fullPath, err := m.getFullMediaPath(relativeFilePath)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	m.hashMutex.Lock()
+	cached, ok := m.perceptualHashes[relativeFilePath]
+	m.hashMutex.Unlock()
+	if ok && cached.modTime.Equal(stat.ModTime()) {
+		return cached.hash, nil
+	}
+
+	img, err := openImage(fullPath, m.maxImagePixels, m.forceRotate)
+	if err != nil {
+		return 0, err
+	}
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.Pix[small.PixOffset(x, y)] > small.Pix[small.PixOffset(x+1, y)] {
+				hash |= 1
+			}
+		}
+	}
+
+	m.hashMutex.Lock()
+	m.perceptualHashes[relativeFilePath] = perceptualHashCache{modTime: stat.ModTime(), hash: hash}
+	m.hashMutex.Unlock()
+	return hash, nil
+}
+
+// findSimilar returns the images that have a perceptual hash within
+// threshold (Hamming distance) of the provided image, sorted with the
+// most similar first. Which images are compared depends on the configured
+// similar scope.
+//
+// A low threshold (less than 5) mostly finds resized and re-encoded
+// copies, while a higher threshold (above 10) also finds images that only
+// look somewhat alike, e.g. images with the same composition.
+func (m *Media) findSimilar(relativeFilePath string, threshold int) ([]SimilarImage, error) {
+	relativeFilePath = filepath.ToSlash(filepath.Clean(relativeFilePath))
+	hash, err := m.perceptualHash(relativeFilePath)
+	if err != nil {
+		return nil, err
+	}
+	scopePath := ""
+	if m.similarScope != similarScopeLibrary {
+		scopePath = filepath.ToSlash(filepath.Dir(relativeFilePath))
+		if scopePath == "." {
+			scopePath = ""
+		}
+	}
+	fileInfos, err := m.getMediaFileInfos(scopePath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	similar := []SimilarImage{}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.path == relativeFilePath || !m.isImage(fileInfo.path) {
+			continue
+		}
+		otherHash, err := m.perceptualHash(fileInfo.path)
+		if err != nil {
+			log.Debugf("Unable to calculate perceptual hash for %s. Reason: %s", fileInfo.path, err)
+			continue
+		}
+		distance := bits.OnesCount64(hash ^ otherHash)
+		if distance <= threshold {
+			similar = append(similar, SimilarImage{Path: fileInfo.path, Distance: distance})
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Distance < similar[j].Distance
+	})
+	return similar, nil
+}
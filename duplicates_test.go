@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	mediaPath := "tmpout/TestFindDuplicates"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/a.jpg")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/sub/b.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+
+	// Same size and same beginning but different end
+	input, err := os.ReadFile("testmedia/jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	input[len(input)-1]++
+	err = os.WriteFile(mediaPath+"/c.jpg", input, 0644)
+	assertExpectNoErr(t, "", err)
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	duplicates, err := media.findDuplicates("", false)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 0, len(duplicates))
+
+	duplicates, err = media.findDuplicates("", true)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, len(duplicates))
+	assertEqualsStr(t, "", "a.jpg,sub/b.jpg", strings.Join(duplicates[0], ","))
+
+	// Only files with same size shall have been hashed
+	assertEqualsInt(t, "", 3, len(media.contentHashes))
+	assertTrue(t, "", media.contentHashes["c.jpg"].full != media.contentHashes["a.jpg"].full)
+
+	// Modified file shall be hashed again
+	copyFile(t, "testmedia/png.png", mediaPath+"/sub/b.jpg")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(mediaPath+"/sub/b.jpg", later, later)
+	duplicates, err = media.findDuplicates("", true)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, len(duplicates))
+	assertEqualsStr(t, "", "png.png,sub/b.jpg", strings.Join(duplicates[0], ","))
+
+	// Invalid folder
+	_, err = media.findDuplicates("dont_exist", true)
+	assertExpectErr(t, "", err)
+}
+
+func TestFindSimilar(t *testing.T) {
+	mediaPath := "tmpout/TestFindSimilar"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	os.MkdirAll(mediaPath+"/other", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/sub/a.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/sub/png.png")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/other/b.jpg")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/sub/video.mp4")
+
+	// Resized and re-encoded copy
+	img, err := imaging.Open("testmedia/jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	err = imaging.Save(imaging.Resize(img, 100, 0, imaging.Lanczos), mediaPath+"/sub/small.jpg", imaging.JPEGQuality(50))
+	assertExpectNoErr(t, "", err)
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	// Folder scope
+	similar, err := media.findSimilar("sub/a.jpg", 5)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, len(similar))
+	assertEqualsStr(t, "", "sub/small.jpg", similar[0].Path)
+	assertTrue(t, "", similar[0].Distance <= 5)
+	assertEqualsInt(t, "", 3, len(media.perceptualHashes))
+
+	// Max threshold shall include all images (but not videos)
+	similar, err = media.findSimilar("sub/a.jpg", 64)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2, len(similar))
+	assertEqualsStr(t, "", "sub/small.jpg", similar[0].Path)
+	assertEqualsStr(t, "", "sub/png.png", similar[1].Path)
+
+	// Library scope
+	media = createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{similarScope: similarScopeLibrary})
+	similar, err = media.findSimilar("sub/a.jpg", 5)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2, len(similar))
+	assertEqualsStr(t, "", "other/b.jpg", similar[0].Path)
+	assertEqualsInt(t, "", 0, similar[0].Distance)
+	assertEqualsStr(t, "", "sub/small.jpg", similar[1].Path)
+
+	// Not an image
+	_, err = media.findSimilar("sub/video.mp4", 5)
+	assertExpectErr(t, "", err)
+	_, err = media.findSimilar("sub/dont_exist.jpg", 5)
+	assertExpectErr(t, "", err)
+}
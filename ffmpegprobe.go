@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ffmpegProbeTimeout is the max time of each ffmpeg command when probing
+const ffmpegProbeTimeout = 10 * time.Second
+
+// probeFFmpeg checks once (at startup) that the configured ffmpeg works
+// by running ffmpeg -version, and optionally a self-test extracting a
+// frame from a generated video with the configured extra arguments. The
+// version and any failure are stored to give clearer errors when the
+// extraction of video frames fails, see extractVideoFrame.
+func (c *Cache) probeFFmpeg(selfTest bool) {
+	if !c.hasVideoThumbnailSupport() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegProbeTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, c.ffmpegPath, "-version").Output()
+	if err != nil {
+		c.ffmpegProbeErr = fmt.Errorf("%s -version failed: %s", c.ffmpegPath, err)
+		log.Warnf("Unable to run ffmpeg. Reason: %s", c.ffmpegProbeErr)
+		return
+	}
+	c.ffmpegVersion, _, _ = strings.Cut(strings.TrimSpace(string(output)), "\n")
+	log.Info("ffmpeg: ", c.ffmpegVersion)
+	if !selfTest {
+		return
+	}
+
+	if err := c.ffmpegSelfTest(); err != nil {
+		c.ffmpegProbeErr = fmt.Errorf("self-test failed: %s", err)
+		log.Warnf("ffmpeg self-test failed. Video thumbnails will likely fail. Reason: %s", err)
+		return
+	}
+	log.Info("ffmpeg self-test passed")
+}
+
+// ffmpegSelfTest extracts a frame from a tiny generated (lavfi) video,
+// the same way as frames are extracted from videos
+func (c *Cache) ffmpegSelfTest() error {
+	dir, err := os.MkdirTemp("", "mediaweb-ffmpeg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	outFilePath := filepath.Join(dir, "selftest.jpg")
+	args := append(slices.Clone(c.ffmpegArgs),
+		"-f", "lavfi", "-i", "color=c=black:s=32x32:d=1", "-vframes", "1", outFilePath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegProbeTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.ffmpegPath, args...)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if _, outFileErr := os.Stat(outFilePath); err == nil && outFileErr != nil {
+		err = outFileErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s: %s\nStderr: %s", c.ffmpegPath, strings.Join(args, " "), err, stderr.String())
+	}
+	return nil
+}
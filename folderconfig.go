@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// folderConfigFileName is the name of the file in a media folder that
+// overrides how the folder is presented, see readFolderConfig
+const folderConfigFileName = ".mediaweb.json"
+
+// folderConfig is the content of a folder configuration file, e.g:
+//
+//	{"sort": "date", "order": "desc", "cover": "IMG_0423.jpg"}
+//
+// All keys are optional.
+type folderConfig struct {
+	Sort  string // name (default) or date, see getDate
+	Order string // asc (default) or desc
+	Cover string // File name of image or video to use as album thumbnail
+}
+
+// readFolderConfig returns the folder configuration of a media folder.
+// The zero value (default presentation) is returned if the folder has no
+// configuration file or if it is invalid.
+func readFolderConfig(fullFolderPath string) folderConfig {
+	var config folderConfig
+	content, err := os.ReadFile(filepath.Join(fullFolderPath, folderConfigFileName))
+	if err != nil {
+		return config // No configuration file is normal
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		log.Warnf("Invalid %s in %s. Reason: %s", folderConfigFileName, fullFolderPath, err)
+		return folderConfig{}
+	}
+	if config.Sort != "" && config.Sort != "name" && config.Sort != "date" {
+		log.Warnf("Invalid sort '%s' in %s. Using name.", config.Sort, fullFolderPath)
+		config.Sort = ""
+	}
+	if config.Order != "" && config.Order != "asc" && config.Order != "desc" {
+		log.Warnf("Invalid order '%s' in %s. Using asc.", config.Order, fullFolderPath)
+		config.Order = ""
+	}
+	return config
+}
+
+// sortFolder sorts the files of a folder (as returned by getFiles)
+// according to its folder configuration, see readFolderConfig
+func (m *Media) sortFolder(relativeFolderPath string, files []File) []File {
+	fullPath, err := m.getFullMediaPath(relativeFolderPath)
+	if err != nil {
+		return files
+	}
+	config := readFolderConfig(fullPath)
+	if config.Sort == "date" {
+		dates := make(map[string]int64, len(files))
+		for _, file := range files {
+			if date, err := m.getDate(file); err == nil {
+				dates[file.Path] = date.UnixNano()
+			}
+		}
+		sort.SliceStable(files, func(i, j int) bool {
+			return dates[files[i].Path] < dates[files[j].Path]
+		})
+	}
+	if config.Order == "desc" {
+		for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+			files[i], files[j] = files[j], files[i]
+		}
+	}
+	return files
+}
+
+// getAlbumCover returns the relative path of the media file configured
+// as cover (album thumbnail) of a folder, see readFolderConfig. Returns
+// false if there is no valid cover.
+func (m *Media) getAlbumCover(relativeFolderPath string) (string, bool) {
+	fullPath, err := m.getFullMediaPath(relativeFolderPath)
+	if err != nil || !isDir(fullPath) {
+		return "", false
+	}
+	cover := readFolderConfig(fullPath).Cover
+	if cover == "" {
+		return "", false
+	}
+	coverPath := path.Join(strings.Trim(filepath.ToSlash(relativeFolderPath), "/"), cover)
+	if path.Base(cover) != cover || m.getFileType(coverPath) == "" {
+		log.Warnf("Invalid cover '%s' in %s. Only media files in the folder are allowed.", cover, fullPath)
+		return "", false
+	}
+	if _, err := os.Stat(filepath.Join(fullPath, cover)); err != nil {
+		log.Warnf("Cover '%s' in %s does not exist", cover, fullPath)
+		return "", false
+	}
+	return coverPath, true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadFolderConfig(t *testing.T) {
+	mediaPath := "tmpout/TestReadFolderConfig"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	assertTrue(t, "No config file", readFolderConfig(mediaPath) == folderConfig{})
+
+	content := `{"sort": "date", "order": "desc", "cover": "IMG_0423.jpg"}`
+	err := os.WriteFile(mediaPath+"/"+folderConfigFileName, []byte(content), 0644)
+	assertExpectNoErr(t, "", err)
+	config := readFolderConfig(mediaPath)
+	assertEqualsStr(t, "", "date", config.Sort)
+	assertEqualsStr(t, "", "desc", config.Order)
+	assertEqualsStr(t, "", "IMG_0423.jpg", config.Cover)
+
+	// Invalid values are ignored
+	content = `{"sort": "size", "order": "random", "cover": "a.jpg"}`
+	err = os.WriteFile(mediaPath+"/"+folderConfigFileName, []byte(content), 0644)
+	assertExpectNoErr(t, "", err)
+	config = readFolderConfig(mediaPath)
+	assertEqualsStr(t, "", "", config.Sort)
+	assertEqualsStr(t, "", "", config.Order)
+	assertEqualsStr(t, "", "a.jpg", config.Cover)
+
+	// Malformed
+	logBuf := captureLog(t)
+	err = os.WriteFile(mediaPath+"/"+folderConfigFileName, []byte(`{"sort": "date"`), 0644)
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "Malformed", readFolderConfig(mediaPath) == folderConfig{})
+	assertTrue(t, "", strings.Contains(logBuf.String(), "Invalid "+folderConfigFileName))
+}
+
+func TestSortFolder(t *testing.T) {
+	mediaPath := "tmpout/TestSortFolder"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/a.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/b.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/c.png")
+	now := time.Now()
+	os.Chtimes(mediaPath+"/a.png", now, now)
+	os.Chtimes(mediaPath+"/b.png", now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+	os.Chtimes(mediaPath+"/c.png", now.Add(-time.Hour), now.Add(-time.Hour))
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	names := func() string {
+		files, err := media.getFiles("")
+		assertExpectNoErr(t, "", err)
+		var result []string
+		for _, file := range media.sortFolder("", files) {
+			result = append(result, file.Name)
+		}
+		return strings.Join(result, ",")
+	}
+	assertEqualsStr(t, "No config file", "a.png,b.png,c.png", names())
+
+	os.WriteFile(mediaPath+"/"+folderConfigFileName, []byte(`{"order": "desc"}`), 0644)
+	assertEqualsStr(t, "", "c.png,b.png,a.png", names())
+	os.WriteFile(mediaPath+"/"+folderConfigFileName, []byte(`{"sort": "date"}`), 0644)
+	assertEqualsStr(t, "", "b.png,c.png,a.png", names())
+	os.WriteFile(mediaPath+"/"+folderConfigFileName, []byte(`{"sort": "date", "order": "desc"}`), 0644)
+	assertEqualsStr(t, "", "a.png,c.png,b.png", names())
+	os.WriteFile(mediaPath+"/"+folderConfigFileName, []byte(`not json`), 0644)
+	assertEqualsStr(t, "Malformed", "a.png,b.png,c.png", names())
+}
+
+func TestGetAlbumCover(t *testing.T) {
+	mediaPath := "tmpout/TestGetAlbumCover"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/sub/cover.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/outside.png")
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/sub/txt.txt")
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	_, ok := media.getAlbumCover("sub")
+	assertFalse(t, "No config file", ok)
+
+	writeCover := func(cover string) {
+		err := os.WriteFile(mediaPath+"/sub/"+folderConfigFileName, []byte(`{"cover": "`+cover+`"}`), 0644)
+		assertExpectNoErr(t, "", err)
+	}
+	writeCover("cover.png")
+	cover, ok := media.getAlbumCover("sub")
+	assertTrue(t, "", ok)
+	assertEqualsStr(t, "", "sub/cover.png", cover)
+	cover, ok = media.getAlbumCover("/sub")
+	assertTrue(t, "", ok)
+	assertEqualsStr(t, "", "sub/cover.png", cover)
+
+	writeCover("missing.png")
+	_, ok = media.getAlbumCover("sub")
+	assertFalse(t, "Missing", ok)
+	writeCover("txt.txt")
+	_, ok = media.getAlbumCover("sub")
+	assertFalse(t, "Not media", ok)
+	writeCover("../outside.png")
+	_, ok = media.getAlbumCover("sub")
+	assertFalse(t, "Outside folder", ok)
+	_, ok = media.getAlbumCover("sub/cover.png")
+	assertFalse(t, "Not a folder", ok)
+}
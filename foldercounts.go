@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// folderCountsCache is cached counts of a folder. It is only valid as
+// long as the modification time of the folder is the same (it changes
+// when files are added, removed or renamed).
+type folderCountsCache struct {
+	modTime     time.Time
+	imageCount  int
+	videoCount  int
+	folderCount int
+}
+
+// addFolderCounts sets ImageCount, VideoCount and FolderCount of all
+// folders in files (as returned by getFiles). The counts only include
+// the media files and folders directly in each folder.
+func (m *Media) addFolderCounts(files []File) {
+	for i := range files {
+		if files[i].Type != "folder" {
+			continue
+		}
+		counts, err := m.getFolderCounts(files[i].Path)
+		if err != nil {
+			continue // Counts are omitted for folders that can't be read
+		}
+		files[i].ImageCount = counts.imageCount
+		files[i].VideoCount = counts.videoCount
+		files[i].FolderCount = counts.folderCount
+	}
+}
+
+// getFolderCounts returns the (cached) number of images, videos and
+// folders in a folder
+func (m *Media) getFolderCounts(relativeFolderPath string) (folderCountsCache, error) {
+	fullPath, err := m.getFullMediaPath(relativeFolderPath)
+	if err != nil {
+		return folderCountsCache{}, err
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return folderCountsCache{}, err
+	}
+	m.folderCountsMutex.Lock()
+	cached, ok := m.folderCounts[relativeFolderPath]
+	m.folderCountsMutex.Unlock()
+	if ok && cached.modTime.Equal(stat.ModTime()) {
+		return cached, nil
+	}
+
+	files, err := m.getFiles(relativeFolderPath)
+	if err != nil {
+		return folderCountsCache{}, err
+	}
+	counts := folderCountsCache{modTime: stat.ModTime()}
+	for _, file := range files {
+		switch file.Type {
+		case "image":
+			counts.imageCount++
+		case "video":
+			counts.videoCount++
+		case "folder":
+			counts.folderCount++
+		}
+	}
+
+	m.folderCountsMutex.Lock()
+	m.folderCounts[relativeFolderPath] = counts
+	m.folderCountsMutex.Unlock()
+	return counts, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGetFolderCounts(t *testing.T) {
+	mediaPath := "tmpout/TestGetFolderCounts"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/album/sub1", os.ModePerm)
+	os.MkdirAll(mediaPath+"/album/sub2", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/album/jpeg.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/album/png.png")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/album/video.mp4")
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/album/txt.txt")
+	copyFile(t, "testmedia/png.png", mediaPath+"/album/sub1/png.png")
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	counts, err := media.getFolderCounts("album")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2, counts.imageCount)
+	assertEqualsInt(t, "", 1, counts.videoCount)
+	assertEqualsInt(t, "", 2, counts.folderCount)
+
+	// Cached until the folder is modified
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(mediaPath+"/album", old, old)
+	media.getFolderCounts("album") // Cache with the old modification time
+	os.Remove(mediaPath + "/album/png.png")
+	os.Chtimes(mediaPath+"/album", old, old)
+	counts, _ = media.getFolderCounts("album")
+	assertEqualsInt(t, "Cached", 2, counts.imageCount)
+	os.Chtimes(mediaPath+"/album", time.Now(), time.Now())
+	counts, _ = media.getFolderCounts("album")
+	assertEqualsInt(t, "Modified", 1, counts.imageCount)
+
+	_, err = media.getFolderCounts("missing")
+	assertExpectErr(t, "", err)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// hasAnimatedThumbnail returns true if the thumbnail of a media file is
+// an animated GIF (.thumb.gif), i.e. if it is a GIF image and
+// gifAnimatedThumbs is enabled. Other thumbnails are JPEG (.thumb.jpg).
+func (c *Cache) hasAnimatedThumbnail(relativeMediaPath string) bool {
+	return c.gifAnimatedThumbs && strings.EqualFold(filepath.Ext(relativeMediaPath), ".gif")
+}
+
+// thumbnailContentType returns the content type of the thumbnail of a
+// media file provided by writeThumbnail
+func (m *Media) thumbnailContentType(relativeFilePath string) string {
+	if m.enableThumbCache && m.cache.hasAnimatedThumbnail(relativeFilePath) {
+		return "image/gif"
+	}
+	return "image/jpeg"
+}
+
+// generateAnimatedGIFThumbnail generates an animated thumbnail of a GIF
+// image with all frames resized to the thumbnail size. The frames are
+// drawn on top of each other (according to their disposal) before they
+// are resized, since each frame may only contain the changed part.
+func (c *Cache) generateAnimatedGIFThumbnail(fullMediaPath, fullThumbPath string) error {
+	file, err := os.Open(fullMediaPath)
+	if err != nil {
+		return fmt.Errorf("unable to open image %s, reason: %s", fullMediaPath, err)
+	}
+	animation, err := gif.DecodeAll(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("unable to decode GIF %s, reason: %s", fullMediaPath, err)
+	}
+	width, height := animation.Config.Width, animation.Config.Height
+	if c.maxImagePixels > 0 && int64(width)*int64(height)*int64(len(animation.Image)) > int64(c.maxImagePixels) {
+		return fmt.Errorf("image too large (%dx%d pixels, %d frames, max is %d pixels)",
+			width, height, len(animation.Image), c.maxImagePixels)
+	}
+
+	background := image.NewUniform(c.thumbBackground)
+	canvas := imaging.New(width, height, c.thumbBackground)
+	thumbnail := &gif.GIF{LoopCount: animation.LoopCount}
+	for i, frame := range animation.Image {
+		var previous *image.NRGBA
+		if animation.Disposal != nil && animation.Disposal[i] == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		thumbImg := imaging.Thumbnail(canvas, 256, 256, c.resampleFilter)
+		palettedImg := image.NewPaletted(thumbImg.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(palettedImg, thumbImg.Bounds(), thumbImg, image.Point{})
+		thumbnail.Image = append(thumbnail.Image, palettedImg)
+		thumbnail.Delay = append(thumbnail.Delay, animation.Delay[i])
+
+		if animation.Disposal != nil {
+			switch animation.Disposal[i] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, frame.Bounds(), background, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = previous
+			}
+		}
+	}
+
+	// Create subdirectories if needed
+	directory := filepath.Dir(fullThumbPath)
+	err = os.MkdirAll(directory, c.dirMode)
+	if err != nil {
+		return fmt.Errorf("unable to create directories in %s for creating thumbnail, reason %s", fullThumbPath, err)
+	}
+
+	// Write thumbnail to file
+	return c.writeCacheFile(fullThumbPath, "thumbnail", func(w io.Writer) error {
+		return gif.EncodeAll(w, thumbnail)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"os"
+	"testing"
+)
+
+// decodeGIF decodes all frames of a GIF file
+func decodeGIF(t *testing.T, fileName string) *gif.GIF {
+	t.Helper()
+	file, err := os.Open(fileName)
+	assertExpectNoErr(t, "", err)
+	defer file.Close()
+	animation, err := gif.DecodeAll(file)
+	assertExpectNoErr(t, "", err)
+	return animation
+}
+
+func TestAnimatedThumbnailPath(t *testing.T) {
+	media := createMedia("/c/mediapath", "/d/thumbpath", true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{gifAnimatedThumbs: true})
+
+	thumbPath, err := media.cache.thumbnailPath("subdrive/anim.gif")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "/d/thumbpath/subdrive/anim.gif.thumb.gif", thumbPath)
+	thumbPath, err = media.cache.thumbnailPath("subdrive/ANIM.GIF")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "/d/thumbpath/subdrive/ANIM.GIF.thumb.gif", thumbPath)
+	thumbPath, err = media.cache.thumbnailPath("subdrive/myimage.jpg")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "/d/thumbpath/subdrive/myimage.jpg.thumb.jpg", thumbPath)
+	assertEqualsStr(t, "", "image/gif", media.thumbnailContentType("anim.gif"))
+	assertEqualsStr(t, "", "image/jpeg", media.thumbnailContentType("myimage.jpg"))
+
+	// Disabled by default
+	media = createMedia("/c/mediapath", "/d/thumbpath", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	thumbPath, err = media.cache.thumbnailPath("subdrive/anim.gif")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "/d/thumbpath/subdrive/anim.gif.thumb.jpg", thumbPath)
+	assertEqualsStr(t, "", "image/jpeg", media.thumbnailContentType("anim.gif"))
+}
+
+func TestAnimatedGIFThumbnail(t *testing.T) {
+	mediaPath := "tmpout/TestAnimatedGIFThumbnail"
+	cachePath := "tmpcache/TestAnimatedGIFThumbnail"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/gif.gif", mediaPath+"/gif.gif")
+
+	// 3 frames where the last frame only updates the middle part
+	red := image.NewPaletted(image.Rect(0, 0, 100, 50), palette.Plan9)
+	blue := image.NewPaletted(image.Rect(0, 0, 100, 50), palette.Plan9)
+	middle := image.NewPaletted(image.Rect(40, 20, 60, 30), palette.Plan9)
+	for _, frame := range []struct {
+		img *image.Paletted
+		c   color.Color
+	}{{red, color.NRGBA{R: 255, A: 255}}, {blue, color.NRGBA{B: 255, A: 255}}, {middle, color.NRGBA{G: 255, A: 255}}} {
+		for y := frame.img.Rect.Min.Y; y < frame.img.Rect.Max.Y; y++ {
+			for x := frame.img.Rect.Min.X; x < frame.img.Rect.Max.X; x++ {
+				frame.img.Set(x, y, frame.c)
+			}
+		}
+	}
+	file, err := os.Create(mediaPath + "/anim.gif")
+	assertExpectNoErr(t, "", err)
+	assertExpectNoErr(t, "", gif.EncodeAll(file, &gif.GIF{
+		Image: []*image.Paletted{red, blue, middle}, Delay: []int{10, 20, 30}}))
+	file.Close()
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{gifAnimatedThumbs: true})
+
+	// Existing (single frame) fixture
+	thumbPath, err := media.cache.generateThumbnail(media, "gif.gif")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", cachePath+"/gif.gif.thumb.gif", thumbPath)
+	thumb := decodeGIF(t, thumbPath)
+	assertEqualsInt(t, "", 1, len(thumb.Image))
+	assertEqualsInt(t, "", 256, thumb.Config.Width)
+	assertEqualsInt(t, "", 256, thumb.Config.Height)
+
+	// All frames are kept with their delays. Partial frames are drawn on
+	// the previous frame.
+	thumbPath, err = media.cache.generateThumbnail(media, "anim.gif")
+	assertExpectNoErr(t, "", err)
+	thumb = decodeGIF(t, thumbPath)
+	assertEqualsInt(t, "", 3, len(thumb.Image))
+	assertEqualsInt(t, "", 30, thumb.Delay[2])
+	assertTrue(t, "Red", colorDistance(color.NRGBA{R: 255, A: 255}, thumb.Image[0].At(128, 128)) < 30)
+	assertTrue(t, "Green", colorDistance(color.NRGBA{G: 255, A: 255}, thumb.Image[2].At(128, 128)) < 30)
+	assertTrue(t, "Blue", colorDistance(color.NRGBA{B: 255, A: 255}, thumb.Image[2].At(2, 128)) < 30)
+
+	// Found when the cache is loaded
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{gifAnimatedThumbs: true})
+	assertTrue(t, "", media.cache.hasThumbnail("anim.gif"))
+
+	// Invalid GIF
+	copyFile(t, "testmedia/invalid.jpg", mediaPath+"/invalid.gif")
+	_, err = media.cache.generateThumbnail(media, "invalid.gif")
+	assertExpectErr(t, "", err)
+}
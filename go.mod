@@ -14,7 +14,16 @@ require github.com/go-ini/ini v1.67.0
 
 require github.com/fsnotify/fsnotify v1.7.0
 
+require github.com/gen2brain/avif v0.4.2
+
+require golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8
+
+require golang.org/x/crypto v0.31.0
+
 require (
-	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8 // indirect
-	golang.org/x/sys v0.4.0 // indirect
+	github.com/ebitengine/purego v0.8.1 // indirect
+	github.com/tetratelabs/wazero v1.8.1 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// isHidden returns true if the file or folder name starts with a dot
+func isHidden(fullPath string) bool {
+	return strings.HasPrefix(filepath.Base(fullPath), ".")
+}
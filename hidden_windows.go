@@ -0,0 +1,24 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// isHidden returns true if the file or folder name starts with a dot
+// or if it has the hidden attribute set
+func isHidden(fullPath string) bool {
+	if strings.HasPrefix(filepath.Base(fullPath), ".") {
+		return true
+	}
+	pointer, err := syscall.UTF16PtrFromString(fullPath)
+	if err != nil {
+		return false
+	}
+	attributes, err := syscall.GetFileAttributes(pointer)
+	if err != nil {
+		return false
+	}
+	return attributes&syscall.FILE_ATTRIBUTE_HIDDEN != 0
+}
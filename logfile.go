@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// logFile is the log output when a log file is configured. It is rotated
+// when it would grow larger than maxSize, i.e. renamed to <path>.1 (and
+// older backups to <path>.2 and so on) and a new file is started.
+type logFile struct {
+	mutex      sync.Mutex
+	path       string
+	mode       os.FileMode
+	maxSize    int64 // Rotate when larger than this in bytes (0 means never)
+	maxBackups int   // Number of rotated files to keep
+	file       *os.File
+	size       int64 // Current size of file
+}
+
+// openLogFile opens (appends to) a log file that is rotated by size. A
+// maxSize of 0 means that it is never rotated.
+func openLogFile(path string, mode os.FileMode, maxSize int64, maxBackups int) (*logFile, error) {
+	l := &logFile{path: path, mode: mode, maxSize: maxSize, maxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file for appending
+func (l *logFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, l.mode)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Write writes a log entry, rotating the file first if it would become
+// larger than maxSize. An entry is never split between files.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			// Keep logging to the current file rather than losing entries
+			fmt.Fprintf(os.Stderr, "Unable to rotate log file %s. Reason: %s\n", l.path, err)
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file, shifts the backups (removing the
+// oldest) and opens a new file
+func (l *logFile) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(l.backupPath(l.maxBackups))
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		os.Rename(l.backupPath(i), l.backupPath(i+1))
+	}
+	renameErr := os.Rename(l.path, l.backupPath(1))
+	if err := l.open(); err != nil {
+		l.file = nil
+		return err
+	}
+	return renameErr
+}
+
+// backupPath returns the path of a rotated log file, 1 is the newest
+func (l *logFile) backupPath(number int) string {
+	return fmt.Sprintf("%s.%d", l.path, number)
+}
+
+// Close closes the log file. Later writes fail.
+func (l *logFile) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogFileRotation(t *testing.T) {
+	logPath := "tmpout/TestLogFileRotation/mediaweb.log"
+	os.RemoveAll("tmpout/TestLogFileRotation")
+	os.MkdirAll("tmpout/TestLogFileRotation", os.ModePerm)
+
+	file, err := openLogFile(logPath, 0644, 100, 2)
+	assertExpectNoErr(t, "", err)
+	entry := strings.Repeat("a", 39) + "\n"
+	for _, prefix := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		_, err = file.Write([]byte(prefix + entry))
+		assertExpectNoErr(t, "", err)
+	}
+	assertExpectNoErr(t, "", file.Close())
+
+	// 2 entries per file, never split, and only 2 old files kept
+	content, err := os.ReadFile(logPath)
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "7"+entry+"8"+entry, string(content))
+	content, err = os.ReadFile(logPath + ".1")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "5"+entry+"6"+entry, string(content))
+	content, err = os.ReadFile(logPath + ".2")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "3"+entry+"4"+entry, string(content))
+	assertFileNotExist(t, "", logPath+".3")
+
+	// Writing after close fails
+	_, err = file.Write([]byte(entry))
+	assertExpectErr(t, "", err)
+}
+
+func TestLogFileNoRotation(t *testing.T) {
+	logPath := "tmpout/TestLogFileNoRotation/mediaweb.log"
+	os.RemoveAll("tmpout/TestLogFileNoRotation")
+	os.MkdirAll("tmpout/TestLogFileNoRotation", os.ModePerm)
+	assertExpectNoErr(t, "", os.WriteFile(logPath, []byte("old\n"), 0644))
+
+	// Appends to an existing file
+	file, err := openLogFile(logPath, 0644, 0, 3)
+	assertExpectNoErr(t, "", err)
+	for i := 0; i < 100; i++ {
+		file.Write([]byte("new entry\n"))
+	}
+	file.Close()
+	content, err := os.ReadFile(logPath)
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "", strings.HasPrefix(string(content), "old\nnew entry\n"))
+	assertEqualsInt(t, "", 4+100*10, len(content))
+	assertFileNotExist(t, "", logPath+".1")
+
+	_, err = openLogFile("tmpout/TestLogFileNoRotation/dont/exist.log", 0644, 0, 3)
+	assertExpectErr(t, "", err)
+}
@@ -5,35 +5,153 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 func mainCommon() *WebAPI {
 	s := loadSettings(findConfFile())
+	log.SetFormatter(toLogFormatter(s.logFormat, s.logTimestamp))
 	log.SetLevel(s.logLevel)
+	var logOutput *logFile
 	if s.logFile != "" {
 		log.Info("Logging will continue in file ", s.logFile)
-		file, err := os.OpenFile(s.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		logFileMode := os.FileMode(s.cacheFileMode)
+		if logFileMode == 0 {
+			logFileMode = 0644
+		}
+		// Kept open until the server has stopped, see WebAPI.closeLogFile
+		var err error
+		logOutput, err = openLogFile(s.logFile, logFileMode, int64(s.logMaxSize)*1024*1024, s.logMaxBackups)
 		if err != nil {
 			log.Panic("Failed to create logfile ", s.logFile)
 		}
-		log.SetOutput(file)
-		defer file.Close()
+		log.SetOutput(logOutput)
+		if s.logMaxSize > 0 {
+			log.Infof("Log file rotated at %d MB, keeping %d old files", s.logMaxSize, s.logMaxBackups)
+		}
 	}
 	log.Info("Version: ", applicationVersion)
 	log.Info("Build time: ", applicationBuildTime)
 	log.Info("Git hash: ", applicationGitHash)
-	media := createMedia(s.mediaPath, s.cachePath,
+	maxImagePixels := s.maxImagePixels * 1000 * 1000
+	if maxImagePixels == 0 {
+		maxImagePixels = -1 // No limit
+	}
+	mediaPath, cachePath := rootPaths(s.mediaPath, s.cachePath, s.rootFolder)
+	media := createMedia(mediaPath, cachePath,
 		s.enableThumbCache, s.ignoreExifThumbs, s.genThumbsOnStartup,
 		s.genThumbsOnAdd, s.genAlbumThumbs, s.autoRotate, s.enablePreview, s.previewMaxSide,
 		s.genPreviewForSmallImages, s.genPreviewOnStartup, s.genPreviewOnAdd,
-		s.enableCacheCleanup)
+		s.enableCacheCleanup, mediaOptions{
+			previewFormat:         s.previewFormat,
+			previewKeepFormat:     s.previewKeepFormat,
+			previewSizes:          s.previewSizes,
+			previewMinSide:        s.previewMinSide,
+			resampleFilter:        s.resampleFilter,
+			thumbBackground:       s.thumbBackground,
+			blurHashXComponents:   s.blurHashX,
+			blurHashYComponents:   s.blurHashY,
+			videoPreviewFrames:    s.videoPreviewFrames,
+			maxImagePixels:        maxImagePixels,
+			watermarkFile:         s.watermarkFile,
+			watermarkPosition:     s.watermarkPosition,
+			watermarkOpacity:      float64(s.watermarkOpacity) / 100,
+			enhancePreviews:       s.enhancePreviews,
+			sharpenSigma:          s.sharpenAmount,
+			contrast:              float64(s.contrastAmount),
+			cacheEntryTTL:         time.Duration(s.cacheEntryTTLDays) * 24 * time.Hour,
+			cacheExpireThumbnails: s.cacheExpireThumbnails,
+			cacheExpirePreviews:   s.cacheExpirePreviews,
+			cacheMaxSize:          int64(s.cacheMaxSizeMB) * 1024 * 1024,
+			cacheMaxAge:           time.Duration(s.cacheMaxAgeDays) * 24 * time.Hour,
+			cacheEvictionInterval: time.Duration(s.cacheEvictionInterval) * time.Minute,
+			cacheDirMode:          os.FileMode(s.cacheDirMode),
+			cacheFileMode:         os.FileMode(s.cacheFileMode),
+			cacheStripExt:         !s.cacheIncludeExt,
+			cacheWriteInPlace:     !s.cacheAtomicWrite,
+			livePhotos:            s.livePhotos,
+			groupSidecars:         s.groupSidecars,
+			showHidden:            !s.skipHidden,
+			imageExtensions:       s.imageExtensions,
+			sniffContent:          s.sniffContent,
+			videoExtensions:       s.videoExtensions,
+			similarScope:          s.similarScope,
+			exifThumbNoRotate:     !s.exifThumbRotate,
+			exifThumbMinSide:      s.exifThumbMinSide,
+			forceRotate:           s.forceRotate,
+			noVideoIconOverlay:    !s.videoIconOverlay,
+			videoThumbFallback:    s.videoThumbFallback,
+			gifAnimatedThumbs:     s.gifAnimatedThumbs,
+			videoContactSheet:     s.videoContactSheet,
+			contactColumns:        s.contactColumns,
+			contactRows:           s.contactRows,
+			ffmpegPath:            s.ffmpegPath,
+			ffmpegArgs:            s.ffmpegExtraArgs,
+			ffmpegSelfTest:        s.ffmpegSelfTest,
+			trashPath:             s.trashPath,
+			trashMaxAge:           time.Duration(s.trashMaxAgeDays) * 24 * time.Hour,
+			watcherDebounce:       time.Duration(s.watcherDebounceSec) * time.Second,
+			watcherResync:         time.Duration(s.watcherResyncInterval) * time.Minute,
+			watchPaths:            s.watchPaths,
+			thumbRetryDelay:       time.Duration(s.thumbRetryDelay) * time.Minute,
+			slowGenThreshold:      time.Duration(s.slowGenThreshold) * time.Millisecond,
+			onDemandConcurrency:   s.onDemandConcurrency,
+			noPreCachePriority:    !s.preCachePriority,
+			thumbMaxRetries:       s.thumbMaxRetries,
+			noCheckStale:          !s.checkStale})
+	var autocertDomains []string
+	if s.autocert {
+		autocertDomains = s.autocertDomains
+	}
 	webAPI := CreateWebAPI(s.port, s.ip, "templates", media,
-		s.userName, s.password, s.tlsCertFile, s.tlsKeyFile)
+		s.userName, s.password, s.tlsCertFile, s.tlsKeyFile, webAPIOptions{
+			allowDelete:       s.allowDelete,
+			viewers:           s.viewers,
+			allowUpload:       s.allowUpload,
+			maxUploadSize:     int64(s.maxUploadSizeMB) * 1024 * 1024,
+			sessionSecret:     s.sessionSecret,
+			sessionTimeout:    time.Duration(s.sessionTimeout) * time.Minute,
+			corsOrigins:       s.corsOrigins,
+			socket:            s.socket,
+			minTLSVersion:     s.minTLSVersion,
+			cipherSuites:      s.tlsCipherSuites,
+			autocertDomains:   autocertDomains,
+			autocertCacheDir:  s.autocertCacheDir,
+			autocertHTTPAddr:  s.autocertHTTPAddr,
+			basePath:          s.basePath,
+			accessLog:         s.accessLog,
+			readHeaderTimeout: time.Duration(s.httpReadHeaderTimeout) * time.Second,
+			readTimeout:       time.Duration(s.httpReadTimeout) * time.Second,
+			writeTimeout:      time.Duration(s.httpWriteTimeout) * time.Second,
+			idleTimeout:       time.Duration(s.httpIdleTimeout) * time.Second,
+			spriteMaxTiles:    s.spriteMaxTiles,
+			defaultFolder:     s.defaultFolder,
+			metrics:           s.metrics})
+	if logOutput != nil {
+		webAPI.logFile = logOutput
+	}
 	return webAPI
 }
 
+// rootPaths returns the media and cache paths to serve when only the root
+// folder (relative mediaPath) shall be visible. Everything above it is
+// hidden since the root folder becomes the media path, i.e. the usual
+// path checks prevent access outside of it. The cache path is rebased the
+// same way so that the cache layout is the same as without root folder,
+// except cache folders in each media folder that follow the media anyway.
+func rootPaths(mediaPath, cachePath, rootFolder string) (string, string) {
+	if rootFolder == "" {
+		return mediaPath, cachePath
+	}
+	log.Info("Root folder: ", rootFolder)
+	if strings.Contains(cachePath, mediaDirToken) {
+		return filepath.Join(mediaPath, rootFolder), cachePath
+	}
+	return filepath.Join(mediaPath, rootFolder), filepath.Join(cachePath, rootFolder)
+}
+
 // getFullPath returns the full path from an absolute base
 // path and a relative path. Returns error on security hacks,
 // i.e. when someone tries to access ../../../ for example to
@@ -44,7 +162,7 @@ func getFullPath(basePath, relativePath string) (string, error) {
 	fullPath := filepath.ToSlash(filepath.Join(basePath, relativePath))
 	diffPath, err := filepath.Rel(basePath, fullPath)
 	diffPath = filepath.ToSlash(diffPath)
-	if err != nil || strings.HasPrefix(diffPath, "../") {
+	if err != nil || diffPath == ".." || strings.HasPrefix(diffPath, "../") {
 		return basePath, fmt.Errorf("hacker attack, someone tries to access: %s", fullPath)
 	}
 	return fullPath, nil
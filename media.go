@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"image"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cozy/goexif2/exif"
@@ -15,20 +18,164 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var imgExtensions = [...]string{".png", ".jpg", ".jpeg", ".tif", ".tiff", ".gif"}
-var vidExtensions = [...]string{".avi", ".mov", ".vid", ".mkv", ".mp4"}
+var defaultImgExtensions = []string{".png", ".jpg", ".jpeg", ".tif", ".tiff", ".gif", ".bmp"}
+var defaultVidExtensions = []string{".avi", ".mov", ".vid", ".mkv", ".mp4", ".webm", ".m4v", ".flv", ".wmv", ".mpg"}
+
+// videoContentTypes are the content types of video formats, since the
+// types known by the OS (used by http.ServeFile) vary between platforms
+var videoContentTypes = map[string]string{
+	".avi":  "video/x-msvideo",
+	".mov":  "video/quicktime",
+	".mkv":  "video/x-matroska",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".m4v":  "video/x-m4v",
+	".flv":  "video/x-flv",
+	".wmv":  "video/x-ms-wmv",
+	".mpg":  "video/mpeg"}
+
+// defaultMaxImagePixels is the default max number of pixels of images to
+// decode (100 megapixels)
+const defaultMaxImagePixels = 100 * 1000 * 1000
 
 // Media represents the media including its base path
 type Media struct {
-	mediaPath          string // Top level path for media files
-	enableThumbCache   bool   // Generate thumbnails
-	ignoreExifThumbs   bool   // Ignore embedded exif thumbnails
-	autoRotate         bool   // Rotate JPEG files when needed
-	enablePreview      bool   // Resize images before provide to client
-	enableCacheCleanup bool   // Enable cleanup of cache area
-	preCacheInProgress bool   // True if thumbnail/preview generation in progress
+	mediaPath          string   // Top level path for media files
+	enableThumbCache   bool     // Generate thumbnails
+	ignoreExifThumbs   bool     // Ignore embedded exif thumbnails
+	exifThumbNoRotate  bool     // Write embedded exif thumbnails as is (client rotates)
+	exifThumbMinSide   int      // Ignore embedded exif thumbnails smaller than this (0 means use all)
+	autoRotate         bool     // Rotate JPEG files when needed
+	enablePreview      bool     // Resize images before provide to client
+	enableCacheCleanup bool     // Enable cleanup of cache area
+	livePhotos         bool     // Pair images with videos having the same base name (Live Photos)
+	groupSidecars      bool     // Group files with the same base name as an image (e.g. RAW files)
+	skipHidden         bool     // Omit hidden files and folders, see isHidden
+	forceRotate        bool     // Use the orientation in .orientation files, see readForcedOrientation
+	imgExtensions      []string // File extensions of images
+	maxImagePixels     int      // Max number of pixels of images to decode (negative means no limit)
+	sniffContent       bool     // Classify files without extension by their content, see sniffFileType
+	vidExtensions      []string // File extensions of videos
+	preCacheInProgress bool     // True if thumbnail/preview generation in progress
 	cache              *Cache
-	watcher            *Watcher // The media watcher
+	watcher            *Watcher      // The media watcher
+	generationSlots    chan struct{} // Limits concurrent on-demand generations, see waitGenerationSlot (nil means no limit)
+
+	progress          PreCacheProgress               // Progress of ongoing thumbnail/preview generation
+	progressListeners map[chan PreCacheProgress]bool // Channels receiving progress updates
+	progressMutex     sync.Mutex                     // For thread safety of progress
+	cancelPreCache    context.CancelFunc             // Cancels the ongoing thumbnail/preview generation
+	preCacheQueue     *preCacheQueue                 // Folders left to process by generateAllCache (nil means directory order)
+	ready             bool                           // False until the thumbnail/preview generation on startup is done
+
+	contentHashes    map[string]contentHash         // Key: relative path of media file
+	perceptualHashes map[string]perceptualHashCache // Key: relative path of image
+	hashMutex        sync.Mutex                     // For thread safety of contentHashes and perceptualHashes
+	similarScope     string                         // similarScopeFolder or similarScopeLibrary
+	trashPath        string                         // Deleted media files are moved here ("" means removed permanently), see moveToTrash
+
+	dimensions      map[string]dimensionsCache // Key: relative path of media file
+	dimensionsMutex sync.Mutex                 // For thread safety of dimensions
+
+	colors      map[string]colorsCache // Key: relative path of image
+	colorsMutex sync.Mutex             // For thread safety of colors
+
+	blurHashes          map[string]blurHashCache // Key: relative path of media file
+	blurHashXComponents int                      // Horizontal BlurHash components, see encodeBlurHash
+	blurHashYComponents int                      // Vertical BlurHash components
+	blurHashMutex       sync.Mutex               // For thread safety of blurHashes
+
+	folderCounts      map[string]folderCountsCache // Key: relative path of folder
+	folderCountsMutex sync.Mutex                   // For thread safety of folderCounts
+
+	dates            map[string]dateCache // Key: relative path of media file
+	dateIndex        []datedFile          // All media files sorted on date (nil if not built)
+	dateIndexVersion int                  // Incremented when dateIndex is invalidated
+	dateMutex        sync.Mutex           // For thread safety of dates and dateIndex
+
+	sniffedTypes map[string]sniffedType // Key: relative path of file without extension
+	sniffMutex   sync.Mutex             // For thread safety of sniffedTypes
+
+	recentFiles   map[string]RecentFile // Index of media files, key: relative path
+	recentIndexed bool                  // True if all media files have been added to recentFiles
+	recentMutex   sync.Mutex            // For thread safety of recentFiles
+
+	tagIndex map[string]map[string]bool // Key: lower case tag, value: relative paths of media files with the tag
+	fileTags map[string][]string        // Key: relative path of media file, value: its tags
+	tagMutex sync.Mutex                 // For thread safety of tagIndex and fileTags
+}
+
+// mediaOptions holds the optional media settings. The zero value
+// gives the default behavior.
+type mediaOptions struct {
+	previewFormat      string // Format of preview files, previewFormatJPEG (default) or previewFormatAVIF
+	previewKeepFormat  bool   // PNG previews of PNG images (instead of previewFormat)
+	previewSizes       []int  // Additional preview sizes clients may request (nil means only previewMaxSide)
+	previewMinSide     int    // Images with width and height not larger than this get no preview (0 means previewMaxSide)
+	resampleFilter     string // Filter when downscaling thumbnails and previews, see resampleFilters ("" means box)
+	thumbBackground    string // Background color of thumbnails and previews as hex, e.g. 000000 ("" means white)
+	videoPreviewFrames int    // Number of frames in animated video previews (0 means default, 5)
+	maxImagePixels     int    // Max number of pixels of images to decode (0 means defaultMaxImagePixels, negative means no limit)
+
+	watermarkFile     string  // Image to add as watermark on image previews ("" means no watermark)
+	watermarkPosition string  // Position of the watermark, see watermarkPositions ("" means bottomright)
+	watermarkOpacity  float64 // Opacity of the watermark, 0.0 - 1.0 (0 means default, 0.5)
+
+	enhancePreviews bool    // Sharpen (and adjust contrast of) image previews
+	sharpenSigma    float64 // Sigma of the sharpening of enhanced previews (0 means default, 0.5)
+	contrast        float64 // Contrast adjustment of enhanced previews in percent, -100 - 100 (0 means none)
+
+	cacheEntryTTL         time.Duration // Evict cache entries not accessed within this time (0 means never)
+	cacheExpireThumbnails bool          // cacheEntryTTL applies to thumbnails
+	cacheExpirePreviews   bool          // cacheEntryTTL applies to previews
+	cacheMaxAge           time.Duration // Evict any cache entry not accessed within this time (0 means never)
+	cacheDirMode          os.FileMode   // Permissions of cache directories (0 means 0777 restricted by umask)
+	cacheFileMode         os.FileMode   // Permissions of cache files (0 means 0666 restricted by umask)
+	cacheStripExt         bool          // Remove the media file extension in cache file names (as in older versions), see cacheFileName
+	cacheWriteInPlace     bool          // Write cache files directly instead of via a temporary file, see writeCacheFile
+	cacheMaxSize          int64         // Evict least recently used cache entries above this size in bytes (0 means no limit)
+	cacheEvictionInterval time.Duration // Time between cache evictions (0 means default, one hour)
+
+	trashPath   string        // Move deleted media files to this path instead of removing them ("" means disabled)
+	trashMaxAge time.Duration // Empty the trash from files deleted longer ago (0 means never)
+
+	livePhotos    bool // Pair images with .mov videos having the same base name (Live Photos)
+	groupSidecars bool // Group files with the same base name as an image, see groupSidecars
+	showHidden    bool // Show hidden files and folders (default is to omit them)
+
+	imageExtensions []string // File extensions of images (nil means defaultImgExtensions)
+	sniffContent    bool     // Classify files without extension by their content (slow)
+	videoExtensions []string // File extensions of videos (nil means defaultVidExtensions)
+	similarScope    string   // Where to search for similar images, similarScopeFolder (default) or similarScopeLibrary
+
+	exifThumbNoRotate  bool     // Don't rotate embedded EXIF thumbnails, see getEXIFThumbnailOrientation
+	exifThumbMinSide   int      // Ignore embedded EXIF thumbnails with width and height less than this (0 means use all)
+	forceRotate        bool     // Override the EXIF orientation with .orientation files, see readForcedOrientation
+	noVideoIconOverlay bool     // Don't add the video icon to video thumbnails
+	videoThumbFallback bool     // Generate a thumbnail with file name and duration if ffmpeg fails
+	gifAnimatedThumbs  bool     // Animated thumbnails of GIF images (instead of the first frame as JPEG)
+	videoContactSheet  bool     // Contact sheets of videos (?contactsheet=true on /thumb)
+	contactColumns     int      // Number of frames horizontally in video contact sheets (0 means default, 4)
+	contactRows        int      // Number of frames vertically in video contact sheets (0 means default, 3)
+	ffmpegPath         string   // ffmpeg command or path to the binary ("" means ffmpeg in PATH)
+	ffmpegArgs         []string // Extra ffmpeg arguments when extracting video frames
+	ffmpegSelfTest     bool     // Test extracting a frame with ffmpeg at startup, see probeFFmpeg
+
+	watcherDebounce time.Duration // Time a new file must be quiet before its thumbnail is generated (0 means no debounce)
+	watcherResync   time.Duration // Time between resyncs catching files missed by the watcher (0 means never)
+	watchPaths      []string      // Relative paths of the folders to watch (nil means the whole media path)
+
+	thumbRetryDelay time.Duration // Delay before first retry of a failed thumbnail/preview generation
+	thumbMaxRetries int           // Max number of retries of a failed thumbnail/preview generation (0 means never)
+	noCheckStale    bool          // Don't regenerate thumbnails/previews older than the media file
+
+	slowGenThreshold time.Duration // Warn about thumbnail generations taking longer than this (0 means never)
+
+	onDemandConcurrency int  // Max number of thumbnails/previews generated at once for clients (0 means no limit)
+	noPreCachePriority  bool // Don't process folders browsed by clients first in generateAllCache
+
+	blurHashXComponents int // Horizontal BlurHash components, 1 - 9 (0 means default, 4)
+	blurHashYComponents int // Vertical BlurHash components, 1 - 9 (0 means default, 3)
 }
 
 // File represents a folder or any other file
@@ -36,6 +183,19 @@ type File struct {
 	Type string // folder, image or video
 	Name string
 	Path string // Including Name. Always using / (even on Windows)
+
+	LiveVideo string   `json:",omitempty"` // Path of paired video if this is a Live Photo
+	Sidecars  []string `json:",omitempty"` // Extensions of grouped files with the same base name, e.g. .CR2
+
+	// Number of media files and folders in a folder, only provided when
+	// requested (see addFolderCounts)
+	ImageCount  int `json:",omitempty"`
+	VideoCount  int `json:",omitempty"`
+	FolderCount int `json:",omitempty"`
+
+	// BlurHash placeholder of images and videos, only provided when
+	// requested (see addBlurHashes)
+	BlurHash string `json:",omitempty"`
 }
 
 // createMedia creates a new media. If thumb cache is enabled the path is
@@ -43,11 +203,19 @@ type File struct {
 func createMedia(mediaPath string, cachepath string, enableThumbCache bool, ignoreExifThumbs bool,
 	genThumbsOnStartup bool, genThumbsOnAdd bool, genAlbumThumbs bool, autoRotate bool,
 	enablePreview bool, previewMaxSide int, genPreviewForSmallImages bool, genPreviewOnStartup bool,
-	genPreviewOnAdd bool, enabledCacheCleanup bool) *Media {
+	genPreviewOnAdd bool, enabledCacheCleanup bool, options mediaOptions) *Media {
 	log.Info("Media path: ", mediaPath)
 	if enableThumbCache || enablePreview {
 		directory := filepath.Dir(cachepath)
-		err := os.MkdirAll(directory, os.ModePerm)
+		dirMode := options.cacheDirMode
+		if dirMode == 0 {
+			dirMode = os.ModePerm
+		}
+		// Cache folders in media folders are created when needed
+		mediaDirCache, err := parseMediaDirCachePath(cachepath)
+		if err == nil && mediaDirCache == "" {
+			err = os.MkdirAll(directory, dirMode)
+		}
 		if err != nil {
 			log.Warnf("Unable to create cache path %s. Reason: %s", cachepath, err)
 			log.Info("Thumbnail and preview cache will be disabled")
@@ -59,25 +227,89 @@ func createMedia(mediaPath string, cachepath string, enableThumbCache bool, igno
 	} else {
 		log.Info("Cache disabled")
 	}
+	if len(options.imageExtensions) == 0 {
+		options.imageExtensions = defaultImgExtensions
+	}
+	if len(options.videoExtensions) == 0 {
+		options.videoExtensions = defaultVidExtensions
+	}
+	if options.maxImagePixels == 0 {
+		options.maxImagePixels = defaultMaxImagePixels
+	}
+	log.Info("Image extensions: ", strings.Join(options.imageExtensions, ", "))
+	log.Info("Video extensions: ", strings.Join(options.videoExtensions, ", "))
 	log.Info("JPEG auto rotate: ", autoRotate)
 	log.Infof("Image preview: %t  (max width/height %d px)", enablePreview, previewMaxSide)
 	media := &Media{mediaPath: filepath.ToSlash(filepath.Clean(mediaPath)),
 		enableThumbCache:   enableThumbCache,
 		ignoreExifThumbs:   ignoreExifThumbs,
+		exifThumbNoRotate:  options.exifThumbNoRotate,
+		exifThumbMinSide:   options.exifThumbMinSide,
 		autoRotate:         autoRotate,
 		enablePreview:      enablePreview,
 		enableCacheCleanup: enabledCacheCleanup,
-		preCacheInProgress: false}
-	log.Info("Video thumbnails supported (ffmpeg installed): ", hasVideoThumbnailSupport())
+		livePhotos:         options.livePhotos,
+		groupSidecars:      options.groupSidecars,
+		skipHidden:         !options.showHidden,
+		forceRotate:        options.forceRotate,
+		imgExtensions:      options.imageExtensions,
+		maxImagePixels:     options.maxImagePixels,
+		sniffContent:       options.sniffContent,
+		sniffedTypes:       map[string]sniffedType{},
+		vidExtensions:      options.videoExtensions,
+		preCacheInProgress: false,
+		progressListeners:  map[chan PreCacheProgress]bool{},
+		contentHashes:      map[string]contentHash{},
+		perceptualHashes:   map[string]perceptualHashCache{},
+		dimensions:         map[string]dimensionsCache{},
+		colors:             map[string]colorsCache{},
+		blurHashes:         map[string]blurHashCache{},
+		folderCounts:       map[string]folderCountsCache{},
+		dates:              map[string]dateCache{},
+		recentFiles:        map[string]RecentFile{},
+		tagIndex:           map[string]map[string]bool{},
+		fileTags:           map[string][]string{},
+		similarScope:       options.similarScope}
+	if options.trashPath != "" {
+		trashPath := options.trashPath
+		if filepath.IsAbs(mediaPath) != filepath.IsAbs(trashPath) {
+			// Same kind of path as the media path, see isInTrash
+			trashPath, _ = filepath.Abs(trashPath)
+			if wd, err := os.Getwd(); err == nil && !filepath.IsAbs(mediaPath) {
+				trashPath, _ = filepath.Rel(wd, trashPath)
+			}
+		}
+		media.trashPath = filepath.ToSlash(filepath.Clean(trashPath))
+		log.Info("Trash path: ", media.trashPath)
+		if options.trashMaxAge > 0 {
+			go media.emptyTrashThread(options.trashMaxAge, time.Hour)
+		}
+	}
+	if !options.noPreCachePriority {
+		media.preCacheQueue = &preCacheQueue{}
+	}
+	media.blurHashXComponents, media.blurHashYComponents = options.blurHashXComponents, options.blurHashYComponents
+	if media.blurHashXComponents < 1 || media.blurHashXComponents > 9 ||
+		media.blurHashYComponents < 1 || media.blurHashYComponents > 9 {
+		media.blurHashXComponents, media.blurHashYComponents = blurHashXComponents, blurHashYComponents
+	}
+	if options.onDemandConcurrency > 0 {
+		media.generationSlots = make(chan struct{}, options.onDemandConcurrency)
+	}
 	if enableThumbCache || enablePreview {
 		cachepath := filepath.ToSlash(filepath.Clean(cachepath))
-		media.cache = createCache(cachepath, previewMaxSide, genPreviewForSmallImages, genAlbumThumbs)
+		media.cache = createCache(media.mediaPath, cachepath, previewMaxSide, genPreviewForSmallImages, genAlbumThumbs, options)
+		log.Info("Video thumbnails supported (ffmpeg installed): ", media.cache.hasVideoThumbnailSupport())
 	}
+	media.ready = true
 	if enableThumbCache && genThumbsOnStartup || enablePreview && genPreviewOnStartup {
-		go media.generateAllCache(enableThumbCache && genThumbsOnStartup, enablePreview && genPreviewOnStartup)
+		media.ready = false // Until generateAllCache is done
+		go media.generateAllCache(context.Background(), enableThumbCache && genThumbsOnStartup,
+			enablePreview && genPreviewOnStartup)
 	}
 	if enableThumbCache && genThumbsOnAdd || enablePreview && genPreviewOnAdd {
-		media.watcher = createWatcher(media, enableThumbCache && genThumbsOnAdd, enablePreview && genPreviewOnAdd)
+		media.watcher = createWatcher(media, enableThumbCache && genThumbsOnAdd, enablePreview && genPreviewOnAdd,
+			options.watcherDebounce, options.watcherResync, options.watchPaths)
 		go media.watcher.startWatcher()
 	}
 	return media
@@ -86,7 +318,14 @@ func createMedia(mediaPath string, cachepath string, enableThumbCache bool, igno
 // getFullMediaPath returns the full path of the provided path, i.e:
 // media path + relative path.
 func (m *Media) getFullMediaPath(relativePath string) (string, error) {
-	return getFullPath(m.mediaPath, relativePath)
+	fullPath, err := getFullPath(m.mediaPath, relativePath)
+	if err == nil && m.isInTrash(fullPath) {
+		return m.mediaPath, fmt.Errorf("access to the trash is not allowed: %s", fullPath)
+	}
+	if err == nil && m.isInCache(fullPath) {
+		return m.mediaPath, fmt.Errorf("access to the cache is not allowed: %s", fullPath)
+	}
+	return fullPath, err
 }
 
 // getRelativePath returns the relative path from an absolute base
@@ -116,6 +355,7 @@ func (m *Media) getRelativeMediaPath(fullPath string) (string, error) {
 func (m *Media) getFiles(relativePath string) ([]File, error) {
 	//var files []File
 	files := make([]File, 0, 500)
+	var others []string // Names of files that are not media
 	fullPath, err := m.getFullMediaPath(relativePath)
 	if err != nil {
 		return files, err
@@ -126,12 +366,19 @@ func (m *Media) getFiles(relativePath string) ([]File, error) {
 	}
 
 	for _, dirEntry := range fileInfos {
+		if m.skipHidden && isHidden(filepath.Join(fullPath, dirEntry.Name())) {
+			log.Debug("getFiles - omitting hidden:", dirEntry.Name())
+			continue
+		}
+		if m.isInTrash(filepath.Join(fullPath, dirEntry.Name())) || m.isInCache(filepath.Join(fullPath, dirEntry.Name())) {
+			continue
+		}
 		fileInfo, _ := dirEntry.Info()
 		fileType := ""
 		if dirEntry.IsDir() || fileInfo.Mode()&os.ModeSymlink != 0 {
 			fileType = "folder"
 		} else {
-			fileType = getFileType(dirEntry.Name())
+			fileType = m.getFileType(filepath.Join(relativePath, dirEntry.Name()))
 		}
 		// Only add directories, videos and images
 		if fileType != "" {
@@ -146,11 +393,134 @@ func (m *Media) getFiles(relativePath string) ([]File, error) {
 			files = append(files, file)
 		} else {
 			log.Debug("getFiles - omitting:", fileInfo.Name())
+			others = append(others, dirEntry.Name())
 		}
 	}
+	if m.groupSidecars {
+		files = groupSidecars(files, others)
+	}
+	if m.livePhotos {
+		pairLivePhotos(files)
+	}
 	return files, nil
 }
 
+// pairLivePhotos sets LiveVideo of all images that have a .mov video
+// with the same base name (i.e. Live Photos).
+func pairLivePhotos(files []File) {
+	videos := make(map[string]string)
+	for _, file := range files {
+		if file.Type == "video" && isLiveVideo(file.Name) {
+			videos[strings.ToLower(baseName(file.Name))] = file.Path
+		}
+	}
+	if len(videos) == 0 {
+		return
+	}
+	for i := range files {
+		if files[i].Type == "image" {
+			files[i].LiveVideo = videos[strings.ToLower(baseName(files[i].Name))]
+		}
+	}
+}
+
+// groupSidecars collapses files sharing the same base name as an image
+// into one entry, e.g. IMG_1234.JPG, IMG_1234.CR2 and IMG_1234.tiff. The
+// primary file is a JPEG if available (otherwise the first image), and the
+// extensions of the other files are added to its Sidecars. otherNames are
+// the non-media files in the same folder (e.g. RAW files). Videos are never
+// grouped.
+func groupSidecars(files []File, otherNames []string) []File {
+	primaries := make(map[string]int) // Key: lower case base name, value: index in files
+	for i, file := range files {
+		if file.Type != "image" {
+			continue
+		}
+		key := strings.ToLower(baseName(file.Name))
+		index, ok := primaries[key]
+		if !ok || (!isJPEG(files[index].Name) && isJPEG(file.Name)) {
+			primaries[key] = i
+		}
+	}
+	if len(primaries) == 0 {
+		return files
+	}
+
+	result := make([]File, 0, len(files))
+	for i, file := range files {
+		index, ok := primaries[strings.ToLower(baseName(file.Name))]
+		if file.Type == "image" && ok && index != i {
+			files[index].Sidecars = append(files[index].Sidecars, filepath.Ext(file.Name))
+		}
+	}
+	for _, name := range otherNames {
+		index, ok := primaries[strings.ToLower(baseName(name))]
+		if ok {
+			files[index].Sidecars = append(files[index].Sidecars, filepath.Ext(name))
+		}
+	}
+	for i, file := range files {
+		index, ok := primaries[strings.ToLower(baseName(file.Name))]
+		if file.Type != "image" || !ok || index == i {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// isJPEG returns true if the file has a JPEG extension
+func isJPEG(pathAndFile string) bool {
+	return hasExtension(pathAndFile, []string{".jpg", ".jpeg"})
+}
+
+// getLiveVideo returns the relative path of the video paired with
+// an image (i.e. the motion component of a Live Photo).
+func (m *Media) getLiveVideo(relativeFilePath string) (string, error) {
+	if !m.livePhotos {
+		return "", fmt.Errorf("live photos disabled")
+	}
+	if !m.isImage(relativeFilePath) {
+		return "", fmt.Errorf("not an image: %s", relativeFilePath)
+	}
+	files, err := m.getFiles(filepath.Dir(relativeFilePath))
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if file.Name == filepath.Base(relativeFilePath) && file.LiveVideo != "" {
+			return file.LiveVideo, nil
+		}
+	}
+	return "", fmt.Errorf("no live video for %s", relativeFilePath)
+}
+
+// isLiveVideo returns true if the file may be the motion component of
+// a Live Photo.
+func isLiveVideo(pathAndFile string) bool {
+	return strings.EqualFold(filepath.Ext(pathAndFile), ".mov")
+}
+
+// baseName returns the file name without extension
+func baseName(pathAndFile string) string {
+	name := filepath.Base(pathAndFile)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// previewFormat returns the preview format of an image to use for a
+// client accepting the provided content types (i.e. the Accept HTTP
+// header). PNG images have PNG previews if previewKeepFormat is enabled.
+// Otherwise AVIF is only used if configured and accepted by the client,
+// and JPEG in all other cases.
+func (m *Media) previewFormat(relativeFilePath, accept string) string {
+	if m.cache != nil && m.cache.previewFormatOf(relativeFilePath) == previewFormatPNG {
+		return previewFormatPNG
+	}
+	if m.cache != nil && m.cache.previewFormat == previewFormatAVIF && strings.Contains(accept, "image/avif") {
+		return previewFormatAVIF
+	}
+	return previewFormatJPEG
+}
+
 func (m *Media) isJPEG(pathAndFile string) bool {
 	extension := filepath.Ext(pathAndFile)
 	return strings.EqualFold(extension, ".jpg") ||
@@ -182,26 +552,15 @@ func (m *Media) extractEXIF(relativeFilePath string) *exif.Exif {
 
 // isRotationNeeded returns true if the file needs to be rotated.
 // It finds this out by reading the EXIF rotation information
-// in the file.
+// in the file (or the .orientation file, see getOrientation).
 // If Media.autoRotate is false this function will always return
 // false.
 func (m *Media) isRotationNeeded(relativeFilePath string) bool {
 	if !m.autoRotate {
 		return false
 	}
-	ex := m.extractEXIF(relativeFilePath)
-	if ex == nil {
-		return false // No EXIF info exist
-	}
-	orientTag, _ := ex.Get(exif.Orientation)
-	if orientTag == nil {
-		return false // No Orientation
-	}
-	orientInt, _ := orientTag.Int(0)
-	if orientInt > 1 && orientInt < 9 {
-		return true // Rotation is needed
-	}
-	return false
+	orientation := m.getOrientation(relativeFilePath)
+	return orientation > 1 && orientation < 9
 }
 
 // rotateAndWrite opens and rotates a JPG/JPEG file according to
@@ -215,37 +574,120 @@ func (m *Media) rotateAndWrite(w io.Writer, relativeFilePath string) error {
 		return err
 	}
 
-	img, err := imaging.Open(fullPath, imaging.AutoOrientation(true))
+	img, err := openImage(fullPath, m.maxImagePixels, m.forceRotate)
 	if err != nil {
 		return err
 	}
-	err = imaging.Encode(w, img, imaging.JPEG)
+	var buffer bytes.Buffer
+	err = imaging.Encode(&buffer, img, imaging.JPEG)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	// Keep the EXIF information (except orientation) of the original
+	jpegBytes := buffer.Bytes()
+	ex := m.extractEXIF(relativeFilePath)
+	if ex != nil {
+		jpegWithExif, err := insertEXIF(jpegBytes, ex.Raw)
+		if err != nil {
+			log.Debugf("Unable to keep EXIF for %s. Reason: %s", relativeFilePath, err)
+		} else {
+			jpegBytes = jpegWithExif
+		}
+	}
+	_, err = w.Write(jpegBytes)
+	return err
 }
 
-// writeEXIFThumbnail extracts the EXIF thumbnail from a JPEG file
-// and rotates it when needed (based on the EXIF orientation tag).
-// Returns err if no thumbnail exist.
-func (m *Media) writeEXIFThumbnail(w io.Writer, relativeFilePath string) error {
+// insertEXIF returns a copy of the JPEG data with an EXIF (APP1)
+// segment created from rawExif (TIFF structure). The orientation is
+// set to normal (1) and the embedded thumbnail (IFD1) is removed since
+// it is not rotated.
+func insertEXIF(jpegBytes []byte, rawExif []byte) ([]byte, error) {
+	if len(jpegBytes) < 2 || jpegBytes[0] != 0xFF || jpegBytes[1] != 0xD8 {
+		return nil, fmt.Errorf("not a JPEG")
+	}
+	if len(rawExif) < 8 {
+		return nil, fmt.Errorf("invalid EXIF")
+	}
+	exifHeader := []byte("Exif\x00\x00")
+	segmentLength := 2 + len(exifHeader) + len(rawExif)
+	if segmentLength > 0xFFFF {
+		return nil, fmt.Errorf("EXIF too large (%d bytes)", len(rawExif))
+	}
+
+	tiffData := make([]byte, len(rawExif))
+	copy(tiffData, rawExif)
+	var order binary.ByteOrder
+	switch string(tiffData[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid EXIF byte order")
+	}
+	ifd0 := int(order.Uint32(tiffData[4:8]))
+	if ifd0+2 > len(tiffData) {
+		return nil, fmt.Errorf("invalid EXIF IFD0 offset")
+	}
+	nbrOfEntries := int(order.Uint16(tiffData[ifd0:]))
+	nextIFD := ifd0 + 2 + nbrOfEntries*12
+	if nextIFD+4 > len(tiffData) {
+		return nil, fmt.Errorf("invalid EXIF IFD0")
+	}
+	for i := 0; i < nbrOfEntries; i++ {
+		entry := tiffData[ifd0+2+i*12:]
+		if order.Uint16(entry) == 0x0112 { // Orientation (SHORT)
+			order.PutUint16(entry[8:], 1)
+		}
+	}
+	order.PutUint32(tiffData[nextIFD:], 0) // Remove IFD1 (thumbnail)
+
+	result := make([]byte, 0, len(jpegBytes)+2+segmentLength)
+	result = append(result, 0xFF, 0xD8, 0xFF, 0xE1, byte(segmentLength>>8), byte(segmentLength))
+	result = append(result, exifHeader...)
+	result = append(result, tiffData...)
+	result = append(result, jpegBytes[2:]...)
+	return result, nil
+}
+
+// exifThumbnail returns the embedded EXIF thumbnail of a JPEG file.
+// Returns err if no thumbnail exist or if it is too small, i.e. if both
+// width and height are less than exifThumbMinSide.
+func (m *Media) exifThumbnail(relativeFilePath string) ([]byte, error) {
 	ex := m.extractEXIF(relativeFilePath)
 	if ex == nil {
-		return fmt.Errorf("no exif info for %s", relativeFilePath)
+		return nil, fmt.Errorf("no exif info for %s", relativeFilePath)
 	}
 	thumbBytes, err := ex.JpegThumbnail()
 	if err != nil {
-		return fmt.Errorf("no exif thumbnail for %s", relativeFilePath)
+		return nil, fmt.Errorf("no exif thumbnail for %s", relativeFilePath)
 	}
-	orientTag, _ := ex.Get(exif.Orientation)
-	if orientTag == nil {
-		// No Orientation assume no rotation needed
-		w.Write(thumbBytes)
-		return nil
+	if m.exifThumbMinSide > 0 {
+		config, _, err := image.DecodeConfig(bytes.NewReader(thumbBytes))
+		if err != nil {
+			return nil, fmt.Errorf("invalid exif thumbnail for %s, reason: %s", relativeFilePath, err)
+		}
+		if max(config.Width, config.Height) < m.exifThumbMinSide {
+			return nil, fmt.Errorf("exif thumbnail for %s too small (%dx%d)", relativeFilePath, config.Width, config.Height)
+		}
 	}
-	orientInt, _ := orientTag.Int(0)
-	if orientInt > 1 && orientInt < 9 {
+	return thumbBytes, nil
+}
+
+// writeEXIFThumbnail extracts the EXIF thumbnail from a JPEG file
+// and rotates it when needed (based on the EXIF orientation tag).
+// If EXIF thumbnail rotation is disabled the thumbnail is always
+// written as is. Returns err if no thumbnail exist or if it is too
+// small, see exifThumbnail.
+func (m *Media) writeEXIFThumbnail(w io.Writer, relativeFilePath string) error {
+	thumbBytes, err := m.exifThumbnail(relativeFilePath)
+	if err != nil {
+		return err
+	}
+	orientInt := m.getOrientation(relativeFilePath) // 0 if no orientation, assume no rotation needed
+	if orientInt > 1 && orientInt < 9 && !m.exifThumbNoRotate {
 		// Rotation is needed
 		img, err := imaging.Decode(bytes.NewReader(thumbBytes))
 		if err != nil {
@@ -253,24 +695,7 @@ func (m *Media) writeEXIFThumbnail(w io.Writer, relativeFilePath string) error {
 			w.Write(thumbBytes)
 			return nil
 		}
-		var outImg *image.NRGBA
-		switch orientInt {
-		case 2:
-			outImg = imaging.FlipV(img)
-		case 3:
-			outImg = imaging.Rotate180(img)
-		case 4:
-			outImg = imaging.Rotate180(imaging.FlipV(img))
-		case 5:
-			outImg = imaging.Rotate270(imaging.FlipV(img))
-		case 6:
-			outImg = imaging.Rotate270(img)
-		case 7:
-			outImg = imaging.Rotate90(imaging.FlipV(img))
-		case 8:
-			outImg = imaging.Rotate90(img)
-		}
-		imaging.Encode(w, outImg, imaging.JPEG)
+		imaging.Encode(w, applyOrientation(img, orientInt), imaging.JPEG)
 	} else {
 		// No rotation is needed
 		w.Write(thumbBytes)
@@ -278,6 +703,24 @@ func (m *Media) writeEXIFThumbnail(w io.Writer, relativeFilePath string) error {
 	return nil
 }
 
+// getEXIFThumbnailOrientation returns the EXIF orientation (2-8) of
+// the media when its thumbnail is an embedded EXIF thumbnail that is
+// written without rotation, i.e. the client needs to rotate it.
+// Returns 0 in all other cases.
+func (m *Media) getEXIFThumbnailOrientation(relativeFilePath string) int {
+	if m.ignoreExifThumbs || !m.exifThumbNoRotate {
+		return 0
+	}
+	if _, err := m.exifThumbnail(relativeFilePath); err != nil {
+		return 0
+	}
+	orientInt := m.getOrientation(relativeFilePath)
+	if orientInt > 1 && orientInt < 9 {
+		return orientInt
+	}
+	return 0
+}
+
 // writeThumbnail writes thumbnail for media to w.
 //
 // It has following sequence/priority:
@@ -286,7 +729,7 @@ func (m *Media) writeEXIFThumbnail(w io.Writer, relativeFilePath string) error {
 //  3. Generate a thumbnail to cache and write
 //  4. If all above fails return error
 func (m *Media) writeThumbnail(w io.Writer, relativeFilePath string) error {
-	if !isImage(relativeFilePath) && !isVideo(relativeFilePath) {
+	if !m.isImage(relativeFilePath) && !m.isVideo(relativeFilePath) {
 		return fmt.Errorf("not a supported media type")
 	}
 	if !m.ignoreExifThumbs && m.writeEXIFThumbnail(w, relativeFilePath) == nil {
@@ -297,7 +740,12 @@ func (m *Media) writeThumbnail(w io.Writer, relativeFilePath string) error {
 	}
 
 	// No EXIF, check thumb cache (and generate if necessary)
+	releaseSlot := func() {}
+	if relativeThumbPath, err := m.cache.relativeThumbnailPath(relativeFilePath); err == nil {
+		releaseSlot = m.waitGenerationSlot(relativeFilePath, m.cache.thumbnails, relativeThumbPath)
+	}
 	thumbFileName, err := m.cache.generateThumbnail(m, relativeFilePath)
+	releaseSlot() // Not needed when writing to the (possibly slow) client
 	if err != nil {
 		return err // Logging handled in generateThumbnail
 	}
@@ -316,24 +764,143 @@ func (m *Media) writeThumbnail(w io.Writer, relativeFilePath string) error {
 	return nil
 }
 
+// waitGenerationSlot limits the number of thumbnails and previews that
+// are generated at once when requested by clients, to keep the server
+// responsive when a page with many uncached thumbnails is loaded. If the
+// cache file has to be generated it waits for a free slot. Cached files
+// are provided without waiting. Call the returned function to release the
+// slot as soon as the cache file is generated, i.e. before it is written
+// to the client.
+func (m *Media) waitGenerationSlot(relativeFilePath string, entries map[string]time.Time, relativeCachePath string) func() {
+	if m.generationSlots == nil || m.cache.isUpToDate(m, relativeFilePath, entries, relativeCachePath) {
+		return func() {}
+	}
+	m.generationSlots <- struct{}{}
+	return func() { <-m.generationSlots }
+}
+
+// cacheAvailable returns true if there is a cache and its path is
+// available, see Cache.isAvailable. Thumbnails and previews are not
+// generated when false.
+func (m *Media) cacheAvailable() bool {
+	return m.cache != nil && m.cache.isAvailable()
+}
+
+// ClearedErrors is the result of clearing error indication files
+type ClearedErrors struct {
+	NbrOfClearedErrors int
+}
+
+// clearErrors removes the error indication files of the media files in
+// a folder (and optionally its sub folders), so that failed thumbnails
+// and previews are generated again.
+func (m *Media) clearErrors(relativeFolderPath string, recursive bool) (ClearedErrors, error) {
+	if m.cache == nil {
+		return ClearedErrors{}, fmt.Errorf("cache disabled")
+	}
+	fullPath, err := m.getFullMediaPath(relativeFolderPath)
+	if err != nil {
+		return ClearedErrors{}, err
+	}
+	if !isDir(fullPath) {
+		return ClearedErrors{}, fmt.Errorf("not a folder: %s", relativeFolderPath)
+	}
+	nbrOfClearedErrors, err := m.cache.clearErrorIndications(relativeFolderPath, recursive)
+	if nbrOfClearedErrors > 0 {
+		log.Infof("Cleared %d error indication files in %s", nbrOfClearedErrors, fullPath)
+	}
+	return ClearedErrors{NbrOfClearedErrors: nbrOfClearedErrors}, err
+}
+
+// writeAlbumThumbnail writes the album thumbnail of a folder to w. The
+// album thumbnails are generated when the cache is generated, so an
+// error is returned if none has been generated yet.
+func (m *Media) writeAlbumThumbnail(w io.Writer, relativeFolderPath string) error {
+	if !m.enableThumbCache || !m.cache.genAlbumThumbs {
+		return fmt.Errorf("album thumbnails disabled")
+	}
+	fullPath, err := m.getFullMediaPath(relativeFolderPath)
+	if err != nil {
+		return err
+	}
+	if !isDir(fullPath) {
+		return fmt.Errorf("not a folder: %s", relativeFolderPath)
+	}
+	albumPath, ok := m.cache.latestAlbumThumbnail(relativeFolderPath)
+	if !ok {
+		return fmt.Errorf("no album thumbnail for %s", relativeFolderPath)
+	}
+	thumbFileName, err := m.cache.previewPathFormat(albumPath, previewFormatJPEG)
+	if err != nil {
+		return err
+	}
+	thumbFile, err := os.Open(thumbFileName)
+	if err != nil {
+		return err
+	}
+	defer thumbFile.Close()
+
+	_, err = io.Copy(w, thumbFile)
+	return err
+}
+
 // getImageWidthAndHeight returns the width and height of an image.
 // Returns error if the width and height could not be determined.
 func (m *Media) getImageWidthAndHeight(fullMediaPath string) (int, int, error) {
-	img, err := imaging.Open(fullMediaPath)
+	img, err := openImage(fullMediaPath, m.maxImagePixels, m.forceRotate)
 	if err != nil {
 		return 0, 0, fmt.Errorf("unable to open image %s, reason: %s", fullMediaPath, err)
 	}
 	return img.Bounds().Dx(), img.Bounds().Dy(), nil
 }
 
-// writePreview writes preview image for media to w.
+// openImage opens an image with EXIF orientation applied. If forceRotate
+// is true the orientation in the .orientation file of the folder (if
+// listed there) is used instead, see readForcedOrientation. The dimensions
+// in the image header are checked first, so that images with more than
+// maxPixels pixels (if positive) are rejected before the memory for the
+// whole image is allocated.
+func openImage(fullPath string, maxPixels int, forceRotate bool) (image.Image, error) {
+	if maxPixels > 0 {
+		file, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		config, _, err := image.DecodeConfig(file)
+		file.Close()
+		if err == nil && int64(config.Width)*int64(config.Height) > int64(maxPixels) {
+			return nil, fmt.Errorf("image too large (%dx%d pixels, max is %d pixels)",
+				config.Width, config.Height, maxPixels)
+		}
+	}
+	if forceRotate {
+		if orientation := readForcedOrientation(fullPath); orientation > 0 {
+			img, err := imaging.Open(fullPath)
+			if err != nil {
+				return nil, err
+			}
+			return applyOrientation(img, orientation), nil
+		}
+	}
+	return imaging.Open(fullPath, imaging.AutoOrientation(true))
+}
+
+// writePreview writes preview image for media to w in the provided
+// format (previewFormatJPEG, previewFormatAVIF or previewFormatPNG).
 //
 // It has following sequence/priority:
 //  1. Write a cached preview file exist
 //  2. Generate a preview in cache and write
 //  3. If all above fails return error
-func (m *Media) writePreview(w io.Writer, relativeFilePath string) error {
-	if !isImage(relativeFilePath) {
+func (m *Media) writePreview(w io.Writer, relativeFilePath string, format string) error {
+	return m.writePreviewSize(w, relativeFilePath, format, 0)
+}
+
+// writePreviewSize is similar to writePreview but writes a preview with
+// the allowed size closest to maxSide, see previewSizeOf. 0 means the
+// configured preview size.
+func (m *Media) writePreviewSize(w io.Writer, relativeFilePath string, format string, maxSide int) error {
+	if !m.isImage(relativeFilePath) {
 		return fmt.Errorf("only images support preview")
 	}
 	if !m.enablePreview {
@@ -341,7 +908,54 @@ func (m *Media) writePreview(w io.Writer, relativeFilePath string) error {
 	}
 
 	// Check preview cache (and generate if necessary)
+	if maxSide > 0 {
+		maxSide = m.cache.previewSizeOf(maxSide)
+	}
+	releaseSlot := func() {}
+	if relativePreviewPath, err := m.cache.relativePreviewPathSize(relativeFilePath, format, maxSide); err == nil {
+		releaseSlot = m.waitGenerationSlot(relativeFilePath, m.cache.previews, relativePreviewPath)
+	}
+	previewFileName, _, err := m.cache.generatePreviewSize(m, relativeFilePath, format, maxSide)
+	releaseSlot()
+	if err != nil {
+		return err // Logging handled in generatePreview
+	}
+
+	previewFile, err := os.Open(previewFileName)
+	if err != nil {
+		return err
+	}
+	defer previewFile.Close()
+
+	_, err = io.Copy(w, previewFile)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeVideoPreview writes the animated GIF preview for a video to w.
+//
+// It has following sequence/priority:
+//  1. Write a cached video preview file exist
+//  2. Generate a video preview in cache and write
+//  3. If all above fails return error
+func (m *Media) writeVideoPreview(w io.Writer, relativeFilePath string) error {
+	if !m.isVideo(relativeFilePath) {
+		return fmt.Errorf("not a video")
+	}
+	if !m.enablePreview {
+		return fmt.Errorf("preview disabled")
+	}
+
+	// Check preview cache (and generate if necessary)
+	releaseSlot := func() {}
+	if relativePreviewPath, err := m.cache.relativePreviewPath(relativeFilePath); err == nil {
+		releaseSlot = m.waitGenerationSlot(relativeFilePath, m.cache.previews, relativePreviewPath)
+	}
 	previewFileName, _, err := m.cache.generatePreview(m, relativeFilePath)
+	releaseSlot()
 	if err != nil {
 		return err // Logging handled in generatePreview
 	}
@@ -353,10 +967,123 @@ func (m *Media) writePreview(w io.Writer, relativeFilePath string) error {
 	defer previewFile.Close()
 
 	_, err = io.Copy(w, previewFile)
+	return err
+}
+
+// ProgressiveImage is what a client needs for progressive loading of an
+// image, i.e. a tiny placeholder shown immediately and the preview URL.
+type ProgressiveImage struct {
+	Placeholder string // Low quality image placeholder (LQIP) as a data URI
+	Preview     string // URL of the preview (or the original image)
+}
+
+// lqipMaxSide is the max width/height of a low quality image placeholder
+const lqipMaxSide = 16
+
+// writeLQIP writes a low quality image placeholder (LQIP), i.e. a tiny
+// blurred JPEG, for an image to w. The thumbnail is used as source.
+func (m *Media) writeLQIP(w io.Writer, relativeFilePath string) error {
+	if !m.isImage(relativeFilePath) {
+		return fmt.Errorf("only images support placeholders")
+	}
+	var thumbBuffer bytes.Buffer
+	err := m.writeThumbnail(&thumbBuffer, relativeFilePath)
 	if err != nil {
 		return err
 	}
+	img, err := imaging.Decode(&thumbBuffer)
+	if err != nil {
+		return err
+	}
+	img = imaging.Fit(img, lqipMaxSide, lqipMaxSide, imaging.Box)
+	img = imaging.Blur(img, 0.8)
+	return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(50))
+}
 
+// deleteMedia removes a media file including its cached thumbnail,
+// previews and error indication files. If a trash path is configured
+// they are moved to the trash instead, see moveToTrash. Returns an error
+// satisfying os.IsNotExist if the media file doesn't exist.
+func (m *Media) deleteMedia(relativeFilePath string) error {
+	if m.getFileType(relativeFilePath) == "" {
+		return fmt.Errorf("not a supported media type")
+	}
+	fullMediaPath, err := m.getFullMediaPath(relativeFilePath)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := os.Stat(fullMediaPath)
+	if err != nil {
+		return err
+	}
+	if fileInfo.IsDir() {
+		return fmt.Errorf("%s is a directory", relativeFilePath)
+	}
+	if m.trashPath != "" {
+		err = m.moveToTrash(relativeFilePath, fullMediaPath)
+	} else {
+		err = os.Remove(fullMediaPath)
+		if err == nil {
+			log.Info("Deleted ", fullMediaPath)
+			if m.cache != nil {
+				m.cache.removeCacheFiles(relativeFilePath)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	m.invalidateDateIndex()
+	m.removeRecent(relativeFilePath)
+	m.removeTags(relativeFilePath)
+	return nil
+}
+
+// moveMedia moves (renames) a media file or folder, including its cache
+// files. Returns an error satisfying os.IsNotExist if the source doesn't
+// exist and os.IsExist if the destination already exist.
+func (m *Media) moveMedia(fromRelativePath, toRelativePath string) error {
+	fromRelativePath = filepath.ToSlash(filepath.Clean(fromRelativePath))
+	toRelativePath = filepath.ToSlash(filepath.Clean(toRelativePath))
+	fromFullPath, err := m.getFullMediaPath(fromRelativePath)
+	if err != nil {
+		return err
+	}
+	toFullPath, err := m.getFullMediaPath(toRelativePath)
+	if err != nil {
+		return err
+	}
+	if fromFullPath == m.mediaPath || toFullPath == m.mediaPath {
+		return fmt.Errorf("not allowed to move the media root")
+	}
+	fileInfo, err := os.Stat(fromFullPath)
+	if err != nil {
+		return err
+	}
+	isFolder := fileInfo.IsDir()
+	if !isFolder && (m.getFileType(fromRelativePath) == "" || m.getFileType(toRelativePath) == "") {
+		return fmt.Errorf("not a supported media type")
+	}
+	if _, err = os.Stat(toFullPath); err == nil {
+		return &os.PathError{Op: "move", Path: toRelativePath, Err: os.ErrExist}
+	}
+	err = os.MkdirAll(filepath.Dir(toFullPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(fromFullPath, toFullPath)
+	if err != nil {
+		return err
+	}
+	log.Infof("Moved %s to %s", fromFullPath, toFullPath)
+	m.invalidateDateIndex()
+	m.removeRecent(fromRelativePath)
+	m.addRecentPath(toRelativePath)
+	m.removeTags(fromRelativePath)
+	m.addTagsPath(toRelativePath)
+	if m.cache != nil {
+		m.cache.moveCacheFiles(fromRelativePath, toRelativePath, isFolder)
+	}
 	return nil
 }
 
@@ -369,78 +1096,230 @@ type PreCacheStatistics struct {
 	NbrOfImageThumb         int
 	NbrOfVideoThumb         int
 	NbrOfImagePreview       int
-	NbrOfAlbumImagePreview  int
+	NbrOfVideoPreview       int
+	NbrOfAlbumThumb         int
 	NbrOfFailedFolders      int // I.e. unable to list contents of folder
 	NbrOfFailedImageThumb   int
 	NbrOfFailedVideoThumb   int
 	NbrOfFailedImagePreview int
+	NbrOfFailedVideoPreview int
+	NbrOfFailedAlbumThumb   int
 	NbrOfSmallImages        int // Don't require any preview
 	NbrRemovedCacheFiles    int
+	Cancelled               bool // Generation stopped before all files were processed
+}
+
+// PreCacheProgress is the accumulated progress of an ongoing
+// thumbnail/preview generation
+type PreCacheProgress struct {
+	NbrOfFolders int    // Number of folders done
+	NbrOfImages  int    // Number of images processed
+	NbrOfVideos  int    // Number of videos processed
+	CurrentPath  string // Path of the last processed file or folder
 }
 
 func (m *Media) isPreCacheInProgress() bool {
 	return m.preCacheInProgress
 }
 
+// startProgress marks that a thumbnail/preview generation is in progress
+// and resets the progress. Returns a context that is cancelled by
+// cancelPreCacheInProgress and true. Returns ctx and false if a generation
+// already was in progress, i.e. if this is a recursive call.
+func (m *Media) startProgress(ctx context.Context, relativePath string) (context.Context, bool) {
+	m.progressMutex.Lock()
+	defer m.progressMutex.Unlock()
+	if m.preCacheInProgress {
+		return ctx, false
+	}
+	m.preCacheInProgress = true
+	m.progress = PreCacheProgress{CurrentPath: relativePath}
+	ctx, m.cancelPreCache = context.WithCancel(ctx)
+	return ctx, true
+}
+
+// stopProgress marks that the thumbnail/preview generation is done and
+// closes all progress listener channels. Shall only be called if
+// startProgress returned true.
+func (m *Media) stopProgress() {
+	m.progressMutex.Lock()
+	defer m.progressMutex.Unlock()
+	m.preCacheInProgress = false
+	if m.cancelPreCache != nil {
+		m.cancelPreCache() // Release the context
+		m.cancelPreCache = nil
+	}
+	for listener := range m.progressListeners {
+		close(listener)
+		delete(m.progressListeners, listener)
+	}
+}
+
+// cancelPreCacheInProgress cancels the ongoing thumbnail/preview
+// generation. Already generated thumbnails and previews are kept.
+// Returns false if no generation is in progress.
+func (m *Media) cancelPreCacheInProgress() bool {
+	m.progressMutex.Lock()
+	defer m.progressMutex.Unlock()
+	if !m.preCacheInProgress || m.cancelPreCache == nil {
+		return false
+	}
+	log.Info("Cancelling thumbnail/preview generation")
+	m.cancelPreCache()
+	return true
+}
+
+// reportProgress updates the progress with a processed file or folder
+// and sends the result to all progress listeners.
+func (m *Media) reportProgress(file File) {
+	m.progressMutex.Lock()
+	defer m.progressMutex.Unlock()
+	switch file.Type {
+	case "folder":
+		m.progress.NbrOfFolders++
+	case "image":
+		m.progress.NbrOfImages++
+	case "video":
+		m.progress.NbrOfVideos++
+	}
+	m.progress.CurrentPath = file.Path
+	for listener := range m.progressListeners {
+		select {
+		case listener <- m.progress:
+		default:
+			// Listener is busy. It will get the next update instead.
+		}
+	}
+}
+
+// subscribeProgress returns a channel that will receive progress updates
+// until the ongoing thumbnail/preview generation is done, when the channel
+// is closed. Returns false if no generation is in progress.
+func (m *Media) subscribeProgress() (chan PreCacheProgress, bool) {
+	m.progressMutex.Lock()
+	defer m.progressMutex.Unlock()
+	if !m.preCacheInProgress {
+		return nil, false
+	}
+	listener := make(chan PreCacheProgress, 10)
+	m.progressListeners[listener] = true
+	return listener, true
+}
+
+// unsubscribeProgress stops progress updates to a channel retrieved by
+// subscribeProgress. It is ok to call this function even if the channel
+// already has been closed.
+func (m *Media) unsubscribeProgress(listener chan PreCacheProgress) {
+	m.progressMutex.Lock()
+	defer m.progressMutex.Unlock()
+	if m.progressListeners[listener] {
+		close(listener)
+		delete(m.progressListeners, listener)
+	}
+}
+
+// getProgress returns the progress of the ongoing (or last) thumbnail/
+// preview generation and true if a generation is in progress
+func (m *Media) getProgress() (PreCacheProgress, bool) {
+	m.progressMutex.Lock()
+	defer m.progressMutex.Unlock()
+	return m.progress, m.preCacheInProgress
+}
+
 func (m *Media) generateCache(relativePath string, recursive bool, thumbnails bool, preview bool) *PreCacheStatistics {
-	return m.updateCache(m.cache, relativePath, recursive, thumbnails, preview)
+	return m.updateCache(context.Background(), m.cache, relativePath, recursive, thumbnails, preview)
 }
 
 // updateCache recursively (optional) goes through all files
 // relativePath and its subdirectories and generates thumbnails and
 // previews for these. If relativePath is "" it means generate for all files.
-func (m *Media) updateCache(c *Cache, relativePath string, recursive bool, thumbnails bool, preview bool) *PreCacheStatistics {
-	prevProgress := m.preCacheInProgress
-	m.preCacheInProgress = true
-	defer func() { m.preCacheInProgress = prevProgress }()
+// The generation stops (keeping what is generated so far) when ctx is done
+// or when cancelled using cancelPreCacheInProgress.
+func (m *Media) updateCache(ctx context.Context, c *Cache, relativePath string, recursive bool, thumbnails bool,
+	preview bool) *PreCacheStatistics {
+	ctx, started := m.startProgress(ctx, relativePath)
+	if started {
+		defer m.stopProgress()
+	}
+
+	stat, subFolders := m.updateFolderCache(ctx, c, relativePath, thumbnails, preview)
+	if !recursive {
+		return stat
+	}
+	for _, subFolder := range subFolders {
+		if ctx.Err() != nil {
+			stat.Cancelled = true
+			return stat
+		}
+		stat.NbrOfFolders++
+		stat.add(m.updateCache(ctx, c, subFolder, true, thumbnails, preview)) // Recursive
+	}
+	return stat
+}
+
+// add adds the statistics of another folder
+func (stat *PreCacheStatistics) add(other *PreCacheStatistics) {
+	stat.NbrOfFolders += other.NbrOfFolders
+	stat.NbrOfImages += other.NbrOfImages
+	stat.NbrOfVideos += other.NbrOfVideos
+	stat.NbrOfExif += other.NbrOfExif
+	stat.NbrOfImageThumb += other.NbrOfImageThumb
+	stat.NbrOfVideoThumb += other.NbrOfVideoThumb
+	stat.NbrOfImagePreview += other.NbrOfImagePreview
+	stat.NbrOfVideoPreview += other.NbrOfVideoPreview
+	stat.NbrOfAlbumThumb += other.NbrOfAlbumThumb
+	stat.NbrOfFailedFolders += other.NbrOfFailedFolders
+	stat.NbrOfFailedImageThumb += other.NbrOfFailedImageThumb
+	stat.NbrOfFailedVideoThumb += other.NbrOfFailedVideoThumb
+	stat.NbrOfFailedImagePreview += other.NbrOfFailedImagePreview
+	stat.NbrOfFailedVideoPreview += other.NbrOfFailedVideoPreview
+	stat.NbrOfFailedAlbumThumb += other.NbrOfFailedAlbumThumb
+	stat.NbrOfSmallImages += other.NbrOfSmallImages
+	stat.NbrRemovedCacheFiles += other.NbrRemovedCacheFiles
+	stat.Cancelled = stat.Cancelled || other.Cancelled
+}
 
+// updateFolderCache generates thumbnails and previews for the files in
+// relativePath (not its sub folders) and the album thumbnail of the
+// folder. Returns the statistics and the relative paths of the sub
+// folders.
+func (m *Media) updateFolderCache(ctx context.Context, c *Cache, relativePath string, thumbnails bool,
+	preview bool) (*PreCacheStatistics, []string) {
 	topFiles := []string{}
+	subFolders := []string{}
 	stat := PreCacheStatistics{}
 	files, err := m.getFiles(relativePath)
 	if err != nil {
 		stat.NbrOfFailedFolders = 1
-		return &stat
+		return &stat, subFolders
 	}
 	for _, file := range files {
+		if ctx.Err() != nil {
+			stat.Cancelled = true
+			return &stat, subFolders
+		}
 		if file.Type == "folder" {
-			if recursive {
-				stat.NbrOfFolders++
-				newStat := m.updateCache(c, file.Path, true, thumbnails, preview) // Recursive
-				stat.NbrOfFolders += newStat.NbrOfFolders
-				stat.NbrOfImages += newStat.NbrOfImages
-				stat.NbrOfVideos += newStat.NbrOfVideos
-				stat.NbrOfExif += newStat.NbrOfExif
-				stat.NbrOfImageThumb += newStat.NbrOfImageThumb
-				stat.NbrOfVideoThumb += newStat.NbrOfVideoThumb
-				stat.NbrOfImagePreview += newStat.NbrOfImagePreview
-				stat.NbrOfFailedFolders += newStat.NbrOfFailedFolders
-				stat.NbrOfFailedImageThumb += newStat.NbrOfFailedImageThumb
-				stat.NbrOfFailedVideoThumb += newStat.NbrOfFailedVideoThumb
-				stat.NbrOfFailedImagePreview += newStat.NbrOfFailedImagePreview
-				stat.NbrOfSmallImages += newStat.NbrOfSmallImages
-				stat.NbrRemovedCacheFiles += newStat.NbrRemovedCacheFiles
-			}
+			subFolders = append(subFolders, file.Path)
 		} else {
 			if file.Type == "image" {
 				stat.NbrOfImages++
 			} else if file.Type == "video" {
 				stat.NbrOfVideos++
 			}
+			m.reportProgress(file)
+			m.addRecent(file)
+			m.addTags(file.Path)
 			// Check if file has EXIF thumbnail
 			hasExifThumb := false
 			if !m.ignoreExifThumbs {
-				ex := m.extractEXIF(file.Path)
-				if ex != nil {
-					_, err := ex.JpegThumbnail()
-					if err == nil {
-						// Media has EXIF thumbnail
-						stat.NbrOfExif++
-						hasExifThumb = true
-					}
+				if _, err := m.exifThumbnail(file.Path); err == nil {
+					// Media has EXIF thumbnail (large enough)
+					stat.NbrOfExif++
+					hasExifThumb = true
 				}
 			}
 
-			if thumbnails && !hasExifThumb && !c.hasThumbnail(file.Path) {
+			if thumbnails && !hasExifThumb && (!c.hasThumbnail(file.Path) || c.isThumbnailStale(m, file.Path)) {
 				// Generate new thumbnail
 				_, err = c.generateThumbnail(m, file.Path)
 				if err != nil {
@@ -458,7 +1337,7 @@ func (m *Media) updateCache(c *Cache, relativePath string, recursive bool, thumb
 				}
 			}
 
-			if preview && file.Type == "image" && !c.hasPreview(file.Path) {
+			if preview && file.Type == "image" && (!c.hasPreview(file.Path) || c.isPreviewStale(m, file.Path)) {
 				// Generate new preview
 				_, tooSmall, err := c.generatePreview(m, file.Path)
 				if err != nil {
@@ -472,20 +1351,37 @@ func (m *Media) updateCache(c *Cache, relativePath string, recursive bool, thumb
 				}
 			}
 
+			// Video previews requires ffmpeg
+			if preview && file.Type == "video" && c.hasVideoThumbnailSupport() &&
+				(!c.hasPreview(file.Path) || c.isPreviewStale(m, file.Path)) {
+				// Generate new video preview
+				_, _, err := c.generatePreview(m, file.Path)
+				if err != nil {
+					stat.NbrOfFailedVideoPreview++
+				} else {
+					stat.NbrOfVideoPreview++
+				}
+			}
+
 			if len(topFiles) < 9 && c.genAlbumThumbs && (hasExifThumb || c.hasThumbnail(file.Path)) {
 				topFiles = append(topFiles, file.Name)
 			}
 		}
 	}
 
+	if ctx.Err() != nil {
+		stat.Cancelled = true
+		return &stat, subFolders
+	}
+
 	if len(topFiles) != 0 {
 		relativeAlbumPreviewPath := c.relativeAlbumThumbnailPath(relativePath, topFiles)
 		if !c.hasAlbumThumbnail(relativeAlbumPreviewPath) {
 			err := c.generateAlbumThumbnail(m, relativeAlbumPreviewPath, relativePath, topFiles)
 			if err != nil {
-				stat.NbrOfFailedImagePreview++
+				stat.NbrOfFailedAlbumThumb++
 			} else {
-				stat.NbrOfAlbumImagePreview++
+				stat.NbrOfAlbumThumb++
 				files = append(files, File{Type: "image", Name: filepath.Base(relativeAlbumPreviewPath), Path: relativeAlbumPreviewPath})
 			}
 		} else {
@@ -496,15 +1392,29 @@ func (m *Media) updateCache(c *Cache, relativePath string, recursive bool, thumb
 	if m.enableCacheCleanup {
 		stat.NbrRemovedCacheFiles += c.cleanupCache(relativePath, files)
 	}
-	return &stat
+	m.reportProgress(File{Type: "folder", Name: filepath.Base(relativePath), Path: relativePath})
+	return &stat, subFolders
 }
 
 // generateAllCache goes through all files in the media path
-// and generates thumbnails/preview for these
-func (m *Media) generateAllCache(thumbnails, preview bool) {
+// and generates thumbnails/preview for these. Folders browsed meanwhile
+// are processed first, see prioritizeFolder. The generation stops when
+// ctx is done or when cancelled using cancelPreCacheInProgress.
+func (m *Media) generateAllCache(ctx context.Context, thumbnails, preview bool) {
 	log.Infof("Pre-generating cache (thumbnails: %t, preview: %t)", thumbnails, preview)
 	startTime := time.Now().UnixNano()
-	stat := m.generateCache("", true, thumbnails, preview)
+	var stat *PreCacheStatistics
+	if m.preCacheQueue != nil {
+		stat = m.updateCacheQueue(ctx, m.cache, thumbnails, preview)
+	} else {
+		stat = m.updateCache(ctx, m.cache, "", true, thumbnails, preview)
+	}
+	if stat.Cancelled {
+		log.Info("Generating cache cancelled")
+	} else {
+		// All media files visited
+		m.setRecentIndexed()
+	}
 	deltaTime := (time.Now().UnixNano() - startTime) / int64(time.Second)
 	minutes := int(deltaTime / 60)
 	seconds := int(deltaTime) - minutes*60
@@ -516,10 +1426,34 @@ func (m *Media) generateAllCache(thumbnails, preview bool) {
 	log.Info("Number of generated image thumbnails: ", stat.NbrOfImageThumb)
 	log.Info("Number of generated video thumbnails: ", stat.NbrOfVideoThumb)
 	log.Info("Number of generated image previews: ", stat.NbrOfImagePreview)
+	log.Info("Number of generated video previews: ", stat.NbrOfVideoPreview)
+	log.Info("Number of generated album thumbnails: ", stat.NbrOfAlbumThumb)
 	log.Info("Number of failed folders: ", stat.NbrOfFailedFolders)
 	log.Info("Number of failed image thumbnails: ", stat.NbrOfFailedImageThumb)
 	log.Info("Number of failed video thumbnails: ", stat.NbrOfFailedVideoThumb)
 	log.Info("Number of failed image previews: ", stat.NbrOfFailedImagePreview)
+	log.Info("Number of failed video previews: ", stat.NbrOfFailedVideoPreview)
+	log.Info("Number of failed album thumbnails: ", stat.NbrOfFailedAlbumThumb)
 	log.Info("Number of small images not require preview: ", stat.NbrOfSmallImages)
 	log.Info("Number of removed cache files: ", stat.NbrRemovedCacheFiles)
+	if m.cache != nil && m.cache.isEvictionEnabled() {
+		log.Info("Number of evicted cache files: ", m.cache.evict())
+	}
+	m.setReady()
+}
+
+// setReady marks that the thumbnail/preview generation on startup is
+// done (or cancelled), see isReady
+func (m *Media) setReady() {
+	m.progressMutex.Lock()
+	m.ready = true
+	m.progressMutex.Unlock()
+}
+
+// isReady returns false while the thumbnail/preview generation on
+// startup is in progress, and true otherwise
+func (m *Media) isReady() bool {
+	m.progressMutex.Lock()
+	defer m.progressMutex.Unlock()
+	return m.ready
 }
@@ -3,10 +3,25 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/cozy/goexif2/exif"
+	"github.com/disintegration/imaging"
 )
 
 type timerType struct {
@@ -28,28 +43,170 @@ func LogTime(t *testing.T, whatWasMeasured string) {
 }
 
 func TestGetFiles(t *testing.T) {
-	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 	files, err := media.getFiles("")
 	assertExpectNoErr(t, "", err)
 	assertTrue(t, "No files found", len(files) > 5)
 }
 
+func TestGetFilesExtensions(t *testing.T) {
+	// Only PNG images and MP4 videos
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{imageExtensions: []string{".png"}, videoExtensions: []string{".mp4"}})
+	files, err := media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	for _, file := range files {
+		if file.Type != "folder" && file.Name != "png.png" && file.Name != "video.mp4" && file.Name != "invalidvideo.mp4" {
+			t.Errorf("Unexpected file %s", file.Name)
+		}
+	}
+	assertEqualsStr(t, "", "image", media.getFileType("image.PNG"))
+	assertEqualsStr(t, "", "", media.getFileType("image.jpg"))
+	assertEqualsStr(t, "", "video", media.getFileType("video.mp4"))
+	assertEqualsStr(t, "", "", media.getFileType("video.mov"))
+
+	// Defaults
+	media = createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	assertEqualsStr(t, "", "image", media.getFileType("image.jpg"))
+	assertEqualsStr(t, "", "image", media.getFileType("image.BMP"))
+	assertEqualsStr(t, "", "video", media.getFileType("video.mov"))
+	assertEqualsStr(t, "", "video", media.getFileType("video.webm"))
+	assertEqualsStr(t, "", "", media.getFileType("video.ogv"))
+}
+
+func TestBMP(t *testing.T) {
+	tmp := "tmpout/TestBMP"
+	os.RemoveAll(tmp)
+	os.MkdirAll(tmp, os.ModePerm)
+	img, err := imaging.Open("testmedia/png.png")
+	assertExpectNoErr(t, "", err)
+	err = imaging.Save(img, tmp+"/bmp.bmp")
+	assertExpectNoErr(t, "", err)
+
+	media := createMedia(tmp, tmp+"/cache", true, false, false, false, true, true, true, 1280, false, false, false, false, mediaOptions{})
+	width, height, err := media.getImageWidthAndHeight(tmp + "/bmp.bmp")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "image width", 1632, width)
+	assertEqualsInt(t, "image height", 1224, height)
+
+	tGenerateImageThumbnail(t, media, tmp+"/bmp.bmp", tmp+"/bmp.thumb.jpg")
+	tGenerateImagePreview(t, media, tmp+"/bmp.bmp", tmp+"/bmp.preview.jpg")
+}
+
 func TestGetFilesInvalid(t *testing.T) {
-	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 	files, err := media.getFiles("invalidfolder")
 	assertExpectErr(t, "invalid path shall give errors", err)
 	assertTrue(t, "Should not find any files", len(files) == 0)
 }
 
 func TestGetFilesHacker(t *testing.T) {
-	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 	files, err := media.getFiles("../..")
 	assertExpectErr(t, "hacker path shall give errors", err)
 	assertTrue(t, "Should not find any files", len(files) == 0)
 }
 
+func TestGetFilesGroupSidecars(t *testing.T) {
+	mediaPath := "tmpout/TestGetFilesGroupSidecars"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/tiff.tiff", mediaPath+"/IMG_1234.tiff")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/IMG_1234.JPG")
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/IMG_1234.CR2")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/IMG_1234.mp4")
+	copyFile(t, "testmedia/png.png", mediaPath+"/IMG_1235.png")
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/IMG_1235.xmp")
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/IMG_1236.CR2")
+
+	media := createMedia(mediaPath, ".", false, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{groupSidecars: true})
+	files, err := media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 3, len(files))
+	assertEqualsStr(t, "", "IMG_1234.JPG", files[0].Name)
+	assertEqualsStr(t, "", ".tiff,.CR2", strings.Join(files[0].Sidecars, ","))
+	assertEqualsStr(t, "", "IMG_1234.mp4", files[1].Name) // Videos are not grouped
+	assertEqualsInt(t, "", 0, len(files[1].Sidecars))
+	assertEqualsStr(t, "", "IMG_1235.png", files[2].Name)
+	assertEqualsStr(t, "", ".xmp", strings.Join(files[2].Sidecars, ","))
+
+	// Disabled
+	media = createMedia(mediaPath, ".", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	files, err = media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 4, len(files))
+	for _, file := range files {
+		assertEqualsInt(t, file.Name, 0, len(file.Sidecars))
+	}
+}
+
+func TestGetFilesSkipHidden(t *testing.T) {
+	mediaPath := "tmpout/TestGetFilesSkipHidden"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/.hiddendir", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/.hidden.jpg")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/.hiddendir/jpeg.jpg")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/visible.jpg")
+
+	media := createMedia(mediaPath, ".", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	files, err := media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, len(files))
+	assertEqualsStr(t, "", "visible.jpg", files[0].Name)
+
+	// Disabled
+	media = createMedia(mediaPath, ".", false, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{showHidden: true})
+	files, err = media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 3, len(files))
+	assertEqualsStr(t, "", ".hidden.jpg", files[0].Name)
+	assertEqualsStr(t, "", ".hiddendir", files[1].Name)
+	assertEqualsStr(t, "", "folder", files[1].Type)
+}
+
+func TestGetFilesLivePhotos(t *testing.T) {
+	mediaPath := "tmpout/TestGetFilesLivePhotos"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/IMG_0001.JPG")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/img_0001.mov")
+	copyFile(t, "testmedia/png.png", mediaPath+"/IMG_0002.png")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/IMG_0002.mp4")
+
+	media := createMedia(mediaPath, ".", false, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{livePhotos: true})
+	files, err := media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 4, len(files))
+	for _, file := range files {
+		if file.Name == "IMG_0001.JPG" {
+			assertEqualsStr(t, "", "img_0001.mov", file.LiveVideo)
+		} else {
+			// Only .mov videos are paired
+			assertEqualsStr(t, file.Name, "", file.LiveVideo)
+		}
+	}
+	liveVideo, err := media.getLiveVideo("IMG_0001.JPG")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "img_0001.mov", liveVideo)
+	_, err = media.getLiveVideo("IMG_0002.png")
+	assertExpectErr(t, "", err)
+
+	// Disabled
+	media = createMedia(mediaPath, ".", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	files, err = media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	for _, file := range files {
+		assertEqualsStr(t, file.Name, "", file.LiveVideo)
+	}
+	_, err = media.getLiveVideo("IMG_0001.JPG")
+	assertExpectErr(t, "", err)
+}
+
 func TestIsRotationNeeded(t *testing.T) {
-	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 
 	rotationNeeded := media.isRotationNeeded("exif_rotate/180deg.jpg")
 	assertTrue(t, "Rotation should be needed", rotationNeeded)
@@ -98,7 +255,7 @@ func TestRotateAndWrite(t *testing.T) {
 	outFileName := "tmpout/TestRotateAndWrite/jpeg_rotated_fixed.jpg"
 	os.MkdirAll("tmpout/TestRotateAndWrite", os.ModePerm) // If already exist no problem
 	os.Remove(outFileName)
-	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 	outFile, err := os.Create(outFileName)
 	assertExpectNoErr(t, "unable to create out", err)
 	defer outFile.Close()
@@ -109,6 +266,34 @@ func TestRotateAndWrite(t *testing.T) {
 	t.Logf("Manually check that %s has been rotated correctly", outFileName)
 }
 
+func TestRotateAndWriteKeepEXIF(t *testing.T) {
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	original := media.extractEXIF("jpeg_rotated.jpg")
+	assertTrue(t, "No EXIF in original", original != nil)
+	originalTime, err := original.Get(exif.DateTimeOriginal)
+	assertExpectNoErr(t, "", err)
+
+	var buffer bytes.Buffer
+	err = media.rotateAndWrite(&buffer, "jpeg_rotated.jpg")
+	assertExpectNoErr(t, "", err)
+
+	rotated, err := exif.Decode(&buffer)
+	assertExpectNoErr(t, "No EXIF in rotated image", err)
+	rotatedTime, err := rotated.Get(exif.DateTimeOriginal)
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", originalTime.String(), rotatedTime.String())
+	orientation, err := rotated.Get(exif.Orientation)
+	assertExpectNoErr(t, "", err)
+	orientationInt, _ := orientation.Int(0)
+	assertEqualsInt(t, "", 1, orientationInt)
+
+	// Invalid data
+	_, err = insertEXIF([]byte("not a jpeg"), original.Raw)
+	assertExpectErr(t, "", err)
+	_, err = insertEXIF([]byte{0xFF, 0xD8}, []byte("XX"))
+	assertExpectErr(t, "", err)
+}
+
 func tEXIFThumbnail(t *testing.T, media *Media, filename string) {
 	t.Helper()
 	inFileName := "exif_rotate/" + filename
@@ -127,7 +312,7 @@ func tEXIFThumbnail(t *testing.T, media *Media, filename string) {
 
 func TestWriteEXIFThumbnail(t *testing.T) {
 	os.MkdirAll("tmpout/TestWriteEXIFThumbnail", os.ModePerm) // If already exist no problem
-	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 
 	tEXIFThumbnail(t, media, "normal.jpg")
 	tEXIFThumbnail(t, media, "180deg.jpg")
@@ -149,9 +334,66 @@ func TestWriteEXIFThumbnail(t *testing.T) {
 	assertExpectErr(t, "No EXIF shall not have thumbnail", err)
 }
 
+func TestEXIFThumbnailNoRotate(t *testing.T) {
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{exifThumbNoRotate: true})
+
+	// Thumbnail shall be written as is
+	ex := media.extractEXIF("exif_rotate/rotate_90deg_cw.jpg")
+	thumbBytes, err := ex.JpegThumbnail()
+	assertExpectNoErr(t, "", err)
+	var b bytes.Buffer
+	err = media.writeEXIFThumbnail(&b, "exif_rotate/rotate_90deg_cw.jpg")
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "thumbnail shall not be re-encoded", bytes.Equal(thumbBytes, b.Bytes()))
+
+	assertEqualsInt(t, "", 6, media.getEXIFThumbnailOrientation("exif_rotate/rotate_90deg_cw.jpg"))
+	assertEqualsInt(t, "", 0, media.getEXIFThumbnailOrientation("exif_rotate/normal.jpg"))
+	assertEqualsInt(t, "", 0, media.getEXIFThumbnailOrientation("png.png"))
+
+	// Default is to rotate on server side
+	media = createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	b.Reset()
+	err = media.writeEXIFThumbnail(&b, "exif_rotate/rotate_90deg_cw.jpg")
+	assertExpectNoErr(t, "", err)
+	assertFalse(t, "thumbnail shall be rotated", bytes.Equal(thumbBytes, b.Bytes()))
+	assertEqualsInt(t, "", 0, media.getEXIFThumbnailOrientation("exif_rotate/rotate_90deg_cw.jpg"))
+}
+
+func TestEXIFThumbMinSide(t *testing.T) {
+	cachePath := "tmpcache/TestEXIFThumbMinSide"
+	os.RemoveAll(cachePath)
+
+	// The EXIF thumbnail of jpeg.jpg is 512x288, large enough
+	media := createMedia("testmedia", cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{exifThumbMinSide: 512})
+	var b bytes.Buffer
+	assertExpectNoErr(t, "", media.writeEXIFThumbnail(&b, "jpeg.jpg"))
+	b.Reset()
+	assertExpectNoErr(t, "", media.writeThumbnail(&b, "jpeg.jpg"))
+	img, err := imaging.Decode(&b)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "EXIF thumbnail", 512, img.Bounds().Dx())
+	assertFileNotExist(t, "", cachePath+"/jpeg.jpg.thumb.jpg")
+
+	// Too small, a thumbnail is generated instead
+	media = createMedia("testmedia", cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{exifThumbMinSide: 513, exifThumbNoRotate: true})
+	assertExpectErr(t, "", media.writeEXIFThumbnail(&b, "jpeg.jpg"))
+	b.Reset()
+	assertExpectNoErr(t, "", media.writeThumbnail(&b, "jpeg.jpg"))
+	img, err = imaging.Decode(&b)
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "Generated thumbnail", img.Bounds().Dx() <= 256)
+	assertFileExist(t, "", cachePath+"/jpeg.jpg.thumb.jpg")
+
+	// The generated thumbnail is already rotated
+	assertEqualsInt(t, "", 0, media.getEXIFThumbnailOrientation("exif_rotate/rotate_90deg_cw.jpg"))
+}
+
 func TestFullPath(t *testing.T) {
 	// Root path
-	media := createMedia(".", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia(".", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 	p, err := media.getFullMediaPath("afile.jpg")
 	assertExpectNoErr(t, "unable to get valid full path", err)
 	assertEqualsStr(t, "invalid path", "afile.jpg", p)
@@ -160,7 +402,7 @@ func TestFullPath(t *testing.T) {
 	assertExpectErr(t, "hackers shall not be allowed", err)
 
 	// Relative path
-	media = createMedia("arelative/path", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media = createMedia("arelative/path", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 	p, err = media.getFullMediaPath("afile.jpg")
 	assertExpectNoErr(t, "unable to get valid full path", err)
 	assertEqualsStr(t, "invalid path", "arelative/path/afile.jpg", p)
@@ -169,7 +411,7 @@ func TestFullPath(t *testing.T) {
 	assertExpectErr(t, "hackers shall not be allowed", err)
 
 	// Absolute path
-	media = createMedia("/root/absolute/path", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media = createMedia("/root/absolute/path", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 	p, err = media.getFullMediaPath("afile.jpg")
 	assertExpectNoErr(t, "unable to get valid full path", err)
 	assertEqualsStr(t, "invalid path", "/root/absolute/path/afile.jpg", p)
@@ -180,7 +422,7 @@ func TestFullPath(t *testing.T) {
 
 func TestRelativePath(t *testing.T) {
 	// Root path
-	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 
 	result, err := media.getRelativePath("", "")
 	assertExpectNoErr(t, "", err)
@@ -243,19 +485,19 @@ func TestRelativePath(t *testing.T) {
 }
 
 func TestThumbnailPath(t *testing.T) {
-	media := createMedia("/c/mediapath", "/d/thumbpath", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("/c/mediapath", "/d/thumbpath", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 
 	thumbPath, err := media.cache.thumbnailPath("myimage.jpg")
 	assertExpectNoErr(t, "", err)
-	assertEqualsStr(t, "", "/d/thumbpath/myimage.thumb.jpg", thumbPath)
+	assertEqualsStr(t, "", "/d/thumbpath/myimage.jpg.thumb.jpg", thumbPath)
 
 	thumbPath, err = media.cache.thumbnailPath("subdrive/myimage.jpg")
 	assertExpectNoErr(t, "", err)
-	assertEqualsStr(t, "", "/d/thumbpath/subdrive/myimage.thumb.jpg", thumbPath)
+	assertEqualsStr(t, "", "/d/thumbpath/subdrive/myimage.jpg.thumb.jpg", thumbPath)
 
 	thumbPath, err = media.cache.thumbnailPath("subdrive/myimage.png")
 	assertExpectNoErr(t, "", err)
-	assertEqualsStr(t, "", "/d/thumbpath/subdrive/myimage.thumb.jpg", thumbPath)
+	assertEqualsStr(t, "", "/d/thumbpath/subdrive/myimage.png.thumb.jpg", thumbPath)
 
 	_, err = media.cache.thumbnailPath("subdrive/myimage")
 	assertExpectErr(t, "", err)
@@ -278,7 +520,7 @@ func tGenerateImageThumbnail(t *testing.T, media *Media, inFileName, outFileName
 func TestGenerateImageThumbnail(t *testing.T) {
 	os.MkdirAll("tmpout/TestGenerateImageThumbnail", os.ModePerm) // If already exist no problem
 
-	media := createMedia("", "", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("", "", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 
 	tGenerateImageThumbnail(t, media, "testmedia/jpeg.jpg", "tmpout/TestGenerateImageThumbnail/jpeg_thumbnail.jpg")
 	tGenerateImageThumbnail(t, media, "testmedia/jpeg_rotated.jpg", "tmpout/TestGenerateImageThumbnail/jpeg_rotated_thumbnail.jpg")
@@ -295,6 +537,267 @@ func TestGenerateImageThumbnail(t *testing.T) {
 	assertExpectErr(t, "", err)
 }
 
+func TestThumbnailBackground(t *testing.T) {
+	mediaPath := "tmpout/TestThumbnailBackground"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+
+	// Transparent image with an opaque red square in the middle
+	img := imaging.New(400, 400, color.NRGBA{})
+	img = imaging.Paste(img, imaging.New(200, 200, color.NRGBA{R: 255, A: 255}), image.Pt(100, 100))
+	assertExpectNoErr(t, "", imaging.Save(img, mediaPath+"/logo.png"))
+
+	for _, background := range []string{"", "#0000ff"} {
+		media := createMedia("", "", true, false, false, false, true, true, false, 0, false, false, false, false,
+			mediaOptions{thumbBackground: background})
+		thumbPath := mediaPath + "/logo" + background + ".thumb.jpg"
+		assertExpectNoErr(t, "", media.cache.generateImageThumbnail(mediaPath+"/logo.png", thumbPath))
+		thumb, err := imaging.Open(thumbPath)
+		assertExpectNoErr(t, "", err)
+		expected := color.Color(color.White)
+		if background != "" {
+			expected = color.NRGBA{B: 255, A: 255}
+		}
+		assertTrue(t, background, colorDistance(expected, thumb.At(2, 2)) < 15)
+		assertTrue(t, background, colorDistance(expected, thumb.At(253, 253)) < 15)
+		assertTrue(t, background, colorDistance(color.NRGBA{R: 255, A: 255}, thumb.At(128, 128)) < 15)
+	}
+}
+
+func TestTransparentPreview(t *testing.T) {
+	mediaPath := "tmpout/TestTransparentPreview"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+
+	// Transparent GIF (palette) with an opaque red square in the middle
+	palette := color.Palette{color.Transparent, color.NRGBA{R: 255, A: 255}}
+	img := image.NewPaletted(image.Rect(0, 0, 400, 400), palette)
+	for y := 100; y < 300; y++ {
+		for x := 100; x < 300; x++ {
+			img.SetColorIndex(x, y, 1)
+		}
+	}
+	assertExpectNoErr(t, "", imaging.Save(img, mediaPath+"/logo.gif"))
+
+	media := createMedia("", "", true, false, false, false, true, true, true, 200, true, false, false, false,
+		mediaOptions{thumbBackground: "00ff00"})
+	for _, path := range []string{mediaPath + "/logo.preview.jpg", mediaPath + "/logo.thumb.jpg"} {
+		if strings.Contains(path, "preview") {
+			assertExpectNoErr(t, "", media.cache.generateImagePreview(mediaPath+"/logo.gif", path))
+		} else {
+			assertExpectNoErr(t, "", media.cache.generateImageThumbnail(mediaPath+"/logo.gif", path))
+		}
+		result, err := imaging.Open(path)
+		assertExpectNoErr(t, "", err)
+		last := result.Bounds().Dx() - 1
+		green := color.NRGBA{G: 255, A: 255}
+		for _, corner := range []image.Point{{0, 0}, {last, 0}, {0, last}, {last, last}} {
+			assertTrue(t, path, colorDistance(green, result.At(corner.X, corner.Y)) < 15)
+		}
+	}
+}
+
+// slotWriter records the number of used generation slots when written to
+type slotWriter struct {
+	media     *Media
+	written   bool
+	usedSlots int
+}
+
+func (sw *slotWriter) Write(p []byte) (int, error) {
+	sw.written = true
+	sw.usedSlots = max(sw.usedSlots, len(sw.media.generationSlots))
+	return len(p), nil
+}
+
+func TestOnDemandConcurrency(t *testing.T) {
+	mediaPath := "tmpout/TestOnDemandConcurrency"
+	cachePath := "tmpcache/TestOnDemandConcurrency"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/cached.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/uncached.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/preview.png")
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 100, true, false, false, false,
+		mediaOptions{onDemandConcurrency: 1})
+	assertExpectNoErr(t, "", media.writeThumbnail(io.Discard, "cached.png"))
+
+	// Occupy the only slot, e.g. by a slow generation
+	media.generationSlots <- struct{}{}
+
+	// Cached thumbnails are not limited
+	done := make(chan error, 2)
+	go func() { done <- media.writeThumbnail(io.Discard, "cached.png") }()
+	select {
+	case err := <-done:
+		assertExpectNoErr(t, "", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cached thumbnail waited for generation slot")
+	}
+
+	// Generations wait for the slot
+	go func() { done <- media.writeThumbnail(io.Discard, "uncached.png") }()
+	go func() { done <- media.writePreview(io.Discard, "preview.png", previewFormatJPEG) }()
+	select {
+	case <-done:
+		t.Fatal("Generation not limited")
+	case <-time.After(200 * time.Millisecond):
+	}
+	assertFileNotExist(t, "", cachePath+"/uncached.png.thumb.jpg")
+
+	// One at a time when the slot is released
+	<-media.generationSlots
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			assertExpectNoErr(t, "", err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Generation not done")
+		}
+	}
+	assertFileExist(t, "", cachePath+"/uncached.png.thumb.jpg")
+	assertFileExist(t, "", cachePath+"/preview.png.preview.jpg")
+	assertEqualsInt(t, "", 0, len(media.generationSlots))
+
+	// The slot is released before writing to the client, i.e. slow
+	// clients don't block generations
+	copyFile(t, "testmedia/png.png", mediaPath+"/slow.png")
+	slow := &slotWriter{media: media}
+	assertExpectNoErr(t, "", media.writeThumbnail(slow, "slow.png"))
+	assertTrue(t, "Written", slow.written)
+	assertEqualsInt(t, "Slot held while writing", 0, slow.usedSlots)
+
+	// No limit by default
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 100, true, false, false, false, mediaOptions{})
+	assertTrue(t, "", media.generationSlots == nil)
+}
+
+func TestCacheFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("File permissions not supported on Windows")
+	}
+	cachePath := "tmpcache/TestCacheFileMode"
+	os.RemoveAll(cachePath)
+	media := createMedia("testmedia", cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{cacheDirMode: 0700, cacheFileMode: 0600})
+
+	err := media.writeThumbnail(&bytes.Buffer{}, "exif_rotate/no_exif.jpg")
+	assertExpectNoErr(t, "", err)
+	stat, err := os.Stat(cachePath + "/exif_rotate")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 0700, int(stat.Mode().Perm()))
+	stat, err = os.Stat(cachePath + "/exif_rotate/no_exif.jpg.thumb.jpg")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 0600, int(stat.Mode().Perm()))
+}
+
+// writeHugePNG writes a small PNG with the dimensions in its header
+// changed to width x height
+func writeHugePNG(t *testing.T, fileName string, width, height uint32) {
+	t.Helper()
+	var buffer bytes.Buffer
+	err := png.Encode(&buffer, image.NewGray(image.Rect(0, 0, 1, 1)))
+	assertExpectNoErr(t, "", err)
+	data := buffer.Bytes()
+	// Signature (8 bytes), IHDR length (4), type (4), width (4), height (4), ... CRC at 29
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	assertExpectNoErr(t, "", os.WriteFile(fileName, data, 0644))
+}
+
+func TestWatermark(t *testing.T) {
+	cachePath := "tmpcache/TestWatermark"
+	os.RemoveAll(cachePath)
+
+	// Baseline without watermark
+	media := createMedia("testmedia", cachePath+"/baseline", true, false, false, false, true, true, true, 256, false, false, false, false,
+		mediaOptions{})
+	baselineFile, _, err := media.cache.generatePreview(media, "jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	baselineThumbFile, err := media.cache.generateThumbnail(media, "png.png")
+	assertExpectNoErr(t, "", err)
+
+	media = createMedia("testmedia", cachePath+"/watermark", true, false, false, false, true, true, true, 256, false, false, false, false,
+		mediaOptions{watermarkFile: "testmedia/png.png", watermarkPosition: "topleft", watermarkOpacity: 1})
+	previewFile, _, err := media.cache.generatePreview(media, "jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	thumbFile, err := media.cache.generateThumbnail(media, "png.png")
+	assertExpectNoErr(t, "", err)
+
+	baseline, err := imaging.Open(baselineFile)
+	assertExpectNoErr(t, "", err)
+	preview, err := imaging.Open(previewFile)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", baseline.Bounds().Dx(), preview.Bounds().Dx())
+	// The watermark covers the upper left corner but not the lower right
+	assertTrue(t, "Upper left shall differ", colorDistance(baseline.At(20, 20), preview.At(20, 20)) > 10)
+	maxX, maxY := preview.Bounds().Dx()-10, preview.Bounds().Dy()-10
+	assertTrue(t, "Lower right shall not differ", colorDistance(baseline.At(maxX, maxY), preview.At(maxX, maxY)) < 10)
+
+	// Thumbnails shall not be watermarked
+	baselineThumb, _ := os.ReadFile(baselineThumbFile)
+	thumb, _ := os.ReadFile(thumbFile)
+	assertTrue(t, "Thumbnail shall not differ", bytes.Equal(baselineThumb, thumb))
+
+	// Invalid watermark file shall disable watermark
+	media = createMedia("testmedia", cachePath+"/invalid", true, false, false, false, true, true, true, 256, false, false, false, false,
+		mediaOptions{watermarkFile: "testmedia/dont_exist.png"})
+	assertTrue(t, "", media.cache.watermark == nil)
+}
+
+// colorDistance returns the sum of the absolute differences of the
+// red, green and blue components (8 bits) of two colors
+func colorDistance(c1, c2 color.Color) int {
+	r1, g1, b1, _ := c1.RGBA()
+	r2, g2, b2, _ := c2.RGBA()
+	abs := func(v int) int {
+		if v < 0 {
+			return -v
+		}
+		return v
+	}
+	return abs(int(r1>>8)-int(r2>>8)) + abs(int(g1>>8)-int(g2>>8)) + abs(int(b1>>8)-int(b2>>8))
+}
+
+func TestMaxImagePixels(t *testing.T) {
+	mediaPath := "tmpout/TestMaxImagePixels"
+	cachePath := "tmpcache/TestMaxImagePixels"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/small.png")
+	writeHugePNG(t, mediaPath+"/huge.png", 50000, 50000)
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 0, true, false, false, false, mediaOptions{})
+	_, err := media.cache.generateThumbnail(media, "small.png")
+	assertExpectNoErr(t, "", err)
+
+	_, err = media.cache.generateThumbnail(media, "huge.png")
+	assertExpectErr(t, "", err)
+	assertTrue(t, err.Error(), strings.Contains(err.Error(), "too large"))
+	assertFileExist(t, "", cachePath+"/huge.png.thumb.err.txt")
+	_, _, err = media.cache.generatePreview(media, "huge.png")
+	assertExpectErr(t, "", err)
+	assertFileExist(t, "", cachePath+"/huge.png.preview.err.txt")
+	_, _, err = media.getImageWidthAndHeight(mediaPath + "/huge.png")
+	assertTrue(t, "", err != nil && strings.Contains(err.Error(), "too large"))
+
+	// Configured limit
+	media = createMedia(mediaPath, cachePath, false, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{maxImagePixels: 100})
+	_, _, err = media.getImageWidthAndHeight(mediaPath + "/small.png")
+	assertTrue(t, "", err != nil && strings.Contains(err.Error(), "too large"))
+
+	// No limit
+	media = createMedia(mediaPath, cachePath, false, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{maxImagePixels: -1})
+	_, _, err = media.getImageWidthAndHeight(mediaPath + "/small.png")
+	assertExpectNoErr(t, "", err)
+}
+
 func tWriteThumbnail(t *testing.T, media *Media, inFileName, outFileName string, failExpected bool) {
 	t.Helper()
 	os.Remove(outFileName)
@@ -316,7 +819,7 @@ func TestWriteThumbnail(t *testing.T) {
 	os.RemoveAll("tmpout/TestWriteThumbnail")
 	os.MkdirAll("tmpout/TestWriteThumbnail", os.ModePerm)
 
-	media := createMedia("testmedia", "tmpcache/TestWriteThumbnail", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", "tmpcache/TestWriteThumbnail", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 
 	// JPEG with embedded EXIF
 	tWriteThumbnail(t, media, "jpeg.jpg", "tmpout/TestWriteThumbnail/jpeg.jpg", false)
@@ -334,7 +837,7 @@ func TestWriteThumbnail(t *testing.T) {
 		// Test invalid
 		tWriteThumbnail(t, media, "invalidvideo.mp4", "tmpout/TestWriteThumbnail/invalidvideo.jpg", true)
 		// Check that error indication file is created
-		assertFileExist(t, "", "tmpcache/TestWriteThumbnail/invalidvideo.thumb.err.txt")
+		assertFileExist(t, "", "tmpcache/TestWriteThumbnail/invalidvideo.mp4.thumb.err.txt")
 	}
 
 	// Non existing file
@@ -343,12 +846,12 @@ func TestWriteThumbnail(t *testing.T) {
 	// Invalid file
 	tWriteThumbnail(t, media, "invalid.jpg", "tmpout/TestWriteThumbnail/invalid.jpg", true)
 	// Check that error indication file is created
-	assertFileExist(t, "", "tmpcache/TestWriteThumbnail/invalid.thumb.err.txt")
+	assertFileExist(t, "", "tmpcache/TestWriteThumbnail/invalid.jpg.thumb.err.txt")
 	// Generate again - just for coverage
 	tWriteThumbnail(t, media, "invalid.jpg", "tmpout/TestWriteThumbnail/invalid.jpg", true)
 
 	// Disable thumb cache
-	media = createMedia("testmedia", "tmpcache/TestWriteThumbnail", false, false, false, false, true, true, false, 0, false, false, false, false)
+	media = createMedia("testmedia", "tmpcache/TestWriteThumbnail", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 
 	// JPEG with embedded EXIF
 	tWriteThumbnail(t, media, "jpeg.jpg", "tmpout/TestWriteThumbnail/jpeg.jpg", false)
@@ -379,6 +882,57 @@ func TestVideoThumbnailSupport(t *testing.T) {
 	assertTrue(t, "Shall be true on at least one platform", shallBeTrueOnWindows || shallBeTrueOnNonWindows)
 }
 
+func TestFFmpegPath(t *testing.T) {
+	// Configured path instead of ffmpeg in PATH
+	cache := createCache("testmedia", "tmpcache/TestFFmpegPath", 0, false, false,
+		mediaOptions{ffmpegPath: "thiscommanddontexit"})
+	assertFalse(t, "", cache.hasVideoThumbnailSupport())
+	err := cache.extractVideoScreenshot("testmedia/video.mp4", "tmpcache/TestFFmpegPath/video.sh.jpg")
+	assertExpectErr(t, "", err)
+
+	cache = createCache("testmedia", "tmpcache/TestFFmpegPath", 0, false, false,
+		mediaOptions{ffmpegPath: "cmd"})
+	shallBeTrueOnWindows := cache.hasVideoThumbnailSupport()
+	cache = createCache("testmedia", "tmpcache/TestFFmpegPath", 0, false, false,
+		mediaOptions{ffmpegPath: "echo", ffmpegArgs: []string{"-hwaccel", "auto"}})
+	shallBeTrueOnNonWindows := cache.hasVideoThumbnailSupport()
+	assertTrue(t, "Shall be true on at least one platform", shallBeTrueOnWindows || shallBeTrueOnNonWindows)
+
+	// The extra arguments are added before the input file (echo doesn't
+	// create any screenshot, so it fails with the command line)
+	if shallBeTrueOnNonWindows {
+		err = cache.extractVideoScreenshot("testmedia/video.mp4", "tmpcache/TestFFmpegPath/video.sh.jpg")
+		assertExpectErr(t, "", err)
+		assertTrue(t, err.Error(), strings.HasPrefix(err.Error(),
+			"ffmpeg present but screenshot extraction failed, check codecs: echo -hwaccel auto -i testmedia/video.mp4 -ss"))
+	}
+}
+
+func TestProbeFFmpeg(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("echo and false commands not supported on Windows")
+	}
+	// echo works as ffmpeg -version, but doesn't create any frame
+	cache := createCache("testmedia", "tmpcache/TestProbeFFmpeg", 0, false, false,
+		mediaOptions{ffmpegPath: "echo"})
+	assertEqualsStr(t, "", "-version", cache.ffmpegVersion)
+	assertExpectNoErr(t, "", cache.ffmpegProbeErr)
+
+	cache = createCache("testmedia", "tmpcache/TestProbeFFmpeg", 0, false, false,
+		mediaOptions{ffmpegPath: "echo", ffmpegSelfTest: true})
+	assertEqualsStr(t, "", "-version", cache.ffmpegVersion)
+	assertExpectErr(t, "", cache.ffmpegProbeErr)
+	err := cache.extractVideoScreenshot("testmedia/video.mp4", "tmpcache/TestProbeFFmpeg/video.sh.jpg")
+	assertExpectErr(t, "", err)
+	assertTrue(t, err.Error(), strings.HasPrefix(err.Error(), "ffmpeg not working (self-test failed"))
+
+	cache = createCache("testmedia", "tmpcache/TestProbeFFmpeg", 0, false, false,
+		mediaOptions{ffmpegPath: "false"})
+	assertEqualsStr(t, "", "", cache.ffmpegVersion)
+	assertExpectErr(t, "", cache.ffmpegProbeErr)
+	assertTrue(t, "Still supported", cache.hasVideoThumbnailSupport())
+}
+
 func tGenerateVideoThumbnail(t *testing.T, media *Media, inFileName, outFileName string) {
 	t.Helper()
 	os.Remove(outFileName)
@@ -391,7 +945,7 @@ func tGenerateVideoThumbnail(t *testing.T, media *Media, inFileName, outFileName
 }
 
 func TestGenerateVideoThumbnail(t *testing.T) {
-	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 	if !hasVideoThumbnailSupport() {
 		t.Skip("ffmpeg not installed skipping test")
 		return
@@ -411,12 +965,90 @@ func TestGenerateVideoThumbnail(t *testing.T) {
 	assertExpectErr(t, "", err)
 }
 
+// countNonBlack returns the number of non-black pixels within rect
+func countNonBlack(img image.Image, rect image.Rectangle) int {
+	count := 0
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			if r+g+b > 0 {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestAddVideoIcon(t *testing.T) {
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	for _, side := range []int{256, 512} {
+		img, err := media.cache.addVideoIcon(imaging.New(side, side, color.Black))
+		assertExpectNoErr(t, "", err)
+		assertEqualsInt(t, "", side, img.Bounds().Dx())
+
+		// Icon in upper right corner only
+		assertTrue(t, "icon shall be present", countNonBlack(img, image.Rect(side/2, 0, side, side/2)) > side)
+		assertEqualsInt(t, "", 0, countNonBlack(img, image.Rect(0, 0, side/2, side)))
+		assertEqualsInt(t, "", 0, countNonBlack(img, image.Rect(0, side/2, side, side)))
+	}
+
+	// Concurrently with different sizes, e.g. precache and client requests
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(side int) {
+			defer wg.Done()
+			icon, err := media.cache.getVideoIcon(side)
+			assertExpectNoErr(t, "", err)
+			assertEqualsInt(t, "", side, icon.Bounds().Dx())
+		}(10 + i%4)
+	}
+	wg.Wait()
+
+	// Disabled
+	media = createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{noVideoIconOverlay: true})
+	img, err := media.cache.addVideoIcon(imaging.New(256, 256, color.Black))
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 0, countNonBlack(img, img.Bounds()))
+}
+
+func TestGenerateVideoPreview(t *testing.T) {
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, true, 1280, false, false, false, false,
+		mediaOptions{videoPreviewFrames: 3})
+	previewPath, err := media.cache.previewPath("subdir/video.mp4")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "subdir/video.mp4.preview.gif", previewPath)
+
+	if !hasVideoThumbnailSupport() {
+		t.Skip("ffmpeg not installed skipping test")
+		return
+	}
+	tmp := "tmpout/TestGenerateVideoPreview"
+	os.MkdirAll(tmp, os.ModePerm) // If already exist no problem
+	outFileName := tmp + "/video.preview.gif"
+	os.Remove(outFileName)
+
+	err = media.cache.generateVideoPreview("testmedia/video.mp4", outFileName)
+	assertExpectNoErr(t, "", err)
+	gifFile, err := os.Open(outFileName)
+	assertExpectNoErr(t, "", err)
+	defer gifFile.Close()
+	animation, err := gif.DecodeAll(gifFile)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "number of frames", 3, len(animation.Image))
+
+	// Test some invalid
+	err = media.cache.generateVideoPreview("invalidvideo.mp4", tmp+"/invalidvideo.preview.gif")
+	assertExpectErr(t, "", err)
+}
+
 func TestGenerateThumbnails(t *testing.T) {
 	cache := "tmpcache/TestGenerateThumbnails"
 	os.RemoveAll(cache)
 	os.MkdirAll(cache, os.ModePerm)
 
-	media := createMedia("testmedia", cache, true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", cache, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 	stat := media.generateCache("", true, true, false)
 	assertEqualsInt(t, "", 1, stat.NbrOfFolders)
 	assertEqualsInt(t, "", 20, stat.NbrOfImages)
@@ -429,31 +1061,99 @@ func TestGenerateThumbnails(t *testing.T) {
 	assertEqualsInt(t, "", 0, stat.NbrOfFailedImagePreview)
 	assertEqualsInt(t, "", 0, stat.NbrOfSmallImages)
 	assertEqualsInt(t, "", 0, stat.NbrRemovedCacheFiles)
+	assertEqualsInt(t, "", 2, stat.NbrOfAlbumThumb) // Top folder and exif_rotate
+	assertEqualsInt(t, "", 0, stat.NbrOfFailedAlbumThumb)
 	if hasVideoThumbnailSupport() {
 		assertEqualsInt(t, "", 1, stat.NbrOfVideoThumb)
 		assertEqualsInt(t, "", 1, stat.NbrOfFailedVideoThumb)
-		assertFileExist(t, "", filepath.Join(cache, "video.thumb.jpg"))
+		assertFileExist(t, "", filepath.Join(cache, "video.mp4.thumb.jpg"))
 	} else {
 		assertEqualsInt(t, "", 0, stat.NbrOfVideoThumb)
 		assertEqualsInt(t, "", 2, stat.NbrOfFailedVideoThumb)
 	}
 
 	// Check that thumbnails where generated
-	assertFileExist(t, "", filepath.Join(cache, "png.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "gif.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "tiff.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "png.png.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "gif.gif.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "tiff.tiff.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.jpg.thumb.jpg"))
 
-	assertCacheThumbExists(t, media.cache, "", "png.jpg")
+	assertCacheThumbExists(t, media.cache, "", "png.png")
 	assertCacheThumbExists(t, media.cache, "", "gif.gif")
 	assertCacheThumbExists(t, media.cache, "", "tiff.tiff")
 	assertCacheThumbExists(t, media.cache, "", "exif_rotate/no_exif.jpg")
 
 	// Check that thumbnails where not generated for EXIF images
-	assertFileNotExist(t, "", filepath.Join(cache, "jpeg.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "jpeg_rotated.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "180deg.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "mirror.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "jpeg.jpg.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "jpeg_rotated.jpg.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "180deg.jpg.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "mirror.jpg.thumb.jpg"))
+}
+
+func TestGenerateConcurrently(t *testing.T) {
+	cache := "tmpcache/TestGenerateConcurrently"
+	os.RemoveAll(cache)
+	logs := captureLog(t)
+
+	media := createMedia("testmedia", cache, true, false, false, false, true, true, true, 1280, false, false, false, false, mediaOptions{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_, err := media.cache.generateThumbnail(media, "png.png")
+			assertExpectNoErr(t, "", err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, _, err := media.cache.generatePreview(media, "png.png")
+			assertExpectNoErr(t, "", err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := media.cache.generateThumbnail(media, "invalid.jpg")
+			assertExpectErr(t, "", err)
+		}()
+	}
+	wg.Wait()
+
+	// Each file shall only have been generated (or failed) once
+	assertEqualsInt(t, "", 1, strings.Count(logs.String(), "Creating new thumbnail for png.png"))
+	assertEqualsInt(t, "", 1, strings.Count(logs.String(), "Creating new preview file for png.png"))
+	assertEqualsInt(t, "", 1, strings.Count(logs.String(), "Creating new thumbnail for invalid.jpg"))
+	assertEqualsInt(t, "", 0, len(media.cache.inProgress))
+}
+
+func TestAlbumThumbnailPersist(t *testing.T) {
+	mediaPath := "tmpout/TestAlbumThumbnailPersist"
+	cache := "tmpcache/TestAlbumThumbnailPersist"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cache)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/gif.gif", mediaPath+"/gif.gif")
+
+	media := createMedia(mediaPath, cache, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	stat := media.generateCache("", false, true, false)
+	assertEqualsInt(t, "", 1, stat.NbrOfAlbumThumb)
+	albumPath := media.cache.relativeAlbumThumbnailPath("", []string{"gif.gif", "png.png"})
+	assertTrue(t, "", media.cache.hasAlbumThumbnail(albumPath))
+	assertTrue(t, "", media.cache.hasPreview(albumPath))
+
+	// Not generated again
+	stat = media.generateCache("", false, true, false)
+	assertEqualsInt(t, "", 0, stat.NbrOfAlbumThumb)
+
+	// Loaded from cache on startup
+	media = createMedia(mediaPath, cache, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	assertTrue(t, "", media.cache.hasAlbumThumbnail(albumPath))
+	stat = media.generateCache("", false, true, false)
+	assertEqualsInt(t, "", 0, stat.NbrOfAlbumThumb)
+
+	// Album changed
+	copyFile(t, "testmedia/tiff.tiff", mediaPath+"/tiff.tiff")
+	stat = media.generateCache("", false, true, false)
+	assertEqualsInt(t, "", 1, stat.NbrOfAlbumThumb)
 }
 
 func TestGeneratePreviews(t *testing.T) {
@@ -467,7 +1167,7 @@ func TestGeneratePreviews(t *testing.T) {
 	unnecessaryDirectory := filepath.Join(cache, "unnecessary_directory")
 	os.MkdirAll(unnecessaryDirectory, os.ModePerm)
 
-	media := createMedia("testmedia", cache, true, false, false, false, true, true, true, 1280, false, false, false, true)
+	media := createMedia("testmedia", cache, true, false, false, false, true, true, true, 1280, false, false, false, true, mediaOptions{})
 	stat := media.generateCache("", true, false, true)
 	assertEqualsInt(t, "", 1, stat.NbrOfFolders)
 	assertEqualsInt(t, "", 20, stat.NbrOfImages)
@@ -482,19 +1182,19 @@ func TestGeneratePreviews(t *testing.T) {
 	assertEqualsInt(t, "", 2, stat.NbrRemovedCacheFiles)
 
 	// Check that previews where generated
-	assertFileExist(t, "", filepath.Join(cache, "png.preview.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "gif.preview.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "normal.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "png.png.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "gif.gif.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "normal.jpg.preview.jpg"))
 
-	assertCachePreviewExists(t, media.cache, "", "png.jpg")
+	assertCachePreviewExists(t, media.cache, "", "png.png")
 	assertCachePreviewExists(t, media.cache, "", "gif.gif")
 	assertCachePreviewExists(t, media.cache, "", "exif_rotate/normal.jpg")
 
 	// Check that no thumbnails where generated
-	assertFileNotExist(t, "", filepath.Join(cache, "png.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "gif.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "tiff.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "png.png.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "gif.gif.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "tiff.tiff.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.jpg.thumb.jpg"))
 
 	// Check that unnecessary files are removed
 	assertFileNotExist(t, "", unnecessaryFile)
@@ -513,7 +1213,7 @@ func TestGenerateThumbnailsAndPreviews(t *testing.T) {
 	unnecessaryDirectory := filepath.Join(cache, "unnecessary_directory")
 	os.MkdirAll(unnecessaryDirectory, os.ModePerm)
 
-	media := createMedia("testmedia", cache, true, false, false, false, true, true, true, 1280, false, false, false, false)
+	media := createMedia("testmedia", cache, true, false, false, false, true, true, true, 1280, false, false, false, false, mediaOptions{})
 	stat := media.generateCache("", true, true, true)
 	assertEqualsInt(t, "", 1, stat.NbrOfFolders)
 	assertEqualsInt(t, "", 20, stat.NbrOfImages)
@@ -528,15 +1228,15 @@ func TestGenerateThumbnailsAndPreviews(t *testing.T) {
 	assertEqualsInt(t, "", 0, stat.NbrRemovedCacheFiles)
 
 	// Check that previews where generated
-	assertFileExist(t, "", filepath.Join(cache, "png.preview.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "gif.preview.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "normal.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "png.png.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "gif.gif.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "normal.jpg.preview.jpg"))
 
 	// Check that thumbnails where generated
-	assertFileExist(t, "", filepath.Join(cache, "png.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "gif.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "tiff.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "png.png.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "gif.gif.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "tiff.tiff.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.jpg.thumb.jpg"))
 
 	// Check that unnecessary files are kept
 	assertFileExist(t, "", unnecessaryFile)
@@ -551,7 +1251,7 @@ func TestGenerateAllThumbnails(t *testing.T) {
 	os.RemoveAll(cache)
 	os.MkdirAll(cache, os.ModePerm)
 
-	media := createMedia("testmedia", cache, true, false, true, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", cache, true, false, true, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 
 	for i := 0; i < 300; i++ {
 		time.Sleep(100 * time.Millisecond)
@@ -562,19 +1262,19 @@ func TestGenerateAllThumbnails(t *testing.T) {
 	assertFalse(t, "", media.isPreCacheInProgress())
 
 	// Check that thumbnails where generated
-	assertFileExist(t, "", filepath.Join(cache, "png.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "gif.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "tiff.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "png.png.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "gif.gif.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "tiff.tiff.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.jpg.thumb.jpg"))
 
 	// Check that thumbnails where not generated for EXIF images
-	assertFileNotExist(t, "", filepath.Join(cache, "jpeg.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "jpeg_rotated.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "180deg.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "mirror.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "jpeg.jpg.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "jpeg_rotated.jpg.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "180deg.jpg.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "mirror.jpg.thumb.jpg"))
 
 	if hasVideoThumbnailSupport() {
-		assertFileExist(t, "", filepath.Join(cache, "video.thumb.jpg"))
+		assertFileExist(t, "", filepath.Join(cache, "video.mp4.thumb.jpg"))
 	}
 }
 
@@ -583,7 +1283,7 @@ func TestGenerateAllPreviews(t *testing.T) {
 	os.RemoveAll(cache)
 	os.MkdirAll(cache, os.ModePerm)
 
-	media := createMedia("testmedia", cache, true, false, false, false, true, true, true, 1280, false, true, false, false)
+	media := createMedia("testmedia", cache, true, false, false, false, true, true, true, 1280, false, true, false, false, mediaOptions{})
 
 	for i := 0; i < 300; i++ {
 		time.Sleep(100 * time.Millisecond)
@@ -594,20 +1294,20 @@ func TestGenerateAllPreviews(t *testing.T) {
 	assertFalse(t, "", media.isPreCacheInProgress())
 
 	// Check that previews where generated
-	assertFileExist(t, "", filepath.Join(cache, "png.preview.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "gif.preview.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "normal.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "png.png.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "gif.gif.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "normal.jpg.preview.jpg"))
 
 	// Check that no previews where generated for "small" images
-	assertFileNotExist(t, "", filepath.Join(cache, "tiff.preview.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "screenshot_viewer.preview.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "tiff.tiff.preview.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "screenshot_viewer.jpg.preview.jpg"))
 
 	// Check that no thumbnails where generated
-	assertFileNotExist(t, "", filepath.Join(cache, "png.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "gif.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "tiff.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.thumb.jpg"))
-	assertFileNotExist(t, "", filepath.Join(cache, "video.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "png.png.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "gif.gif.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "tiff.tiff.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.jpg.thumb.jpg"))
+	assertFileNotExist(t, "", filepath.Join(cache, "video.mp4.thumb.jpg"))
 }
 
 func TestGenerateAllThumbsAndPreviews(t *testing.T) {
@@ -615,7 +1315,7 @@ func TestGenerateAllThumbsAndPreviews(t *testing.T) {
 	os.RemoveAll(cache)
 	os.MkdirAll(cache, os.ModePerm)
 
-	media := createMedia("testmedia", cache, true, false, true, false, true, true, true, 1280, false, true, false, false)
+	media := createMedia("testmedia", cache, true, false, true, false, true, true, true, 1280, false, true, false, false, mediaOptions{})
 
 	for i := 0; i < 300; i++ {
 		time.Sleep(100 * time.Millisecond)
@@ -626,15 +1326,15 @@ func TestGenerateAllThumbsAndPreviews(t *testing.T) {
 	assertFalse(t, "", media.isPreCacheInProgress())
 
 	// Check that thumbnails where generated
-	assertFileExist(t, "", filepath.Join(cache, "png.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "gif.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "tiff.thumb.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "png.png.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "gif.gif.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "tiff.tiff.thumb.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "no_exif.jpg.thumb.jpg"))
 
 	// Check that previews where generated
-	assertFileExist(t, "", filepath.Join(cache, "png.preview.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "gif.preview.jpg"))
-	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "normal.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "png.png.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "gif.gif.preview.jpg"))
+	assertFileExist(t, "", filepath.Join(cache, "exif_rotate", "normal.jpg.preview.jpg"))
 
 }
 
@@ -643,7 +1343,7 @@ func TestGenerateNoThumbnails(t *testing.T) {
 	os.RemoveAll(cache)
 	os.MkdirAll(cache, os.ModePerm)
 
-	media := createMedia("testmedia", cache, true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", cache, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 
 	assertFalse(t, "", media.isPreCacheInProgress())
 	time.Sleep(100 * time.Millisecond)
@@ -659,7 +1359,7 @@ func TestGenerateNoThumbnails(t *testing.T) {
 }
 
 func TestGetImageWidthAndHeight(t *testing.T) {
-	media := createMedia("", "", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("", "", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 
 	width, height, err := media.getImageWidthAndHeight("testmedia/jpeg.jpg")
 	assertExpectNoErr(t, "", err)
@@ -681,25 +1381,53 @@ func TestGetImageWidthAndHeight(t *testing.T) {
 	assertEqualsInt(t, "image width", 979, width)
 	assertEqualsInt(t, "image height", 734, height)
 
+	// Width and height shall be as displayed, i.e. after EXIF rotation
+	width, height, err = media.getImageWidthAndHeight("testmedia/exif_rotate/rotate_90deg_cw.jpg")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "image width", 2322, width)
+	assertEqualsInt(t, "image height", 4128, height)
+
 	// Test invalid
 	_, _, err = media.getImageWidthAndHeight("testmedia/invalid.jpg")
 	assertExpectErr(t, "", err)
 }
 
+func TestGeneratePreviewRotatedThreshold(t *testing.T) {
+	cache := "tmpcache/TestGeneratePreviewRotatedThreshold"
+	os.RemoveAll(cache)
+	inFileName := "exif_rotate/rotate_90deg_cw.jpg" // 2322x4128 when rotated
+
+	// Exactly at the threshold
+	media := createMedia("testmedia", cache, true, false, false, false, true, true, true, 4128, false, false, false, false, mediaOptions{})
+	_, tooSmall, err := media.cache.generatePreviewFormat(media, inFileName, previewFormatJPEG)
+	assertExpectErr(t, "", err)
+	assertTrue(t, "", tooSmall)
+
+	// Just below the threshold
+	media = createMedia("testmedia", cache, true, false, false, false, true, true, true, 4127, false, false, false, false, mediaOptions{})
+	previewFileName, tooSmall, err := media.cache.generatePreviewFormat(media, inFileName, previewFormatJPEG)
+	assertExpectNoErr(t, "", err)
+	assertFalse(t, "", tooSmall)
+	width, height, err := media.getImageWidthAndHeight(previewFileName)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "preview height", 4127, height)
+	assertTrue(t, "preview width", width < height)
+}
+
 func TestPreviewPath(t *testing.T) {
-	media := createMedia("/c/mediapath", "/d/thumbpath", true, false, false, false, true, true, true, 1280, false, false, false, false)
+	media := createMedia("/c/mediapath", "/d/thumbpath", true, false, false, false, true, true, true, 1280, false, false, false, false, mediaOptions{})
 
 	previewPath, err := media.cache.previewPath("myimage.jpg")
 	assertExpectNoErr(t, "", err)
-	assertEqualsStr(t, "", "/d/thumbpath/myimage.preview.jpg", previewPath)
+	assertEqualsStr(t, "", "/d/thumbpath/myimage.jpg.preview.jpg", previewPath)
 
 	previewPath, err = media.cache.previewPath("subdrive/myimage.jpg")
 	assertExpectNoErr(t, "", err)
-	assertEqualsStr(t, "", "/d/thumbpath/subdrive/myimage.preview.jpg", previewPath)
+	assertEqualsStr(t, "", "/d/thumbpath/subdrive/myimage.jpg.preview.jpg", previewPath)
 
 	previewPath, err = media.cache.previewPath("subdrive/myimage.png")
 	assertExpectNoErr(t, "", err)
-	assertEqualsStr(t, "", "/d/thumbpath/subdrive/myimage.preview.jpg", previewPath)
+	assertEqualsStr(t, "", "/d/thumbpath/subdrive/myimage.png.preview.jpg", previewPath)
 
 	_, err = media.cache.previewPath("subdrive/myimage")
 	assertExpectErr(t, "", err)
@@ -708,6 +1436,210 @@ func TestPreviewPath(t *testing.T) {
 	assertExpectErr(t, "", err)
 }
 
+func TestPreviewSizes(t *testing.T) {
+	cache := "tmpcache/TestPreviewSizes"
+	os.RemoveAll(cache)
+	media := createMedia("testmedia", cache, true, false, false, false, true, true, true, 1280, true, false, false, false,
+		mediaOptions{previewSizes: []int{320, 640}})
+
+	assertEqualsInt(t, "", 320, media.cache.previewSizeOf(1))
+	assertEqualsInt(t, "", 640, media.cache.previewSizeOf(321))
+	assertEqualsInt(t, "", 1280, media.cache.previewSizeOf(1280))
+	assertEqualsInt(t, "", 1280, media.cache.previewSizeOf(5000))
+
+	previewPath, err := media.cache.relativePreviewPathSize("sub/myimage.jpg", previewFormatJPEG, 640)
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "sub/myimage.jpg.preview-640.jpg", previewPath)
+	previewPath, _ = media.cache.relativePreviewPathSize("sub/myimage.jpg", previewFormatJPEG, 1280)
+	assertEqualsStr(t, "", "sub/myimage.jpg.preview.jpg", previewPath)
+	assertEqualsInt(t, "", 10, len(media.cache.relativePreviewPaths("myimage.jpg"))) // 3 JPEG, 3 AVIF, 1 GIF, 3 PNG
+
+	var buf bytes.Buffer
+	assertExpectNoErr(t, "", media.writePreviewSize(&buf, "png.png", previewFormatJPEG, 500))
+	img, err := imaging.Decode(&buf)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 640, max(img.Bounds().Dx(), img.Bounds().Dy()))
+	assertFileExist(t, "", cache+"/png.png.preview-640.jpg")
+	assertFileNotExist(t, "", cache+"/png.png.preview.jpg")
+
+	// Sized previews are found on startup and removed with the media file
+	media = createMedia("testmedia", cache, true, false, false, false, true, true, true, 1280, true, false, false, false,
+		mediaOptions{previewSizes: []int{320, 640}})
+	assertTrue(t, "", media.cache.hasEntry(media.cache.previews, "png.png.preview-640.jpg"))
+	assertEqualsInt(t, "", 1, media.cache.removeCacheFiles("png.png"))
+	assertFileNotExist(t, "", cache+"/png.png.preview-640.jpg")
+}
+
+func TestPreviewKeepFormat(t *testing.T) {
+	mediaPath := "tmpout/TestPreviewKeepFormat"
+	cachePath := "tmpcache/TestPreviewKeepFormat"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/jpeg.jpg")
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 100, true, false, false, false,
+		mediaOptions{previewKeepFormat: true})
+	previewPath, err := media.cache.relativePreviewPath("png.png")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "png.png.preview.png", previewPath)
+	previewPath, err = media.cache.relativePreviewPath("jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "jpeg.jpg.preview.jpg", previewPath)
+	assertEqualsStr(t, "", previewFormatPNG, media.previewFormat("png.png", "image/avif,*/*"))
+	assertEqualsStr(t, "", previewFormatJPEG, media.previewFormat("jpeg.jpg", "image/avif,*/*"))
+
+	// Generated as PNG
+	previewFile, _, err := media.cache.generatePreview(media, "png.png")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", cachePath+"/png.png.preview.png", previewFile)
+	file, err := os.Open(previewFile)
+	assertExpectNoErr(t, "", err)
+	_, format, err := image.DecodeConfig(file)
+	file.Close()
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "png", format)
+
+	// Found when the cache is loaded again
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 100, true, false, false, false,
+		mediaOptions{previewKeepFormat: true})
+	assertTrue(t, "", media.cache.hasPreview("png.png"))
+	assertFalse(t, "", media.cache.hasPreview("jpeg.jpg"))
+
+	// Default is JPEG also for PNG images
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 100, true, false, false, false,
+		mediaOptions{})
+	assertFalse(t, "", media.cache.hasPreview("png.png"))
+	assertEqualsStr(t, "", previewFormatJPEG, media.previewFormat("png.png", ""))
+}
+
+func TestCacheIncludeExt(t *testing.T) {
+	mediaPath := "tmpout/TestCacheIncludeExt"
+	cachePath := "tmpcache/TestCacheIncludeExt"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/photo.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/photo.png")
+
+	// Same cache files without the extension
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 100, true, false, false, false,
+		mediaOptions{cacheStripExt: true})
+	jpegThumbPath, _ := media.cache.relativeThumbnailPath("photo.jpg")
+	pngThumbPath, _ := media.cache.relativeThumbnailPath("photo.png")
+	assertEqualsStr(t, "", "photo.thumb.jpg", jpegThumbPath)
+	assertEqualsStr(t, "", jpegThumbPath, pngThumbPath)
+
+	// Default
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 100, true, false, false, false,
+		mediaOptions{})
+	jpegThumbPath, _ = media.cache.relativeThumbnailPath("photo.jpg")
+	pngThumbPath, _ = media.cache.relativeThumbnailPath("photo.png")
+	assertEqualsStr(t, "", "photo.jpg.thumb.jpg", jpegThumbPath)
+	assertEqualsStr(t, "", "photo.png.thumb.jpg", pngThumbPath)
+	previewPath, _ := media.cache.relativePreviewPath("photo.png")
+	assertEqualsStr(t, "", "photo.png.preview.jpg", previewPath)
+	assertEqualsStr(t, "", "photo.png.thumb.err.txt", media.cache.errorIndicationPath(pngThumbPath))
+
+	// Distinct thumbnails
+	jpegThumbFile, err := media.cache.generateThumbnail(media, "photo.jpg")
+	assertExpectNoErr(t, "", err)
+	pngThumbFile, err := media.cache.generateThumbnail(media, "photo.png")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", cachePath+"/photo.jpg.thumb.jpg", jpegThumbFile)
+	assertEqualsStr(t, "", cachePath+"/photo.png.thumb.jpg", pngThumbFile)
+	jpegThumb, err := os.ReadFile(jpegThumbFile)
+	assertExpectNoErr(t, "", err)
+	pngThumb, err := os.ReadFile(pngThumbFile)
+	assertExpectNoErr(t, "", err)
+	assertFalse(t, "", bytes.Equal(jpegThumb, pngThumb))
+	albumPath := media.cache.relativeAlbumThumbnailPath("", []string{"photo.jpg", "photo.png"})
+	assertExpectNoErr(t, "", media.cache.generateAlbumThumbnail(media, albumPath, "", []string{"photo.jpg", "photo.png"}))
+
+	// Found when the cache is loaded again and kept by the cleanup
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 100, true, false, false, false,
+		mediaOptions{})
+	assertTrue(t, "", media.cache.hasThumbnail("photo.jpg"))
+	assertTrue(t, "", media.cache.hasThumbnail("photo.png"))
+	assertTrue(t, "", media.cache.hasAlbumThumbnail(albumPath))
+	files, err := media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	files = append(files, File{Type: "image", Name: albumPath, Path: albumPath})
+	assertEqualsInt(t, "", 0, media.cache.cleanupCache("", files))
+	assertFileExist(t, "", jpegThumbFile)
+	assertFileExist(t, "", pngThumbFile)
+}
+
+func TestCacheIncludeExtMigration(t *testing.T) {
+	mediaPath := "tmpout/TestCacheIncludeExtMigration"
+	cachePath := "tmpcache/TestCacheIncludeExtMigration"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/photo.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/photo.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/other.png")
+
+	// Cache files named without the extension
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 100, true, false, false, false,
+		mediaOptions{cacheStripExt: true})
+	for _, path := range []string{"photo.png", "other.png"} {
+		_, err := media.cache.generateThumbnail(media, path)
+		assertExpectNoErr(t, path, err)
+	}
+	os.WriteFile(cachePath+"/other.preview.err.txt", []byte("error"), 0644)
+	assertFileExist(t, "", cachePath+"/photo.thumb.jpg")
+
+	// Renamed by the cleanup, except the shared one that is removed
+	logs := captureLog(t)
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 100, true, false, false, false,
+		mediaOptions{})
+	files, err := media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, media.cache.cleanupCache("", files))
+	assertFileNotExist(t, "", cachePath+"/other.thumb.jpg")
+	assertFileExist(t, "", cachePath+"/other.png.thumb.jpg")
+	assertFileExist(t, "", cachePath+"/other.png.preview.err.txt")
+	assertTrue(t, "", media.cache.hasThumbnail("other.png"))
+	assertFileNotExist(t, "", cachePath+"/photo.thumb.jpg")
+	assertFalse(t, "", media.cache.hasThumbnail("photo.png"))
+	assertTrue(t, "", strings.Contains(logs.String(), "photo.thumb.jpg was shared by media files with the same name (photo.jpg, photo.png)"))
+
+	// The removed one is generated again
+	thumbFileName, err := media.cache.generateThumbnail(media, "photo.png")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", cachePath+"/photo.png.thumb.jpg", thumbFileName)
+}
+
+func TestPreviewFormat(t *testing.T) {
+	media := createMedia("/c/mediapath", "/d/thumbpath", true, false, false, false, true, true, true, 1280, false, false, false, false,
+		mediaOptions{previewFormat: previewFormatAVIF})
+
+	previewPath, err := media.cache.previewPathFormat("subdrive/myimage.jpg", previewFormatAVIF)
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "/d/thumbpath/subdrive/myimage.jpg.preview.avif", previewPath)
+
+	previewPath, err = media.cache.previewPathFormat("subdrive/myimage.jpg", previewFormatJPEG)
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", "/d/thumbpath/subdrive/myimage.jpg.preview.jpg", previewPath)
+
+	// AVIF shall only be used if supported by both build and client
+	if avifSupported {
+		assertEqualsStr(t, "", previewFormatAVIF, media.previewFormat("myimage.jpg", "image/avif,image/webp,*/*"))
+	} else {
+		assertEqualsStr(t, "", previewFormatJPEG, media.cache.previewFormat)
+		assertEqualsStr(t, "", previewFormatJPEG, media.previewFormat("myimage.jpg", "image/avif,image/webp,*/*"))
+	}
+	assertEqualsStr(t, "", previewFormatJPEG, media.previewFormat("myimage.jpg", "image/webp,*/*"))
+	assertEqualsStr(t, "", previewFormatJPEG, media.previewFormat("myimage.jpg", ""))
+
+	// Default is JPEG
+	media = createMedia("/c/mediapath", "/d/thumbpath", true, false, false, false, true, true, true, 1280, false, false, false, false, mediaOptions{})
+	assertEqualsStr(t, "", previewFormatJPEG, media.cache.previewFormat)
+	assertEqualsStr(t, "", previewFormatJPEG, media.previewFormat("myimage.jpg", "image/avif,image/webp,*/*"))
+}
+
 func tGenerateImagePreview(t *testing.T, media *Media, inFileName, outFileName string) {
 	t.Helper()
 	os.Remove(outFileName)
@@ -726,7 +1658,7 @@ func tGenerateImagePreview(t *testing.T, media *Media, inFileName, outFileName s
 func TestGenerateImagePreview(t *testing.T) {
 	os.MkdirAll("tmpout/TestGenerateImagePreview", os.ModePerm) // If already exist no problem
 
-	media := createMedia("", "", true, false, false, false, true, true, true, 1280, false, false, false, false)
+	media := createMedia("", "", true, false, false, false, true, true, true, 1280, false, false, false, false, mediaOptions{})
 
 	tGenerateImagePreview(t, media, "testmedia/jpeg.jpg", "tmpout/TestGenerateImagePreview/jpeg_preview.jpg")
 	tGenerateImagePreview(t, media, "testmedia/jpeg_rotated.jpg", "tmpout/TestGenerateImagePreview/jpeg_rotated_preview.jpg")
@@ -743,13 +1675,43 @@ func TestGenerateImagePreview(t *testing.T) {
 	assertExpectErr(t, "", err)
 }
 
+func TestResampleFilter(t *testing.T) {
+	media := createMedia("", "", true, false, false, false, true, true, true, 1280, false, false, false, false, mediaOptions{})
+	assertTrue(t, "", imaging.Box.Support == media.cache.resampleFilter.Support)
+
+	media = createMedia("", "", true, false, false, false, true, true, true, 1280, false, false, false, false,
+		mediaOptions{resampleFilter: "lanczos"})
+	assertTrue(t, "", imaging.Lanczos.Support == media.cache.resampleFilter.Support)
+
+	os.MkdirAll("tmpout/TestResampleFilter", os.ModePerm)
+	tGenerateImagePreview(t, media, "testmedia/png.png", "tmpout/TestResampleFilter/png_preview.jpg")
+}
+
+// BenchmarkResampleFilter compares the preview generation time of the
+// resample filters. Run with: go test -run none -bench ResampleFilter
+func BenchmarkResampleFilter(b *testing.B) {
+	os.MkdirAll("tmpout/BenchmarkResampleFilter", os.ModePerm)
+	for _, filter := range []string{"box", "linear", "catmullrom", "lanczos"} {
+		media := createMedia("", "", true, false, false, false, true, true, true, 1280, false, false, false, false,
+			mediaOptions{resampleFilter: filter})
+		b.Run(filter, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := media.cache.generateImagePreview("testmedia/png.png", "tmpout/BenchmarkResampleFilter/"+filter+".jpg")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func tWritePreview(t *testing.T, media *Media, inFileName, outFileName string, failExpected bool) {
 	t.Helper()
 	os.Remove(outFileName)
 	outFile, err := os.Create(outFileName)
 	assertExpectNoErr(t, "unable to create out", err)
 	defer outFile.Close()
-	err = media.writePreview(outFile, inFileName)
+	err = media.writePreview(outFile, inFileName, previewFormatJPEG)
 	if failExpected {
 		assertExpectErr(t, "should fail", err)
 	} else {
@@ -768,7 +1730,7 @@ func TestWritePreview(t *testing.T) {
 	os.RemoveAll("tmpout/TestWritePreview")
 	os.MkdirAll("tmpout/TestWritePreview", os.ModePerm)
 
-	media := createMedia("testmedia", "tmpcache/TestWritePreview", true, false, false, false, true, true, true, 970, false, false, false, false)
+	media := createMedia("testmedia", "tmpcache/TestWritePreview", true, false, false, false, true, true, true, 970, false, false, false, false, mediaOptions{})
 
 	// JPEG
 	tWritePreview(t, media, "jpeg.jpg", "tmpout/TestWritePreview/jpeg.jpg", false)
@@ -794,7 +1756,7 @@ func TestWritePreview(t *testing.T) {
 	// Invalid file
 	tWritePreview(t, media, "invalid.jpg", "tmpout/TestWritePreview/invalid.jpg", true)
 	// Check that error indication file is created
-	assertFileExist(t, "", "tmpcache/TestWritePreview/invalid.preview.err.txt")
+	assertFileExist(t, "", "tmpcache/TestWritePreview/invalid.jpg.preview.err.txt")
 	// Regenerate for increased coverage
 	tWritePreview(t, media, "invalid.jpg", "tmpout/TestWritePreview/invalid.jpg", true)
 
@@ -802,8 +1764,491 @@ func TestWritePreview(t *testing.T) {
 	tWritePreview(t, media, "../../secret.jpg", "tmpout/TestWritePreview/invalid.jpg", true)
 
 	// Disable preview
-	media = createMedia("testmedia", "tmpcache/TestWritePreview", false, false, false, false, true, true, false, 0, false, false, false, false)
+	media = createMedia("testmedia", "tmpcache/TestWritePreview", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
 
 	// Should fail since preview is disabled now
 	tWritePreview(t, media, "jpeg.jpg", "tmpout/TestWritePreview/jpeg.jpg", true)
 }
+
+func TestPreviewMinSide(t *testing.T) {
+	os.RemoveAll("tmpcache/TestPreviewMinSide")
+	os.MkdirAll("tmpcache/TestPreviewMinSide", os.ModePerm)
+
+	// Default is previewMaxSide, tiff.tiff is 979x734
+	media := createMedia("testmedia", "tmpcache/TestPreviewMinSide", true, false, false, false, true, true, true, 1280, false, false, false, false, mediaOptions{})
+	assertEqualsInt(t, "", 1280, media.cache.previewMinSide)
+	_, tooSmall, err := media.cache.generatePreview(media, "tiff.tiff")
+	assertExpectErr(t, "", err)
+	assertTrue(t, "tiff.tiff too small", tooSmall)
+
+	// screenshot_browser.jpg is 680x445
+	media = createMedia("testmedia", "tmpcache/TestPreviewMinSide", true, false, false, false, true, true, true, 1280, false, false, false, false,
+		mediaOptions{previewMinSide: 700})
+	_, tooSmall, err = media.cache.generatePreview(media, "screenshot_browser.jpg")
+	assertExpectErr(t, "", err)
+	assertTrue(t, "screenshot_browser.jpg too small", tooSmall)
+	previewPath, tooSmall, err := media.cache.generatePreview(media, "tiff.tiff")
+	assertExpectNoErr(t, "", err)
+	assertFalse(t, "tiff.tiff too small", tooSmall)
+	width, height, err := media.getImageWidthAndHeight(previewPath)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "Not upscaled", 979, width)
+	assertEqualsInt(t, "Not upscaled", 734, height)
+}
+
+// writeErrorIndication writes an error indication file with the provided
+// number of attempts made the provided time ago
+func writeErrorIndication(t *testing.T, fileName string, attempts int, ago time.Duration) {
+	t.Helper()
+	content := fmt.Sprintf("attempts: %d\nlast: %s\nfailed", attempts, time.Now().Add(-ago).Format(time.RFC3339))
+	assertExpectNoErr(t, "", os.WriteFile(fileName, []byte(content), 0644))
+}
+
+func TestStaleThumbnail(t *testing.T) {
+	mediaPath := "tmpout/TestStaleThumbnail"
+	cachePath := "tmpcache/TestStaleThumbnail"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/image.png")
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 0, true, false, false, false, mediaOptions{})
+	thumbFileName, err := media.cache.generateThumbnail(media, "image.png")
+	assertExpectNoErr(t, "", err)
+	previewFileName, _, err := media.cache.generatePreview(media, "image.png")
+	assertExpectNoErr(t, "", err)
+
+	// The cache entry time is used for cache hits, i.e. the cache file
+	// is not checked
+	c := media.cache
+	relativeThumbPath, _ := c.relativeThumbnailPath("image.png")
+	relativePreviewPath, _ := c.relativePreviewPath("image.png")
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(thumbFileName, old, old)
+	os.Chtimes(mediaPath+"/image.png", old.Add(time.Minute), old.Add(time.Minute))
+	assertTrue(t, "", c.isUpToDate(media, "image.png", c.thumbnails, relativeThumbPath))
+
+	// Edit the image in place (after the thumbnail and preview were generated)
+	os.Chtimes(previewFileName, old, old)
+	c.setEntry(c.thumbnails, relativeThumbPath, old)
+	c.setEntry(c.previews, relativePreviewPath, old)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/image.png")
+	_, err = media.cache.generateThumbnail(media, "image.png")
+	assertExpectNoErr(t, "", err)
+	stat, _ := os.Stat(thumbFileName)
+	assertTrue(t, "Thumbnail shall be regenerated", stat.ModTime().After(old))
+	stat, _ = os.Stat(previewFileName)
+	assertTrue(t, "Preview not requested yet", stat.ModTime().Equal(old))
+
+	// Pre-cache shall regenerate the stale preview
+	statistics := media.generateCache("", false, true, true)
+	assertEqualsInt(t, "", 0, statistics.NbrOfImageThumb)
+	assertEqualsInt(t, "", 1, statistics.NbrOfImagePreview)
+	stat, _ = os.Stat(previewFileName)
+	assertTrue(t, "Preview shall be regenerated", stat.ModTime().After(old))
+
+	// Disabled
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 0, true, false, false, false,
+		mediaOptions{noCheckStale: true})
+	os.Chtimes(thumbFileName, old, old)
+	_, err = media.cache.generateThumbnail(media, "image.png")
+	assertExpectNoErr(t, "", err)
+	stat, _ = os.Stat(thumbFileName)
+	assertTrue(t, "Thumbnail shall not be regenerated", stat.ModTime().Equal(old))
+}
+
+func TestThumbnailRetry(t *testing.T) {
+	mediaPath := "tmpout/TestThumbnailRetry"
+	cachePath := "tmpcache/TestThumbnailRetry"
+	errFile := cachePath + "/image.png.thumb.err.txt"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	os.MkdirAll(cachePath, os.ModePerm)
+	copyFile(t, "testmedia/invalid.jpg", mediaPath+"/image.png")
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{thumbRetryDelay: time.Hour, thumbMaxRetries: 2})
+
+	// First attempt
+	_, err := media.cache.generateThumbnail(media, "image.png")
+	assertExpectErr(t, "", err)
+	indication, err := readErrorIndicationFile(errFile)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, indication.attempts)
+
+	// Retry delay not elapsed
+	_, err = media.cache.generateThumbnail(media, "image.png")
+	assertExpectErr(t, "", err)
+	indication, _ = readErrorIndicationFile(errFile)
+	assertEqualsInt(t, "", 1, indication.attempts)
+
+	// Retry delay elapsed, fails again
+	writeErrorIndication(t, errFile, 1, 2*time.Hour)
+	_, err = media.cache.generateThumbnail(media, "image.png")
+	assertExpectErr(t, "", err)
+	indication, _ = readErrorIndicationFile(errFile)
+	assertEqualsInt(t, "", 2, indication.attempts)
+
+	// The delay is doubled for the second retry
+	copyFile(t, "testmedia/png.png", mediaPath+"/image.png")
+	writeErrorIndication(t, errFile, 2, 90*time.Minute)
+	_, err = media.cache.generateThumbnail(media, "image.png")
+	assertExpectErr(t, "", err)
+	writeErrorIndication(t, errFile, 2, 3*time.Hour)
+	thumbFileName, err := media.cache.generateThumbnail(media, "image.png")
+	assertExpectNoErr(t, "", err)
+	assertFileExist(t, "", thumbFileName)
+	assertFileNotExist(t, "", errFile)
+
+	// Retries exhausted
+	relativeThumbPath, _ := media.cache.relativeThumbnailPath("image.png")
+	assertExpectNoErr(t, "", media.cache.removeCacheFile(relativeThumbPath))
+	writeErrorIndication(t, errFile, 3, 1000*time.Hour)
+	_, err = media.cache.generateThumbnail(media, "image.png")
+	assertExpectErr(t, "", err)
+
+	// Error indication file without attempts (one attempt at mod time)
+	assertExpectNoErr(t, "", os.WriteFile(errFile, []byte("failed"), 0644))
+	_, err = media.cache.generateThumbnail(media, "image.png")
+	assertExpectErr(t, "", err)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(errFile, old, old)
+	_, err = media.cache.generateThumbnail(media, "image.png")
+	assertExpectNoErr(t, "", err)
+
+	// Never retry by default
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	assertExpectNoErr(t, "", media.cache.removeCacheFile(relativeThumbPath))
+	writeErrorIndication(t, errFile, 1, 1000*time.Hour)
+	_, err = media.cache.generateThumbnail(media, "image.png")
+	assertExpectErr(t, "", err)
+}
+
+func TestCacheEntryTTL(t *testing.T) {
+	os.RemoveAll("tmpcache/TestCacheEntryTTL")
+	os.MkdirAll("tmpcache/TestCacheEntryTTL", os.ModePerm)
+
+	options := mediaOptions{cacheEntryTTL: time.Hour, cacheExpirePreviews: true}
+	media := createMedia("testmedia", "tmpcache/TestCacheEntryTTL", true, false, false, false, true, true, true, 970, false, false, false, false, options)
+	c := media.cache
+
+	thumbPath, err := c.generateThumbnail(media, "jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	previewPath, _, err := c.generatePreview(media, "jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+
+	// Nothing has expired yet
+	assertEqualsInt(t, "", 0, c.evictExpired())
+	assertFileExist(t, "", previewPath)
+
+	// Age all entries, only the preview shall be evicted
+	relativeThumbPath, _ := c.relativeThumbnailPath("jpeg.jpg")
+	relativePreviewPath, _ := c.relativePreviewPath("jpeg.jpg")
+	old := time.Now().Add(-2 * time.Hour)
+	c.setEntry(c.thumbnails, relativeThumbPath, old)
+	c.setEntry(c.previews, relativePreviewPath, old)
+	assertEqualsInt(t, "", 1, c.evictExpired())
+	assertFileNotExist(t, "", previewPath)
+	assertFalse(t, "", c.hasPreview("jpeg.jpg"))
+	assertFileExist(t, "", thumbPath)
+	assertTrue(t, "", c.hasThumbnail("jpeg.jpg"))
+
+	// Access shall refresh the entry
+	_, err = c.generateThumbnail(media, "jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	c.expireThumbnails = true
+	assertEqualsInt(t, "", 0, c.evictExpired())
+
+	// Cache loaded on startup shall use the file modification time
+	os.Chtimes(thumbPath, old, old)
+	options.cacheExpireThumbnails = true
+	media = createMedia("testmedia", "tmpcache/TestCacheEntryTTL", true, false, false, false, true, true, true, 970, false, false, false, false, options)
+	assertEqualsInt(t, "", 1, media.cache.evictExpired())
+	assertFileNotExist(t, "", thumbPath)
+
+	// TTL disabled
+	media = createMedia("testmedia", "tmpcache/TestCacheEntryTTL", true, false, false, false, true, true, true, 970, false, false, false, false, mediaOptions{})
+	assertEqualsInt(t, "", 0, media.cache.evictExpired())
+}
+
+func TestCacheEvict(t *testing.T) {
+	os.RemoveAll("tmpcache/TestCacheEvict")
+	os.MkdirAll("tmpcache/TestCacheEvict", os.ModePerm)
+
+	media := createMedia("testmedia", "tmpcache/TestCacheEvict", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	c := media.cache
+	assertFalse(t, "", c.isEvictionEnabled())
+
+	// Thumbnails with oldest access first
+	mediaFiles := []string{"png.png", "tiff.tiff", "jpeg.jpg"}
+	var sizes []int64
+	for i, mediaFile := range mediaFiles {
+		thumbPath, err := c.generateThumbnail(media, mediaFile)
+		assertExpectNoErr(t, "", err)
+		fileInfo, err := os.Stat(thumbPath)
+		assertExpectNoErr(t, "", err)
+		sizes = append(sizes, fileInfo.Size())
+		relativeThumbPath, _ := c.relativeThumbnailPath(mediaFile)
+		c.setEntry(c.thumbnails, relativeThumbPath, time.Now().Add(time.Duration(i-len(mediaFiles))*time.Hour))
+	}
+
+	// Nothing to evict
+	c.maxSize = sizes[0] + sizes[1] + sizes[2]
+	assertTrue(t, "", c.isEvictionEnabled())
+	assertEqualsInt(t, "", 0, c.evict())
+
+	// Least recently used shall be evicted first
+	c.maxSize = sizes[1] + sizes[2]
+	assertEqualsInt(t, "", 1, c.evict())
+	assertFalse(t, "", c.hasThumbnail("png.png"))
+	assertTrue(t, "", c.hasThumbnail("tiff.tiff"))
+	assertFileNotExist(t, "", "tmpcache/TestCacheEvict/png.png.thumb.jpg")
+	assertFileExist(t, "", "tmpcache/TestCacheEvict/tiff.tiff.thumb.jpg")
+
+	// Max age (tiff.tiff accessed two hours ago and jpeg.jpg one hour ago)
+	c.maxSize = 0
+	c.maxAge = 90 * time.Minute
+	assertEqualsInt(t, "", 1, c.evict())
+	assertFalse(t, "", c.hasThumbnail("tiff.tiff"))
+	assertTrue(t, "", c.hasThumbnail("jpeg.jpg"))
+}
+
+func TestProgress(t *testing.T) {
+	cache := "tmpcache/TestProgress"
+	os.RemoveAll(cache)
+	os.MkdirAll(cache, os.ModePerm)
+
+	media := createMedia("testmedia", cache, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	// No generation in progress
+	_, ok := media.subscribeProgress()
+	assertFalse(t, "", ok)
+
+	// Subscribe twice to check that all listeners get the updates
+	go media.generateCache("", true, true, false)
+	var listener1, listener2 chan PreCacheProgress
+	for i := 0; i < 100 && !ok; i++ {
+		listener1, ok = media.subscribeProgress()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertTrue(t, "Never subscribed", ok)
+	listener2, ok = media.subscribeProgress()
+	assertTrue(t, "Never subscribed", ok)
+
+	var progress1, progress2 PreCacheProgress
+	for progress := range listener1 {
+		progress1 = progress
+	}
+	for progress := range listener2 {
+		progress2 = progress
+	}
+	assertTrue(t, "No images reported", progress1.NbrOfImages > 0)
+	assertTrue(t, "No images reported", progress2.NbrOfImages > 0)
+	assertFalse(t, "", media.isPreCacheInProgress())
+
+	// Unsubscribe of closed channel shall be ok
+	media.unsubscribeProgress(listener1)
+}
+
+func TestCancelPreCache(t *testing.T) {
+	cache := "tmpcache/TestCancelPreCache"
+	os.RemoveAll(cache)
+	os.MkdirAll(cache, os.ModePerm)
+
+	media := createMedia("testmedia", cache, true, false, false, false, true, true, true, 1280, false, false, false, false, mediaOptions{})
+
+	// Nothing to cancel
+	assertFalse(t, "", media.cancelPreCacheInProgress())
+
+	statChan := make(chan *PreCacheStatistics)
+	go func() {
+		statChan <- media.generateCache("", true, true, true)
+	}()
+	var listener chan PreCacheProgress
+	ok := false
+	for i := 0; i < 100 && !ok; i++ {
+		listener, ok = media.subscribeProgress()
+		time.Sleep(time.Millisecond)
+	}
+	assertTrue(t, "Never subscribed", ok)
+
+	// Cancel when first file has been processed
+	<-listener
+	assertTrue(t, "", media.cancelPreCacheInProgress())
+	var stat *PreCacheStatistics
+	select {
+	case stat = <-statChan:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Generation not stopped")
+	}
+	assertTrue(t, "", stat.Cancelled)
+	assertFalse(t, "", media.isPreCacheInProgress())
+	assertFalse(t, "", media.cancelPreCacheInProgress())
+
+	// Restart shall continue where it was cancelled
+	stat = media.generateCache("", true, true, true)
+	assertFalse(t, "", stat.Cancelled)
+}
+
+func TestCacheUnavailable(t *testing.T) {
+	mediaPath := "tmpout/TestCacheUnavailable"
+	cachePath := "tmpcache/TestCacheUnavailable"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/image.png")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/exif.jpg") // Has EXIF thumbnail
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 0, true, false, false, false, mediaOptions{})
+	assertTrue(t, "Cache path shall be created", media.cacheAvailable())
+
+	// E.g. removable drive unmounted
+	os.RemoveAll(cachePath)
+	assertTrue(t, "", !media.cacheAvailable())
+	_, err := media.cache.generateThumbnail(media, "image.png")
+	assertTrue(t, "", err == errCacheUnavailable)
+	_, _, err = media.cache.generatePreview(media, "image.png")
+	assertTrue(t, "", err == errCacheUnavailable)
+	assertFileNotExist(t, "No error indication files", cachePath)
+
+	// EXIF thumbnails shall still be available
+	var buf bytes.Buffer
+	assertExpectNoErr(t, "", media.writeThumbnail(&buf, "exif.jpg"))
+	assertExpectErr(t, "", media.writeThumbnail(&buf, "image.png"))
+
+	// Mounted again
+	os.MkdirAll(cachePath, os.ModePerm)
+	assertTrue(t, "", media.cacheAvailable())
+	thumbFileName, err := media.cache.generateThumbnail(media, "image.png")
+	assertExpectNoErr(t, "", err)
+	assertFileExist(t, "", thumbFileName)
+}
+
+func TestEnhancePreview(t *testing.T) {
+	cachePath := "tmpcache/TestEnhancePreview"
+	os.RemoveAll(cachePath)
+
+	media := createMedia("testmedia", cachePath, true, false, false, false, true, true, true, 200, false, false, false, false,
+		mediaOptions{})
+	plainFile := cachePath + "/plain.jpg"
+	err := media.cache.generateImagePreview("testmedia/jpeg.jpg", plainFile)
+	assertExpectNoErr(t, "", err)
+
+	media = createMedia("testmedia", cachePath, true, false, false, false, true, true, true, 200, false, false, false, false,
+		mediaOptions{enhancePreviews: true, contrast: 20})
+	enhancedFile := cachePath + "/enhanced.jpg"
+	err = media.cache.generateImagePreview("testmedia/jpeg.jpg", enhancedFile)
+	assertExpectNoErr(t, "", err)
+
+	plain, err := imaging.Open(plainFile)
+	assertExpectNoErr(t, "", err)
+	enhanced, err := imaging.Open(enhancedFile)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "Same size", plain.Bounds().Dx(), enhanced.Bounds().Dx())
+	assertEqualsInt(t, "Same size", plain.Bounds().Dy(), enhanced.Bounds().Dy())
+	differs := false
+	for y := 0; y < plain.Bounds().Dy() && !differs; y++ {
+		for x := 0; x < plain.Bounds().Dx() && !differs; x++ {
+			differs = colorDistance(plain.At(x, y), enhanced.At(x, y)) > 10
+		}
+	}
+	assertTrue(t, "Enhanced preview shall differ", differs)
+}
+
+func TestClearErrors(t *testing.T) {
+	mediaPath := "tmpout/TestClearErrors"
+	cachePath := "tmpcache/TestClearErrors"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/invalid.jpg", mediaPath+"/invalid.jpg")
+	copyFile(t, "testmedia/invalid.jpg", mediaPath+"/sub/invalid.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/sub/png.png")
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	media.generateCache("", true, true, false)
+	assertFileExist(t, "", cachePath+"/invalid.jpg.thumb.err.txt")
+	assertFileExist(t, "", cachePath+"/sub/invalid.jpg.thumb.err.txt")
+
+	// Only the folder itself
+	cleared, err := media.clearErrors("", false)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, cleared.NbrOfClearedErrors)
+	assertFileNotExist(t, "", cachePath+"/invalid.jpg.thumb.err.txt")
+	assertFileExist(t, "", cachePath+"/sub/invalid.jpg.thumb.err.txt")
+
+	// Recursive
+	cleared, err = media.clearErrors("", true)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, cleared.NbrOfClearedErrors)
+	assertFileNotExist(t, "", cachePath+"/sub/invalid.jpg.thumb.err.txt")
+	assertFileExist(t, "", cachePath+"/sub/png.png.thumb.jpg")
+
+	_, err = media.clearErrors("sub/png.png", false)
+	assertExpectErr(t, "", err)
+	_, err = media.clearErrors("../TestClearErrors2", false)
+	assertExpectErr(t, "", err)
+}
+
+func TestReadyAfterGenerateAllCache(t *testing.T) {
+	mediaPath := "tmpout/TestReadyAfterGenerateAllCache"
+	cachePath := "tmpcache/TestReadyAfterGenerateAllCache"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	assertTrue(t, "", media.isReady())
+
+	media.ready = false // As when generating on startup
+	media.generateAllCache(context.Background(), true, false)
+	assertTrue(t, "", media.isReady())
+	assertFileExist(t, "", cachePath+"/png.png.thumb.jpg")
+}
+
+func TestCacheAtomicWrite(t *testing.T) {
+	cachePath := "tmpcache/TestCacheAtomicWrite"
+	os.RemoveAll(cachePath)
+	media := createMedia("testmedia", cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	os.MkdirAll(cachePath, os.ModePerm)
+	interrupted := func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return fmt.Errorf("interrupted")
+	}
+
+	// Interrupted write leaves no file, neither the cache file nor the temporary file
+	err := media.cache.writeCacheFile(cachePath+"/interrupted.thumb.jpg", "thumbnail", interrupted)
+	assertExpectErr(t, "", err)
+	assertFileNotExist(t, "", cachePath+"/interrupted.thumb.jpg")
+	dirEntries, _ := os.ReadDir(cachePath)
+	assertEqualsInt(t, "No temporary files", 0, len(dirEntries))
+
+	// An existing file is kept if interrupted, and replaced when complete
+	os.WriteFile(cachePath+"/existing.thumb.jpg", []byte("existing"), 0644)
+	assertExpectErr(t, "", media.cache.writeCacheFile(cachePath+"/existing.thumb.jpg", "thumbnail", interrupted))
+	content, _ := os.ReadFile(cachePath + "/existing.thumb.jpg")
+	assertEqualsStr(t, "", "existing", string(content))
+	err = media.cache.writeCacheFile(cachePath+"/existing.thumb.jpg", "thumbnail", func(w io.Writer) error {
+		_, err := w.Write([]byte("complete"))
+		return err
+	})
+	assertExpectNoErr(t, "", err)
+	content, _ = os.ReadFile(cachePath + "/existing.thumb.jpg")
+	assertEqualsStr(t, "", "complete", string(content))
+	dirEntries, _ = os.ReadDir(cachePath)
+	assertEqualsInt(t, "No temporary files", 1, len(dirEntries))
+
+	// Generated thumbnails are complete
+	_, err = media.cache.generateThumbnail(media, "png.png")
+	assertExpectNoErr(t, "", err)
+	_, err = imaging.Open(cachePath + "/png.png.thumb.jpg")
+	assertExpectNoErr(t, "", err)
+
+	// Written in place when disabled, i.e. the partial file is left
+	media = createMedia("testmedia", cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{cacheWriteInPlace: true})
+	assertExpectErr(t, "", media.cache.writeCacheFile(cachePath+"/inplace.thumb.jpg", "thumbnail", interrupted))
+	content, _ = os.ReadFile(cachePath + "/inplace.thumb.jpg")
+	assertEqualsStr(t, "", "partial", string(content))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metricsRoutes are the first path segments that are counted as separate
+// routes in the request metrics. Other requests (the web client files and
+// invalid paths) are counted as "static" to keep the number of series low.
+var metricsRoutes = map[string]bool{
+	"login": true, "logout": true, "folder": true, "media": true, "live": true,
+	"download": true, "move": true, "batchmeta": true, "thumb": true,
+	"thumbsheet": true, "thumbsheetmap": true, "isPreCacheInProgress": true,
+	"cancel-precache": true, "clearerrors": true, "duplicates": true,
+	"search": true, "similar": true, "bydate": true, "capabilities": true,
+	"color": true, "recent": true, "cachestats": true, "prune": true, "trash": true,
+	"upload": true, "dimensions": true, "progressive": true, "progress": true, "metrics": true,
+	"healthz": true, "readyz": true, "shutdown": true, "loglevel": true}
+
+// metricsMethods are the HTTP methods counted separately, others are
+// counted as "other"
+var metricsMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true, "OPTIONS": true}
+
+// Metrics holds the counters provided by /metrics. The counters are keyed
+// on their formatted labels, e.g. kind="thumbnail",result="ok".
+type Metrics struct {
+	mutex           sync.Mutex
+	requests        map[string]uint64  // HTTP requests by route, method and status
+	generated       map[string]uint64  // Generated thumbnails/previews by kind and result
+	generationCount map[string]uint64  // Successful generations by kind
+	generationTime  map[string]float64 // Seconds spent on successful generations by kind
+	cacheRequests   map[string]uint64  // Cache lookups by kind and result (hit/miss)
+}
+
+// appMetrics holds the metrics of the process. It is updated from both
+// the Web API and the cache, also when /metrics is disabled (it is cheap).
+var appMetrics = newMetrics()
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		requests:        map[string]uint64{},
+		generated:       map[string]uint64{},
+		generationCount: map[string]uint64{},
+		generationTime:  map[string]float64{},
+		cacheRequests:   map[string]uint64{}}
+}
+
+// countRequest counts a served HTTP request
+func (mt *Metrics) countRequest(route, method string, status int) {
+	if !metricsRoutes[route] {
+		route = "static"
+	}
+	if !metricsMethods[method] {
+		method = "other"
+	}
+	labels := fmt.Sprintf("route=%q,method=%q,status=\"%d\"", route, method, status)
+	mt.mutex.Lock()
+	mt.requests[labels]++
+	mt.mutex.Unlock()
+}
+
+// countGeneration counts a thumbnail or preview generation and the time
+// it took
+func (mt *Metrics) countGeneration(kind string, duration time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	labels := fmt.Sprintf("kind=%q,result=%q", kind, result)
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	mt.generated[labels]++
+	if err == nil {
+		kindLabel := fmt.Sprintf("kind=%q", kind)
+		mt.generationCount[kindLabel]++
+		mt.generationTime[kindLabel] += duration.Seconds()
+	}
+}
+
+// countCache counts a cache lookup of a thumbnail or preview
+func (mt *Metrics) countCache(kind string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	labels := fmt.Sprintf("kind=%q,result=%q", kind, result)
+	mt.mutex.Lock()
+	mt.cacheRequests[labels]++
+	mt.mutex.Unlock()
+}
+
+// write writes all metrics, including the thumbnail/preview generation
+// progress of media, in the Prometheus text exposition format
+func (mt *Metrics) write(w io.Writer, media *Media) {
+	mt.mutex.Lock()
+	writeCounter(w, "mediaweb_http_requests_total", "Number of HTTP requests by route, method and status.", mt.requests)
+	writeCounter(w, "mediaweb_generated_total", "Number of thumbnail and preview generations by result.", mt.generated)
+	fmt.Fprintln(w, "# HELP mediaweb_generation_seconds Time spent on successful thumbnail and preview generations.")
+	fmt.Fprintln(w, "# TYPE mediaweb_generation_seconds summary")
+	for _, labels := range sortedLabels(mt.generationCount) {
+		fmt.Fprintf(w, "mediaweb_generation_seconds_sum{%s} %g\n", labels, mt.generationTime[labels])
+		fmt.Fprintf(w, "mediaweb_generation_seconds_count{%s} %d\n", labels, mt.generationCount[labels])
+	}
+	writeCounter(w, "mediaweb_cache_requests_total", "Number of thumbnail and preview cache lookups by result.", mt.cacheRequests)
+	mt.mutex.Unlock()
+
+	progress, inProgress := media.getProgress()
+	fmt.Fprintln(w, "# HELP mediaweb_precache_in_progress 1 if thumbnail/preview generation is in progress.")
+	fmt.Fprintln(w, "# TYPE mediaweb_precache_in_progress gauge")
+	if inProgress {
+		fmt.Fprintln(w, "mediaweb_precache_in_progress 1")
+	} else {
+		fmt.Fprintln(w, "mediaweb_precache_in_progress 0")
+	}
+	fmt.Fprintln(w, "# HELP mediaweb_precache_processed Number of folders and files processed by the ongoing or last generation.")
+	fmt.Fprintln(w, "# TYPE mediaweb_precache_processed gauge")
+	fmt.Fprintf(w, "mediaweb_precache_processed{type=\"folder\"} %d\n", progress.NbrOfFolders)
+	fmt.Fprintf(w, "mediaweb_precache_processed{type=\"image\"} %d\n", progress.NbrOfImages)
+	fmt.Fprintf(w, "mediaweb_precache_processed{type=\"video\"} %d\n", progress.NbrOfVideos)
+}
+
+// writeCounter writes a counter with one line per label set
+func writeCounter(w io.Writer, name, help string, counter map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	for _, labels := range sortedLabels(counter) {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, labels, counter[labels])
+	}
+}
+
+// sortedLabels returns the label sets of a metric in a stable order
+func sortedLabels(metric map[string]uint64) []string {
+	labels := make([]string, 0, len(metric))
+	for label := range metric {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	metrics := newMetrics()
+	metrics.countRequest("thumb", "GET", 200)
+	metrics.countRequest("thumb", "GET", 200)
+	metrics.countRequest("index.html", "GET", 200)
+	metrics.countRequest("folder", "PROPFIND", 404)
+	metrics.countGeneration("thumbnail", 1500*time.Millisecond, nil)
+	metrics.countGeneration("thumbnail", time.Second, errors.New("failed"))
+	metrics.countCache("preview", true)
+	metrics.countCache("preview", false)
+
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	var buf bytes.Buffer
+	metrics.write(&buf, media)
+	text := buf.String()
+	for _, line := range []string{
+		"# TYPE mediaweb_http_requests_total counter",
+		`mediaweb_http_requests_total{route="thumb",method="GET",status="200"} 2`,
+		`mediaweb_http_requests_total{route="static",method="GET",status="200"} 1`,
+		`mediaweb_http_requests_total{route="folder",method="other",status="404"} 1`,
+		`mediaweb_generated_total{kind="thumbnail",result="ok"} 1`,
+		`mediaweb_generated_total{kind="thumbnail",result="error"} 1`,
+		`mediaweb_generation_seconds_sum{kind="thumbnail"} 1.5`,
+		`mediaweb_generation_seconds_count{kind="thumbnail"} 1`,
+		`mediaweb_cache_requests_total{kind="preview",result="hit"} 1`,
+		`mediaweb_cache_requests_total{kind="preview",result="miss"} 1`,
+		"mediaweb_precache_in_progress 0",
+		`mediaweb_precache_processed{type="image"} 0`} {
+		assertTrue(t, line, strings.Contains(text, line+"\n"))
+	}
+}
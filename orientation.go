@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/goexif2/exif"
+	"github.com/disintegration/imaging"
+	log "github.com/sirupsen/logrus"
+)
+
+// orientationFileName is the name of the file in a media folder that
+// overrides the EXIF orientation of its images, see readForcedOrientation
+const orientationFileName = ".orientation"
+
+// readForcedOrientation returns the EXIF orientation (1, 3, 6 or 8) of
+// an image given by the .orientation file in the same folder, or 0 if
+// the image isn't listed or there is no such file. Each line in the file
+// is a file name and the clockwise rotation in degrees, for example:
+//
+//	# Old camera without orientation tag
+//	IMG_0012.JPG = 90
+//	IMG_0013.JPG = 0
+//
+// 0 means no rotation, even if the EXIF orientation says otherwise.
+func readForcedOrientation(fullPath string) int {
+	file, err := os.Open(filepath.Join(filepath.Dir(fullPath), orientationFileName))
+	if err != nil {
+		return 0 // No .orientation file is normal
+	}
+	defer file.Close()
+	name := filepath.Base(fullPath)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		separator := strings.LastIndex(line, "=")
+		if separator < 0 || strings.TrimSpace(line[:separator]) != name {
+			continue
+		}
+		degrees, err := strconv.Atoi(strings.TrimSpace(line[separator+1:]))
+		if err != nil || degrees%90 != 0 {
+			log.Warnf("Invalid rotation '%s' in %s", line, file.Name())
+			return 0
+		}
+		switch (degrees%360 + 360) % 360 {
+		case 90:
+			return 6
+		case 180:
+			return 3
+		case 270:
+			return 8
+		default:
+			return 1
+		}
+	}
+	return 0
+}
+
+// getOrientation returns the EXIF orientation (1-8) of an image. If
+// forceRotate is enabled the .orientation file of the folder is checked
+// first, see readForcedOrientation. Returns 0 if unknown.
+func (m *Media) getOrientation(relativeFilePath string) int {
+	if m.forceRotate {
+		fullPath, err := m.getFullMediaPath(relativeFilePath)
+		if err != nil {
+			return 0
+		}
+		if orientation := readForcedOrientation(fullPath); orientation > 0 {
+			return orientation
+		}
+	}
+	ex := m.extractEXIF(relativeFilePath)
+	if ex == nil {
+		return 0 // No EXIF info exist
+	}
+	orientTag, _ := ex.Get(exif.Orientation)
+	if orientTag == nil {
+		return 0 // No Orientation
+	}
+	orientInt, _ := orientTag.Int(0)
+	if orientInt < 1 || orientInt > 8 {
+		return 0
+	}
+	return orientInt
+}
+
+// applyOrientation rotates and/or flips an image according to an EXIF
+// orientation (2-8). The image is returned as is for other values.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipV(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.Rotate180(imaging.FlipV(img))
+	case 5:
+		return imaging.Rotate270(imaging.FlipV(img))
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Rotate90(imaging.FlipV(img))
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestReadForcedOrientation(t *testing.T) {
+	mediaPath := "tmpout/TestReadForcedOrientation"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	assertEqualsInt(t, "No .orientation file", 0, readForcedOrientation(mediaPath+"/a.jpg"))
+
+	content := "# Comment\n\n a.jpg = 90\nb.jpg=180\nc.jpg = 270\nd.jpg = 0\ne.jpg = -90\nf.jpg = 45\nname=with=equal.jpg = 360\n"
+	err := os.WriteFile(mediaPath+"/"+orientationFileName, []byte(content), 0644)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 6, readForcedOrientation(mediaPath+"/a.jpg"))
+	assertEqualsInt(t, "", 3, readForcedOrientation(mediaPath+"/b.jpg"))
+	assertEqualsInt(t, "", 8, readForcedOrientation(mediaPath+"/c.jpg"))
+	assertEqualsInt(t, "", 1, readForcedOrientation(mediaPath+"/d.jpg"))
+	assertEqualsInt(t, "", 8, readForcedOrientation(mediaPath+"/e.jpg"))
+	assertEqualsInt(t, "Invalid", 0, readForcedOrientation(mediaPath+"/f.jpg"))
+	assertEqualsInt(t, "", 1, readForcedOrientation(mediaPath+"/name=with=equal.jpg"))
+	assertEqualsInt(t, "Not listed", 0, readForcedOrientation(mediaPath+"/g.jpg"))
+	assertEqualsInt(t, "Case sensitive", 0, readForcedOrientation(mediaPath+"/A.jpg"))
+}
+
+func TestForceRotate(t *testing.T) {
+	mediaPath := "tmpout/TestForceRotate"
+	cachePath := "tmpcache/TestForceRotate"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/exif_rotate/no_exif.jpg", mediaPath+"/no_exif.jpg")
+	copyFile(t, "testmedia/exif_rotate/rotate_90deg_cw.jpg", mediaPath+"/rotated.jpg")
+	content := "no_exif.jpg = 90\nrotated.jpg = 0\n"
+	err := os.WriteFile(mediaPath+"/"+orientationFileName, []byte(content), 0644)
+	assertExpectNoErr(t, "", err)
+
+	// Disabled, only EXIF is used
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	assertTrue(t, "", !media.isRotationNeeded("no_exif.jpg"))
+	assertTrue(t, "", media.isRotationNeeded("rotated.jpg"))
+	width, height, err := media.getImageWidthAndHeight(mediaPath + "/no_exif.jpg")
+	assertExpectNoErr(t, "", err)
+
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{forceRotate: true})
+	assertTrue(t, "", media.isRotationNeeded("no_exif.jpg"))
+	assertTrue(t, "", !media.isRotationNeeded("rotated.jpg"))
+	assertEqualsInt(t, "", 6, media.getOrientation("no_exif.jpg"))
+	rotatedWidth, rotatedHeight, err := media.getImageWidthAndHeight(mediaPath + "/no_exif.jpg")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", height, rotatedWidth)
+	assertEqualsInt(t, "", width, rotatedHeight)
+
+	// Rotated image shall be served
+	var buf bytes.Buffer
+	err = media.rotateAndWrite(&buf, "no_exif.jpg")
+	assertExpectNoErr(t, "", err)
+	img, err := imaging.Decode(&buf)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", height, img.Bounds().Dx())
+
+	// Generated thumbnail shall be rotated
+	thumbFileName, err := media.cache.generateThumbnail(media, "no_exif.jpg")
+	assertExpectNoErr(t, "", err)
+	thumb, err := imaging.Open(thumbFileName)
+	assertExpectNoErr(t, "", err)
+	original, err := imaging.Open(mediaPath + "/no_exif.jpg")
+	assertExpectNoErr(t, "", err)
+	expected := imaging.Thumbnail(imaging.Rotate270(original), 256, 256, imaging.Box)
+	differs := 0
+	for y := 0; y < 256; y += 16 {
+		for x := 0; x < 256; x += 16 {
+			if colorDistance(expected.At(x, y), thumb.At(x, y)) > 40 {
+				differs++
+			}
+		}
+	}
+	assertTrue(t, "Thumbnail shall be rotated", differs < 26) // Less than 10% (JPEG artifacts)
+}
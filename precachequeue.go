@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// preCacheQueue is the folders left to process by generateAllCache.
+// Folders browsed by clients are moved to the front of the queue, see
+// prioritize, so that they get their thumbnails quickly also when the
+// whole media path hasn't been processed yet.
+type preCacheQueue struct {
+	mutex   sync.Mutex
+	active  bool            // True while generateAllCache is using the queue
+	folders []string        // Relative paths of folders left to process, next first
+	queued  map[string]bool // Folders queued during this generation, also processed ones
+}
+
+// start (re)starts the queue with the root folder of the media path
+func (q *preCacheQueue) start() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.active = true
+	q.folders = []string{""}
+	q.queued = map[string]bool{"": true}
+}
+
+// stop clears the queue. Folders are not prioritized until the next start.
+func (q *preCacheQueue) stop() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.active = false
+	q.folders = nil
+	q.queued = nil
+}
+
+// push adds folders to the back of the queue. Folders already queued
+// (e.g. prioritized before their parent folder was processed) are
+// skipped.
+func (q *preCacheQueue) push(folders []string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, folder := range folders {
+		if !q.queued[folder] {
+			q.queued[folder] = true
+			q.folders = append(q.folders, folder)
+		}
+	}
+}
+
+// pop removes and returns the next folder to process. Returns false if
+// the queue is empty.
+func (q *preCacheQueue) pop() (string, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.folders) == 0 {
+		return "", false
+	}
+	folder := q.folders[0]
+	q.folders = q.folders[1:]
+	return folder, true
+}
+
+// prioritize moves a folder to the front of the queue, or adds it there
+// if it hasn't been queued yet. Returns false if the queue isn't active
+// or if the folder already has been processed.
+func (q *preCacheQueue) prioritize(folder string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.active {
+		return false
+	}
+	index := slices.Index(q.folders, folder)
+	if index < 0 && q.queued[folder] {
+		return false // Already processed (or in progress)
+	}
+	if index >= 0 {
+		q.folders = slices.Delete(q.folders, index, index+1)
+	}
+	q.queued[folder] = true
+	q.folders = slices.Insert(q.folders, 0, folder)
+	return true
+}
+
+// prioritizeFolder makes an ongoing generateAllCache process the folder
+// next, if it hasn't been processed already
+func (m *Media) prioritizeFolder(relativeFolderPath string) {
+	if m.preCacheQueue != nil && m.preCacheQueue.prioritize(relativeFolderPath) {
+		log.Debug("Prioritized thumbnail/preview generation of ", relativeFolderPath)
+	}
+}
+
+// updateCacheQueue generates thumbnails and previews for the folders in
+// the queue (starting with the whole media path) until it is empty or
+// ctx is done. Sub folders are added to the back of the queue.
+func (m *Media) updateCacheQueue(ctx context.Context, c *Cache, thumbnails, preview bool) *PreCacheStatistics {
+	ctx, started := m.startProgress(ctx, "")
+	if started {
+		defer m.stopProgress()
+	}
+	m.preCacheQueue.start()
+	defer m.preCacheQueue.stop()
+
+	stat := &PreCacheStatistics{}
+	for {
+		if ctx.Err() != nil {
+			stat.Cancelled = true
+			return stat
+		}
+		folder, ok := m.preCacheQueue.pop()
+		if !ok {
+			return stat
+		}
+		folderStat, subFolders := m.updateFolderCache(ctx, c, folder, thumbnails, preview)
+		stat.add(folderStat)
+		stat.NbrOfFolders += len(subFolders)
+		m.preCacheQueue.push(subFolders)
+	}
+}
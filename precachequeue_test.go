@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestPreCacheQueue(t *testing.T) {
+	q := &preCacheQueue{}
+	assertFalse(t, "Not active", q.prioritize("a"))
+
+	q.start()
+	folder, ok := q.pop()
+	assertTrue(t, "", ok)
+	assertEqualsStr(t, "", "", folder)
+	q.push([]string{"a", "b", "c"})
+	assertTrue(t, "", q.prioritize("c"))
+	assertTrue(t, "Not yet queued", q.prioritize("b/sub"))
+	assertFalse(t, "Already processed", q.prioritize(""))
+	q.push([]string{"b/sub", "b/other"}) // b/sub already queued
+
+	expected := []string{"b/sub", "c", "a", "b", "b/other"}
+	for _, expectedFolder := range expected {
+		folder, ok = q.pop()
+		assertTrue(t, "", ok)
+		assertEqualsStr(t, "", expectedFolder, folder)
+	}
+	_, ok = q.pop()
+	assertFalse(t, "Empty", ok)
+
+	q.stop()
+	assertFalse(t, "Stopped", q.prioritize("a"))
+}
+
+func TestUpdateCacheQueue(t *testing.T) {
+	mediaPath := "tmpout/TestUpdateCacheQueue"
+	cachePath := "tmpcache/TestUpdateCacheQueue"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath+"/a/b", os.ModePerm)
+	os.MkdirAll(mediaPath+"/c", os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/a/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/a/b/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/c/png.png")
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	assertTrue(t, "Queue by default", media.preCacheQueue != nil)
+
+	stat := media.updateCacheQueue(context.Background(), media.cache, true, false)
+	assertEqualsInt(t, "", 3, stat.NbrOfFolders)
+	assertEqualsInt(t, "", 4, stat.NbrOfImages)
+	assertEqualsInt(t, "", 4, stat.NbrOfImageThumb)
+	assertFalse(t, "", stat.Cancelled)
+	assertFileExist(t, "", cachePath+"/a/b/png.png.thumb.jpg")
+	assertFileExist(t, "", cachePath+"/c/png.png.thumb.jpg")
+	assertFalse(t, "Queue stopped", media.preCacheQueue.prioritize("c"))
+
+	// Cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stat = media.updateCacheQueue(ctx, media.cache, true, false)
+	assertTrue(t, "", stat.Cancelled)
+
+	// Directory order
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{noPreCachePriority: true})
+	assertTrue(t, "", media.preCacheQueue == nil)
+	media.prioritizeFolder("c") // No queue
+}
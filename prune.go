@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PruneResult is the number of files and directories removed from the
+// cache by pruneCache
+type PruneResult struct {
+	NbrRemovedFiles   int // Thumbnail, preview and error indication files
+	NbrRemovedFolders int // Empty cache directories
+}
+
+// pruneCache removes all thumbnail, preview and error indication files
+// in the whole cache that don't have any corresponding media file, and
+// all empty cache directories. Unlike cleanupCache it walks the cache
+// instead of the media, so it also finds the cache files of removed
+// folders. It can be run while serving requests.
+func (m *Media) pruneCache() (PruneResult, error) {
+	if m.cache == nil {
+		return PruneResult{}, fmt.Errorf("cache disabled")
+	}
+	if !m.cacheAvailable() {
+		return PruneResult{}, errCacheUnavailable
+	}
+	startTime := time.Now()
+	var result PruneResult
+	m.cache.pruneFolder(m, "", &result)
+	log.Infof("Pruned cache in %s. Removed %d files and %d folders.",
+		time.Since(startTime).Round(time.Millisecond), result.NbrRemovedFiles, result.NbrRemovedFolders)
+	return result, nil
+}
+
+// pruneFolder prunes a cache directory and its sub directories, see
+// pruneCache. Returns true if the directory is empty afterwards.
+func (c *Cache) pruneFolder(m *Media, relativePath string, result *PruneResult) bool {
+	fullCachePath, err := c.getFullCacheFolderPath(relativePath)
+	if err != nil {
+		return false
+	}
+	if c.mediaDirCache != "" {
+		// The cache folders of removed media folders are removed with
+		// them, and the cache folders are kept even if empty
+		for _, subFolder := range c.cacheSubFolders(relativePath, nil) {
+			c.pruneFolder(m, subFolder, result) // Recursive
+		}
+		if !isDir(fullCachePath) {
+			return false
+		}
+	}
+	dirEntries, err := os.ReadDir(fullCachePath)
+	if err != nil {
+		log.Warnf("Unable to prune %s. Reason: %s", fullCachePath, err)
+		return false
+	}
+
+	// All cache files of a removed media folder are orphans. Folders that
+	// can't be read for other reasons are kept to be on the safe side.
+	mediaExists := true
+	var cacheFileNames []string
+	files, err := m.getFiles(relativePath)
+	if err != nil {
+		if fullMediaPath, pathErr := m.getFullMediaPath(relativePath); pathErr == nil {
+			if stat, statErr := os.Stat(fullMediaPath); statErr == nil && stat.IsDir() {
+				log.Warnf("Unable to prune %s. Reason: %s", fullCachePath, err)
+				return false
+			}
+		}
+		mediaExists = false
+	} else {
+		cacheFileNames = c.cacheFileNames(files)
+	}
+
+	nbrRemaining := 0
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		subRelativePath := filepath.ToSlash(filepath.Join(relativePath, name))
+		if dirEntry.IsDir() && c.mediaDirCache != "" {
+			nbrRemaining++ // Not created by mediaweb
+			continue
+		} else if dirEntry.IsDir() {
+			if !c.pruneFolder(m, subRelativePath, result) { // Recursive
+				nbrRemaining++
+			} else if err := os.Remove(filepath.Join(fullCachePath, name)); err == nil {
+				result.NbrRemovedFolders++
+			} else {
+				nbrRemaining++ // E.g. a file was generated after the directory was pruned
+			}
+			continue
+		}
+		if mediaExists && (contains(cacheFileNames, name) || albumThumbnailRegexp.MatchString(name)) {
+			nbrRemaining++
+			continue
+		}
+		if err := c.removeCacheFile(subRelativePath); err != nil {
+			log.Warnf("Unable to remove %s. Reason: %s", filepath.Join(fullCachePath, name), err)
+			nbrRemaining++
+			continue
+		}
+		result.NbrRemovedFiles++
+	}
+	return nbrRemaining == 0 && relativePath != ""
+}
+
+// removeCacheFile removes a cache file and its cache entry
+func (c *Cache) removeCacheFile(relativePath string) error {
+	fullPath, err := c.getFullCachePath(relativePath)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.thumbnails, relativePath)
+	delete(c.previews, relativePath)
+	delete(c.albumThumbnails, relativePath)
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+	log.Debug("Removed ", fullPath)
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPruneCache(t *testing.T) {
+	mediaPath := "tmpout/TestPruneCache"
+	cachePath := "tmpcache/TestPruneCache"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath+"/removed/sub", os.ModePerm)
+	os.MkdirAll(mediaPath+"/kept", os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/removed.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/kept/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/removed/sub/png.png")
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	for _, path := range []string{"png.png", "removed.png", "kept/png.png", "removed/sub/png.png"} {
+		_, err := media.cache.generateThumbnail(media, path)
+		assertExpectNoErr(t, path, err)
+	}
+	os.MkdirAll(cachePath+"/kept/empty", os.ModePerm)
+	os.WriteFile(cachePath+"/kept/invalid.err.txt", []byte("error"), 0644)
+	os.WriteFile(cachePath+"/kept/png.png.thumb.err.txt", []byte("error"), 0644)
+
+	// Unknown files and empty folders
+	result, err := media.pruneCache()
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, result.NbrRemovedFiles) // invalid.err.txt
+	assertEqualsInt(t, "", 1, result.NbrRemovedFolders)
+	assertFileExist(t, "", cachePath+"/kept/png.png.thumb.err.txt")
+
+	os.Remove(mediaPath + "/removed.png")
+	os.RemoveAll(mediaPath + "/removed")
+	result, err = media.pruneCache()
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2, result.NbrRemovedFiles)
+	assertEqualsInt(t, "", 2, result.NbrRemovedFolders)
+	assertFileExist(t, "", cachePath+"/png.png.thumb.jpg")
+	assertFileExist(t, "", cachePath+"/kept/png.png.thumb.jpg")
+	assertFileNotExist(t, "", cachePath+"/removed.png.thumb.jpg")
+	assertFileNotExist(t, "", cachePath+"/removed")
+	assertFalse(t, "Cache entry removed", media.cache.hasThumbnail("removed.png"))
+	assertTrue(t, "", media.cache.hasThumbnail("png.png"))
+
+	// No cache
+	media = createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	_, err = media.pruneCache()
+	assertExpectErr(t, "", err)
+}
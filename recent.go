@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RecentFile is a media file with its modification time
+type RecentFile struct {
+	File
+	Modified time.Time
+}
+
+// getRecent returns at most limit media files modified the last days,
+// newest first. fileType is image, video or "" (both). Only permitted
+// files are included (nil means all).
+func (m *Media) getRecent(limit, days int, fileType string, permitted func(string) bool) []RecentFile {
+	since := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	recent := []RecentFile{}
+	for _, file := range m.getRecentIndex() {
+		if file.Modified.Before(since) || (fileType != "" && file.Type != fileType) ||
+			(permitted != nil && !permitted(file.Path)) {
+			continue
+		}
+		recent = append(recent, file)
+	}
+	sort.Slice(recent, func(i, j int) bool {
+		if recent[i].Modified.Equal(recent[j].Modified) {
+			return recent[i].Path < recent[j].Path
+		}
+		return recent[i].Modified.After(recent[j].Modified)
+	})
+	if len(recent) > limit {
+		recent = recent[:limit]
+	}
+	return recent
+}
+
+// getRecentIndex returns all media files with their modification times.
+// With a watcher the index is built once (by the pre-cache walk or on
+// first use) and then kept up to date by the watcher. Without a watcher
+// the media tree is walked on each call.
+func (m *Media) getRecentIndex() []RecentFile {
+	if m.watcher == nil {
+		files := []RecentFile{}
+		m.walkRecent("", func(file RecentFile) {
+			files = append(files, file)
+		})
+		return files
+	}
+	m.recentMutex.Lock()
+	indexed := m.recentIndexed
+	m.recentMutex.Unlock()
+	if !indexed {
+		m.indexRecent("")
+		m.setRecentIndexed()
+	}
+	m.recentMutex.Lock()
+	defer m.recentMutex.Unlock()
+	files := make([]RecentFile, 0, len(m.recentFiles))
+	for _, file := range m.recentFiles {
+		files = append(files, file)
+	}
+	return files
+}
+
+// setRecentIndexed marks the index as complete, i.e. all media files
+// have been added
+func (m *Media) setRecentIndexed() {
+	m.recentMutex.Lock()
+	m.recentIndexed = true
+	m.recentMutex.Unlock()
+}
+
+// indexRecent adds the media files in relativePath and its sub folders
+// to the index
+func (m *Media) indexRecent(relativePath string) {
+	m.walkRecent(relativePath, func(file RecentFile) {
+		m.recentMutex.Lock()
+		m.recentFiles[file.Path] = file
+		m.recentMutex.Unlock()
+	})
+}
+
+// indexRecentFolder adds (or updates) the media files in relativePath,
+// but not in its sub folders, to the index
+func (m *Media) indexRecentFolder(relativePath string) {
+	files, err := m.getFiles(relativePath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.Type != "folder" {
+			m.addRecent(file)
+		}
+	}
+}
+
+// walkRecent calls found for each media file in relativePath and its
+// sub folders
+func (m *Media) walkRecent(relativePath string, found func(RecentFile)) {
+	files, err := m.getFiles(relativePath)
+	if err != nil {
+		log.Warnf("Unable to read folder %s. Reason: %s", relativePath, err)
+		return
+	}
+	for _, file := range files {
+		if file.Type == "folder" {
+			m.walkRecent(file.Path, found) // Recursive
+			continue
+		}
+		if recentFile, err := m.getRecentFile(file); err == nil {
+			found(recentFile)
+		}
+	}
+}
+
+// getRecentFile returns the media file with its modification time
+func (m *Media) getRecentFile(file File) (RecentFile, error) {
+	fullPath, err := m.getFullMediaPath(file.Path)
+	if err != nil {
+		return RecentFile{}, err
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return RecentFile{}, err
+	}
+	return RecentFile{File: file, Modified: stat.ModTime()}, nil
+}
+
+// addRecent adds (or updates) a media file in the index
+func (m *Media) addRecent(file File) {
+	recentFile, err := m.getRecentFile(file)
+	if err != nil {
+		return
+	}
+	m.recentMutex.Lock()
+	m.recentFiles[file.Path] = recentFile
+	m.recentMutex.Unlock()
+}
+
+// addRecentPath adds a created file or folder (including its sub folders)
+// to the index. Files that isn't media are ignored.
+func (m *Media) addRecentPath(relativePath string) {
+	relativePath = strings.TrimPrefix(filepath.ToSlash(relativePath), "/")
+	fullPath, err := m.getFullMediaPath(relativePath)
+	if err != nil {
+		return
+	}
+	if isDir(fullPath) {
+		m.indexRecent(relativePath)
+		return
+	}
+	fileType := m.getFileType(relativePath)
+	if fileType == "" {
+		return
+	}
+	m.addRecent(File{Type: fileType, Name: filepath.Base(relativePath), Path: relativePath})
+}
+
+// removeRecent removes a file, or a folder and all files in it, from the
+// index
+func (m *Media) removeRecent(relativePath string) {
+	relativePath = strings.TrimPrefix(filepath.ToSlash(relativePath), "/")
+	m.recentMutex.Lock()
+	defer m.recentMutex.Unlock()
+	delete(m.recentFiles, relativePath)
+	for path := range m.recentFiles {
+		if strings.HasPrefix(path, relativePath+"/") {
+			delete(m.recentFiles, path)
+		}
+	}
+}
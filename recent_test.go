@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGetRecent(t *testing.T) {
+	mediaPath := "tmpout/TestGetRecent"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/a.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/sub/b.png")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/sub/video.mp4")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/old.jpg")
+	now := time.Now()
+	for file, age := range map[string]time.Duration{"a.jpg": time.Hour, "sub/b.png": 2 * time.Hour,
+		"sub/video.mp4": 24 * time.Hour, "old.jpg": 60 * 24 * time.Hour} {
+		os.Chtimes(mediaPath+"/"+file, now.Add(-age), now.Add(-age))
+	}
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	recent := media.getRecent(50, 30, "", nil)
+	assertEqualsInt(t, "", 3, len(recent))
+	assertEqualsStr(t, "", "a.jpg", recent[0].Path)
+	assertEqualsStr(t, "", "sub/b.png", recent[1].Path)
+	assertEqualsStr(t, "", "sub/video.mp4", recent[2].Path)
+	assertEqualsStr(t, "", "video", recent[2].Type)
+
+	recent = media.getRecent(1, 30, "", nil)
+	assertEqualsInt(t, "", 1, len(recent))
+	assertEqualsStr(t, "", "a.jpg", recent[0].Path)
+	recent = media.getRecent(50, 90, "image", nil)
+	assertEqualsInt(t, "", 3, len(recent))
+	assertEqualsStr(t, "", "old.jpg", recent[2].Path)
+	recent = media.getRecent(50, 30, "video", nil)
+	assertEqualsInt(t, "", 1, len(recent))
+
+	// Without a watcher there is no index
+	assertEqualsInt(t, "", 0, len(media.recentFiles))
+
+	// With a watcher the index shall be built once and then updated
+	media.watcher = createWatcher(media, false, false, 0, 0, nil)
+	assertEqualsInt(t, "", 3, len(media.getRecent(50, 30, "", nil)))
+	assertEqualsInt(t, "", 4, len(media.recentFiles))
+	copyFile(t, "testmedia/png.png", mediaPath+"/new.png")
+	assertEqualsInt(t, "", 3, len(media.getRecent(50, 30, "", nil)))
+	media.addRecentPath("new.png")
+	recent = media.getRecent(50, 30, "", nil)
+	assertEqualsInt(t, "", 4, len(recent))
+	assertEqualsStr(t, "", "new.png", recent[0].Path)
+
+	media.removeRecent("sub")
+	assertEqualsInt(t, "", 2, len(media.getRecent(50, 30, "", nil)))
+	media.addRecentPath("sub")
+	assertEqualsInt(t, "", 4, len(media.getRecent(50, 30, "", nil)))
+	media.addRecentPath("../TestDateBuckets/a.jpg")
+	media.addRecentPath("dont_exist.jpg")
+	assertEqualsInt(t, "", 5, len(media.recentFiles))
+
+	// Deleted and moved files
+	assertExpectNoErr(t, "", media.deleteMedia("new.png"))
+	assertExpectNoErr(t, "", media.moveMedia("a.jpg", "sub/moved.jpg"))
+	recent = media.getRecent(50, 30, "", nil)
+	assertEqualsInt(t, "", 3, len(recent))
+	assertEqualsStr(t, "", "sub/moved.jpg", recent[0].Path)
+}
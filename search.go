@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cozy/goexif2/exif"
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits of a search to avoid runaway scans of large media trees
+const (
+	searchMaxDepth   = 32   // Max number of sub folder levels
+	searchMaxResults = 1000 // Max number of results
+)
+
+// SearchResult is a file matching a search
+type SearchResult struct {
+	Path   string // Relative path of the file
+	Type   string // folder, image or video
+	Reason string // What matched: name, camera or date
+}
+
+// search finds the files in relativePath (and its sub folders if
+// recursive) whose name contains query (case-insensitive). If matchEXIF
+// is true images are also matched on EXIF camera model and date (in the
+// format 2006-01-02 15:04:05). found is called for each match. The paths
+// are resolved with getFiles so the search can't escape the media path.
+func (m *Media) search(relativePath, query string, recursive, matchEXIF bool, found func(SearchResult)) error {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return fmt.Errorf("empty search term")
+	}
+	files, err := m.getFiles(relativePath)
+	if err != nil {
+		return err
+	}
+	depth := 0
+	if recursive {
+		depth = searchMaxDepth
+	}
+	count := 0
+	m.searchFiles(files, query, matchEXIF, depth, &count, found)
+	if count >= searchMaxResults {
+		log.Infof("Search for '%s' limited to %d results", query, searchMaxResults)
+	}
+	return nil
+}
+
+// searchFiles matches files and continues in the sub folders until
+// depth is 0 or searchMaxResults is reached. count is the number of
+// results so far.
+func (m *Media) searchFiles(files []File, query string, matchEXIF bool, depth int, count *int, found func(SearchResult)) {
+	for _, file := range files {
+		if *count >= searchMaxResults {
+			return
+		}
+		reason := m.searchMatch(file, query, matchEXIF)
+		if reason != "" {
+			*count++
+			found(SearchResult{Path: file.Path, Type: file.Type, Reason: reason})
+		}
+		if file.Type == "folder" && depth > 0 {
+			subFiles, err := m.getFiles(file.Path)
+			if err != nil {
+				log.Warnf("Unable to search folder %s. Reason: %s", file.Path, err)
+				continue
+			}
+			m.searchFiles(subFiles, query, matchEXIF, depth-1, count, found) // Recursive
+		}
+	}
+}
+
+// searchMatch returns why the file matches query, or "" if no match
+func (m *Media) searchMatch(file File, query string, matchEXIF bool) string {
+	if strings.Contains(strings.ToLower(file.Name), query) {
+		return "name"
+	}
+	if !matchEXIF || file.Type != "image" {
+		return ""
+	}
+	ex := m.extractEXIF(file.Path)
+	if ex == nil {
+		return ""
+	}
+	if modelTag, err := ex.Get(exif.Model); err == nil {
+		model, _ := modelTag.StringVal()
+		if strings.Contains(strings.ToLower(model), query) {
+			return "camera"
+		}
+	}
+	if date, err := ex.DateTime(); err == nil {
+		if strings.Contains(date.Format("2006-01-02 15:04:05"), query) {
+			return "date"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	mediaPath := "tmpout/TestSearch"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/Summer/beach", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/Summer/beach/IMG_0001.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/Summer/sunset.png")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/summer.mp4")
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	search := func(relativePath, query string, recursive, matchEXIF bool) map[string]string {
+		t.Helper()
+		results := make(map[string]string)
+		err := media.search(relativePath, query, recursive, matchEXIF, func(result SearchResult) {
+			results[result.Path] = result.Reason
+		})
+		assertExpectNoErr(t, "", err)
+		return results
+	}
+
+	results := search("", "SUMMER", false, false)
+	assertEqualsInt(t, "", 2, len(results))
+	assertEqualsStr(t, "", "name", results["Summer"])
+	assertEqualsStr(t, "", "name", results["summer.mp4"])
+
+	results = search("", "s", true, false)
+	assertEqualsInt(t, "", 3, len(results))
+	assertEqualsStr(t, "", "name", results["Summer/sunset.png"])
+
+	results = search("Summer", "img", true, false)
+	assertEqualsInt(t, "", 1, len(results))
+	assertEqualsStr(t, "", "name", results["Summer/beach/IMG_0001.jpg"])
+
+	// EXIF camera model and date
+	assertEqualsInt(t, "", 0, len(search("", "sm-n9005", true, false)))
+	results = search("", "sm-n9005", true, true)
+	assertEqualsInt(t, "", 1, len(results))
+	assertEqualsStr(t, "", "camera", results["Summer/beach/IMG_0001.jpg"])
+	results = search("", "2018-04-06", true, true)
+	assertEqualsInt(t, "", 1, len(results))
+	assertEqualsStr(t, "", "date", results["Summer/beach/IMG_0001.jpg"])
+
+	// Invalid
+	err := media.search("", " ", true, false, func(SearchResult) {})
+	assertExpectErr(t, "", err)
+	err = media.search("../..", "s", true, false, func(SearchResult) {})
+	assertExpectErr(t, "", err)
+}
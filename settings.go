@@ -1,8 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/go-ini/ini"
@@ -11,27 +15,111 @@ import (
 
 type settings struct {
 	port                     int       // Network port
-	ip                       string    // Network IP ("" means any)
+	ip                       string    // Comma separated network IPs, IPv4 or IPv6 ("" means any)
+	socket                   string    // Unix domain socket path ("" means TCP on ip and port)
+	basePath                 string    // URL path prefix, e.g. gallery ("" means none)
 	mediaPath                string    // Top level path for media files
+	rootFolder               string    // Folder (relative mediaPath) served as root ("" means mediaPath)
+	defaultFolder            string    // Folder (relative rootFolder) clients shall start in
 	cachePath                string    // Top level path for cache (thumbs and preview)
 	enableThumbCache         bool      // Generate thumbnails
 	ignoreExifThumbs         bool      // Ignore embedded exif thumbnails
+	exifThumbRotate          bool      // Rotate embedded exif thumbnails
+	exifThumbMinSide         int       // Ignore embedded exif thumbnails smaller than this (0 means use all)
+	videoIconOverlay         bool      // Add video icon to video thumbnails
+	videoThumbFallback       bool      // Film strip thumbnail when ffmpeg fails
+	gifAnimatedThumbs        bool      // Animated thumbnails of GIF images
+	videoContactSheet        bool      // Contact sheets of videos (?contactsheet=true on /thumb)
+	contactColumns           int       // Number of frames horizontally in video contact sheets
+	contactRows              int       // Number of frames vertically in video contact sheets
+	ffmpegPath               string    // ffmpeg binary ("" means ffmpeg in PATH)
+	ffmpegExtraArgs          []string  // Extra ffmpeg arguments, e.g. hardware acceleration
+	ffmpegSelfTest           bool      // Test extracting a frame with ffmpeg at startup
+	watcherDebounceSec       int       // Seconds a new file must be quiet before thumbnail generation
+	watcherResyncInterval    int       // Minutes between resyncs catching files missed by the watcher
+	watchPaths               []string  // Relative paths of the folders to watch (nil means all)
+	thumbRetryDelay          int       // Minutes before first retry of failed thumbnail/preview generation
+	slowGenThreshold         int       // Milliseconds before a thumbnail generation is logged as slow (0 means never)
+	onDemandConcurrency      int       // Max number of thumbnails/previews generated at once for clients (0 means no limit)
+	preCachePriority         bool      // Generate thumbnails/previews of browsed folders first on startup
+	thumbMaxRetries          int       // Max retries of failed thumbnail/preview generation
+	checkStale               bool      // Regenerate thumbnails/previews older than the media file
 	genThumbsOnStartup       bool      // Generate all thumbnails on startup
 	genThumbsOnAdd           bool      // Generate thumbnails when file added (start watcher)
 	genAlbumThumbs           bool      // Generate album thumbnails
 	autoRotate               bool      // Rotate JPEG files when needed
+	forceRotate              bool      // Override EXIF orientation with .orientation files
 	enablePreview            bool      // Generate preview files
 	previewMaxSide           int       // Max height/width of preview file
-	genPreviewForSmallImages bool      // Generate preview files also for images smaller then previewMaxSide
+	previewMinSide           int       // Images not larger than this (height/width) are too small for a preview
+	previewSizes             []int     // Additional preview sizes clients may request
+	previewFormat            string    // Format of preview files (jpeg or avif)
+	previewKeepFormat        bool      // PNG previews of PNG images
+	resampleFilter           string    // Filter when downscaling thumbnails and previews (box, linear, catmullrom or lanczos)
+	thumbBackground          string    // Background color of thumbnails and previews as hex, e.g. ffffff
+	blurHashX                int       // Horizontal BlurHash components (?blurhash=true on /folder)
+	blurHashY                int       // Vertical BlurHash components
+	videoPreviewFrames       int       // Number of frames in animated video previews
+	maxImagePixels           int       // Max megapixels of images to decode (0 means no limit)
+	watermarkFile            string    // Image to add as watermark on previews ("" means no watermark)
+	watermarkPosition        string    // Position of watermark (topleft, topright, bottomleft, bottomright or center)
+	watermarkOpacity         int       // Opacity of watermark in percent
+	enhancePreviews          bool      // Sharpen (and adjust contrast of) image previews
+	sharpenAmount            float64   // Sigma of the sharpening of enhanced previews
+	contrastAmount           int       // Contrast adjustment of enhanced previews in percent (-100 - 100)
+	genPreviewForSmallImages bool      // Generate preview files also for images smaller then previewMinSide
 	genPreviewOnStartup      bool      // Generate all preview on startup
 	genPreviewOnAdd          bool      // Generate preview when file added (start watcher)
 	enableCacheCleanup       bool      // Clear cache from unnecessary files
+	livePhotos               bool      // Pair images and .mov videos with same base name (Live Photos)
+	groupSidecars            bool      // Group files with same base name as an image (e.g. RAW files)
+	skipHidden               bool      // Omit hidden files and folders
+	imageExtensions          []string  // File extensions of images (nil means default)
+	videoExtensions          []string  // File extensions of videos (nil means default)
+	sniffContent             bool      // Classify files without extension by their content
+	similarScope             string    // Where to search for similar images (folder or library)
+	cacheEntryTTLDays        int       // Days since last access before cache entries are evicted (0 means never)
+	cacheExpireThumbnails    bool      // Evict thumbnails older than cacheEntryTTLDays
+	cacheExpirePreviews      bool      // Evict previews older than cacheEntryTTLDays
+	cacheMaxSizeMB           int       // Max size of cache in MB (0 means no limit)
+	cacheMaxAgeDays          int       // Days since last access before any cache entry is evicted (0 means never)
+	cacheEvictionInterval    int       // Minutes between cache evictions
+	cacheDirMode             uint32    // Permissions of cache directories (0 means default)
+	cacheFileMode            uint32    // Permissions of cache and log files (0 means default)
+	cacheIncludeExt          bool      // Keep the media file extension in cache file names
+	cacheAtomicWrite         bool      // Write cache files via a temporary file that is renamed when complete
 	logLevel                 log.Level // Logging level
 	logFile                  string    // Log file ("" means stderr)
+	logMaxSize               int       // Rotate the log file when larger than this in MB (0 means never)
+	logMaxBackups            int       // Number of rotated log files to keep
+	logFormat                string    // Log format, text or json
+	logTimestamp             bool      // Include timestamp in log entries
+	accessLog                bool      // Log each HTTP request
 	userName                 string    // User name ("" means no authentication)
 	password                 string    // Password
+	viewers                  passwords // Users only allowed to browse
 	tlsCertFile              string    // TLS certification file
 	tlsKeyFile               string    // TLS key file
+	minTLSVersion            uint16    // Minimum TLS version
+	tlsCipherSuites          []uint16  // Allowed TLS 1.0-1.2 cipher suites (nil means Go defaults)
+	autocert                 bool      // Get TLS certificates from Let's Encrypt
+	autocertDomains          []string  // Domains to get Let's Encrypt certificates for
+	autocertCacheDir         string    // Where to store Let's Encrypt certificates
+	autocertHTTPAddr         string    // Where to listen for the Let's Encrypt HTTP-01 challenges
+	allowDelete              bool      // Allow deleting media files without authentication
+	trashPath                string    // Move deleted media files here ("" means removed permanently)
+	trashMaxAgeDays          int       // Days before deleted files are removed from the trash (0 means never)
+	allowUpload              bool      // Allow uploading media files (requires authentication)
+	maxUploadSizeMB          int       // Max size of uploaded files in MB (0 means no limit)
+	sessionSecret            string    // Secret for signing session cookies ("" means random)
+	sessionTimeout           int       // Minutes until a login session expires
+	httpReadHeaderTimeout    int       // Seconds to read request headers (0 means no timeout)
+	httpReadTimeout          int       // Seconds to read a whole request (0 means no timeout)
+	httpWriteTimeout         int       // Seconds to write a response, except media streaming (0 means no timeout)
+	httpIdleTimeout          int       // Seconds to keep idle connections open (0 means no timeout)
+	spriteMaxTiles           int       // Max number of thumbnails per /thumbsheet page
+	metrics                  bool      // Provide Prometheus metrics on /metrics
+	corsOrigins              []string  // Origins allowed for cross-origin requests (nil means no CORS)
 }
 
 // defaultConfPath holds configuration file paths in priority order
@@ -86,6 +174,14 @@ func loadSettings(fileName string) settings {
 	ip := section.Key("ip").MustString("")
 	result.ip = ip
 
+	// Load socket (OPTIONAL)
+	// Default: "" (listen on ip and port)
+	result.socket = section.Key("socket").MustString("")
+
+	// Load basePath (OPTIONAL)
+	// Default: "" (no prefix)
+	result.basePath = section.Key("basepath").MustString("")
+
 	// Load mediaPath (MANDATORY)
 	if !section.HasKey("mediapath") {
 		log.Panic("Mandatory property 'mediapath' is not defined in ", fileName)
@@ -93,6 +189,24 @@ func loadSettings(fileName string) settings {
 	mediaPath := section.Key("mediapath").MustString("")
 	result.mediaPath = mediaPath
 
+	// Load rootFolder (OPTIONAL)
+	// Default: "" (media path)
+	rootFolder := strings.Trim(filepath.ToSlash(section.Key("rootfolder").MustString("")), "/")
+	if _, err := getFullPath(result.mediaPath, rootFolder); err != nil {
+		log.Warnf("Invalid rootfolder %s. Not within the media path.", rootFolder)
+		rootFolder = ""
+	}
+	result.rootFolder = rootFolder
+
+	// Load defaultFolder (OPTIONAL)
+	// Default: "" (media path)
+	defaultFolder := strings.Trim(filepath.ToSlash(section.Key("defaultfolder").MustString("")), "/")
+	if _, err := getFullPath(result.mediaPath, defaultFolder); err != nil {
+		log.Warnf("Invalid defaultfolder %s. Not within the media path.", defaultFolder)
+		defaultFolder = ""
+	}
+	result.defaultFolder = defaultFolder
+
 	// Load cachePath (OPTIONAL)
 	// Default: OS temp directory
 	if section.HasKey("cachepath") {
@@ -115,6 +229,11 @@ func loadSettings(fileName string) settings {
 		log.Panicf("cachepath and mediapath have the same value '%s'", result.mediaPath)
 	}
 
+	// Check that cache folders in media folders never collide with media
+	if _, err := parseMediaDirCachePath(result.cachePath); err != nil {
+		log.Panicf("Invalid cachepath '%s'. Reason: %s", result.cachePath, err)
+	}
+
 	// Load enableThumbCache (OPTIONAL)
 	// Default: true
 	result.enableThumbCache = readOptionalBool(section, "enablethumbcache", true)
@@ -123,6 +242,60 @@ func loadSettings(fileName string) settings {
 	// Default: false
 	result.ignoreExifThumbs = readOptionalBool(section, "ignoreexifthumbs", false)
 
+	// Load exifThumbRotate (OPTIONAL)
+	// Default: true
+	result.exifThumbRotate = readOptionalBool(section, "exifthumbrotate", true)
+
+	// Load exifThumbMinSide (OPTIONAL)
+	// Default: 0 (use all exif thumbnails)
+	result.exifThumbMinSide = readOptionalInt(section, "exifthumbminside", 0)
+	if result.exifThumbMinSide < 0 {
+		log.Warnf("Invalid exifthumbminside %d. Using 0.", result.exifThumbMinSide)
+		result.exifThumbMinSide = 0
+	}
+
+	// Load videoIconOverlay (OPTIONAL)
+	// Default: true
+	result.videoIconOverlay = readOptionalBool(section, "videoiconoverlay", true)
+
+	// Load videoThumbFallback (OPTIONAL)
+	// Default: false
+	result.videoThumbFallback = readOptionalBool(section, "videothumbfallback", false)
+
+	// Load gifAnimatedThumbs (OPTIONAL)
+	// Default: false
+	result.gifAnimatedThumbs = readOptionalBool(section, "gifanimatedthumbs", false)
+
+	// Load videoContactSheet (OPTIONAL)
+	// Default: false
+	result.videoContactSheet = readOptionalBool(section, "videocontactsheet", false)
+
+	// Load contactColumns and contactRows (OPTIONAL)
+	// Default: 4x3
+	contactGrid := section.Key("videocontactgrid").MustString("4x3")
+	contactColumnsStr, contactRowsStr, _ := strings.Cut(strings.ToLower(contactGrid), "x")
+	result.contactColumns, _ = strconv.Atoi(strings.TrimSpace(contactColumnsStr))
+	result.contactRows, _ = strconv.Atoi(strings.TrimSpace(contactRowsStr))
+	if result.contactColumns < 1 || result.contactColumns > 9 || result.contactRows < 1 || result.contactRows > 9 {
+		log.Warnf("Invalid videocontactgrid '%s'. Using 4x3.", contactGrid)
+		result.contactColumns, result.contactRows = 4, 3
+	}
+
+	// Load ffmpegPath (OPTIONAL)
+	// Default: "" (ffmpeg in PATH)
+	result.ffmpegPath = section.Key("ffmpegpath").MustString("")
+	if result.ffmpegPath != "" && !isFFmpegInstalled(result.ffmpegPath) {
+		log.Warnf("Invalid ffmpegpath %s. No such executable, video thumbnails will not be supported.", result.ffmpegPath)
+	}
+
+	// Load ffmpegExtraArgs (OPTIONAL)
+	// Default: "" (none)
+	result.ffmpegExtraArgs = strings.Fields(section.Key("ffmpegextraargs").MustString(""))
+
+	// Load ffmpegSelfTest (OPTIONAL)
+	// Default: false
+	result.ffmpegSelfTest = readOptionalBool(section, "ffmpegselftest", false)
+
 	// Load genthumbsonstartup (OPTIONAL)
 	// Default: false
 	result.genThumbsOnStartup = readOptionalBool(section, "genthumbsonstartup", false)
@@ -139,6 +312,10 @@ func loadSettings(fileName string) settings {
 	// Default: true
 	result.autoRotate = readOptionalBool(section, "autorotate", true)
 
+	// Load forceRotate (OPTIONAL)
+	// Default: false
+	result.forceRotate = readOptionalBool(section, "forcerotate", false)
+
 	// Load enablePreview (OPTIONAL)
 	// Default: false
 	result.enablePreview = readOptionalBool(section, "enablepreview", false)
@@ -147,6 +324,128 @@ func loadSettings(fileName string) settings {
 	// Default: 1280 (pixels)
 	result.previewMaxSide = readOptionalInt(section, "previewmaxside", 1280)
 
+	// Load previewMinSide (OPTIONAL)
+	// Default: previewMaxSide
+	result.previewMinSide = readOptionalInt(section, "previewminside", result.previewMaxSide)
+	if result.previewMinSide < 1 || result.previewMinSide > result.previewMaxSide {
+		log.Warnf("Invalid previewminside %d. Using previewmaxside (%d).", result.previewMinSide, result.previewMaxSide)
+		result.previewMinSide = result.previewMaxSide
+	}
+
+	// Load previewSizes (OPTIONAL)
+	// Default: "" (only previewmaxside)
+	for _, sizeStr := range strings.Split(section.Key("previewsizes").MustString(""), ",") {
+		sizeStr = strings.TrimSpace(sizeStr)
+		if sizeStr == "" {
+			continue
+		}
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil || size < 1 || size > 10000 {
+			log.Warnf("Invalid previewsizes %s. Ignoring it.", sizeStr)
+			continue
+		}
+		result.previewSizes = append(result.previewSizes, size)
+	}
+
+	// Load previewFormat (OPTIONAL)
+	// Default: jpeg
+	previewFormat := section.Key("previewformat").MustString(previewFormatJPEG)
+	if previewFormat != previewFormatJPEG && previewFormat != previewFormatAVIF {
+		log.Warnf("Invalid previewformat '%s'. Using %s.", previewFormat, previewFormatJPEG)
+		previewFormat = previewFormatJPEG
+	}
+	result.previewFormat = previewFormat
+
+	// Load previewKeepFormat (OPTIONAL)
+	// Default: false
+	result.previewKeepFormat = readOptionalBool(section, "previewkeepformat", false)
+
+	// Load resampleFilter (OPTIONAL)
+	// Default: box
+	resampleFilter := section.Key("resamplefilter").MustString("box")
+	if _, ok := resampleFilters[resampleFilter]; !ok {
+		log.Warnf("Invalid resamplefilter '%s'. Using box.", resampleFilter)
+		resampleFilter = "box"
+	}
+	result.resampleFilter = resampleFilter
+
+	// Load thumbBackground (OPTIONAL)
+	// Default: ffffff
+	thumbBackground := section.Key("thumbbackground").MustString("ffffff")
+	if _, err := parseHexColor(thumbBackground); err != nil {
+		log.Warnf("Invalid thumbbackground '%s'. Using ffffff.", thumbBackground)
+		thumbBackground = "ffffff"
+	}
+	result.thumbBackground = thumbBackground
+
+	// Load blurHashX and blurHashY (OPTIONAL)
+	// Default: 4x3
+	blurHashComponents := section.Key("blurhashcomponents").MustString("4x3")
+	blurHashXStr, blurHashYStr, _ := strings.Cut(strings.ToLower(blurHashComponents), "x")
+	result.blurHashX, _ = strconv.Atoi(strings.TrimSpace(blurHashXStr))
+	result.blurHashY, _ = strconv.Atoi(strings.TrimSpace(blurHashYStr))
+	if result.blurHashX < 1 || result.blurHashX > 9 || result.blurHashY < 1 || result.blurHashY > 9 {
+		log.Warnf("Invalid blurhashcomponents '%s'. Using 4x3.", blurHashComponents)
+		result.blurHashX, result.blurHashY = 4, 3
+	}
+
+	// Load videoPreviewFrames (OPTIONAL)
+	// Default: 5
+	result.videoPreviewFrames = readOptionalInt(section, "videopreviewframes", 5)
+	if result.videoPreviewFrames < 1 {
+		log.Warnf("Invalid videopreviewframes %d. Using 5.", result.videoPreviewFrames)
+		result.videoPreviewFrames = 5
+	}
+
+	// Load maxImagePixels (OPTIONAL)
+	// Default: 100 (megapixels)
+	result.maxImagePixels = readOptionalInt(section, "maximagepixels", 100)
+	if result.maxImagePixels < 0 {
+		log.Warnf("Invalid maximagepixels %d. Using 100.", result.maxImagePixels)
+		result.maxImagePixels = 100
+	}
+
+	// Load watermarkFile (OPTIONAL)
+	// Default: "" (no watermark)
+	result.watermarkFile = section.Key("watermarkfile").MustString("")
+
+	// Load watermarkPosition (OPTIONAL)
+	// Default: bottomright
+	watermarkPosition := section.Key("watermarkposition").MustString("bottomright")
+	if !slices.Contains(watermarkPositions, watermarkPosition) {
+		log.Warnf("Invalid watermarkposition '%s'. Using bottomright.", watermarkPosition)
+		watermarkPosition = "bottomright"
+	}
+	result.watermarkPosition = watermarkPosition
+
+	// Load watermarkOpacity (OPTIONAL)
+	// Default: 50 (percent)
+	result.watermarkOpacity = readOptionalInt(section, "watermarkopacity", 50)
+	if result.watermarkOpacity < 1 || result.watermarkOpacity > 100 {
+		log.Warnf("Invalid watermarkopacity %d. Using 50.", result.watermarkOpacity)
+		result.watermarkOpacity = 50
+	}
+
+	// Load enhancePreviews (OPTIONAL)
+	// Default: false
+	result.enhancePreviews = readOptionalBool(section, "enhancepreviews", false)
+
+	// Load sharpenAmount (OPTIONAL)
+	// Default: 0.5
+	result.sharpenAmount = readOptionalFloat(section, "sharpenamount", 0.5)
+	if result.sharpenAmount <= 0 || result.sharpenAmount > 5 {
+		log.Warnf("Invalid sharpenamount %g. Using 0.5.", result.sharpenAmount)
+		result.sharpenAmount = 0.5
+	}
+
+	// Load contrastAmount (OPTIONAL)
+	// Default: 0 (percent, i.e. no adjustment)
+	result.contrastAmount = readOptionalInt(section, "contrastamount", 0)
+	if result.contrastAmount < -100 || result.contrastAmount > 100 {
+		log.Warnf("Invalid contrastamount %d. Using 0.", result.contrastAmount)
+		result.contrastAmount = 0
+	}
+
 	// Load genPreviewForSmallImages (OPTIONAL)
 	// Default: false
 	result.genPreviewForSmallImages = readOptionalBool(section, "genpreviewforsmallimages", false)
@@ -159,19 +458,221 @@ func loadSettings(fileName string) settings {
 	// Default: true
 	result.genPreviewOnAdd = readOptionalBool(section, "genpreviewonadd", true)
 
+	// Load watcherDebounce (OPTIONAL)
+	// Default: 2 (seconds)
+	result.watcherDebounceSec = readOptionalInt(section, "watcherdebounce", 2)
+	if result.watcherDebounceSec < 0 {
+		log.Warnf("Invalid watcherdebounce %d. Using 2.", result.watcherDebounceSec)
+		result.watcherDebounceSec = 2
+	}
+
+	// Load watcherResyncInterval (OPTIONAL)
+	// Default: 10 (minutes)
+	result.watcherResyncInterval = readOptionalInt(section, "watcherresyncinterval", 10)
+	if result.watcherResyncInterval < 0 {
+		log.Warnf("Invalid watcherresyncinterval %d. Using 10.", result.watcherResyncInterval)
+		result.watcherResyncInterval = 10
+	}
+
+	// Load watchPaths (OPTIONAL)
+	// Default: "" (whole media path)
+	for _, watchPath := range strings.Split(section.Key("watchpaths").MustString(""), ",") {
+		watchPath = strings.TrimSpace(watchPath)
+		if watchPath == "" {
+			continue
+		}
+		if _, err := getFullPath(result.mediaPath, watchPath); err != nil {
+			log.Warnf("Invalid watchpaths %s. Not within the media path.", watchPath)
+			continue
+		}
+		result.watchPaths = append(result.watchPaths, watchPath)
+	}
+
 	// Load enableCacheCleanup (OPTIONAL)
 	// Default: false
 	result.enableCacheCleanup = readOptionalBool(section, "enablecachecleanup", false)
 
+	// Load imageExtensions (OPTIONAL)
+	// Default: .png, .jpg, .jpeg, .tif, .tiff, .gif, .bmp
+	result.imageExtensions = toExtensions(section.Key("imageextensions").MustString(""))
+
+	// Load videoExtensions (OPTIONAL)
+	// Default: .avi, .mov, .vid, .mkv, .mp4, .webm, .m4v, .flv, .wmv, .mpg
+	result.videoExtensions = toExtensions(section.Key("videoextensions").MustString(""))
+
+	// Load sniffContent (OPTIONAL)
+	// Default: false
+	result.sniffContent = readOptionalBool(section, "sniffcontent", false)
+
+	// Load similarScope (OPTIONAL)
+	// Default: folder
+	similarScope := section.Key("similarscope").MustString(similarScopeFolder)
+	if similarScope != similarScopeFolder && similarScope != similarScopeLibrary {
+		log.Warnf("Invalid similarscope '%s'. Using %s.", similarScope, similarScopeFolder)
+		similarScope = similarScopeFolder
+	}
+	result.similarScope = similarScope
+
+	// Load livePhotos (OPTIONAL)
+	// Default: false
+	result.livePhotos = readOptionalBool(section, "livephotos", false)
+
+	// Load groupSidecars (OPTIONAL)
+	// Default: false
+	result.groupSidecars = readOptionalBool(section, "groupsidecars", false)
+
+	// Load skipHidden (OPTIONAL)
+	// Default: true
+	result.skipHidden = readOptionalBool(section, "skiphidden", true)
+
+	// Load cacheEntryTTLDays (OPTIONAL)
+	// Default: 0 (never evict)
+	result.cacheEntryTTLDays = readOptionalInt(section, "cacheentryttldays", 0)
+	if result.cacheEntryTTLDays < 0 {
+		log.Warnf("Invalid cacheentryttldays %d. Using 0.", result.cacheEntryTTLDays)
+		result.cacheEntryTTLDays = 0
+	}
+
+	// Load cacheExpireTypes (OPTIONAL)
+	// Default: preview
+	cacheExpireTypes := section.Key("cacheexpiretypes").MustString("preview")
+	for _, expireType := range strings.Split(cacheExpireTypes, ",") {
+		switch strings.TrimSpace(expireType) {
+		case "thumbnail":
+			result.cacheExpireThumbnails = true
+		case "preview":
+			result.cacheExpirePreviews = true
+		case "":
+		default:
+			log.Warnf("Invalid cacheexpiretypes value '%s'. Ignoring.", expireType)
+		}
+	}
+
+	// Load cacheMaxSizeMB (OPTIONAL)
+	// Default: 0 (no limit)
+	result.cacheMaxSizeMB = readOptionalInt(section, "cachemaxsize", 0)
+	if result.cacheMaxSizeMB < 0 {
+		log.Warnf("Invalid cachemaxsize %d. Using 0.", result.cacheMaxSizeMB)
+		result.cacheMaxSizeMB = 0
+	}
+
+	// Load cacheMaxAgeDays (OPTIONAL)
+	// Default: 0 (never evict)
+	result.cacheMaxAgeDays = readOptionalInt(section, "cachemaxage", 0)
+	if result.cacheMaxAgeDays < 0 {
+		log.Warnf("Invalid cachemaxage %d. Using 0.", result.cacheMaxAgeDays)
+		result.cacheMaxAgeDays = 0
+	}
+
+	// Load cacheEvictionInterval (OPTIONAL)
+	// Default: 60 (minutes)
+	result.cacheEvictionInterval = readOptionalInt(section, "cacheevictioninterval", 60)
+	if result.cacheEvictionInterval < 1 {
+		log.Warnf("Invalid cacheevictioninterval %d. Using 60.", result.cacheEvictionInterval)
+		result.cacheEvictionInterval = 60
+	}
+
+	// Load cacheDirMode (OPTIONAL)
+	// Default: 0 (0777 restricted by umask)
+	result.cacheDirMode = readOptionalFileMode(section, "cachedirmode", 0700)
+
+	// Load cacheFileMode (OPTIONAL)
+	// Default: 0 (0666 restricted by umask, 0644 for the log file)
+	result.cacheFileMode = readOptionalFileMode(section, "cachefilemode", 0600)
+
+	// Load cacheIncludeExt (OPTIONAL)
+	// Default: true
+	result.cacheIncludeExt = readOptionalBool(section, "cacheincludeext", true)
+
+	// Load cacheAtomicWrite (OPTIONAL)
+	// Default: true
+	result.cacheAtomicWrite = readOptionalBool(section, "cacheatomicwrite", true)
+
+	// Load thumbRetryDelay (OPTIONAL)
+	// Default: 60 (minutes)
+	result.thumbRetryDelay = readOptionalInt(section, "thumbretrydelay", 60)
+	if result.thumbRetryDelay < 0 {
+		log.Warnf("Invalid thumbretrydelay %d. Using 60.", result.thumbRetryDelay)
+		result.thumbRetryDelay = 60
+	}
+
+	// Load thumbMaxRetries (OPTIONAL)
+	// Default: 0 (never retry)
+	result.thumbMaxRetries = readOptionalInt(section, "thumbmaxretries", 0)
+	if result.thumbMaxRetries < 0 {
+		log.Warnf("Invalid thumbmaxretries %d. Using 0.", result.thumbMaxRetries)
+		result.thumbMaxRetries = 0
+	}
+
+	// Load slowGenThreshold (OPTIONAL)
+	// Default: 0 (never warn)
+	result.slowGenThreshold = readOptionalInt(section, "slowgenthreshold", 0)
+	if result.slowGenThreshold < 0 {
+		log.Warnf("Invalid slowgenthreshold %d. Using 0.", result.slowGenThreshold)
+		result.slowGenThreshold = 0
+	}
+
+	// Load onDemandConcurrency (OPTIONAL)
+	// Default: 0 (no limit)
+	result.onDemandConcurrency = readOptionalInt(section, "ondemandconcurrency", 0)
+	if result.onDemandConcurrency < 0 {
+		log.Warnf("Invalid ondemandconcurrency %d. Using 0.", result.onDemandConcurrency)
+		result.onDemandConcurrency = 0
+	}
+
+	// Load preCachePriority (OPTIONAL)
+	// Default: true
+	result.preCachePriority = readOptionalBool(section, "precachepriority", true)
+
+	// Load checkStale (OPTIONAL)
+	// Default: true
+	result.checkStale = readOptionalBool(section, "checkstale", true)
+
 	// Load logFile (OPTIONAL)
 	// Default: "" (log to stderr)
 	logFile := section.Key("logfile").MustString("")
 	result.logFile = logFile
 
+	// Load logMaxSize (OPTIONAL)
+	// Default: 0 (no rotation)
+	result.logMaxSize = readOptionalInt(section, "logmaxsize", 0)
+	if result.logMaxSize < 0 {
+		log.Warnf("Invalid logmaxsize %d. Using 0.", result.logMaxSize)
+		result.logMaxSize = 0
+	}
+
+	// Load logMaxBackups (OPTIONAL)
+	// Default: 3
+	result.logMaxBackups = readOptionalInt(section, "logmaxbackups", 3)
+	if result.logMaxBackups < 1 {
+		log.Warnf("Invalid logmaxbackups %d. Using 3.", result.logMaxBackups)
+		result.logMaxBackups = 3
+	}
+
 	// Load logLevel (OPTIONAL)
 	// Default: info
 	logLevel := section.Key("loglevel").MustString("info")
-	result.logLevel = toLogLvl(logLevel)
+	result.logLevel, err = parseLogLevel(logLevel)
+	if err != nil {
+		log.Warnf("Invalid loglevel '%s'. Using info level.", logLevel)
+		result.logLevel = log.InfoLevel
+	}
+
+	// Load logFormat (OPTIONAL)
+	// Default: text
+	result.logFormat = section.Key("logformat").MustString("text")
+	if result.logFormat != "text" && result.logFormat != "json" {
+		log.Warnf("Invalid logformat '%s'. Using text.", result.logFormat)
+		result.logFormat = "text"
+	}
+
+	// Load logTimestamp (OPTIONAL)
+	// Default: true
+	result.logTimestamp = readOptionalBool(section, "logtimestamp", true)
+
+	// Load accessLog (OPTIONAL)
+	// Default: false
+	result.accessLog = readOptionalBool(section, "accesslog", false)
 
 	// Load username (OPTIONAL)
 	// Default: "" (no authentication)
@@ -183,6 +684,28 @@ func loadSettings(fileName string) settings {
 	password := section.Key("password").MustString("")
 	result.password = password
 
+	// Load viewers (OPTIONAL)
+	// Default: "" (only the user above)
+	result.viewers = passwords{}
+	for _, viewer := range strings.Split(section.Key("viewers").MustString(""), ",") {
+		if viewer = strings.TrimSpace(viewer); viewer == "" {
+			continue
+		}
+		viewerName, viewerPassword, found := strings.Cut(viewer, ":")
+		viewerName = strings.TrimSpace(viewerName)
+		if !found || viewerName == "" {
+			log.Warnf("Invalid viewer '%s', expected user:password. Skipping it.", viewer)
+		} else if viewerName == result.userName {
+			log.Warnf("Viewer '%s' is the same as username. Skipping it.", viewerName)
+		} else {
+			result.viewers[viewerName] = strings.TrimSpace(viewerPassword)
+		}
+	}
+	if len(result.viewers) > 0 && result.userName == "" {
+		log.Warn("viewers requires username to be set. Ignoring viewers.")
+		result.viewers = passwords{}
+	}
+
 	// Load tlsCertFile (OPTIONAL)
 	// Default: ""
 	tlsCertFile := section.Key("tlscertfile").MustString("")
@@ -193,30 +716,257 @@ func loadSettings(fileName string) settings {
 	tlsKeyFile := section.Key("tlskeyfile").MustString("")
 	result.tlsKeyFile = tlsKeyFile
 
+	// Load minTLSVersion (OPTIONAL)
+	// Default: 1.2
+	result.minTLSVersion = toTLSVersion(section.Key("mintlsversion").MustString("1.2"))
+
+	// Load tlsCipherSuites (OPTIONAL)
+	// Default: "" (Go defaults)
+	result.tlsCipherSuites = toCipherSuites(section.Key("tlsciphers").MustString(""))
+
+	// Load autocert (OPTIONAL)
+	// Default: false
+	result.autocert = readOptionalBool(section, "autocert", false)
+
+	// Load autocertDomains (OPTIONAL, MANDATORY if autocert)
+	// Default: ""
+	for _, domain := range strings.Split(section.Key("autocertdomains").MustString(""), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			result.autocertDomains = append(result.autocertDomains, domain)
+		}
+	}
+
+	// Load autocertCacheDir (OPTIONAL, MANDATORY if autocert)
+	// Default: ""
+	result.autocertCacheDir = section.Key("autocertcachedir").MustString("")
+
+	// Load autocertHTTPAddr (OPTIONAL)
+	// Default: :80
+	result.autocertHTTPAddr = section.Key("autocerthttpaddr").MustString(":80")
+
+	// Check that autocert settings are valid
+	if result.autocert {
+		if result.tlsCertFile != "" || result.tlsKeyFile != "" {
+			log.Panic("autocert can't be combined with tlscertfile and tlskeyfile")
+		}
+		if len(result.autocertDomains) == 0 {
+			log.Panic("autocertdomains is mandatory when autocert is enabled")
+		}
+		if result.autocertCacheDir == "" {
+			log.Panic("autocertcachedir is mandatory when autocert is enabled")
+		}
+		if pathEquals(result.autocertCacheDir, result.mediaPath) ||
+			pathEquals(result.autocertCacheDir, result.cachePath) {
+			log.Panicf("autocertcachedir '%s' can't be the same as mediapath or cachepath", result.autocertCacheDir)
+		}
+	}
+
+	// Load allowDelete (OPTIONAL)
+	// Default: false
+	result.allowDelete = readOptionalBool(section, "allowdelete", false)
+
+	// Load trashPath (OPTIONAL)
+	// Default: "" (deleted files are removed permanently)
+	result.trashPath = section.Key("trashpath").MustString("")
+	if result.trashPath != "" &&
+		(pathEquals(result.trashPath, result.mediaPath) || pathEquals(result.trashPath, result.cachePath)) {
+		log.Warnf("Invalid trashpath '%s', can't be the same as mediapath or cachepath. Deleted files will be removed permanently.", result.trashPath)
+		result.trashPath = ""
+	}
+
+	// Load trashMaxAgeDays (OPTIONAL)
+	// Default: 30
+	result.trashMaxAgeDays = readOptionalInt(section, "trashmaxage", 30)
+	if result.trashMaxAgeDays < 0 {
+		log.Warnf("Invalid trashmaxage %d. Using 30.", result.trashMaxAgeDays)
+		result.trashMaxAgeDays = 30
+	}
+
+	// Load allowUpload (OPTIONAL)
+	// Default: false
+	result.allowUpload = readOptionalBool(section, "allowupload", false)
+	if result.allowUpload && result.userName == "" {
+		log.Warn("allowupload requires username to be set. Uploads will not be allowed.")
+	}
+
+	// Load maxUploadSizeMB (OPTIONAL)
+	// Default: 500
+	result.maxUploadSizeMB = readOptionalInt(section, "maxuploadsize", 500)
+	if result.maxUploadSizeMB < 0 {
+		log.Warnf("Invalid maxuploadsize %d. Using 500.", result.maxUploadSizeMB)
+		result.maxUploadSizeMB = 500
+	}
+
+	// Load sessionSecret (OPTIONAL)
+	// Default: "" (random secret generated on startup)
+	result.sessionSecret = section.Key("sessionsecret").MustString("")
+
+	// Load sessionTimeout (OPTIONAL)
+	// Default: 1440 (minutes)
+	result.sessionTimeout = readOptionalInt(section, "sessiontimeout", 1440)
+	if result.sessionTimeout < 1 {
+		log.Warnf("Invalid sessiontimeout %d. Using 1440.", result.sessionTimeout)
+		result.sessionTimeout = 1440
+	}
+
+	// Load httpReadHeaderTimeout (OPTIONAL)
+	// Default: 10 (seconds)
+	result.httpReadHeaderTimeout = readOptionalInt(section, "httpreadheadertimeout", 10)
+	if result.httpReadHeaderTimeout < 0 {
+		log.Warnf("Invalid httpreadheadertimeout %d. Using 10.", result.httpReadHeaderTimeout)
+		result.httpReadHeaderTimeout = 10
+	}
+
+	// Load httpReadTimeout (OPTIONAL)
+	// Default: 60 (seconds)
+	result.httpReadTimeout = readOptionalInt(section, "httpreadtimeout", 60)
+	if result.httpReadTimeout < 0 {
+		log.Warnf("Invalid httpreadtimeout %d. Using 60.", result.httpReadTimeout)
+		result.httpReadTimeout = 60
+	}
+
+	// Load httpWriteTimeout (OPTIONAL)
+	// Default: 300 (seconds)
+	result.httpWriteTimeout = readOptionalInt(section, "httpwritetimeout", 300)
+	if result.httpWriteTimeout < 0 {
+		log.Warnf("Invalid httpwritetimeout %d. Using 300.", result.httpWriteTimeout)
+		result.httpWriteTimeout = 300
+	}
+
+	// Load httpIdleTimeout (OPTIONAL)
+	// Default: 120 (seconds)
+	result.httpIdleTimeout = readOptionalInt(section, "httpidletimeout", 120)
+	if result.httpIdleTimeout < 0 {
+		log.Warnf("Invalid httpidletimeout %d. Using 120.", result.httpIdleTimeout)
+		result.httpIdleTimeout = 120
+	}
+
+	// Load spriteMaxTiles (OPTIONAL)
+	// Default: 100
+	result.spriteMaxTiles = readOptionalInt(section, "spritemaxtiles", 100)
+	if result.spriteMaxTiles < 1 || result.spriteMaxTiles > 1000 {
+		log.Warnf("Invalid spritemaxtiles %d. Using 100.", result.spriteMaxTiles)
+		result.spriteMaxTiles = 100
+	}
+
+	// Load metrics (OPTIONAL)
+	// Default: false
+	result.metrics = readOptionalBool(section, "metrics", false)
+
+	// Load corsOrigins (OPTIONAL)
+	// Default: "" (no cross-origin requests)
+	for _, origin := range strings.Split(section.Key("corsorigins").MustString(""), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			result.corsOrigins = append(result.corsOrigins, origin)
+		}
+	}
+
 	return result
 }
 
+// toLogLvl returns the log level with the provided name. Invalid names
+// are logged and info level is used, see parseLogLevel for a variant that
+// returns an error instead.
 func toLogLvl(level string) log.Level {
-	var logLevel log.Level
+	logLevel, err := parseLogLevel(level)
+	if err != nil {
+		log.Warnf("Invalid loglevel '%s'. Using info level.", level)
+		return log.InfoLevel
+	}
+	return logLevel
+}
+
+// parseLogLevel returns the log level with the provided name, or error if
+// it isn't a valid log level. "warning" is accepted as well as "warn" since
+// that is the name logrus uses.
+func parseLogLevel(level string) (log.Level, error) {
 	switch level {
 	case "trace":
-		logLevel = log.TraceLevel
+		return log.TraceLevel, nil
 	case "debug":
-		logLevel = log.DebugLevel
+		return log.DebugLevel, nil
 	case "info":
-		logLevel = log.InfoLevel
-	case "warn":
-		logLevel = log.WarnLevel
+		return log.InfoLevel, nil
+	case "warn", "warning":
+		return log.WarnLevel, nil
 	case "error":
-		logLevel = log.ErrorLevel
+		return log.ErrorLevel, nil
 	case "panic":
-		logLevel = log.PanicLevel
-	default:
-		log.Warnf("Invalid loglevel '%s'. Using info level.", level)
-		logLevel = log.InfoLevel
+		return log.PanicLevel, nil
 	}
+	return log.InfoLevel, fmt.Errorf("invalid log level '%s'", level)
+}
 
-	return logLevel
+// toLogFormatter returns the log formatter for the log format (text or
+// json)
+func toLogFormatter(format string, timestamp bool) log.Formatter {
+	if format == "json" {
+		return &log.JSONFormatter{DisableTimestamp: !timestamp}
+	}
+	return &log.TextFormatter{DisableTimestamp: !timestamp}
+}
+
+// toTLSVersion converts a TLS version, e.g. 1.2, to its tls constant
+func toTLSVersion(version string) uint16 {
+	switch strings.TrimSpace(version) {
+	case "1.0":
+		return tls.VersionTLS10
+	case "1.1":
+		return tls.VersionTLS11
+	case "1.2":
+		return tls.VersionTLS12
+	case "1.3":
+		return tls.VersionTLS13
+	}
+	log.Warnf("Invalid mintlsversion '%s'. Using 1.2.", version)
+	return tls.VersionTLS12
+}
+
+// toCipherSuites converts a comma separated list of cipher suite names,
+// e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, to their IDs. Unknown,
+// insecure and TLS 1.3 (not configurable) cipher suites are ignored.
+// Returns nil for an empty list.
+func toCipherSuites(cipherList string) []uint16 {
+	var cipherSuites []uint16
+	for _, name := range strings.Split(cipherList, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, cipherSuite := range tls.CipherSuites() {
+			tls13Only := len(cipherSuite.SupportedVersions) == 1 &&
+				cipherSuite.SupportedVersions[0] == tls.VersionTLS13
+			if cipherSuite.Name == name && !tls13Only {
+				cipherSuites = append(cipherSuites, cipherSuite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Warnf("Unknown, insecure or TLS 1.3 cipher suite '%s'. Ignoring it.", name)
+		}
+	}
+	return cipherSuites
+}
+
+// toExtensions converts a comma separated list of file extensions to a
+// slice where all extensions starts with a dot. Returns nil for an empty
+// list.
+func toExtensions(extensionList string) []string {
+	var extensions []string
+	for _, extension := range strings.Split(extensionList, ",") {
+		extension = strings.ToLower(strings.TrimSpace(extension))
+		if extension == "" {
+			continue
+		}
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		extensions = append(extensions, extension)
+	}
+	return extensions
 }
 
 func pathEquals(path1, path2 string) bool {
@@ -240,6 +990,19 @@ func readOptionalBool(section *ini.Section, key string, defaultVal bool) bool {
 	return result
 }
 
+func readOptionalFloat(section *ini.Section, key string, defaultVal float64) float64 {
+	if !section.HasKey(key) {
+		return defaultVal
+	}
+
+	result, err := section.Key(key).Float64()
+	if err != nil {
+		result = defaultVal
+		log.Warn(err)
+	}
+	return result
+}
+
 func readOptionalInt(section *ini.Section, key string, defaultVal int) int {
 	if !section.HasKey(key) {
 		return defaultVal
@@ -252,3 +1015,24 @@ func readOptionalInt(section *ini.Section, key string, defaultVal int) int {
 	}
 	return result
 }
+
+// readOptionalFileMode reads an octal file mode, e.g. 0755. Modes above
+// 0777 (e.g. setuid) are invalid and minMode (the permissions mediaweb
+// itself needs) is always added. Returns 0 if not set or invalid.
+func readOptionalFileMode(section *ini.Section, key string, minMode uint32) uint32 {
+	if !section.HasKey(key) {
+		return 0
+	}
+	value := strings.TrimSpace(section.Key(key).String())
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		log.Warnf("Invalid %s %s. Using default.", key, value)
+		return 0
+	}
+	result := uint32(mode)
+	if result&minMode != minMode {
+		log.Warnf("%s %04o lacks owner permissions. Using %04o.", key, result, result|minMode)
+		result |= minMode
+	}
+	return result
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	log "github.com/sirupsen/logrus"
 )
 
 func TestSettingsDefault(t *testing.T) {
@@ -23,19 +28,104 @@ mediapath = Y:\pictures`
 	assertEqualsBool(t, "enablethumbCache", true, s.enableThumbCache)
 	assertEqualsBool(t, "genthumbsonstartup", false, s.genThumbsOnStartup)
 	assertEqualsBool(t, "genthumbsonadd", true, s.genThumbsOnAdd)
+	assertEqualsBool(t, "genalbumthumbs", true, s.genAlbumThumbs)
 	assertEqualsBool(t, "autoRotate", true, s.autoRotate)
+	assertEqualsBool(t, "forcerotate", false, s.forceRotate)
 	assertEqualsBool(t, "enablepreview", false, s.enablePreview)
 	assertEqualsInt(t, "previewmaxside", 1280, s.previewMaxSide)
+	assertEqualsInt(t, "previewminside", 1280, s.previewMinSide)
+	assertEqualsInt(t, "previewsizes", 0, len(s.previewSizes))
+	assertEqualsStr(t, "previewformat", "jpeg", s.previewFormat)
+	assertEqualsBool(t, "previewkeepformat", false, s.previewKeepFormat)
+	assertEqualsStr(t, "resamplefilter", "box", s.resampleFilter)
+	assertEqualsStr(t, "thumbbackground", "ffffff", s.thumbBackground)
+	assertEqualsInt(t, "blurhashcomponents", 4, s.blurHashX)
+	assertEqualsInt(t, "blurhashcomponents", 3, s.blurHashY)
+	assertEqualsInt(t, "videopreviewframes", 5, s.videoPreviewFrames)
+	assertEqualsInt(t, "maximagepixels", 100, s.maxImagePixels)
+	assertEqualsStr(t, "watermarkfile", "", s.watermarkFile)
+	assertEqualsStr(t, "watermarkposition", "bottomright", s.watermarkPosition)
+	assertEqualsInt(t, "watermarkopacity", 50, s.watermarkOpacity)
+	assertEqualsBool(t, "enhancepreviews", false, s.enhancePreviews)
+	assertTrue(t, "sharpenamount", s.sharpenAmount == 0.5)
+	assertEqualsInt(t, "contrastamount", 0, s.contrastAmount)
 	assertEqualsBool(t, "genpreviewonstartup", false, s.genPreviewOnStartup)
 	assertEqualsBool(t, "genpreviewonadd", true, s.genPreviewOnAdd)
+	assertEqualsInt(t, "watcherdebounce", 2, s.watcherDebounceSec)
+	assertEqualsInt(t, "watcherresyncinterval", 10, s.watcherResyncInterval)
+	assertEqualsInt(t, "watchpaths", 0, len(s.watchPaths))
 	assertEqualsBool(t, "enablecachecleanup", false, s.enableCacheCleanup)
-	// assertEqualsInt(t, "logLevel", int(llog.LvlInfo), int(s.logLevel))
+	assertEqualsStr(t, "similarscope", "folder", s.similarScope)
+	assertEqualsBool(t, "exifthumbrotate", true, s.exifThumbRotate)
+	assertEqualsInt(t, "exifthumbminside", 0, s.exifThumbMinSide)
+	assertEqualsBool(t, "videoiconoverlay", true, s.videoIconOverlay)
+	assertEqualsBool(t, "videothumbfallback", false, s.videoThumbFallback)
+	assertEqualsBool(t, "gifanimatedthumbs", false, s.gifAnimatedThumbs)
+	assertEqualsBool(t, "videocontactsheet", false, s.videoContactSheet)
+	assertEqualsInt(t, "videocontactgrid", 4, s.contactColumns)
+	assertEqualsInt(t, "videocontactgrid", 3, s.contactRows)
+	assertEqualsStr(t, "ffmpegpath", "", s.ffmpegPath)
+	assertEqualsInt(t, "ffmpegextraargs", 0, len(s.ffmpegExtraArgs))
+	assertEqualsBool(t, "ffmpegselftest", false, s.ffmpegSelfTest)
+	assertEqualsBool(t, "livephotos", false, s.livePhotos)
+	assertEqualsBool(t, "groupsidecars", false, s.groupSidecars)
+	assertEqualsBool(t, "skiphidden", true, s.skipHidden)
+	assertEqualsInt(t, "cachedirmode", 0, int(s.cacheDirMode))
+	assertEqualsInt(t, "cachefilemode", 0, int(s.cacheFileMode))
+	assertEqualsBool(t, "cacheincludeext", true, s.cacheIncludeExt)
+	assertEqualsBool(t, "cacheatomicwrite", true, s.cacheAtomicWrite)
+	assertEqualsInt(t, "imageextensions", 0, len(s.imageExtensions))
+	assertEqualsInt(t, "videoextensions", 0, len(s.videoExtensions))
+	assertEqualsBool(t, "sniffcontent", false, s.sniffContent)
+	assertEqualsInt(t, "cacheentryttldays", 0, s.cacheEntryTTLDays)
+	assertEqualsBool(t, "cacheexpiretypes thumbnail", false, s.cacheExpireThumbnails)
+	assertEqualsBool(t, "cacheexpiretypes preview", true, s.cacheExpirePreviews)
+	assertEqualsInt(t, "cachemaxsize", 0, s.cacheMaxSizeMB)
+	assertEqualsInt(t, "cachemaxage", 0, s.cacheMaxAgeDays)
+	assertEqualsInt(t, "cacheevictioninterval", 60, s.cacheEvictionInterval)
+	assertEqualsInt(t, "thumbretrydelay", 60, s.thumbRetryDelay)
+	assertEqualsInt(t, "slowgenthreshold", 0, s.slowGenThreshold)
+	assertEqualsInt(t, "ondemandconcurrency", 0, s.onDemandConcurrency)
+	assertEqualsBool(t, "precachepriority", true, s.preCachePriority)
+	assertEqualsBool(t, "checkstale", true, s.checkStale)
+	assertEqualsInt(t, "thumbmaxretries", 0, s.thumbMaxRetries)
+	assertEqualsInt(t, "logLevel", int(log.InfoLevel), int(s.logLevel))
 	assertEqualsStr(t, "logFile", "", s.logFile)
+	assertEqualsInt(t, "logmaxsize", 0, s.logMaxSize)
+	assertEqualsInt(t, "logmaxbackups", 3, s.logMaxBackups)
+	assertEqualsStr(t, "logformat", "text", s.logFormat)
+	assertEqualsBool(t, "logtimestamp", true, s.logTimestamp)
+	assertEqualsBool(t, "accesslog", false, s.accessLog)
 	assertEqualsStr(t, "userName", "", s.userName)
 	assertEqualsStr(t, "password", "", s.password)
+	assertEqualsInt(t, "viewers", 0, len(s.viewers))
 	assertEqualsStr(t, "ip", "", s.ip)
+	assertEqualsStr(t, "socket", "", s.socket)
+	assertEqualsStr(t, "basepath", "", s.basePath)
 	assertEqualsStr(t, "tlsCertFile", "", s.tlsCertFile)
 	assertEqualsStr(t, "tlsKeyFile", "", s.tlsKeyFile)
+	assertEqualsInt(t, "mintlsversion", tls.VersionTLS12, int(s.minTLSVersion))
+	assertEqualsInt(t, "tlsciphers", 0, len(s.tlsCipherSuites))
+	assertEqualsBool(t, "autocert", false, s.autocert)
+	assertEqualsInt(t, "autocertdomains", 0, len(s.autocertDomains))
+	assertEqualsStr(t, "autocertcachedir", "", s.autocertCacheDir)
+	assertEqualsStr(t, "autocerthttpaddr", ":80", s.autocertHTTPAddr)
+	assertEqualsBool(t, "allowdelete", false, s.allowDelete)
+	assertEqualsBool(t, "allowupload", false, s.allowUpload)
+	assertEqualsInt(t, "maxuploadsize", 500, s.maxUploadSizeMB)
+	assertEqualsStr(t, "trashpath", "", s.trashPath)
+	assertEqualsInt(t, "trashmaxage", 30, s.trashMaxAgeDays)
+	assertEqualsStr(t, "sessionsecret", "", s.sessionSecret)
+	assertEqualsInt(t, "sessiontimeout", 1440, s.sessionTimeout)
+	assertEqualsInt(t, "httpreadheadertimeout", 10, s.httpReadHeaderTimeout)
+	assertEqualsInt(t, "httpreadtimeout", 60, s.httpReadTimeout)
+	assertEqualsInt(t, "httpwritetimeout", 300, s.httpWriteTimeout)
+	assertEqualsInt(t, "httpidletimeout", 120, s.httpIdleTimeout)
+	assertEqualsInt(t, "spritemaxtiles", 100, s.spriteMaxTiles)
+	assertEqualsStr(t, "rootfolder", "", s.rootFolder)
+	assertEqualsStr(t, "defaultfolder", "", s.defaultFolder)
+	assertEqualsBool(t, "metrics", false, s.metrics)
+	assertEqualsInt(t, "corsorigins", 0, len(s.corsOrigins))
 
 }
 
@@ -44,23 +134,101 @@ func TestSettings(t *testing.T) {
 		`
 port = 80
 ip = 192.168.1.2
+socket = /run/mediaweb.sock
+basepath = /gallery/
 mediapath = /media/usb/pictures
 cachepath = /tmp/thumb
 enablethumbcache = off
 genthumbsonstartup = on
 genthumbsonadd = off
+genalbumthumbs = off
 autorotate = false
+forcerotate = on
 enablepreview = true
 previewmaxside = 1920
+previewminside = 1024
+previewsizes = 640, 3840
+previewformat = avif
+previewkeepformat = on
+resamplefilter = lanczos
+thumbbackground = 202020
+blurhashcomponents = 5x4
+videopreviewframes = 8
+maximagepixels = 0
+watermarkfile = /tmp/logo.png
+watermarkposition = topleft
+watermarkopacity = 80
+enhancepreviews = on
+sharpenamount = 1.5
+contrastamount = 20
 genpreviewonstartup = on
 genpreviewonadd = off
+watcherdebounce = 10
+watcherresyncinterval = 0
+watchpaths = incoming, 2024/summer
 enablecachecleanup = on
+livephotos = on
+groupsidecars = on
+skiphidden = off
+cachedirmode = 0750
+cachefilemode = 640
+cacheincludeext = off
+cacheatomicwrite = off
+similarscope = library
+exifthumbrotate = off
+exifthumbminside = 200
+videoiconoverlay = off
+videothumbfallback = on
+gifanimatedthumbs = on
+videocontactsheet = on
+videocontactgrid = 3X2
+ffmpegpath = /opt/ffmpeg/bin/ffmpeg
+ffmpegextraargs = -hwaccel  auto
+ffmpegselftest = on
+imageextensions = .jpg,JPEG
+videoextensions = .mp4, webm ,.M4V
+sniffcontent = on
+cacheentryttldays = 30
+cacheexpiretypes = thumbnail, preview
+cachemaxsize = 500
+cachemaxage = 90
+cacheevictioninterval = 10
+thumbretrydelay = 5
+slowgenthreshold = 2000
+ondemandconcurrency = 4
+precachepriority = off
+checkstale = off
+thumbmaxretries = 3
 loglevel = debug
 logfile = /tmp/log/mediaweb.log
+logmaxsize = 10
+logmaxbackups = 5
+logformat = json
+logtimestamp = off
+accesslog = on
 username = an_email@password.com
 password = """A!#_q7*+"""
+viewers = anna:secret1, bob : pass:word, an_email@password.com:other, broken
 tlscertfile = /file/my_cert_file.crt
 tlskeyfile = /file/my_cert_file.key
+mintlsversion = 1.3
+tlsciphers = TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+allowdelete = on
+allowupload = on
+maxuploadsize = 0
+trashpath = /media/usb/trash
+trashmaxage = 0
+sessionsecret = my secret
+sessiontimeout = 60
+httpreadheadertimeout = 5
+httpreadtimeout = 30
+httpwritetimeout = 0
+httpidletimeout = 90
+spritemaxtiles = 40
+rootfolder = /shared/family/
+defaultfolder = /2024/
+metrics = on
+corsorigins = https://a.example.com, http://localhost:3000
 `
 	fullPath := createConfigFile(t, "TestSettings.conf", contents)
 	s := loadSettings(fullPath)
@@ -74,19 +242,104 @@ tlskeyfile = /file/my_cert_file.key
 	assertEqualsBool(t, "enableThumbCache", false, s.enableThumbCache)
 	assertEqualsBool(t, "genthumbsonstartup", true, s.genThumbsOnStartup)
 	assertEqualsBool(t, "genthumbsonadd", false, s.genThumbsOnAdd)
+	assertEqualsBool(t, "genalbumthumbs", false, s.genAlbumThumbs)
 	assertEqualsBool(t, "autoRotate", false, s.autoRotate)
+	assertEqualsBool(t, "forcerotate", true, s.forceRotate)
 	assertEqualsBool(t, "enablepreview", true, s.enablePreview)
 	assertEqualsInt(t, "previewmaxside", 1920, s.previewMaxSide)
+	assertEqualsInt(t, "previewminside", 1024, s.previewMinSide)
+	assertEqualsInt(t, "previewsizes", 2, len(s.previewSizes))
+	assertEqualsInt(t, "previewsizes", 3840, s.previewSizes[1])
+	assertEqualsStr(t, "previewformat", "avif", s.previewFormat)
+	assertEqualsBool(t, "previewkeepformat", true, s.previewKeepFormat)
+	assertEqualsStr(t, "resamplefilter", "lanczos", s.resampleFilter)
+	assertEqualsStr(t, "thumbbackground", "202020", s.thumbBackground)
+	assertEqualsInt(t, "blurhashcomponents", 5, s.blurHashX)
+	assertEqualsInt(t, "blurhashcomponents", 4, s.blurHashY)
+	assertEqualsInt(t, "videopreviewframes", 8, s.videoPreviewFrames)
+	assertEqualsInt(t, "maximagepixels", 0, s.maxImagePixels)
+	assertEqualsStr(t, "watermarkfile", "/tmp/logo.png", s.watermarkFile)
+	assertEqualsStr(t, "watermarkposition", "topleft", s.watermarkPosition)
+	assertEqualsInt(t, "watermarkopacity", 80, s.watermarkOpacity)
+	assertEqualsBool(t, "enhancepreviews", true, s.enhancePreviews)
+	assertTrue(t, "sharpenamount", s.sharpenAmount == 1.5)
+	assertEqualsInt(t, "contrastamount", 20, s.contrastAmount)
 	assertEqualsBool(t, "genpreviewonstartup", true, s.genPreviewOnStartup)
 	assertEqualsBool(t, "genpreviewonadd", false, s.genPreviewOnAdd)
+	assertEqualsInt(t, "watcherdebounce", 10, s.watcherDebounceSec)
+	assertEqualsInt(t, "watcherresyncinterval", 0, s.watcherResyncInterval)
+	assertEqualsStr(t, "watchpaths", "incoming,2024/summer", strings.Join(s.watchPaths, ","))
 	assertEqualsBool(t, "enablecachecleanup", true, s.enableCacheCleanup)
-	// assertEqualsInt(t, "logLevel", int(llog.LvlDebug), int(s.logLevel))
+	assertEqualsStr(t, "similarscope", "library", s.similarScope)
+	assertEqualsBool(t, "exifthumbrotate", false, s.exifThumbRotate)
+	assertEqualsInt(t, "exifthumbminside", 200, s.exifThumbMinSide)
+	assertEqualsBool(t, "videoiconoverlay", false, s.videoIconOverlay)
+	assertEqualsBool(t, "videothumbfallback", true, s.videoThumbFallback)
+	assertEqualsBool(t, "gifanimatedthumbs", true, s.gifAnimatedThumbs)
+	assertEqualsBool(t, "videocontactsheet", true, s.videoContactSheet)
+	assertEqualsInt(t, "videocontactgrid", 3, s.contactColumns)
+	assertEqualsInt(t, "videocontactgrid", 2, s.contactRows)
+	assertEqualsStr(t, "ffmpegpath", "/opt/ffmpeg/bin/ffmpeg", s.ffmpegPath)
+	assertEqualsStr(t, "ffmpegextraargs", "-hwaccel auto", strings.Join(s.ffmpegExtraArgs, " "))
+	assertEqualsBool(t, "ffmpegselftest", true, s.ffmpegSelfTest)
+	assertEqualsBool(t, "livephotos", true, s.livePhotos)
+	assertEqualsBool(t, "groupsidecars", true, s.groupSidecars)
+	assertEqualsBool(t, "skiphidden", false, s.skipHidden)
+	assertEqualsInt(t, "cachedirmode", 0750, int(s.cacheDirMode))
+	assertEqualsInt(t, "cachefilemode", 0640, int(s.cacheFileMode))
+	assertEqualsBool(t, "cacheincludeext", false, s.cacheIncludeExt)
+	assertEqualsBool(t, "cacheatomicwrite", false, s.cacheAtomicWrite)
+	assertEqualsStr(t, "imageextensions", ".jpg,.jpeg", strings.Join(s.imageExtensions, ","))
+	assertEqualsStr(t, "videoextensions", ".mp4,.webm,.m4v", strings.Join(s.videoExtensions, ","))
+	assertEqualsBool(t, "sniffcontent", true, s.sniffContent)
+	assertEqualsInt(t, "cacheentryttldays", 30, s.cacheEntryTTLDays)
+	assertEqualsBool(t, "cacheexpiretypes thumbnail", true, s.cacheExpireThumbnails)
+	assertEqualsBool(t, "cacheexpiretypes preview", true, s.cacheExpirePreviews)
+	assertEqualsInt(t, "cachemaxsize", 500, s.cacheMaxSizeMB)
+	assertEqualsInt(t, "cachemaxage", 90, s.cacheMaxAgeDays)
+	assertEqualsInt(t, "cacheevictioninterval", 10, s.cacheEvictionInterval)
+	assertEqualsInt(t, "thumbretrydelay", 5, s.thumbRetryDelay)
+	assertEqualsInt(t, "slowgenthreshold", 2000, s.slowGenThreshold)
+	assertEqualsInt(t, "ondemandconcurrency", 4, s.onDemandConcurrency)
+	assertEqualsBool(t, "precachepriority", false, s.preCachePriority)
+	assertEqualsBool(t, "checkstale", false, s.checkStale)
+	assertEqualsInt(t, "thumbmaxretries", 3, s.thumbMaxRetries)
+	assertEqualsInt(t, "logLevel", int(log.DebugLevel), int(s.logLevel))
 	assertEqualsStr(t, "logFile", "/tmp/log/mediaweb.log", s.logFile)
+	assertEqualsInt(t, "logmaxsize", 10, s.logMaxSize)
+	assertEqualsInt(t, "logmaxbackups", 5, s.logMaxBackups)
+	assertEqualsStr(t, "logformat", "json", s.logFormat)
+	assertEqualsBool(t, "logtimestamp", false, s.logTimestamp)
+	assertEqualsBool(t, "accesslog", true, s.accessLog)
 	assertEqualsStr(t, "userName", "an_email@password.com", s.userName)
 	assertEqualsStr(t, "password", "A!#_q7*+", s.password)
+	assertEqualsInt(t, "viewers", 2, len(s.viewers))
+	assertEqualsStr(t, "viewers anna", "secret1", s.viewers["anna"])
+	assertEqualsStr(t, "viewers bob", "pass:word", s.viewers["bob"])
 	assertEqualsStr(t, "ip", "192.168.1.2", s.ip)
+	assertEqualsStr(t, "socket", "/run/mediaweb.sock", s.socket)
+	assertEqualsStr(t, "basepath", "/gallery/", s.basePath)
 	assertEqualsStr(t, "tlsCertFile", "/file/my_cert_file.crt", s.tlsCertFile)
 	assertEqualsStr(t, "tlsKeyFile", "/file/my_cert_file.key", s.tlsKeyFile)
+	assertEqualsInt(t, "mintlsversion", tls.VersionTLS13, int(s.minTLSVersion))
+	assertEqualsInt(t, "tlsciphers", 2, len(s.tlsCipherSuites))
+	assertEqualsInt(t, "tlsciphers", int(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), int(s.tlsCipherSuites[0]))
+	assertEqualsBool(t, "allowdelete", true, s.allowDelete)
+	assertEqualsBool(t, "allowupload", true, s.allowUpload)
+	assertEqualsInt(t, "maxuploadsize", 0, s.maxUploadSizeMB)
+	assertEqualsStr(t, "trashpath", "/media/usb/trash", s.trashPath)
+	assertEqualsInt(t, "trashmaxage", 0, s.trashMaxAgeDays)
+	assertEqualsStr(t, "sessionsecret", "my secret", s.sessionSecret)
+	assertEqualsInt(t, "sessiontimeout", 60, s.sessionTimeout)
+	assertEqualsInt(t, "httpreadheadertimeout", 5, s.httpReadHeaderTimeout)
+	assertEqualsInt(t, "httpreadtimeout", 30, s.httpReadTimeout)
+	assertEqualsInt(t, "httpwritetimeout", 0, s.httpWriteTimeout)
+	assertEqualsInt(t, "httpidletimeout", 90, s.httpIdleTimeout)
+	assertEqualsInt(t, "spritemaxtiles", 40, s.spriteMaxTiles)
+	assertEqualsStr(t, "rootfolder", "shared/family", s.rootFolder)
+	assertEqualsStr(t, "defaultfolder", "2024", s.defaultFolder)
+	assertEqualsBool(t, "metrics", true, s.metrics)
+	assertEqualsStr(t, "corsorigins", "https://a.example.com,http://localhost:3000", strings.Join(s.corsOrigins, ","))
 
 }
 
@@ -99,14 +352,72 @@ cachepath = /tmp/thumb
 enablethumbcache = 33
 genthumbsonstartup = -1
 genthumbsonadd = 5.5
+genalbumthumbs = maybe
 autorotate = invalid
+forcerotate = sideways
 enablepreview = 27
 previewmaxside = invalid
+previewminside = 2000
+previewsizes = small, -1, 0
+previewformat = webp
+previewkeepformat = maybe
+resamplefilter = bicubic
+thumbbackground = 12345
+blurhashcomponents = 10x3
+videocontactsheet = maybe
+videocontactgrid = 4
+videopreviewframes = 0
+maximagepixels = -5
+watermarkposition = middle
+watermarkopacity = 101
+sharpenamount = 0
+contrastamount = 101
 enablethumbcache = -6
 genthumbsonstartup = 67
 enablecachecleanup = 4.5
-loglevel = debug
+cacheentryttldays = -3
+cacheexpiretypes = transcode
+similarscope = everywhere
+cachemaxsize = -1
+cachemaxage = -1
+cacheevictioninterval = 0
+thumbretrydelay = -1
+slowgenthreshold = -100
+exifthumbminside = -1
+ondemandconcurrency = -2
+precachepriority = first
+checkstale = sometimes
+thumbmaxretries = -1
+watcherdebounce = -1
+watcherresyncinterval = -5
+watchpaths = ../outside, ..
+mintlsversion = 2.0
+tlsciphers = TLS_RSA_WITH_RC4_128_SHA, TLS_AES_128_GCM_SHA256
+loglevel = verbose
 logfile = /tmp/log/mediaweb.log
+logmaxsize = -1
+logmaxbackups = 0
+logformat = xml
+accesslog = 17
+httpreadheadertimeout = -1
+httpreadtimeout = invalid
+httpwritetimeout = -5
+httpidletimeout = -1
+spritemaxtiles = 0
+rootfolder = shared/../../other
+defaultfolder = ../other
+trashpath = /media/usb/pictures
+trashmaxage = -7
+allowupload = 2
+maxuploadsize = -100
+viewers = anna:secret1
+metrics = maybe
+skiphidden = 12
+cachedirmode = 0799
+cachefilemode = 0044
+cacheincludeext = sometimes
+cacheatomicwrite = always
+ffmpegselftest = perhaps
 `
 	fullPath := createConfigFile(t, "TestSettings.conf", contents)
 	s := loadSettings(fullPath)
@@ -118,17 +429,79 @@ logfile = /tmp/log/mediaweb.log
 	// Check set values on optional
 	assertEqualsStr(t, "cachePath", "/tmp/thumb", s.cachePath)
 	assertEqualsInt(t, "previewmaxside", 1280, s.previewMaxSide)
-	// assertEqualsInt(t, "logLevel", int(llog.LvlDebug), int(s.logLevel))
+	assertEqualsInt(t, "previewminside", 1280, s.previewMinSide)
+	assertEqualsInt(t, "previewsizes", 0, len(s.previewSizes))
+	assertEqualsStr(t, "previewformat", "jpeg", s.previewFormat)
+	assertEqualsBool(t, "previewkeepformat", false, s.previewKeepFormat)
+	assertEqualsStr(t, "resamplefilter", "box", s.resampleFilter)
+	assertEqualsStr(t, "thumbbackground", "ffffff", s.thumbBackground)
+	assertEqualsInt(t, "blurhashcomponents", 4, s.blurHashX)
+	assertEqualsInt(t, "blurhashcomponents", 3, s.blurHashY)
+	assertEqualsBool(t, "videocontactsheet", false, s.videoContactSheet)
+	assertEqualsInt(t, "videocontactgrid", 4, s.contactColumns)
+	assertEqualsInt(t, "videocontactgrid", 3, s.contactRows)
+	assertEqualsInt(t, "videopreviewframes", 5, s.videoPreviewFrames)
+	assertEqualsInt(t, "maximagepixels", 100, s.maxImagePixels)
+	assertEqualsStr(t, "watermarkposition", "bottomright", s.watermarkPosition)
+	assertEqualsInt(t, "watermarkopacity", 50, s.watermarkOpacity)
+	assertEqualsBool(t, "enhancepreviews", false, s.enhancePreviews)
+	assertTrue(t, "sharpenamount", s.sharpenAmount == 0.5)
+	assertEqualsInt(t, "contrastamount", 0, s.contrastAmount)
+	assertEqualsInt(t, "cacheentryttldays", 0, s.cacheEntryTTLDays)
+	assertEqualsBool(t, "cacheexpiretypes thumbnail", false, s.cacheExpireThumbnails)
+	assertEqualsBool(t, "cacheexpiretypes preview", false, s.cacheExpirePreviews)
+	assertEqualsStr(t, "similarscope", "folder", s.similarScope)
+	assertEqualsInt(t, "cachemaxsize", 0, s.cacheMaxSizeMB)
+	assertEqualsInt(t, "cachemaxage", 0, s.cacheMaxAgeDays)
+	assertEqualsInt(t, "cacheevictioninterval", 60, s.cacheEvictionInterval)
+	assertEqualsInt(t, "thumbretrydelay", 60, s.thumbRetryDelay)
+	assertEqualsInt(t, "slowgenthreshold", 0, s.slowGenThreshold)
+	assertEqualsInt(t, "exifthumbminside", 0, s.exifThumbMinSide)
+	assertEqualsInt(t, "ondemandconcurrency", 0, s.onDemandConcurrency)
+	assertEqualsBool(t, "precachepriority", true, s.preCachePriority)
+	assertEqualsBool(t, "checkstale", true, s.checkStale)
+	assertEqualsInt(t, "thumbmaxretries", 0, s.thumbMaxRetries)
+	assertEqualsInt(t, "mintlsversion", tls.VersionTLS12, int(s.minTLSVersion))
+	assertEqualsInt(t, "tlsciphers", 0, len(s.tlsCipherSuites))
+	assertEqualsInt(t, "logLevel", int(log.InfoLevel), int(s.logLevel))
 	assertEqualsStr(t, "logFile", "/tmp/log/mediaweb.log", s.logFile)
+	assertEqualsInt(t, "logmaxsize", 0, s.logMaxSize)
+	assertEqualsInt(t, "logmaxbackups", 3, s.logMaxBackups)
 
 	// Should be default on invalid values
+	assertEqualsStr(t, "logformat", "text", s.logFormat)
+	assertEqualsBool(t, "accesslog", false, s.accessLog)
+	assertEqualsBool(t, "skiphidden", true, s.skipHidden)
+	assertEqualsInt(t, "cachedirmode", 0, int(s.cacheDirMode))
+	assertEqualsInt(t, "cachefilemode", 0644, int(s.cacheFileMode)) // Owner shall always have read/write
+	assertEqualsBool(t, "cacheincludeext", true, s.cacheIncludeExt)
+	assertEqualsBool(t, "cacheatomicwrite", true, s.cacheAtomicWrite)
+	assertEqualsBool(t, "ffmpegselftest", false, s.ffmpegSelfTest)
 	assertEqualsBool(t, "enablethumbCache", true, s.enableThumbCache)
 	assertEqualsBool(t, "genthumbsonstartup", false, s.genThumbsOnStartup)
 	assertEqualsBool(t, "genthumbsonadd", true, s.genThumbsOnAdd)
+	assertEqualsBool(t, "genalbumthumbs", true, s.genAlbumThumbs)
 	assertEqualsBool(t, "autoRotate", true, s.autoRotate)
+	assertEqualsBool(t, "forcerotate", false, s.forceRotate)
 	assertEqualsBool(t, "enablepreview", false, s.enablePreview)
 	assertEqualsBool(t, "genpreviewonstartup", false, s.genPreviewOnStartup)
 	assertEqualsBool(t, "genpreviewonadd", true, s.genPreviewOnAdd)
+	assertEqualsInt(t, "watcherdebounce", 2, s.watcherDebounceSec)
+	assertEqualsInt(t, "watcherresyncinterval", 10, s.watcherResyncInterval)
+	assertEqualsInt(t, "watchpaths", 0, len(s.watchPaths))
+	assertEqualsInt(t, "httpreadheadertimeout", 10, s.httpReadHeaderTimeout)
+	assertEqualsInt(t, "httpreadtimeout", 60, s.httpReadTimeout)
+	assertEqualsInt(t, "httpwritetimeout", 300, s.httpWriteTimeout)
+	assertEqualsInt(t, "httpidletimeout", 120, s.httpIdleTimeout)
+	assertEqualsInt(t, "spritemaxtiles", 100, s.spriteMaxTiles)
+	assertEqualsStr(t, "rootfolder", "", s.rootFolder)
+	assertEqualsStr(t, "defaultfolder", "", s.defaultFolder)
+	assertEqualsStr(t, "trashpath", "", s.trashPath)
+	assertEqualsInt(t, "trashmaxage", 30, s.trashMaxAgeDays)
+	assertEqualsInt(t, "viewers", 0, len(s.viewers))
+	assertEqualsBool(t, "allowupload", false, s.allowUpload)
+	assertEqualsInt(t, "maxuploadsize", 500, s.maxUploadSizeMB)
+	assertEqualsBool(t, "metrics", false, s.metrics)
 	assertEqualsBool(t, "enablecachecleanup", false, s.enableCacheCleanup)
 
 }
@@ -196,27 +569,134 @@ func TestSettingsMissingMediaPath(t *testing.T) {
 	t.Fatal("Panic expected")
 }
 
-func TestToLogLvl(t *testing.T) {
-	// checkLvl(t, llog.LvlTrace, "trace")
-	// checkLvl(t, llog.LvlDebug, "debug")
-	// checkLvl(t, llog.LvlInfo, "info")
-	// checkLvl(t, llog.LvlWarn, "warn")
-	// checkLvl(t, llog.LvlError, "error")
-	// checkLvl(t, llog.LvlPanic, "panic")
+func TestSettingsAutocert(t *testing.T) {
+	contents :=
+		`port = 443
+mediapath = /media/usb/pictures
+cachepath = /tmp/cache
+autocert = on
+autocertdomains = photos.example.com, www.photos.example.com
+autocertcachedir = /tmp/autocert
+autocerthttpaddr = 127.0.0.1:8080`
+	fullPath := createConfigFile(t, "TestSettingsAutocert.conf", contents)
+	s := loadSettings(fullPath)
+	assertEqualsBool(t, "autocert", true, s.autocert)
+	assertEqualsStr(t, "autocertdomains", "photos.example.com,www.photos.example.com", strings.Join(s.autocertDomains, ","))
+	assertEqualsStr(t, "autocertcachedir", "/tmp/autocert", s.autocertCacheDir)
+	assertEqualsStr(t, "autocerthttpaddr", "127.0.0.1:8080", s.autocertHTTPAddr)
+}
+
+func TestSettingsAutocertWithCertFile(t *testing.T) {
+	contents :=
+		`port = 443
+mediapath = /media/usb/pictures
+autocert = on
+autocertdomains = photos.example.com
+tlscertfile = public.crt
+tlskeyfile = private.key`
+	fullPath := createConfigFile(t, "TestSettingsAutocertWithCertFile.conf", contents)
+	defer expectPanic(t)
+	loadSettings(fullPath)
+	t.Fatal("Panic expected")
+}
+
+func TestSettingsAutocertMissingDomains(t *testing.T) {
+	contents :=
+		`port = 443
+mediapath = /media/usb/pictures
+autocert = on`
+	fullPath := createConfigFile(t, "TestSettingsAutocertMissingDomains.conf", contents)
+	defer expectPanic(t)
+	loadSettings(fullPath)
+	t.Fatal("Panic expected")
+}
+
+func TestSettingsAutocertMissingCacheDir(t *testing.T) {
+	contents :=
+		`port = 443
+mediapath = /media/usb/pictures
+autocert = on
+autocertdomains = photos.example.com`
+	fullPath := createConfigFile(t, "TestSettingsAutocertMissingCacheDir.conf", contents)
+	defer expectPanic(t)
+	loadSettings(fullPath)
+	t.Fatal("Panic expected")
+}
 
-	// // Invalid shall be info
-	// checkLvl(t, llog.LvlInfo, "")
-	// checkLvl(t, llog.LvlInfo, "invalid")
+func TestSettingsAutocertCacheDir(t *testing.T) {
+	contents :=
+		`port = 443
+mediapath = /media/usb/pictures
+cachepath = /tmp/cache
+autocert = on
+autocertdomains = photos.example.com
+autocertcachedir = /tmp/cache`
+	fullPath := createConfigFile(t, "TestSettingsAutocertCacheDir.conf", contents)
+	defer expectPanic(t)
+	loadSettings(fullPath)
+	t.Fatal("Panic expected")
+}
+
+func TestToLogFormatter(t *testing.T) {
+	entry := log.WithField("key", "value")
+	entry.Message = "message"
+
+	formatted, err := toLogFormatter("json", true).Format(entry)
+	assertExpectNoErr(t, "", err)
+	var fields map[string]string
+	assertExpectNoErr(t, "", json.Unmarshal(formatted, &fields))
+	assertEqualsStr(t, "", "message", fields["msg"])
+	assertEqualsStr(t, "", "value", fields["key"])
+	_, hasTime := fields["time"]
+	assertTrue(t, "", hasTime)
+
+	formatted, err = toLogFormatter("json", false).Format(entry)
+	assertExpectNoErr(t, "", err)
+	fields = nil
+	assertExpectNoErr(t, "", json.Unmarshal(formatted, &fields))
+	_, hasTime = fields["time"]
+	assertFalse(t, "", hasTime)
+
+	formatted, err = toLogFormatter("text", false).Format(entry)
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "", strings.Contains(string(formatted), "msg=message key=value"))
+	assertFalse(t, "", strings.Contains(string(formatted), "time="))
+}
 
+func TestParseLogLevel(t *testing.T) {
+	checkLvl(t, log.TraceLevel, "trace")
+	checkLvl(t, log.DebugLevel, "debug")
+	checkLvl(t, log.InfoLevel, "info")
+	checkLvl(t, log.WarnLevel, "warn")
+	checkLvl(t, log.WarnLevel, "warning")
+	checkLvl(t, log.ErrorLevel, "error")
+	checkLvl(t, log.PanicLevel, "panic")
+
+	// Invalid shall be an error, not info
+	for _, strLevel := range []string{"", "invalid", "INFO", " debug"} {
+		_, err := parseLogLevel(strLevel)
+		assertExpectErr(t, strLevel, err)
+	}
 }
 
-// func checkLvl(t *testing.T, expected llog.Level, strLevel string) {
-// 	level := toLogLvl(strLevel)
-// 	if level != expected {
-// 		t.Fatalf("%s should be level %d but was %d", strLevel, int(expected), int(level))
-// 	}
+func TestToLogLvl(t *testing.T) {
+	logs := captureLog(t)
+	assertEqualsInt(t, "", int(log.DebugLevel), int(toLogLvl("debug")))
+	assertEqualsInt(t, "", int(log.InfoLevel), int(toLogLvl("info")))
+	assertFalse(t, "", strings.Contains(logs.String(), "Invalid loglevel"))
+
+	// Invalid shall be info
+	assertEqualsInt(t, "", int(log.InfoLevel), int(toLogLvl("")))
+	assertEqualsInt(t, "", int(log.InfoLevel), int(toLogLvl("invalid")))
+	assertTrue(t, "", strings.Contains(logs.String(), "Invalid loglevel 'invalid'"))
+}
 
-// }
+func checkLvl(t *testing.T, expected log.Level, strLevel string) {
+	t.Helper()
+	level, err := parseLogLevel(strLevel)
+	assertExpectNoErr(t, strLevel, err)
+	assertEqualsInt(t, strLevel, int(expected), int(level))
+}
 
 // createConfigFile creates a configuration file. Returns the full path to it.
 func createConfigFile(t *testing.T, name, contents string) string {
@@ -269,3 +749,26 @@ cachepath = Y:\pictures`
 	loadSettings(fullPath)
 	t.Fatal("Panic expected")
 }
+
+func TestSettingsMediaDirCachePath(t *testing.T) {
+	contents :=
+		`
+port = 80
+mediapath = Y:\pictures
+cachepath = {mediadir}/.mediaweb-cache`
+	fullPath := createConfigFile(t, "TestSettingsMediaDirCachePath.conf", contents)
+	s := loadSettings(fullPath)
+	assertEqualsStr(t, "cachepath", "{mediadir}/.mediaweb-cache", s.cachePath)
+}
+
+func TestSettingsInvalidMediaDirCachePath(t *testing.T) {
+	contents :=
+		`
+port = 80
+mediapath = Y:\pictures
+cachepath = {mediadir}`
+	fullPath := createConfigFile(t, "TestSettingsInvalidMediaDirCachePath.conf", contents)
+	defer expectPanic(t)
+	loadSettings(fullPath)
+	t.Fatal("Panic expected")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sniffedType is a cached file type of a file without extension. It is
+// only valid as long as the modification time is the same.
+type sniffedType struct {
+	modTime  time.Time
+	fileType string // image, video or "" (neither)
+}
+
+// sniffFileType returns the (cached) file type of a media file without
+// extension based on its content, i.e. "image" if it can be decoded as
+// an image, "video" if the first bytes identify a video and "" for any
+// other file. "" is also returned for files with an extension, if content
+// sniffing is disabled or if the file can't be read.
+func (m *Media) sniffFileType(relativeFilePath string) string {
+	if !m.sniffContent || filepath.Ext(relativeFilePath) != "" {
+		return ""
+	}
+	fullPath, err := m.getFullMediaPath(relativeFilePath)
+	if err != nil {
+		return ""
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil || stat.IsDir() {
+		return ""
+	}
+	relativeFilePath = strings.TrimPrefix(filepath.ToSlash(relativeFilePath), "/")
+	m.sniffMutex.Lock()
+	cached, ok := m.sniffedTypes[relativeFilePath]
+	m.sniffMutex.Unlock()
+	if ok && cached.modTime.Equal(stat.ModTime()) {
+		return cached.fileType
+	}
+
+	fileType := sniffContent(fullPath)
+
+	m.sniffMutex.Lock()
+	m.sniffedTypes[relativeFilePath] = sniffedType{modTime: stat.ModTime(), fileType: fileType}
+	m.sniffMutex.Unlock()
+	return fileType
+}
+
+// sniffContent returns "image" if the header of the file can be decoded
+// by any of the supported image decoders, "video" if the first 512 bytes
+// identify a video (see http.DetectContentType), otherwise "".
+func sniffContent(fullPath string) string {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	if _, _, err := image.DecodeConfig(file); err == nil {
+		return "image"
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return ""
+	}
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(file, header)
+	if strings.HasPrefix(http.DetectContentType(header[:n]), "video/") {
+		return "video"
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSniffContent(t *testing.T) {
+	mediaPath := "tmpout/TestSniffContent"
+	cachePath := "tmpcache/TestSniffContent"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/photo")
+	copyFile(t, "testmedia/png.png", mediaPath+"/screenshot")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/movie")
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/notes")
+	copyFile(t, "testmedia/invalid.jpg", mediaPath+"/broken")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/visible.jpg")
+
+	// Disabled by default
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	files, err := media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1, len(files))
+	assertEqualsStr(t, "", "", media.getFileType("photo"))
+	_, err = media.cache.thumbnailPath("photo")
+	assertExpectErr(t, "", err)
+
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{sniffContent: true})
+	files, err = media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 4, len(files))
+	assertEqualsStr(t, "", "movie", files[0].Name)
+	assertEqualsStr(t, "", "video", files[0].Type)
+	assertEqualsStr(t, "", "photo", files[1].Name)
+	assertEqualsStr(t, "", "image", files[1].Type)
+	assertEqualsStr(t, "", "screenshot", files[2].Name)
+	assertEqualsStr(t, "", "image", files[2].Type)
+	assertEqualsStr(t, "", "visible.jpg", files[3].Name)
+
+	// Sniffing failures shall just omit the file
+	assertEqualsStr(t, "", "", media.getFileType("notes"))
+	assertEqualsStr(t, "", "", media.getFileType("broken"))
+	assertEqualsStr(t, "", "", media.getFileType("dont_exist"))
+	assertEqualsStr(t, "", "", media.getFileType("../../testmedia/txt.txt"))
+
+	// Thumbnail of file without extension
+	thumbFileName, err := media.cache.generateThumbnail(media, "photo")
+	assertExpectNoErr(t, "", err)
+	assertEqualsStr(t, "", cachePath+"/photo.thumb.jpg", thumbFileName)
+
+	// Cached until modified
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/photo")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(mediaPath+"/photo", later, later)
+	assertEqualsStr(t, "", "image", media.sniffedTypes["photo"].fileType)
+	assertEqualsStr(t, "", "", media.getFileType("photo"))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/goexif2/exif"
+)
+
+// autoTags returns the tags of a media file derived from its EXIF
+// information. The tags are read only, nothing is written to the file.
+// The EXIF fields are mapped to tags as follows:
+//
+//	Make             -> camera make, e.g. Canon
+//	Model            -> camera model, e.g. Canon EOS 80D
+//	LensModel        -> lens, e.g. EF-S18-135mm f/3.5-5.6 IS USM
+//	DateTimeOriginal -> year, e.g. 2023 (DateTime if not provided)
+//
+// Media without EXIF information (e.g. videos) have no tags.
+func (m *Media) autoTags(relativeFilePath string) []string {
+	tags := []string{}
+	if !m.isImage(relativeFilePath) {
+		return tags
+	}
+	ex := m.extractEXIF(relativeFilePath)
+	if ex == nil {
+		return tags
+	}
+	for _, field := range []exif.FieldName{exif.Make, exif.Model, exif.LensModel} {
+		tag, err := ex.Get(field)
+		if err != nil {
+			continue
+		}
+		value, _ := tag.StringVal()
+		value = strings.TrimSpace(strings.Trim(value, "\x00"))
+		if value != "" && !containsFold(tags, value) {
+			tags = append(tags, value)
+		}
+	}
+	if date, err := ex.DateTime(); err == nil {
+		tags = append(tags, strconv.Itoa(date.Year()))
+	}
+	return tags
+}
+
+// getTags returns the tags of a media file, see autoTags. With a watcher
+// the tags are kept in the tag index (added by the pre-cache walk or on
+// first use). Without a watcher the tags are read each time.
+func (m *Media) getTags(relativeFilePath string) []string {
+	if m.watcher == nil {
+		return m.autoTags(relativeFilePath)
+	}
+	m.tagMutex.Lock()
+	tags, ok := m.fileTags[relativeFilePath]
+	m.tagMutex.Unlock()
+	if !ok {
+		tags = m.addTags(relativeFilePath)
+	}
+	return tags
+}
+
+// filterTag returns the media files (not folders) that have a tag. Tags
+// are case insensitive.
+func (m *Media) filterTag(files []File, tag string) []File {
+	tag = strings.ToLower(tag)
+	filtered := []File{}
+	for _, file := range files {
+		if file.Type == "folder" {
+			continue
+		}
+		if m.watcher == nil {
+			if containsFold(m.autoTags(file.Path), tag) {
+				filtered = append(filtered, file)
+			}
+			continue
+		}
+		m.getTags(file.Path) // Make sure the file is indexed
+		m.tagMutex.Lock()
+		tagged := m.tagIndex[tag][file.Path]
+		m.tagMutex.Unlock()
+		if tagged {
+			filtered = append(filtered, file)
+		}
+	}
+	return filtered
+}
+
+// addTags adds (or updates) a media file in the tag index. Returns its
+// tags.
+func (m *Media) addTags(relativeFilePath string) []string {
+	tags := m.autoTags(relativeFilePath)
+	m.tagMutex.Lock()
+	defer m.tagMutex.Unlock()
+	m.removeTagsLocked(relativeFilePath)
+	m.fileTags[relativeFilePath] = tags
+	for _, tag := range tags {
+		tag = strings.ToLower(tag)
+		if m.tagIndex[tag] == nil {
+			m.tagIndex[tag] = map[string]bool{}
+		}
+		m.tagIndex[tag][relativeFilePath] = true
+	}
+	return tags
+}
+
+// addTagsPath adds a created file or folder (including its sub folders)
+// to the tag index. Files that isn't media are ignored.
+func (m *Media) addTagsPath(relativePath string) {
+	relativePath = strings.TrimPrefix(filepath.ToSlash(relativePath), "/")
+	fullPath, err := m.getFullMediaPath(relativePath)
+	if err != nil {
+		return
+	}
+	if isDir(fullPath) {
+		m.walkRecent(relativePath, func(file RecentFile) {
+			m.addTags(file.Path)
+		})
+		return
+	}
+	if m.getFileType(relativePath) != "" {
+		m.addTags(relativePath)
+	}
+}
+
+// indexTagsFolder adds (or updates) the media files in relativePath, but
+// not in its sub folders, to the tag index
+func (m *Media) indexTagsFolder(relativePath string) {
+	files, err := m.getFiles(relativePath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.Type != "folder" {
+			m.addTags(file.Path)
+		}
+	}
+}
+
+// removeTags removes a file, or a folder and all files in it, from the
+// tag index
+func (m *Media) removeTags(relativePath string) {
+	relativePath = strings.TrimPrefix(filepath.ToSlash(relativePath), "/")
+	m.tagMutex.Lock()
+	defer m.tagMutex.Unlock()
+	m.removeTagsLocked(relativePath)
+	for path := range m.fileTags {
+		if strings.HasPrefix(path, relativePath+"/") {
+			m.removeTagsLocked(path)
+		}
+	}
+}
+
+// removeTagsLocked removes a file from the tag index. tagMutex must be
+// locked.
+func (m *Media) removeTagsLocked(relativeFilePath string) {
+	for _, tag := range m.fileTags[relativeFilePath] {
+		tag = strings.ToLower(tag)
+		delete(m.tagIndex[tag], relativeFilePath)
+		if len(m.tagIndex[tag]) == 0 {
+			delete(m.tagIndex, tag)
+		}
+	}
+	delete(m.fileTags, relativeFilePath)
+}
+
+// containsFold returns true if the slice contains the string, ignoring
+// case
+func containsFold(slice []string, s string) bool {
+	for _, item := range slice {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAutoTags(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	assertEqualsStr(t, "", "SAMSUNG,SM-N9005,2018", strings.Join(media.autoTags("jpeg.jpg"), ","))
+	assertEqualsInt(t, "No EXIF", 0, len(media.autoTags("exif_rotate/no_exif.jpg")))
+	assertEqualsInt(t, "", 0, len(media.autoTags("png.png")))
+	assertEqualsInt(t, "Video", 0, len(media.autoTags("video.mp4")))
+	assertEqualsInt(t, "Missing", 0, len(media.autoTags("dont_exist.jpg")))
+}
+
+func TestFilterTag(t *testing.T) {
+	mediaPath := "tmpout/TestFilterTag"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/a.jpg")
+	copyFile(t, "testmedia/exif_rotate/no_exif.jpg", mediaPath+"/b.jpg")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/sub/c.jpg")
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	files, err := media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	filtered := media.filterTag(files, "samsung")
+	assertEqualsInt(t, "", 1, len(filtered))
+	assertEqualsStr(t, "", "a.jpg", filtered[0].Path)
+	assertEqualsInt(t, "", 1, len(media.filterTag(files, "2018")))
+	assertEqualsInt(t, "", 0, len(media.filterTag(files, "Canon")))
+
+	// Without a watcher there is no index
+	assertEqualsInt(t, "", 0, len(media.fileTags))
+
+	// With a watcher the index shall be used and updated
+	media.watcher = createWatcher(media, false, false, 0, 0, nil)
+	assertEqualsInt(t, "", 1, len(media.filterTag(files, "SAMSUNG")))
+	assertEqualsInt(t, "", 2, len(media.fileTags))
+	assertEqualsInt(t, "", 1, len(media.tagIndex["sm-n9005"]))
+	media.addTagsPath("sub")
+	assertEqualsInt(t, "", 2, len(media.tagIndex["sm-n9005"]))
+
+	assertExpectNoErr(t, "", media.moveMedia("a.jpg", "sub/moved.jpg"))
+	assertTrue(t, "", media.tagIndex["2018"]["sub/moved.jpg"])
+	assertFalse(t, "", media.tagIndex["2018"]["a.jpg"])
+	media.removeTags("sub")
+	assertEqualsInt(t, "", 0, len(media.tagIndex["2018"]))
+	assertEqualsInt(t, "", 1, len(media.fileTags))
+}
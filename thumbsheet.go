@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/disintegration/imaging"
+	log "github.com/sirupsen/logrus"
+)
+
+// Layout of thumbnail sheets
+const (
+	thumbSheetTileSize = 256 // Width and height of each tile (same as generated thumbnails)
+	thumbSheetColumns  = 10  // Max number of tiles per row
+)
+
+// ThumbSheetTile is the position of a thumbnail in a thumbnail sheet
+type ThumbSheetTile struct {
+	X int
+	Y int
+	W int
+	H int
+}
+
+// ThumbSheet is the layout of one page of a thumbnail sheet, i.e. a
+// single image with the thumbnails of the media files in a folder
+type ThumbSheet struct {
+	Page   int                       // Page number, starting at 0
+	Pages  int                       // Number of pages
+	Width  int                       // Width of the sheet image
+	Height int                       // Height of the sheet image
+	Tiles  map[string]ThumbSheetTile // Key: relative path of media file
+}
+
+// getThumbSheet returns the layout of a page of the thumbnail sheet of
+// relativeFolderPath. Each page has at most maxTiles thumbnails, in the
+// same order as the folder listing (sub folders are not included).
+func (m *Media) getThumbSheet(relativeFolderPath string, page, maxTiles int) (ThumbSheet, error) {
+	files, err := m.getFiles(relativeFolderPath)
+	if err != nil {
+		return ThumbSheet{}, err
+	}
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.Type != "folder" {
+			paths = append(paths, file.Path)
+		}
+	}
+	if len(paths) == 0 {
+		return ThumbSheet{}, fmt.Errorf("no media files in %s", relativeFolderPath)
+	}
+	pages := (len(paths) + maxTiles - 1) / maxTiles
+	if page < 0 || page >= pages {
+		return ThumbSheet{}, fmt.Errorf("page %d out of range (%d pages)", page, pages)
+	}
+	paths = paths[page*maxTiles : min(len(paths), (page+1)*maxTiles)]
+
+	columns := min(len(paths), thumbSheetColumns)
+	rows := (len(paths) + columns - 1) / columns
+	sheet := ThumbSheet{
+		Page:   page,
+		Pages:  pages,
+		Width:  columns * thumbSheetTileSize,
+		Height: rows * thumbSheetTileSize,
+		Tiles:  make(map[string]ThumbSheetTile, len(paths))}
+	for i, path := range paths {
+		sheet.Tiles[path] = ThumbSheetTile{
+			X: (i % columns) * thumbSheetTileSize,
+			Y: (i / columns) * thumbSheetTileSize,
+			W: thumbSheetTileSize,
+			H: thumbSheetTileSize}
+	}
+	return sheet, nil
+}
+
+// writeThumbSheet writes the thumbnail sheet as a JPEG image to w. The
+// thumbnails are retrieved (and generated if necessary) the same way as
+// single thumbnails, see writeThumbnail. The default image or video icon
+// is used for media without thumbnail.
+func (m *Media) writeThumbSheet(w io.Writer, sheet ThumbSheet) error {
+	sheetImg := imaging.New(sheet.Width, sheet.Height, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+	for path, tile := range sheet.Tiles {
+		thumb, err := m.getThumbnailImage(path)
+		if err != nil {
+			log.Debugf("No thumbnail for %s in thumbnail sheet. Reason: %s", path, err)
+			icon := embedImageIconBytes
+			if m.isVideo(path) {
+				icon = embedVideoIconBytes
+			}
+			if thumb, err = imaging.Decode(bytes.NewReader(icon)); err != nil {
+				continue
+			}
+			thumb = imaging.Fit(thumb, tile.W, tile.H, imaging.Box)
+			sheetImg = imaging.Paste(sheetImg, thumb, image.Pt(
+				tile.X+(tile.W-thumb.Bounds().Dx())/2, tile.Y+(tile.H-thumb.Bounds().Dy())/2))
+			continue
+		}
+		thumb = imaging.Fill(thumb, tile.W, tile.H, imaging.Center, imaging.Box)
+		sheetImg = imaging.Paste(sheetImg, thumb, image.Pt(tile.X, tile.Y))
+	}
+	return imaging.Encode(w, sheetImg, imaging.JPEG)
+}
+
+// getThumbnailImage returns the decoded thumbnail of a media file. EXIF
+// thumbnails are rotated, also if the client is supposed to rotate them
+// (see getEXIFThumbnailOrientation).
+func (m *Media) getThumbnailImage(relativeFilePath string) (image.Image, error) {
+	var buffer bytes.Buffer
+	if err := m.writeThumbnail(&buffer, relativeFilePath); err != nil {
+		return nil, err
+	}
+	thumb, err := imaging.Decode(&buffer)
+	if err != nil {
+		return nil, err
+	}
+	return applyOrientation(thumb, m.getEXIFThumbnailOrientation(relativeFilePath)), nil
+}
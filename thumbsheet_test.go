@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestThumbSheet(t *testing.T) {
+	mediaPath := "tmpout/TestThumbSheet"
+	cachePath := "tmpcache/TestThumbSheet"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/a.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/b.png")
+	copyFile(t, "testmedia/gif.gif", mediaPath+"/c.gif")
+	copyFile(t, "testmedia/invalid.jpg", mediaPath+"/d.jpg")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/sub/e.jpg")
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	// Sub folders are not included
+	sheet, err := media.getThumbSheet("", 0, 100)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 0, sheet.Page)
+	assertEqualsInt(t, "", 1, sheet.Pages)
+	assertEqualsInt(t, "", 4*thumbSheetTileSize, sheet.Width)
+	assertEqualsInt(t, "", thumbSheetTileSize, sheet.Height)
+	assertEqualsInt(t, "", 4, len(sheet.Tiles))
+	assertEqualsInt(t, "", 3*thumbSheetTileSize, sheet.Tiles["d.jpg"].X)
+	_, hasFolder := sheet.Tiles["sub"]
+	assertTrue(t, "", !hasFolder)
+
+	// Pages
+	sheet, err = media.getThumbSheet("", 1, 3)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2, sheet.Pages)
+	assertEqualsInt(t, "", 1, len(sheet.Tiles))
+	assertEqualsInt(t, "", 0, sheet.Tiles["d.jpg"].X)
+	assertEqualsInt(t, "", thumbSheetTileSize, sheet.Width)
+	assertExpectErr(t, "", getThumbSheetErr(media, "", 2, 3))
+	assertExpectErr(t, "", getThumbSheetErr(media, "", -1, 3))
+	assertExpectErr(t, "", getThumbSheetErr(media, "dont_exist", 0, 100))
+	os.MkdirAll(mediaPath+"/empty", os.ModePerm)
+	assertExpectErr(t, "", getThumbSheetErr(media, "empty", 0, 100))
+
+	// Image (an icon is used for d.jpg)
+	sheet, _ = media.getThumbSheet("", 0, 100)
+	var buf bytes.Buffer
+	assertExpectNoErr(t, "", media.writeThumbSheet(&buf, sheet))
+	img, err := imaging.Decode(&buf)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", sheet.Width, img.Bounds().Dx())
+	assertEqualsInt(t, "", sheet.Height, img.Bounds().Dy())
+	assertFileExist(t, "", cachePath+"/b.png.thumb.jpg") // jpeg.jpg has an EXIF thumbnail
+}
+
+func getThumbSheetErr(media *Media, relativePath string, page, maxTiles int) error {
+	_, err := media.getThumbSheet(relativePath, page, maxTiles)
+	return err
+}
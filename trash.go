@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Layout of the trash. Deleted media files are moved to a folder named
+// by the date of the deletion, e.g. <trashpath>/2024-05-17/media/a/b.jpg
+// and their cache files to <trashpath>/2024-05-17/cache/a/b.thumb.jpg.
+const (
+	trashDateFormat  = "2006-01-02"
+	trashMediaFolder = "media"
+	trashCacheFolder = "cache"
+)
+
+// isInTrash returns true if the full path is the trash path or anything
+// in it. The trash is not part of the media even if the trash path is
+// located in the media path.
+func (m *Media) isInTrash(fullPath string) bool {
+	if m.trashPath == "" {
+		return false
+	}
+	diffPath, err := filepath.Rel(m.trashPath, fullPath)
+	diffPath = filepath.ToSlash(diffPath)
+	return err == nil && diffPath != ".." && !strings.HasPrefix(diffPath, "../")
+}
+
+// moveToTrash moves a media file, and its cache files, to the trash
+// folder of today. A file with the same path deleted earlier the same
+// day is replaced.
+func (m *Media) moveToTrash(relativeFilePath, fullMediaPath string) error {
+	trashFolder := filepath.Join(m.trashPath, time.Now().Format(trashDateFormat))
+	toFullPath := filepath.Join(trashFolder, trashMediaFolder, filepath.FromSlash(relativeFilePath))
+	if err := os.MkdirAll(filepath.Dir(toFullPath), os.ModePerm); err != nil {
+		return err
+	}
+	os.Remove(toFullPath) // Rename doesn't replace files on all platforms
+	if err := os.Rename(fullMediaPath, toFullPath); err != nil {
+		return err
+	}
+	log.Infof("Moved %s to trash %s", fullMediaPath, toFullPath)
+	if m.cache != nil {
+		m.cache.moveCacheFilesToTrash(relativeFilePath, filepath.Join(trashFolder, trashCacheFolder))
+	}
+	return nil
+}
+
+// restoreFromTrash moves a media file, and its cache files, back from
+// the trash. If the file has been deleted several times the most recent
+// one is restored. Returns an error satisfying os.IsNotExist if the file
+// isn't in the trash and os.IsExist if the media file already exist.
+func (m *Media) restoreFromTrash(relativeFilePath string) error {
+	if m.trashPath == "" {
+		return fmt.Errorf("trash disabled")
+	}
+	relativeFilePath = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(relativeFilePath)), "/")
+	fullMediaPath, err := m.getFullMediaPath(relativeFilePath)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(fullMediaPath); err == nil {
+		return &os.PathError{Op: "restore", Path: relativeFilePath, Err: os.ErrExist}
+	}
+	for _, folder := range m.getTrashFolders() {
+		trashFolder := filepath.Join(m.trashPath, folder)
+		fromFullPath := filepath.Join(trashFolder, trashMediaFolder, filepath.FromSlash(relativeFilePath))
+		if _, err := os.Stat(fromFullPath); err != nil {
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(fullMediaPath), os.ModePerm); err != nil {
+			return err
+		}
+		if err = os.Rename(fromFullPath, fullMediaPath); err != nil {
+			return err
+		}
+		log.Infof("Restored %s from trash %s", fullMediaPath, fromFullPath)
+		if m.cache != nil {
+			m.cache.restoreCacheFilesFromTrash(relativeFilePath, filepath.Join(trashFolder, trashCacheFolder))
+		}
+		m.invalidateDateIndex()
+		m.addRecentPath(relativeFilePath)
+		m.addTagsPath(relativeFilePath)
+		return nil
+	}
+	return &os.PathError{Op: "restore", Path: relativeFilePath, Err: os.ErrNotExist}
+}
+
+// getTrashFolders returns the names of the dated trash folders, most
+// recent first
+func (m *Media) getTrashFolders() []string {
+	dirEntries, err := os.ReadDir(m.trashPath)
+	if err != nil {
+		return nil // Nothing deleted yet
+	}
+	folders := []string{}
+	for _, dirEntry := range dirEntries {
+		if _, err := time.Parse(trashDateFormat, dirEntry.Name()); err == nil && dirEntry.IsDir() {
+			folders = append(folders, dirEntry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(folders)))
+	return folders
+}
+
+// emptyTrash removes the dated trash folders older than maxAge.
+// Returns the number of removed folders.
+func (m *Media) emptyTrash(maxAge time.Duration) int {
+	nbrRemovedFolders := 0
+	for _, folder := range m.getTrashFolders() {
+		date, _ := time.ParseInLocation(trashDateFormat, folder, time.Local)
+		// A folder contains files deleted during the whole day
+		if time.Since(date.AddDate(0, 0, 1)) <= maxAge {
+			continue
+		}
+		fullPath := filepath.Join(m.trashPath, folder)
+		if err := os.RemoveAll(fullPath); err != nil {
+			log.Warnf("Unable to empty trash %s. Reason: %s", fullPath, err)
+			continue
+		}
+		log.Info("Emptied trash ", fullPath)
+		nbrRemovedFolders++
+	}
+	return nbrRemovedFolders
+}
+
+// emptyTrashThread empties the trash from files older than maxAge at
+// startup and then with the provided interval
+func (m *Media) emptyTrashThread(maxAge, interval time.Duration) {
+	for {
+		m.emptyTrash(maxAge)
+		time.Sleep(interval)
+	}
+}
+
+// relativeCachePaths returns the relative paths of the thumbnail, the
+// contact sheet and all previews that may exist of a media file
+func (c *Cache) relativeCachePaths(relativeMediaPath string) []string {
+	relativePaths := make([]string, 0, 4)
+	relativeThumbPath, err := c.relativeThumbnailPath(relativeMediaPath)
+	if err == nil {
+		relativePaths = append(relativePaths, relativeThumbPath)
+	}
+	relativeSheetPath, err := c.relativeContactSheetPath(relativeMediaPath)
+	if err == nil {
+		relativePaths = append(relativePaths, relativeSheetPath)
+	}
+	return append(relativePaths, c.relativePreviewPaths(relativeMediaPath)...)
+}
+
+// moveCacheFilesToTrash moves the thumbnail, all previews and their error
+// indication files of a media file to the cache folder of a trash folder
+func (c *Cache) moveCacheFilesToTrash(relativeMediaPath, trashCachePath string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, relativePath := range c.relativeCachePaths(relativeMediaPath) {
+		delete(c.thumbnails, relativePath)
+		delete(c.previews, relativePath)
+		fullPath, err := c.getFullCachePath(relativePath)
+		if err != nil {
+			continue
+		}
+		toFullPath := filepath.Join(trashCachePath, filepath.FromSlash(relativePath))
+		c.moveCacheFile(fullPath, toFullPath)
+		c.moveCacheFile(c.errorIndicationPath(fullPath), c.errorIndicationPath(toFullPath))
+	}
+}
+
+// restoreCacheFilesFromTrash moves the cache files of a media file back
+// from the cache folder of a trash folder, see moveCacheFilesToTrash
+func (c *Cache) restoreCacheFilesFromTrash(relativeMediaPath, trashCachePath string) {
+	c.mutex.Lock()
+	for _, relativePath := range c.relativeCachePaths(relativeMediaPath) {
+		fullPath, err := c.getFullCachePath(relativePath)
+		if err != nil {
+			continue
+		}
+		fromFullPath := filepath.Join(trashCachePath, filepath.FromSlash(relativePath))
+		c.moveCacheFile(fromFullPath, fullPath)
+		c.moveCacheFile(c.errorIndicationPath(fromFullPath), c.errorIndicationPath(fullPath))
+	}
+	c.mutex.Unlock()
+
+	folder := path.Dir(relativeMediaPath)
+	if folder == "." {
+		folder = ""
+	}
+	c.loadCache(folder, false) // Add the restored cache files
+}
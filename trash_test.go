@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	mediaPath := "tmpout/TestTrash"
+	cachePath := "tmpcache/TestTrash"
+	trashPath := mediaPath + "/.trash"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/sub/jpeg.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{trashPath: trashPath})
+	_, err := media.cache.generateThumbnail(media, "sub/jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	assertFileExist(t, "", cachePath+"/sub/jpeg.jpg.thumb.jpg")
+
+	// Delete moves to the dated trash folder
+	assertExpectNoErr(t, "", media.deleteMedia("sub/jpeg.jpg"))
+	trashFolder := trashPath + "/" + time.Now().Format(trashDateFormat)
+	assertFileNotExist(t, "", mediaPath+"/sub/jpeg.jpg")
+	assertFileExist(t, "", trashFolder+"/media/sub/jpeg.jpg")
+	assertFileNotExist(t, "", cachePath+"/sub/jpeg.jpg.thumb.jpg")
+	assertFileExist(t, "", trashFolder+"/cache/sub/jpeg.jpg.thumb.jpg")
+	assertFalse(t, "", media.cache.hasThumbnail("sub/jpeg.jpg"))
+
+	// The trash isn't part of the media
+	files, err := media.getFiles("")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 2, len(files)) // png.png and sub
+	_, err = media.getFullMediaPath(".trash/" + time.Now().Format(trashDateFormat) + "/media/sub/jpeg.jpg")
+	assertExpectErr(t, "", err)
+
+	// Restore
+	assertExpectNoErr(t, "", media.restoreFromTrash("sub/jpeg.jpg"))
+	assertFileExist(t, "", mediaPath+"/sub/jpeg.jpg")
+	assertFileNotExist(t, "", trashFolder+"/media/sub/jpeg.jpg")
+	assertFileExist(t, "", cachePath+"/sub/jpeg.jpg.thumb.jpg")
+	assertTrue(t, "", media.cache.hasThumbnail("sub/jpeg.jpg"))
+	assertTrue(t, "", os.IsNotExist(media.restoreFromTrash("sub/dont_exist.jpg")))
+
+	// Restore when the file already exist
+	assertExpectNoErr(t, "", media.deleteMedia("png.png"))
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	assertTrue(t, "", os.IsExist(media.restoreFromTrash("png.png")))
+
+	// Empty only folders older than max age
+	os.MkdirAll(trashPath+"/2001-02-03/media", os.ModePerm)
+	assertEqualsInt(t, "", 1, media.emptyTrash(24*time.Hour))
+	assertFileNotExist(t, "", trashPath+"/2001-02-03")
+	assertFileExist(t, "", trashFolder+"/media/png.png")
+	assertEqualsInt(t, "", 0, media.emptyTrash(0)) // Files deleted today may be younger than max age
+	assertFileExist(t, "", trashFolder)
+
+	// Disabled
+	media = createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	assertExpectErr(t, "", media.restoreFromTrash("png.png"))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// storeMedia stores the content of r as a media file. The content is
+// first written to a temporary (hidden) file in the same folder, so that
+// a partially uploaded file never is visible. Returns an error satisfying
+// os.IsExist if the file already exist and overwrite is false.
+func (m *Media) storeMedia(relativeFilePath string, r io.Reader, overwrite bool) error {
+	relativeFilePath = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(relativeFilePath)), "/")
+	if m.getFileType(relativeFilePath) == "" {
+		return fmt.Errorf("not a supported media type")
+	}
+	fullMediaPath, err := m.getFullMediaPath(relativeFilePath)
+	if err != nil {
+		return err
+	}
+	existed := false
+	if fileInfo, err := os.Stat(fullMediaPath); err == nil {
+		if fileInfo.IsDir() {
+			return fmt.Errorf("%s is a directory", relativeFilePath)
+		} else if !overwrite {
+			return &os.PathError{Op: "upload", Path: relativeFilePath, Err: os.ErrExist}
+		}
+		existed = true
+	}
+	if err = os.MkdirAll(filepath.Dir(fullMediaPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	tempPath := filepath.Join(filepath.Dir(fullMediaPath),
+		fmt.Sprintf(".%s.%d-%d.upload", filepath.Base(fullMediaPath), os.Getpid(), tempFileCounter.Add(1)))
+	tempFile, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tempFile, r)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, fullMediaPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	log.Info("Stored uploaded file ", fullMediaPath)
+
+	if existed && m.cache != nil {
+		m.cache.removeCacheFiles(relativeFilePath) // Generated from the old file
+	}
+	m.invalidateDateIndex()
+	m.addRecentPath(relativeFilePath)
+	m.addTagsPath(relativeFilePath)
+	if m.watcher == nil && m.cache != nil {
+		go m.generateFileCache(relativeFilePath) // Otherwise the watcher will do it
+	}
+	return nil
+}
+
+// generateFileCache generates the thumbnail and preview of a media file
+// (if enabled)
+func (m *Media) generateFileCache(relativeFilePath string) {
+	if m.enableThumbCache {
+		if _, err := m.cache.generateThumbnail(m, relativeFilePath); err != nil {
+			log.Warnf("Unable to generate thumbnail of %s. Reason: %s", relativeFilePath, err)
+		}
+	}
+	if m.enablePreview {
+		if _, tooSmall, err := m.cache.generatePreview(m, relativeFilePath); err != nil && !tooSmall {
+			log.Warnf("Unable to generate preview of %s. Reason: %s", relativeFilePath, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreMedia(t *testing.T) {
+	mediaPath := "tmpout/TestStoreMedia"
+	cachePath := "tmpcache/TestStoreMedia"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	content, err := os.ReadFile("testmedia/png.png")
+	assertExpectNoErr(t, "", err)
+
+	// New file in new folder, thumbnail generated in the background
+	assertExpectNoErr(t, "", media.storeMedia("new/png.png", bytes.NewReader(content), false))
+	assertFileExist(t, "", mediaPath+"/new/png.png")
+	for i := 0; i < 50 && !media.cache.hasThumbnail("new/png.png"); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assertTrue(t, "Thumbnail generated", media.cache.hasThumbnail("new/png.png"))
+	dirEntries, _ := os.ReadDir(mediaPath + "/new")
+	assertEqualsInt(t, "No temporary files", 1, len(dirEntries))
+
+	// Already exist
+	assertTrue(t, "", os.IsExist(media.storeMedia("new/png.png", bytes.NewReader(content), false)))
+	assertExpectNoErr(t, "", media.storeMedia("new/png.png", bytes.NewReader(content), true))
+
+	// Interrupted upload leaves nothing
+	reader := &failingReader{}
+	assertExpectErr(t, "", media.storeMedia("new/interrupted.png", reader, false))
+	assertFileNotExist(t, "", mediaPath+"/new/interrupted.png")
+	dirEntries, _ = os.ReadDir(mediaPath + "/new")
+	assertEqualsInt(t, "No temporary files", 1, len(dirEntries))
+
+	// Invalid paths
+	assertExpectErr(t, "", media.storeMedia("new/text.txt", strings.NewReader("text"), false))
+	assertExpectErr(t, "", media.storeMedia("../png.png", bytes.NewReader(content), false))
+	assertFileNotExist(t, "", "tmpout/png.png")
+	os.MkdirAll(mediaPath+"/folder.png", os.ModePerm)
+	assertExpectErr(t, "", media.storeMedia("folder.png", bytes.NewReader(content), true))
+}
+
+// failingReader provides some data and then fails, as an interrupted
+// upload
+type failingReader struct {
+	read bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.read {
+		return 0, os.ErrDeadlineExceeded
+	}
+	r.read = true
+	return copy(p, "partial"), nil
+}
@@ -1,90 +1,62 @@
 package main
 
 import (
-	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-
-	log "github.com/sirupsen/logrus"
 )
 
+// Default ffmpeg command, see also the ffmpegpath setting.
 // For testing purposes
 var ffmpegCmd = "ffmpeg"
 
 // videoThumbnailSupport returns true if ffmpeg is installed, and thus
 // video thumbnails is supported
 func hasVideoThumbnailSupport() bool {
-	_, err := exec.LookPath(ffmpegCmd)
-	return err == nil
+	return isFFmpegInstalled(ffmpegCmd)
 }
 
-// getFiles returns a slice of File's sorted on file name
-func getFiles(fullPath string, relativePath string) ([]File, error) {
-	files := make([]File, 0, 500)
-	fileInfos, err := os.ReadDir(fullPath)
-	if err != nil {
-		return files, err
-	}
-
-	for _, dirEntry := range fileInfos {
-		fileInfo, _ := dirEntry.Info()
-		fileType := ""
-		if dirEntry.IsDir() || fileInfo.Mode()&os.ModeSymlink != 0 {
-			fileType = "folder"
-		} else {
-			fileType = getFileType(dirEntry.Name())
-		}
-		// Only add directories, videos and images
-		if fileType != "" {
-			// Use path with / slash
-			pathOriginal := filepath.Join(relativePath, dirEntry.Name())
-			pathNew := filepath.ToSlash(pathOriginal)
-
-			file := File{
-				Type: fileType,
-				Name: dirEntry.Name(),
-				Path: pathNew}
-			files = append(files, file)
-		} else {
-			log.Debug("getFiles - omitting:", fileInfo.Name())
-		}
-	}
-	return files, nil
+// isFFmpegInstalled returns true if the ffmpeg command (a name in PATH
+// or a path to the binary) exist
+func isFFmpegInstalled(command string) bool {
+	_, err := exec.LookPath(command)
+	return err == nil
 }
 
 // getFileType returns "video" for video files and "image" for image files.
 // For all other files (including folders) "" is returned.
 // relativeFileName can also include an absolute or relative path.
-func getFileType(relativeFileName string) string {
+// Files without extension are classified by their content if content
+// sniffing is enabled, which requires the path relative to the media path.
+func (m *Media) getFileType(relativeFileName string) string {
 
 	// Check if this is an image
-	if isImage(relativeFileName) {
+	if m.isImage(relativeFileName) {
 		return "image"
 	}
 
 	// Check if this is a video
-	if isVideo(relativeFileName) {
+	if m.isVideo(relativeFileName) {
 		return "video"
 	}
 
 	return "" // Not a video nor an image
 }
 
-func isImage(pathAndFile string) bool {
-	extension := filepath.Ext(pathAndFile)
-	for _, imgExtension := range imgExtensions {
-		if strings.EqualFold(extension, imgExtension) {
-			return true
-		}
-	}
-	return false
+func (m *Media) isImage(pathAndFile string) bool {
+	return hasExtension(pathAndFile, m.imgExtensions) || m.sniffFileType(pathAndFile) == "image"
+}
+
+func (m *Media) isVideo(pathAndFile string) bool {
+	return hasExtension(pathAndFile, m.vidExtensions) || m.sniffFileType(pathAndFile) == "video"
 }
 
-func isVideo(pathAndFile string) bool {
+// hasExtension returns true if the file has any of the extensions
+// (case insensitive)
+func hasExtension(pathAndFile string, extensions []string) bool {
 	extension := filepath.Ext(pathAndFile)
-	for _, vidExtension := range vidExtensions {
-		if strings.EqualFold(extension, vidExtension) {
+	for _, e := range extensions {
+		if strings.EqualFold(extension, e) {
 			return true
 		}
 	}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Layout of fallback video thumbnails. They are drawn in half size and
+// then scaled up, since the built-in font is only 13 pixels high.
+const (
+	fallbackThumbSide    = 128 // Side before scaling up to 256
+	fallbackStripHeight  = 16  // Height of the film strip borders
+	fallbackLineHeight   = 14  // Distance between text lines
+	fallbackMaxTextLines = 4   // Max number of lines of the file name
+	fallbackTextMargin   = 4   // Left and right margin of the text
+	fallbackHoleDistance = 16  // Distance between the film strip holes
+	fallbackHoleWidth    = 8   // Width of each film strip hole
+	fallbackHoleHeight   = 6   // Height of each film strip hole
+)
+
+// generateFallbackVideoThumbnail generates a thumbnail of a video that
+// ffmpeg was unable to extract a frame from, showing the file name and
+// duration (if known) on a film strip.
+func (c *Cache) generateFallbackVideoThumbnail(fullMediaPath, fullThumbPath string) error {
+	thumbImg, err := c.addVideoIcon(
+		renderFallbackVideoThumbnail(filepath.Base(fullMediaPath), c.getVideoDuration(fullMediaPath)))
+	if err != nil {
+		return err
+	}
+	return c.writeCacheFile(fullThumbPath, "thumbnail", func(w io.Writer) error {
+		return imaging.Encode(w, thumbImg, imaging.JPEG)
+	})
+}
+
+// renderFallbackVideoThumbnail draws the file name and duration (0 means
+// unknown) on a film strip background
+func renderFallbackVideoThumbnail(fileName string, duration time.Duration) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, fallbackThumbSide, fallbackThumbSide))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{48, 48, 48, 255}), image.Point{}, draw.Src)
+
+	// Film strip borders with holes
+	black := image.NewUniform(color.RGBA{0, 0, 0, 255})
+	hole := image.NewUniform(color.RGBA{200, 200, 200, 255})
+	for _, top := range []int{0, fallbackThumbSide - fallbackStripHeight} {
+		draw.Draw(img, image.Rect(0, top, fallbackThumbSide, top+fallbackStripHeight), black, image.Point{}, draw.Src)
+		holeTop := top + (fallbackStripHeight-fallbackHoleHeight)/2
+		for x := (fallbackHoleDistance - fallbackHoleWidth) / 2; x < fallbackThumbSide; x += fallbackHoleDistance {
+			draw.Draw(img, image.Rect(x, holeTop, x+fallbackHoleWidth, holeTop+fallbackHoleHeight), hole, image.Point{}, draw.Src)
+		}
+	}
+
+	// File name (wrapped) and duration, centered
+	lines := wrapText(fileName, (fallbackThumbSide-2*fallbackTextMargin)/basicfont.Face7x13.Advance, fallbackMaxTextLines)
+	if duration > 0 {
+		lines = append(lines, "", formatVideoDuration(duration))
+	}
+	drawer := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(color.RGBA{255, 255, 255, 255}),
+		Face: basicfont.Face7x13}
+	textTop := (fallbackThumbSide-len(lines)*fallbackLineHeight)/2 + basicfont.Face7x13.Ascent
+	for i, line := range lines {
+		x := (fallbackThumbSide - drawer.MeasureString(line).Round()) / 2
+		drawer.Dot = fixed.P(x, textTop+i*fallbackLineHeight)
+		drawer.DrawString(line)
+	}
+	return imaging.Resize(img, 2*fallbackThumbSide, 2*fallbackThumbSide, imaging.NearestNeighbor)
+}
+
+// wrapText splits text in at most maxLines lines of at most lineLength
+// characters. Non-ASCII characters are replaced with '?' since the font
+// only has ASCII glyphs, and "..." marks that the text was truncated.
+func wrapText(text string, lineLength, maxLines int) []string {
+	runes := []rune(strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '?'
+		}
+		return r
+	}, text))
+	lines := []string{}
+	for len(runes) > 0 && len(lines) < maxLines {
+		n := min(len(runes), lineLength)
+		lines = append(lines, string(runes[:n]))
+		runes = runes[n:]
+	}
+	if len(runes) > 0 {
+		last := []rune(lines[len(lines)-1])
+		lines[len(lines)-1] = string(last[:len(last)-3]) + "..."
+	}
+	return lines
+}
+
+// formatVideoDuration formats a duration as m:ss or h:mm:ss
+func formatVideoDuration(duration time.Duration) string {
+	seconds := int(duration.Round(time.Second).Seconds())
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
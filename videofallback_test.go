@@ -0,0 +1,42 @@
+package main
+
+import (
+	"image/color"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestWrapText(t *testing.T) {
+	assertEqualsStr(t, "", "video.mp4", strings.Join(wrapText("video.mp4", 10, 2), "|"))
+	assertEqualsStr(t, "", "0123456789|abc", strings.Join(wrapText("0123456789abc", 10, 2), "|"))
+	assertEqualsStr(t, "", "0123456789|abcdefg...", strings.Join(wrapText("0123456789abcdefghijklm", 10, 2), "|"))
+	assertEqualsStr(t, "", "sm?rg?s.mp4", strings.Join(wrapText("smörgås.mp4", 20, 2), "|"))
+	assertEqualsInt(t, "", 0, len(wrapText("", 10, 2)))
+}
+
+func TestFormatVideoDuration(t *testing.T) {
+	assertEqualsStr(t, "", "0:07", formatVideoDuration(7*time.Second))
+	assertEqualsStr(t, "", "12:03", formatVideoDuration(12*time.Minute+3400*time.Millisecond))
+	assertEqualsStr(t, "", "1:02:03", formatVideoDuration(time.Hour+2*time.Minute+3*time.Second))
+}
+
+func TestFallbackVideoThumbnail(t *testing.T) {
+	img := renderFallbackVideoThumbnail("a very long video file name.mp4", 95*time.Second)
+	assertEqualsInt(t, "", 256, img.Bounds().Dx())
+	assertEqualsInt(t, "", 256, img.Bounds().Dy())
+	assertTrue(t, "Film strip", colorDistance(img.At(0, 0), color.Black) < 10)
+	assertTrue(t, "Background", colorDistance(img.At(2, 100), color.Black) > 50)
+
+	cachePath := "tmpcache/TestFallbackVideoThumbnail"
+	os.RemoveAll(cachePath)
+	cache := createCache("testmedia", cachePath, 0, false, false, mediaOptions{})
+	thumbPath := cachePath + "/video.thumb.jpg"
+	assertExpectNoErr(t, "", cache.generateFallbackVideoThumbnail("testmedia/invalidvideo.mp4", thumbPath))
+	thumb, err := imaging.Open(thumbPath)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 256, thumb.Bounds().Dx())
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
@@ -13,14 +14,30 @@ import (
 type Watcher struct {
 	media           *Media
 	updater         *Updater
-	stopWatcherChan chan bool // Set to true to stop the watcher go-routine
-	done            chan bool // Set to true when watcher go-routine has stopped
+	debounce        time.Duration          // Time a new file must be quiet before update (0 means no debounce)
+	pending         map[string]pendingFile // Key: path of new file waiting for debounce
+	resyncInterval  time.Duration          // Time between resyncs catching missed events (0 means no periodic resync)
+	lastResync      time.Time              // Start time of the last resync (or of the watcher)
+	watchPaths      []string               // Relative paths of the watched folders (nil means the whole media path)
+	stopWatcherChan chan bool              // Set to true to stop the watcher go-routine
+	done            chan bool              // Set to true when watcher go-routine has stopped
 }
 
-func createWatcher(media *Media, thumbnails, preview bool) *Watcher {
+// pendingFile is a new file that is still being written
+type pendingFile struct {
+	relativeMediaPath string    // The directory of the file
+	lastEvent         time.Time // Time of last create/write event
+}
+
+func createWatcher(media *Media, thumbnails, preview bool, debounce, resyncInterval time.Duration,
+	watchPaths []string) *Watcher {
 	return &Watcher{
 		media:           media,
 		updater:         createUpdater(media, thumbnails, preview),
+		debounce:        debounce,
+		pending:         make(map[string]pendingFile),
+		resyncInterval:  resyncInterval,
+		watchPaths:      watchPaths,
 		stopWatcherChan: make(chan bool),
 		done:            make(chan bool)}
 }
@@ -55,9 +72,30 @@ func (w *Watcher) startWatcher() {
 		return
 	}
 
+	w.lastResync = time.Now()
 	go w.mediaWatcher(watcher)
 
-	w.watchFolder(watcher, w.media.mediaPath)
+	for _, path := range w.watchRoots() {
+		w.watchFolder(watcher, path)
+	}
+}
+
+// watchRoots returns the full paths of the top folders to watch, i.e.
+// the media path or the watch paths within it
+func (w *Watcher) watchRoots() []string {
+	if len(w.watchPaths) == 0 {
+		return []string{w.media.mediaPath}
+	}
+	roots := make([]string, 0, len(w.watchPaths))
+	for _, watchPath := range w.watchPaths {
+		fullPath, err := w.media.getFullMediaPath(watchPath)
+		if err != nil {
+			log.Warnf("Not watching %s. Reason: %s", watchPath, err)
+			continue
+		}
+		roots = append(roots, fullPath)
+	}
+	return roots
 }
 
 // watchFolder with watch the provided folder including its
@@ -79,8 +117,12 @@ func (w *Watcher) watchFolder(watcher *fsnotify.Watcher, path string) error {
 
 	for _, dirEntry := range fileInfos {
 		fileInfo, _ := dirEntry.Info()
+		subPath := filepath.Join(path, dirEntry.Name())
+		if w.media.skipHidden && isHidden(subPath) {
+			continue
+		}
 		if dirEntry.IsDir() || fileInfo.Mode()&os.ModeSymlink != 0 {
-			w.watchFolder(watcher, filepath.Join(path, dirEntry.Name()))
+			w.watchFolder(watcher, subPath)
 		}
 	}
 	return nil
@@ -91,22 +133,55 @@ func (w *Watcher) watchFolder(watcher *fsnotify.Watcher, path string) error {
 //
 // Note that we ignore rename and delete events, i.e. there
 // is no clean up.
+//
+// New files are debounced, i.e. the directory is not marked as
+// updated until the file has had no create/write events during
+// the debounce time. This avoids generating thumbnails of files
+// that are still being copied.
+//
+// fsnotify may drop events under heavy load (e.g. when thousands of
+// files are imported). To catch missed files the folders are resynced
+// periodically (if resyncInterval is set) and on watcher errors.
 func (w *Watcher) mediaWatcher(watcher *fsnotify.Watcher) {
+	var debounceTick <-chan time.Time // nil (never ticks) if no debounce
+	if w.debounce > 0 {
+		ticker := time.NewTicker(w.debounce / 2)
+		defer ticker.Stop()
+		debounceTick = ticker.C
+	}
+	var resyncTick <-chan time.Time // nil (never ticks) if no periodic resync
+	if w.resyncInterval > 0 {
+		ticker := time.NewTicker(w.resyncInterval)
+		defer ticker.Stop()
+		resyncTick = ticker.C
+	}
 	for {
 		select {
 		case event, ok := <-watcher.Events:
 			if ok {
 				log.Debug("Watcher event: ", event)
 				path := event.Name
+				if w.media.skipHidden && isHidden(path) || w.media.isInTrash(path) || w.media.isInCache(path) {
+					continue
+				}
+				w.media.invalidateDateIndex()
 				// relativeMediaPath is always the last diretory, never a file
 				// (because we call getDir)
 				relativeMediaPath, err := w.media.getRelativeMediaPath(getDir(path))
 				if err == nil {
 					if event.Op&fsnotify.Create == fsnotify.Create {
+						if relativePath, err := w.media.getRelativeMediaPath(path); err == nil {
+							w.media.addRecentPath(relativePath)
+							w.media.addTagsPath(relativePath)
+						}
 						if isDir(path) {
 							// This is an new diretory
 							// Watch it
 							w.watchFolder(watcher, path)
+						} else if w.debounce > 0 {
+							// Wait until the file is quiet
+							w.pending[path] = pendingFile{relativeMediaPath, time.Now()}
+							continue
 						}
 						// Mark the directory as changed so that updater eventually
 						// will create the thumbnails
@@ -114,10 +189,17 @@ func (w *Watcher) mediaWatcher(watcher *fsnotify.Watcher) {
 					} else if (event.Op&fsnotify.Remove == fsnotify.Remove) ||
 						(event.Op&fsnotify.Rename == fsnotify.Rename) {
 						// Files has been removed, renamed or moved
+						if relativePath, err := w.media.getRelativeMediaPath(path); err == nil {
+							w.media.removeRecent(relativePath)
+							w.media.removeTags(relativePath)
+						}
 						// Mark the directory as changed so that updater eventually
 						// will create the thumbnails
 						w.updater.markDirectoryAsUpdated(relativeMediaPath)
 					} else if event.Op&fsnotify.Write == fsnotify.Write {
+						if _, ok := w.pending[path]; ok {
+							w.pending[path] = pendingFile{relativeMediaPath, time.Now()}
+						}
 						// Tell updater that there is operations performed in the
 						// directory (i.e. wait for a while before generating the
 						// thumbnails)
@@ -125,9 +207,15 @@ func (w *Watcher) mediaWatcher(watcher *fsnotify.Watcher) {
 					}
 				}
 			}
+		case now := <-debounceTick:
+			w.updatePending(now)
+		case <-resyncTick:
+			w.resyncSinceLast(watcher)
 		case err, ok := <-watcher.Errors:
 			if ok {
+				// Events may have been lost (e.g. fsnotify.ErrEventOverflow)
 				log.Warn("Watcher error:", err)
+				w.resyncSinceLast(watcher)
 			}
 		case <-w.stopWatcherChan:
 			log.Info("Shutting down media watcher")
@@ -138,6 +226,69 @@ func (w *Watcher) mediaWatcher(watcher *fsnotify.Watcher) {
 	}
 }
 
+// updatePending marks the directories of all pending files that have
+// been quiet for the debounce time as updated.
+func (w *Watcher) updatePending(now time.Time) {
+	for path, file := range w.pending {
+		if now.Sub(file.lastEvent) >= w.debounce {
+			delete(w.pending, path)
+			w.updater.markDirectoryAsUpdated(file.relativeMediaPath)
+		}
+	}
+}
+
+// resyncMargin is subtracted from the time of the last resync to handle
+// file systems with coarse modification times (e.g. FAT)
+const resyncMargin = 2 * time.Second
+
+// resyncSinceLast resyncs the folders modified since the last resync
+func (w *Watcher) resyncSinceLast(watcher *fsnotify.Watcher) {
+	start := time.Now()
+	count := 0
+	for _, path := range w.watchRoots() {
+		count += w.resync(watcher, path, w.lastResync.Add(-resyncMargin))
+	}
+	w.lastResync = start
+	log.Debugf("Watcher resync found %d modified folders", count)
+}
+
+// resync finds the folders in path (including sub folders) that have
+// been modified since the provided time, i.e. folders where files have
+// been added, removed or renamed. These folders are watched (again) and
+// marked as updated, so that files missed by the watcher are handled.
+// Returns the number of modified folders.
+func (w *Watcher) resync(watcher *fsnotify.Watcher, path string, since time.Time) int {
+	count := 0
+	if stat, err := os.Stat(path); err == nil && !stat.ModTime().Before(since) {
+		relativeMediaPath, err := w.media.getRelativeMediaPath(path)
+		if err == nil {
+			if err = watcher.Add(path); err != nil {
+				log.Errorf("Watch folder %s error: %s", path, err)
+			}
+			w.media.invalidateDateIndex()
+			w.media.indexRecentFolder(relativeMediaPath)
+			w.media.indexTagsFolder(relativeMediaPath)
+			w.updater.markDirectoryAsUpdated(relativeMediaPath)
+			count++
+		}
+	}
+	dirEntries, err := os.ReadDir(path)
+	if err != nil {
+		log.Warnf("Watcher resync unable to read folder %s. Reason: %s", path, err)
+		return count
+	}
+	for _, dirEntry := range dirEntries {
+		subPath := filepath.Join(path, dirEntry.Name())
+		if w.media.skipHidden && isHidden(subPath) {
+			continue
+		}
+		if dirEntry.IsDir() || (dirEntry.Type()&os.ModeSymlink != 0 && isDir(subPath)) {
+			count += w.resync(watcher, subPath, since) // Recursive
+		}
+	}
+	return count
+}
+
 // isDir return true if the path is a directory
 func isDir(path string) bool {
 	_, err := os.ReadDir(path)
@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -83,7 +84,7 @@ func TestWatcherImages(t *testing.T) {
 	os.RemoveAll(cache)
 	os.MkdirAll(cache, os.ModePerm)
 
-	media := createMedia(mediaPath, cache, true, false, false, true, true, true, false, 0, false, false, false, true)
+	media := createMedia(mediaPath, cache, true, false, false, true, true, true, false, 0, false, false, false, true, mediaOptions{})
 	defer media.watcher.stopWatcherAndWait()
 
 	time.Sleep(100 * time.Millisecond) // Wait for watcher to start
@@ -92,13 +93,13 @@ func TestWatcherImages(t *testing.T) {
 	copyFile(t, "templates/icon_image.png", mediaPath+"/icon_image.png")
 
 	// Verify that thumbnail was created
-	assertFileCreated(t, "", cache+"/icon_image.thumb.jpg")
+	assertFileCreated(t, "", cache+"/icon_image.png.thumb.jpg")
 
 	// Remove file
 	os.Remove(mediaPath + "/icon_image.png")
 
 	// Verify that thumbnail was removed
-	assertFileRemoved(t, "", cache+"/icon_image.thumb.jpg")
+	assertFileRemoved(t, "", cache+"/icon_image.png.thumb.jpg")
 
 	// Add many files
 	copyFile(t, "templates/icon_image.png", mediaPath+"/icon_image.png")
@@ -107,10 +108,10 @@ func TestWatcherImages(t *testing.T) {
 	copyFile(t, "testmedia/tiff.tiff", mediaPath+"/tiff.tiff")
 
 	// Verify that thumbnails where created
-	assertFileCreated(t, "", cache+"/icon_image.thumb.jpg")
-	assertFileCreated(t, "", cache+"/no_exif.thumb.jpg")
-	assertFileCreated(t, "", cache+"/gif.thumb.jpg")
-	assertFileCreated(t, "", cache+"/tiff.thumb.jpg")
+	assertFileCreated(t, "", cache+"/icon_image.png.thumb.jpg")
+	assertFileCreated(t, "", cache+"/no_exif.jpg.thumb.jpg")
+	assertFileCreated(t, "", cache+"/gif.gif.thumb.jpg")
+	assertFileCreated(t, "", cache+"/tiff.tiff.thumb.jpg")
 
 }
 
@@ -132,7 +133,7 @@ func TestWatcherFileLocked(t *testing.T) {
 	os.RemoveAll(cache)
 	os.MkdirAll(cache, os.ModePerm)
 
-	media := createMedia(mediaPath, cache, true, false, false, true, true, true, false, 0, false, false, false, false)
+	media := createMedia(mediaPath, cache, true, false, false, true, true, true, false, 0, false, false, false, false, mediaOptions{})
 	defer media.watcher.stopWatcherAndWait()
 
 	time.Sleep(100 * time.Millisecond) // Wait for watcher to start
@@ -144,10 +145,10 @@ func TestWatcherFileLocked(t *testing.T) {
 	copyFileExternal(t, "testmedia/tiff.tiff", mediaPath+"/tiff.tiff")
 
 	// Verify that thumbnails where created
-	assertFileCreated(t, "", cache+"/icon_image.thumb.jpg")
-	assertFileCreated(t, "", cache+"/no_exif.thumb.jpg")
-	assertFileCreated(t, "", cache+"/gif.thumb.jpg")
-	assertFileCreated(t, "", cache+"/tiff.thumb.jpg")
+	assertFileCreated(t, "", cache+"/icon_image.png.thumb.jpg")
+	assertFileCreated(t, "", cache+"/no_exif.jpg.thumb.jpg")
+	assertFileCreated(t, "", cache+"/gif.gif.thumb.jpg")
+	assertFileCreated(t, "", cache+"/tiff.tiff.thumb.jpg")
 
 }
 
@@ -160,7 +161,7 @@ func TestWatcherSubfolder(t *testing.T) {
 	os.RemoveAll(cache)
 	os.MkdirAll(cache, os.ModePerm)
 
-	media := createMedia(mediaPath, cache, true, false, false, true, true, true, false, 0, false, false, false, true)
+	media := createMedia(mediaPath, cache, true, false, false, true, true, true, false, 0, false, false, false, true, mediaOptions{})
 	defer media.watcher.stopWatcherAndWait()
 
 	time.Sleep(100 * time.Millisecond) // Wait for watcher to start
@@ -174,16 +175,16 @@ func TestWatcherSubfolder(t *testing.T) {
 	copyFile(t, "testmedia/tiff.tiff", mediaPath+"/subdir/tiff.tiff")
 
 	// Verify that thumbnails where created for subdirectory
-	assertFileCreated(t, "", cache+"/subdir/icon_image.thumb.jpg")
-	assertFileCreated(t, "", cache+"/subdir/no_exif.thumb.jpg")
-	assertFileCreated(t, "", cache+"/subdir/gif.thumb.jpg")
-	assertFileCreated(t, "", cache+"/subdir/tiff.thumb.jpg")
+	assertFileCreated(t, "", cache+"/subdir/icon_image.png.thumb.jpg")
+	assertFileCreated(t, "", cache+"/subdir/no_exif.jpg.thumb.jpg")
+	assertFileCreated(t, "", cache+"/subdir/gif.gif.thumb.jpg")
+	assertFileCreated(t, "", cache+"/subdir/tiff.tiff.thumb.jpg")
 
 	// Add a subdirectory of the subdiretory
 	os.MkdirAll(mediaPath+"/subdir/submore", os.ModePerm)
 	time.Sleep(500 * time.Millisecond) // Wait for subfolder to be watched
 	copyFile(t, "testmedia/exif_rotate/no_exif.jpg", mediaPath+"/subdir/submore/no_exif.jpg")
-	assertFileCreated(t, "", cache+"/subdir/submore/no_exif.thumb.jpg")
+	assertFileCreated(t, "", cache+"/subdir/submore/no_exif.jpg.thumb.jpg")
 
 	// Remove directory
 	os.RemoveAll(mediaPath + "/subdir/submore")
@@ -192,7 +193,7 @@ func TestWatcherSubfolder(t *testing.T) {
 	assertFileRemoved(t, "", cache+"/subdir/submore")
 
 	// But secure that other files are kept
-	assertFileCreated(t, "", cache+"/subdir/icon_image.thumb.jpg")
+	assertFileCreated(t, "", cache+"/subdir/icon_image.png.thumb.jpg")
 }
 
 func TestWatcherVideo(t *testing.T) {
@@ -204,7 +205,7 @@ func TestWatcherVideo(t *testing.T) {
 	os.RemoveAll(cache)
 	os.MkdirAll(cache, os.ModePerm)
 
-	media := createMedia(mediaPath, cache, true, false, false, true, true, true, false, 0, false, false, false, false)
+	media := createMedia(mediaPath, cache, true, false, false, true, true, true, false, 0, false, false, false, false, mediaOptions{})
 	defer media.watcher.stopWatcherAndWait()
 
 	if !hasVideoThumbnailSupport() {
@@ -218,28 +219,150 @@ func TestWatcherVideo(t *testing.T) {
 	copyFile(t, "testmedia/video.mp4", mediaPath+"/video.mp4")
 
 	// Verify that thumbnail was created
-	assertFileCreated(t, "", cache+"/video.thumb.jpg")
+	assertFileCreated(t, "", cache+"/video.mp4.thumb.jpg")
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	mediaPath := "tmpout/TestWatcherDebounce"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+
+	cache := "tmpcache/TestWatcherDebounce"
+	os.RemoveAll(cache)
+	os.MkdirAll(cache, os.ModePerm)
+
+	media := createMedia(mediaPath, cache, true, false, false, true, true, true, false, 0, false, false, false, false,
+		mediaOptions{watcherDebounce: 500 * time.Millisecond})
+	defer media.watcher.stopWatcherAndWait()
+
+	time.Sleep(100 * time.Millisecond) // Wait for watcher to start
+
+	// Keep writing to the file, no thumbnail until it is quiet
+	input, err := os.ReadFile("testmedia/gif.gif")
+	assertExpectNoErr(t, "", err)
+	file, err := os.Create(mediaPath + "/gif.gif")
+	assertExpectNoErr(t, "", err)
+	for i := 0; i < 10; i++ {
+		file.Write(input[i*len(input)/10 : (i+1)*len(input)/10])
+		time.Sleep(300 * time.Millisecond)
+	}
+	file.Close()
+	media.watcher.updater.mutex.Lock()
+	assertEqualsInt(t, "", 0, len(media.watcher.updater.directories))
+	media.watcher.updater.mutex.Unlock()
+	assertFileNotExist(t, "", cache+"/gif.gif.thumb.jpg")
+
+	// Verify that thumbnail was created
+	assertFileCreated(t, "", cache+"/gif.gif.thumb.jpg")
+}
+
+func TestWatcherUpdatePending(t *testing.T) {
+	// Don't start the watcher, so that we can test its internal
+	// functionality
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	w := createWatcher(media, true, false, 2*time.Second, 0, nil)
+	now := time.Now()
+	w.pending["testmedia/gif.gif"] = pendingFile{"", now}
+	w.pending["testmedia/exif_rotate/normal.jpg"] = pendingFile{"exif_rotate", now.Add(-3 * time.Second)}
+
+	w.updatePending(now.Add(time.Second))
+	assertEqualsInt(t, "", 1, len(w.pending))
+	assertEqualsInt(t, "", 1, len(w.updater.directories))
+	_, ok := w.updater.directories["exif_rotate"]
+	assertTrue(t, "", ok)
+
+	w.updatePending(now.Add(2 * time.Second))
+	assertEqualsInt(t, "", 0, len(w.pending))
+	assertEqualsInt(t, "", 2, len(w.updater.directories))
 }
 
 func TestWatchFolder(t *testing.T) {
 	// Don't start the watcher, so that we can test its internal
 	// functionality
-	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false)
+	media := createMedia("testmedia", ".", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	w := createWatcher(media, false, false, 0, 0, nil)
 
 	watcher, err := fsnotify.NewWatcher()
 	assertExpectNoErr(t, "", err)
 
 	// Test some valid
-	err = media.watcher.watchFolder(watcher, "testmedia")
+	err = w.watchFolder(watcher, "testmedia")
 	assertExpectNoErr(t, "", err)
-	err = media.watcher.watchFolder(watcher, "templates")
+	err = w.watchFolder(watcher, "templates")
 	assertExpectNoErr(t, "", err)
 
 	// Test some invalid
-	err = media.watcher.watchFolder(watcher, "dontexist")
+	err = w.watchFolder(watcher, "dontexist")
 	assertExpectErr(t, "", err)
-	err = media.watcher.watchFolder(watcher, "testmedia/dontexist")
+	err = w.watchFolder(watcher, "testmedia/dontexist")
 	assertExpectErr(t, "", err)
-	err = media.watcher.watchFolder(watcher, "testmedia/jpeg.jpg")
+	err = w.watchFolder(watcher, "testmedia/jpeg.jpg")
 	assertExpectErr(t, "", err)
 }
+
+func TestWatcherResync(t *testing.T) {
+	mediaPath := "tmpout/TestWatcherResync"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/old", os.ModePerm)
+	os.MkdirAll(mediaPath+"/new", os.ModePerm)
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(mediaPath+"/old", past, past)
+	os.Chtimes(mediaPath+"/new", past, past)
+	os.Chtimes(mediaPath, past, past)
+
+	// Don't start the watcher, i.e. no events are handled. This simulates
+	// events missed by fsnotify.
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	w := createWatcher(media, true, false, 0, time.Minute, nil)
+	watcher, err := fsnotify.NewWatcher()
+	assertExpectNoErr(t, "", err)
+	defer watcher.Close()
+	since := time.Now()
+
+	// Nothing modified
+	assertEqualsInt(t, "", 0, w.resync(watcher, mediaPath, since))
+	assertEqualsInt(t, "", 0, len(w.updater.directories))
+
+	// Missed file and missed folder (with a file)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/new/jpeg.jpg")
+	os.MkdirAll(mediaPath+"/new/sub", os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/new/sub/png.png")
+	assertEqualsInt(t, "", 2, w.resync(watcher, mediaPath, since))
+	assertEqualsInt(t, "", 2, len(w.updater.directories))
+	_, ok := w.updater.directories["new"]
+	assertTrue(t, "", ok)
+	_, ok = w.updater.directories["new/sub"]
+	assertTrue(t, "", ok)
+	assertTrue(t, "", len(watcher.WatchList()) == 2)
+
+	// The recent index shall be updated
+	_, ok = media.recentFiles["new/jpeg.jpg"]
+	assertTrue(t, "", ok)
+	_, ok = media.recentFiles["new/sub/png.png"]
+	assertTrue(t, "", ok)
+
+	// Next resync only handles folders modified since last resync
+	w.updater.directories = make(map[string]time.Time)
+	w.lastResync = time.Now().Add(resyncMargin)
+	w.resyncSinceLast(watcher)
+	assertEqualsInt(t, "", 0, len(w.updater.directories))
+}
+
+func TestWatchRoots(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	w := createWatcher(media, false, false, 0, 0, nil)
+	assertEqualsStr(t, "", "testmedia", strings.Join(w.watchRoots(), ","))
+
+	// Paths outside the media path shall be ignored
+	w = createWatcher(media, false, false, 0, 0, []string{"exif_rotate", "../templates", "..", "/exif_rotate/"})
+	assertEqualsStr(t, "", "testmedia/exif_rotate,testmedia/exif_rotate", strings.Join(w.watchRoots(), ","))
+
+	// Only the watch paths shall be watched
+	watcher, err := fsnotify.NewWatcher()
+	assertExpectNoErr(t, "", err)
+	defer watcher.Close()
+	for _, path := range w.watchRoots() {
+		assertExpectNoErr(t, "", w.watchFolder(watcher, path))
+	}
+	assertEqualsStr(t, "", "testmedia/exif_rotate", strings.Join(watcher.WatchList(), ","))
+}
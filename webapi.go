@@ -1,13 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -21,68 +37,347 @@ type WebAPI struct {
 	password     string // Password
 	tlsCertFile  string // TLS certification file ("" means no TLS)
 	tlsKeyFile   string // TLS key file ("" means no TLS)
+	autocert     bool   // TLS certificates from Let's Encrypt
+	allowDelete  bool   // Allow deleting media files also without authentication
+
+	viewers        passwords     // Users only allowed to browse, i.e. not delete, move etc.
+	allowUpload    bool          // Allow uploading media files (requires authentication)
+	maxUploadSize  int64         // Max size of uploaded files in bytes (0 means no limit)
+	sessionSecret  []byte        // Secret used to sign session cookies
+	sessionTimeout time.Duration // Time until a session expires
+	corsOrigins    []string      // Origins allowed for cross-origin requests (nil means no CORS)
+	socket         string        // Unix domain socket path ("" means TCP)
+	addresses      []string      // TCP addresses to listen to, e.g. 127.0.0.1:9834 and [::1]:9834
+	basePath       string        // URL path prefix, e.g. /gallery ("" means none)
+	accessLog      bool          // Log each request
+	spriteMaxTiles int           // Max number of thumbnails per thumbnail sheet page
+	defaultFolder  string        // Folder clients shall start in ("" means media path)
+	metrics        bool          // Provide /metrics
+	logFile        io.Closer     // Log output to close when the server has stopped (nil means none)
+
+	failureMutex  sync.Mutex     // Protects loginFailures
+	loginFailures map[string]int // Number of failed login attempts per client IP
+}
+
+// passwords maps user names to passwords
+type passwords map[string]string
+
+// webAPIOptions holds the optional Web API settings. The zero value
+// gives the default behavior.
+type webAPIOptions struct {
+	allowDelete    bool          // Allow DELETE of media files even if no user name is configured
+	viewers        passwords     // Users only allowed to browse (requires a user name)
+	allowUpload    bool          // Allow PUT of media files (requires a user name)
+	maxUploadSize  int64         // Max size of uploaded files in bytes (0 means no limit)
+	sessionSecret  string        // Secret used to sign session cookies ("" means random)
+	sessionTimeout time.Duration // Time until a session expires (0 means default, 24 hours)
+	corsOrigins    []string      // Origins allowed for cross-origin requests, "*" means all (nil means no CORS)
+	socket         string        // Listen on this Unix domain socket instead of ip and port ("" means TCP)
+	minTLSVersion  uint16        // Minimum TLS version (0 means TLS 1.2)
+	cipherSuites   []uint16      // Allowed TLS 1.0-1.2 cipher suites (nil means Go defaults)
+
+	autocertDomains  []string // Get TLS certificates for these domains from Let's Encrypt (nil means disabled)
+	autocertCacheDir string   // Where to store the Let's Encrypt certificates
+	autocertHTTPAddr string   // Where to listen for the Let's Encrypt HTTP-01 challenges, e.g. :80
+
+	basePath  string // URL path prefix when hosted in a sub path behind a reverse proxy, e.g. gallery ("" means none)
+	accessLog bool   // Log method, path, status, size, duration and client IP of each request
+
+	readHeaderTimeout time.Duration // Time to read the request headers (0 means no timeout)
+	readTimeout       time.Duration // Time to read the whole request (0 means no timeout)
+	writeTimeout      time.Duration // Time to write the response, not used when streaming media (0 means no timeout)
+	idleTimeout       time.Duration // Time to keep an idle keep-alive connection (0 means no timeout)
+
+	spriteMaxTiles int    // Max number of thumbnails per thumbnail sheet page (0 means 100)
+	metrics        bool   // Provide Prometheus metrics on /metrics
+	defaultFolder  string // Folder clients shall start in, relative media path ("" means media path)
 }
 
+// sessionCookieName is the name of the session cookie set by /login
+const sessionCookieName = "mediaweb_session"
+
+// userContextKey is the request context key of the authenticated user,
+// see requestUser
+type userContextKey struct{}
+
+// Limits of the failed login attempts bookkeeping
+const (
+	loginFailureWarnLimit = 10   // Warn for each this many failed attempts from the same client IP
+	loginFailureMaxIPs    = 1000 // Max number of client IPs to keep track of
+)
+
 // CreateWebAPI creates a new Web API instance
 func CreateWebAPI(port int, ip, templatePath string, media *Media, userName, password,
-	tlsCertFile, tlsKeyFile string) *WebAPI {
-	portStr := fmt.Sprintf("%s:%d", ip, port)
-	server := &http.Server{Addr: portStr}
+	tlsCertFile, tlsKeyFile string, options webAPIOptions) *WebAPI {
+	addresses := listenAddresses(ip, port)
+	minTLSVersion := options.minTLSVersion
+	if minTLSVersion == 0 {
+		minTLSVersion = tls.VersionTLS12
+	}
+	// HTTP/2 is enabled by default (ALPN) when serving TLS with a
+	// tls.Config without NextProtos
+	server := &http.Server{Addr: addresses[0],
+		ReadHeaderTimeout: options.readHeaderTimeout,
+		ReadTimeout:       options.readTimeout,
+		WriteTimeout:      options.writeTimeout,
+		IdleTimeout:       options.idleTimeout,
+		TLSConfig: &tls.Config{
+			MinVersion:   minTLSVersion,
+			CipherSuites: options.cipherSuites}}
+	if len(options.autocertDomains) > 0 {
+		err := configureAutocert(server, options.autocertDomains, options.autocertCacheDir, options.autocertHTTPAddr)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	sessionSecret := []byte(options.sessionSecret)
+	if len(sessionSecret) == 0 {
+		// Sessions will not survive a restart
+		sessionSecret = make([]byte, 32)
+		if _, err := rand.Read(sessionSecret); err != nil {
+			log.Panic("Unable to generate session secret: ", err)
+		}
+	}
+	sessionTimeout := options.sessionTimeout
+	if sessionTimeout <= 0 {
+		sessionTimeout = 24 * time.Hour
+	}
+	spriteMaxTiles := options.spriteMaxTiles
+	if spriteMaxTiles <= 0 {
+		spriteMaxTiles = 100
+	}
 	webAPI := &WebAPI{
-		server:       server,
-		templatePath: templatePath,
-		media:        media,
-		userName:     userName,
-		password:     password,
-		tlsCertFile:  tlsCertFile,
-		tlsKeyFile:   tlsKeyFile}
+		server:         server,
+		templatePath:   templatePath,
+		media:          media,
+		userName:       userName,
+		password:       password,
+		viewers:        options.viewers,
+		allowUpload:    options.allowUpload,
+		maxUploadSize:  options.maxUploadSize,
+		tlsCertFile:    tlsCertFile,
+		tlsKeyFile:     tlsKeyFile,
+		autocert:       len(options.autocertDomains) > 0,
+		allowDelete:    options.allowDelete,
+		sessionSecret:  sessionSecret,
+		sessionTimeout: sessionTimeout,
+		corsOrigins:    options.corsOrigins,
+		socket:         options.socket,
+		addresses:      addresses,
+		basePath:       cleanBasePath(options.basePath),
+		accessLog:      options.accessLog,
+		spriteMaxTiles: spriteMaxTiles,
+		defaultFolder:  options.defaultFolder,
+		metrics:        options.metrics,
+		loginFailures:  make(map[string]int)}
 	http.Handle("/", webAPI)
 	return webAPI
 }
 
+// listenAddresses returns the TCP addresses to listen to for a comma
+// separated list of IPv4 and/or IPv6 addresses. An empty list means all
+// interfaces.
+func listenAddresses(ipList string, port int) []string {
+	addresses := []string{}
+	for _, ip := range strings.Split(ipList, ",") {
+		ip = strings.Trim(strings.TrimSpace(ip), "[]") // Brackets are optional for IPv6
+		if ip != "" {
+			addresses = append(addresses, net.JoinHostPort(ip, strconv.Itoa(port)))
+		}
+	}
+	if len(addresses) == 0 {
+		addresses = append(addresses, net.JoinHostPort("", strconv.Itoa(port)))
+	}
+	return addresses
+}
+
 // Start starts the HTTP server. Stop it using the Stop function. Non-blocking.
-// Returns a channel that is written to when the HTTP server has stopped.
+// Returns a channel that is written to when the HTTP server has stopped,
+// i.e. when it has stopped listening to all addresses.
 func (wa *WebAPI) Start() chan bool {
 	done := make(chan bool)
 
 	go func() {
-		log.Info("Starting Web API on port ", wa.server.Addr)
-		if wa.tlsCertFile != "" && wa.tlsKeyFile != "" {
+		if wa.socket != "" {
+			wa.serveSocket()
+			wa.closeLogFile()
+			done <- true // Signal that http server has stopped
+			return
+		}
+		if wa.isTLS() {
 			log.Info("Using TLS (HTTPS)")
-			if err := wa.server.ListenAndServeTLS(wa.tlsCertFile, wa.tlsKeyFile); err != nil {
-				// cannot panic, because this probably is an intentional close
-				log.Info("WebAPI: ListenAndServeTLS() shutdown reason: ", err)
-			}
-		} else {
-			if err := wa.server.ListenAndServe(); err != nil {
-				// cannot panic, because this probably is an intentional close
-				log.Info("WebAPI: ListenAndServeTLS() shutdown reason: ", err)
-			}
 		}
+		var wg sync.WaitGroup
+		for _, address := range wa.addresses {
+			wg.Add(1)
+			go func(address string) {
+				defer wg.Done()
+				wa.serveAddress(address)
+			}(address)
+		}
+		wg.Wait()
 		// TODO fix this wa.media.stopWatcher() // Stop the folder watcher (if it is running)
+		wa.closeLogFile()
 		done <- true // Signal that http server has stopped
 	}()
 	return done
 }
 
+// closeLogFile closes the log file (if any) when the server has stopped.
+// Later logging is output on stderr.
+func (wa *WebAPI) closeLogFile() {
+	if wa.logFile != nil {
+		log.Info("Closing log file")
+		log.SetOutput(os.Stderr)
+		wa.logFile.Close()
+		wa.logFile = nil
+	}
+}
+
+// serveAddress serves HTTP (or HTTPS if TLS is configured) on a TCP
+// address. All addresses share the same server. Blocks until the server
+// is stopped.
+func (wa *WebAPI) serveAddress(address string) {
+	log.Info("Starting Web API on port ", address)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Errorf("Unable to listen on %s. Reason: %s", address, err)
+		return
+	}
+	if wa.isTLS() {
+		err = wa.server.ServeTLS(listener, wa.tlsCertFile, wa.tlsKeyFile)
+	} else {
+		err = wa.server.Serve(listener)
+	}
+	// cannot panic, because this probably is an intentional close
+	log.Infof("WebAPI: Serve() on %s shutdown reason: %s", address, err)
+}
+
+// isTLS returns true if HTTPS shall be served, i.e. if certificate
+// files are configured or certificates are provided by Let's Encrypt
+func (wa *WebAPI) isTLS() bool {
+	return (wa.tlsCertFile != "" && wa.tlsKeyFile != "") || wa.autocert
+}
+
+// serveSocket serves HTTP (or HTTPS if TLS is configured) on the Unix
+// domain socket. Blocks until the server is stopped.
+func (wa *WebAPI) serveSocket() {
+	log.Info("Starting Web API on socket ", wa.socket)
+	removeSocket(wa.socket) // Stale socket
+	listener, err := net.Listen("unix", wa.socket)
+	if err != nil {
+		log.Errorf("Unable to listen on socket %s. Reason: %s", wa.socket, err)
+		return
+	}
+	if wa.isTLS() {
+		log.Info("Using TLS (HTTPS)")
+		err = wa.server.ServeTLS(listener, wa.tlsCertFile, wa.tlsKeyFile)
+	} else {
+		err = wa.server.Serve(listener)
+	}
+	// cannot panic, because this probably is an intentional close
+	log.Info("WebAPI: Serve() shutdown reason: ", err)
+}
+
+// removeSocket removes the socket file if it exist, e.g. a stale one after
+// a crash. Other types of files are left untouched.
+func removeSocket(socket string) {
+	stat, err := os.Stat(socket)
+	if err == nil && stat.Mode()&os.ModeSocket != 0 {
+		log.Info("Removing socket ", socket)
+		os.Remove(socket)
+	}
+}
+
 // Stop stops the HTTP server.
 func (wa *WebAPI) Stop() {
 	wa.server.Shutdown(context.Background())
+	if wa.socket != "" {
+		removeSocket(wa.socket) // Normally already removed when the listener is closed
+	}
 }
 
-// ServeHTTP handles incoming HTTP requests
+// ServeHTTP handles incoming HTTP requests, logs them if access logging
+// is enabled and counts them if metrics are enabled
 func (wa *WebAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !wa.accessLog && !wa.metrics {
+		wa.serveHTTP(w, r)
+		return
+	}
+	start := time.Now()
+	method, requestPath := r.Method, r.URL.Path // r.URL.Path is modified when serving
+	lw := &loggingResponseWriter{ResponseWriter: w}
+	wa.serveHTTP(lw, r)
+	if lw.status == 0 {
+		lw.status = http.StatusOK // Nothing written
+	}
+	if wa.metrics {
+		appMetrics.countRequest(wa.route(requestPath), method, lw.status)
+	}
+	if !wa.accessLog {
+		return
+	}
+	log.WithFields(log.Fields{
+		"method":   method,
+		"path":     requestPath,
+		"status":   lw.status,
+		"size":     lw.size,
+		"duration": time.Since(start).Round(time.Microsecond).String(),
+		"client":   clientIP(r)}).Info("HTTP request")
+}
+
+// route returns the first path segment (after the base path) of a
+// request path, e.g. thumb for /thumb/dir/image.jpg
+func (wa *WebAPI) route(requestPath string) string {
+	if wa.basePath != "" {
+		relativePath, ok := stripBasePath(requestPath, wa.basePath)
+		if !ok {
+			return ""
+		}
+		requestPath = relativePath
+	}
+	head, _ := shiftPath(requestPath)
+	return head
+}
+
+// serveHTTP dispatches the request to the handler of the path
+func (wa *WebAPI) serveHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// Remove the base path (if any)
+	if wa.basePath != "" {
+		relativePath, ok := stripBasePath(r.URL.Path, wa.basePath)
+		if !ok {
+			respondError(w, http.StatusNotFound, "Not found: "+r.URL.Path)
+			return
+		}
+		r.URL.Path = relativePath
+	}
+
+	// Handle cross-origin requests (before authentication since
+	// preflight requests don't include any credentials)
+	if len(wa.corsOrigins) > 0 && wa.setCORSHeaders(w, r) && r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
-	// Handle authentication
-	if wa.userName != "" {
-		// Authentication required
-		user, pass, _ := r.BasicAuth()
-		if wa.userName != user || wa.password != pass {
-			log.Infof("Invalid user login attempt. user: %s, password: %s", user, pass)
+	// Handle authentication (login is handled separately). Only the
+	// admin user, i.e. not the viewers, may change anything.
+	if wa.userName != "" && !isPublic(r) {
+		user := wa.authenticatedUser(r)
+		if user == "" {
 			w.Header().Set("WWW-Authenticate", "Basic realm=\"MediaWEB requires username and password\"")
-			http.Error(w, "Unauthorized. Invalid username or password.", http.StatusUnauthorized)
+			respondError(w, http.StatusUnauthorized, "Unauthorized. Invalid username or password.")
+			return
+		}
+		if user != wa.userName && isAdminOnly(r) {
+			respondError(w, http.StatusForbidden, "Forbidden. Only allowed for the admin user.")
 			return
 		}
+		r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+	}
+
+	if r.TLS != nil {
+		log.Debugf("%s %s using %s (%s)", r.Method, r.URL.Path, tls.VersionName(r.TLS.Version), r.Proto)
 	}
 
 	// Handle request
@@ -92,21 +387,286 @@ func (wa *WebAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	head, r.URL.Path = shiftPath(r.URL.Path)
 	if head == "shutdown" && r.Method == "POST" {
 		wa.Stop()
+	} else if head == "login" && r.Method == "POST" {
+		wa.serveHTTPLogin(w, r)
+	} else if head == "logout" && r.Method == "POST" {
+		wa.serveHTTPLogout(w, r)
 	} else if head == "folder" && r.Method == "GET" {
 		wa.serveHTTPFolder(w, r)
+	} else if head == "folder" && r.Method == "HEAD" {
+		serveHTTPHead(w, r, wa.serveHTTPFolder)
 	} else if head == "media" && r.Method == "GET" {
+		disableWriteTimeout(w) // Videos may take long to download
 		wa.serveHTTPMedia(w, r)
+	} else if head == "media" && r.Method == "HEAD" {
+		serveHTTPHead(w, r, wa.serveHTTPMedia)
+	} else if head == "media" && r.Method == "DELETE" {
+		wa.serveHTTPDeleteMedia(w, r)
+	} else if head == "media" && r.Method == "PUT" {
+		disableReadTimeout(w) // Large videos may take long to upload
+		wa.serveHTTPUploadMedia(w, r)
+	} else if head == "upload" && r.Method == "POST" {
+		disableReadTimeout(w)
+		wa.serveHTTPUploadFiles(w, r)
+	} else if head == "live" && r.Method == "GET" {
+		disableWriteTimeout(w)
+		wa.serveHTTPLive(w, r)
+	} else if head == "download" && r.Method == "GET" {
+		disableWriteTimeout(w) // Large folders may take long to download
+		wa.serveHTTPDownload(w, r)
+	} else if head == "move" && r.Method == "POST" {
+		wa.serveHTTPMove(w, r)
+	} else if head == "batchmeta" && r.Method == "POST" {
+		wa.serveHTTPBatchMeta(w, r)
 	} else if head == "thumb" && r.Method == "GET" {
 		wa.serveHTTPThumbnail(w, r)
+	} else if head == "thumb" && r.Method == "HEAD" {
+		serveHTTPHead(w, r, wa.serveHTTPThumbnail)
+	} else if head == "thumbsheet" && r.Method == "GET" {
+		wa.serveHTTPThumbSheet(w, r, false)
+	} else if head == "thumbsheetmap" && r.Method == "GET" {
+		wa.serveHTTPThumbSheet(w, r, true)
 	} else if head == "isPreCacheInProgress" && r.Method == "GET" {
 		toJSON(w, wa.media.isPreCacheInProgress())
+	} else if head == "cancel-precache" && r.Method == "POST" {
+		toJSON(w, wa.media.cancelPreCacheInProgress())
+	} else if head == "clearerrors" {
+		wa.serveHTTPClearErrors(w, r)
+	} else if head == "duplicates" && r.Method == "GET" {
+		wa.serveHTTPDuplicates(w, r)
+	} else if head == "search" && r.Method == "GET" {
+		wa.serveHTTPSearch(w, r)
+	} else if head == "similar" && r.Method == "GET" {
+		wa.serveHTTPSimilar(w, r)
+	} else if head == "bydate" && r.Method == "GET" {
+		wa.serveHTTPByDate(w, r)
+	} else if head == "capabilities" && r.Method == "GET" {
+		wa.serveHTTPCapabilities(w)
+	} else if head == "recent" && r.Method == "GET" {
+		wa.serveHTTPRecent(w, r)
+	} else if head == "color" && r.Method == "GET" {
+		wa.serveHTTPColor(w, r)
+	} else if head == "cachestats" && r.Method == "GET" {
+		wa.serveHTTPCacheStats(w)
+	} else if head == "prune" && r.Method == "POST" {
+		wa.serveHTTPPrune(w)
+	} else if head == "loglevel" && (r.Method == "GET" || r.Method == "PUT") {
+		wa.serveHTTPLogLevel(w, r)
+	} else if head == "trash" && r.Method == "POST" && r.URL.Path == "/restore" {
+		wa.serveHTTPRestore(w, r)
+	} else if head == "dimensions" && r.Method == "GET" {
+		wa.serveHTTPDimensions(w, r)
+	} else if head == "progressive" && r.Method == "GET" {
+		wa.serveHTTPProgressive(w, r)
+	} else if head == "metrics" && r.Method == "GET" && wa.metrics {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		appMetrics.write(w, wa.media)
+	} else if head == "healthz" && r.Method == "GET" {
+		fmt.Fprintln(w, "ok") // Alive as long as requests are served
+	} else if head == "readyz" && r.Method == "GET" {
+		wa.serveHTTPReady(w)
+	} else if head == "progress" && r.Method == "GET" {
+		disableWriteTimeout(w) // Long-lived event stream
+		wa.serveHTTPProgress(w, r)
 	} else if r.Method == "GET" {
 		r.URL.Path = originalURL
 		wa.serveHTTPStatic(w, r)
 	} else {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "This is not a valid path: %s or method %s!", r.URL.Path, r.Method)
+		respondError(w, http.StatusNotFound, fmt.Sprintf("This is not a valid path: %s or method %s!", r.URL.Path, r.Method))
+	}
+}
+
+// setCORSHeaders sets the CORS headers if the origin of the request
+// is allowed. Returns false if not a cross-origin request or if the
+// origin is not allowed.
+func (wa *WebAPI) setCORSHeaders(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	if contains(wa.corsOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else if contains(wa.corsOrigins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	return true
+}
+
+// requestUser returns the authenticated user of a request ("" if
+// authentication is disabled)
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userContextKey{}).(string)
+	return user
+}
+
+// isPermitted returns true if the user of the request may access the
+// media file or folder according to the folder ACL files, see
+// Media.isPermitted. The admin user may access everything.
+func (wa *WebAPI) isPermitted(r *http.Request, relativePath string) bool {
+	user := requestUser(r)
+	return (user != "" && user == wa.userName) || wa.media.isPermitted(relativePath, user)
+}
+
+// permittedFunc returns a function that tells if the user of the request
+// may access a media file or folder, see isPermitted. The ACL files are
+// only read once per folder, i.e. use it when filtering many paths.
+func (wa *WebAPI) permittedFunc(r *http.Request) func(relativePath string) bool {
+	user := requestUser(r)
+	if user != "" && user == wa.userName {
+		return func(string) bool { return true }
+	}
+	return wa.media.newACLChecker(user).isPermitted
+}
+
+// authenticatedUser returns the user of a valid session cookie or valid
+// basic authentication credentials. Returns "" if not authenticated.
+func (wa *WebAPI) authenticatedUser(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err == nil {
+		if user := wa.sessionUser(cookie.Value); user != "" {
+			return user
+		}
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "" // No credentials provided, not a login attempt
+	}
+	if wa.isValidLogin(user, pass) {
+		wa.resetLoginFailures(r)
+		return user
+	}
+	wa.logLoginFailure(r, user)
+	return ""
+}
+
+// isValidLogin returns true if the user is the admin user or a viewer
+// and the password is correct
+func (wa *WebAPI) isValidLogin(user, pass string) bool {
+	if user == wa.userName {
+		return pass == wa.password
+	}
+	password, ok := wa.viewers[user]
+	return ok && pass == password
+}
+
+// isUser returns true if the user is the admin user or a viewer
+func (wa *WebAPI) isUser(user string) bool {
+	_, isViewer := wa.viewers[user]
+	return user == wa.userName || isViewer
+}
+
+// logLoginFailure logs a failed login attempt. The attempted password
+// is never logged. Repeated failures from the same client IP are
+// counted and logged as warnings.
+func (wa *WebAPI) logLoginFailure(r *http.Request, user string) {
+	ip := clientIP(r)
+	wa.failureMutex.Lock()
+	if _, ok := wa.loginFailures[ip]; !ok && len(wa.loginFailures) >= loginFailureMaxIPs {
+		wa.loginFailures = make(map[string]int) // Start over rather than grow without limit
+	}
+	wa.loginFailures[ip]++
+	failures := wa.loginFailures[ip]
+	wa.failureMutex.Unlock()
+
+	log.Infof("Invalid user login attempt. user: %s, client: %s", user, ip)
+	if failures%loginFailureWarnLimit == 0 {
+		log.Warnf("%d failed login attempts from %s", failures, ip)
+	}
+}
+
+// resetLoginFailures clears the failed login attempts of the client IP
+func (wa *WebAPI) resetLoginFailures(r *http.Request) {
+	ip := clientIP(r)
+	wa.failureMutex.Lock()
+	delete(wa.loginFailures, ip)
+	wa.failureMutex.Unlock()
+}
+
+// serveHTTPLogin validates the username and password form values and
+// sets a session cookie if they are valid.
+func (wa *WebAPI) serveHTTPLogin(w http.ResponseWriter, r *http.Request) {
+	if wa.userName == "" {
+		// No authentication required
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	user := r.FormValue("username")
+	if !wa.isValidLogin(user, r.FormValue("password")) {
+		wa.logLoginFailure(r, user)
+		respondError(w, http.StatusUnauthorized, "Unauthorized. Invalid username or password.")
+		return
+	}
+	wa.resetLoginFailures(r)
+	expires := time.Now().Add(wa.sessionTimeout)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    wa.createSession(user, expires),
+		Path:     wa.basePath + "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   wa.isTLS(),
+		SameSite: http.SameSiteStrictMode})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveHTTPLogout removes the session cookie
+func (wa *WebAPI) serveHTTPLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     wa.basePath + "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createSession returns a session cookie value for the user that is
+// valid until expires. The value is signed using the session secret.
+func (wa *WebAPI) createSession(user string, expires time.Time) string {
+	payload := fmt.Sprintf("%s|%d", user, expires.Unix())
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(wa.signSession(payload))
+}
+
+// sessionUser returns the user of the session cookie value if it is
+// signed with the session secret, belongs to a configured user and has
+// not expired. Returns "" otherwise.
+func (wa *WebAPI) sessionUser(value string) string {
+	encodedPayload, encodedSignature, found := strings.Cut(value, ".")
+	if !found {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return ""
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, wa.signSession(string(payload))) {
+		return ""
+	}
+	separator := strings.LastIndex(string(payload), "|")
+	if separator < 0 || !wa.isUser(string(payload[:separator])) {
+		return ""
+	}
+	expires, err := strconv.ParseInt(string(payload[separator+1:]), 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return ""
 	}
+	return string(payload[:separator])
+}
+
+// signSession returns the HMAC-SHA256 of the session payload
+func (wa *WebAPI) signSession(payload string) []byte {
+	mac := hmac.New(sha256.New, wa.sessionSecret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
 }
 
 func (wa *WebAPI) serveHTTPStatic(w http.ResponseWriter, r *http.Request) {
@@ -126,6 +686,10 @@ func (wa *WebAPI) serveHTTPStatic(w http.ResponseWriter, r *http.Request) {
 	} else {
 		if filepath.Ext(fileName) == ".html" {
 			w.Header().Set("Content-Type", "text/html")
+			if wa.basePath != "" {
+				// Make the relative URLs in the page relative the base path
+				bytes = insertBaseHref(bytes, wa.basePath+"/")
+			}
 		} else if filepath.Ext(fileName) == ".ico" {
 			w.Header().Set("Content-Type", "image/x-icon")
 		} else {
@@ -135,91 +699,1145 @@ func (wa *WebAPI) serveHTTPStatic(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// serveHTTPFolder generates JSON will files in folder
+// serveHTTPFolder generates JSON will files in folder. Only the media
+// files with a tag are included if the tag query is provided (see
+// autoTags). The number of media files in each sub folder is included if
+// the counts query is true.
 func (wa *WebAPI) serveHTTPFolder(w http.ResponseWriter, r *http.Request) {
 	folder := ""
 	if len(r.URL.Path) > 0 {
 		folder = r.URL.Path[1:] // Remove '/'
 	}
+	if !wa.isPermitted(r, folder) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+folder)
+		return
+	}
 	files, err := wa.media.getFiles(folder)
 	if err != nil {
-		http.Error(w, "Get files: "+err.Error(), http.StatusNotFound)
+		respondError(w, http.StatusNotFound, "Get files: "+err.Error())
 		return
 	}
-	toJSON(w, files)
+	permitted := wa.permittedFunc(r)
+	files = slices.DeleteFunc(files, func(file File) bool {
+		return file.Type == "folder" && !permitted(file.Path) // Hide folders the user may not access
+	})
+	wa.media.prioritizeFolder(folder)
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		files = wa.media.filterTag(files, tag)
+	}
+	if r.URL.Query().Get("counts") == "true" {
+		wa.media.addFolderCounts(files)
+	}
+	if r.URL.Query().Get("blurhash") == "true" {
+		wa.media.addBlurHashes(files)
+	}
+	toJSON(w, wa.media.sortFolder(folder, files))
 }
 
-// serveHTTPMedia opens the media
-func (wa *WebAPI) serveHTTPMedia(w http.ResponseWriter, r *http.Request) {
-	relativePath := r.URL.Path
-	// Only accept media files of security reasons
-	if getFileType(relativePath) == "" {
-		http.Error(w, "Not a valid media file: "+relativePath, http.StatusNotFound)
+// serveHTTPDuplicates generates JSON with groups of media files with
+// identical content in the folder (and its sub folders if the recursive
+// query is true).
+func (wa *WebAPI) serveHTTPDuplicates(w http.ResponseWriter, r *http.Request) {
+	folder := ""
+	if len(r.URL.Path) > 0 {
+		folder = r.URL.Path[1:] // Remove '/'
+	}
+	if !wa.isPermitted(r, folder) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+folder)
 		return
 	}
-	originalImage, hasOriginalImageQuery := r.URL.Query()["original-image"]
-	// Write preview file if possible and allowed
-	if !hasOriginalImageQuery || originalImage[0] != "true" {
-		err := wa.media.writePreview(w, relativePath)
-		if err == nil {
-			// Previews are always in JPEG format
-			w.Header().Set("Content-Type", "image/jpeg")
-			return
+	recursive := r.URL.Query().Get("recursive") == "true"
+	duplicates, err := wa.media.findDuplicates(folder, recursive)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Find duplicates: "+err.Error())
+		return
+	}
+	permitted := wa.permittedFunc(r)
+	permittedDuplicates := [][]string{}
+	for _, group := range duplicates {
+		group = slices.DeleteFunc(group, func(relativePath string) bool { return !permitted(relativePath) })
+		if len(group) > 1 {
+			permittedDuplicates = append(permittedDuplicates, group)
 		}
 	}
-	if wa.media.isRotationNeeded(relativePath) {
-		// This is a JPEG file which requires rotation.
-		w.Header().Set("Content-Type", "image/jpeg")
-		err := wa.media.rotateAndWrite(w, relativePath)
-		if err != nil {
-			http.Error(w, "Rotate file: "+err.Error(), http.StatusInternalServerError)
+	toJSON(w, permittedDuplicates)
+}
+
+// serveHTTPSearch streams a JSON array with the files matching the q
+// query in the folder (and its sub folders if recursive=true). EXIF
+// camera model and date are also matched if exif=true.
+func (wa *WebAPI) serveHTTPSearch(w http.ResponseWriter, r *http.Request) {
+	folder := ""
+	if len(r.URL.Path) > 0 {
+		folder = r.URL.Path[1:] // Remove '/'
+	}
+	if !wa.isPermitted(r, folder) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+folder)
+		return
+	}
+	query := r.URL.Query()
+	if strings.TrimSpace(query.Get("q")) == "" {
+		respondError(w, http.StatusBadRequest, "Missing search term (q)")
+		return
+	}
+	permitted := wa.permittedFunc(r)
+	flusher, _ := w.(http.Flusher)
+	started := false
+	err := wa.media.search(folder, query.Get("q"), query.Get("recursive") == "true", query.Get("exif") == "true",
+		func(result SearchResult) {
+			if !permitted(result.Path) {
+				return
+			}
+			if started {
+				w.Write([]byte(","))
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte("["))
+				started = true
+			}
+			js, _ := json.Marshal(result)
+			w.Write(js)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		})
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Search: "+err.Error())
+		return
+	}
+	if !started {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("["))
+	}
+	w.Write([]byte("]"))
+}
+
+// serveHTTPSimilar generates JSON with images similar to the image.
+// The threshold query (default 10) is the max number of differing bits
+// of the 64 bit perceptual hashes.
+func (wa *WebAPI) serveHTTPSimilar(w http.ResponseWriter, r *http.Request) {
+	relativePath := r.URL.Path
+	if len(relativePath) > 0 {
+		relativePath = relativePath[1:] // Remove '/'
+	}
+	threshold := 10
+	if thresholdStr := r.URL.Query().Get("threshold"); thresholdStr != "" {
+		var err error
+		threshold, err = strconv.Atoi(thresholdStr)
+		if err != nil || threshold < 0 || threshold > 64 {
+			respondError(w, http.StatusBadRequest, "Invalid threshold: "+thresholdStr)
 			return
 		}
-	} else {
-		// This is any other media file
-		fullPath, err := wa.media.getFullMediaPath(relativePath)
+	}
+	if !wa.isPermitted(r, relativePath) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+relativePath)
+		return
+	}
+	similar, err := wa.media.findSimilar(relativePath, threshold)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Find similar: "+err.Error())
+		return
+	}
+	permitted := wa.permittedFunc(r)
+	toJSON(w, slices.DeleteFunc(similar, func(image SimilarImage) bool { return !permitted(image.Path) }))
+}
+
+// serveHTTPByDate generates JSON with the date buckets of all media
+// files, or with the files in a bucket if provided in the path (e.g.
+// /bydate/2021-05). The granularity query (year, month or day, default
+// month) decides the size of the buckets.
+func (wa *WebAPI) serveHTTPByDate(w http.ResponseWriter, r *http.Request) {
+	bucket := ""
+	if len(r.URL.Path) > 0 {
+		bucket = r.URL.Path[1:] // Remove '/'
+	}
+	permitted := wa.permittedFunc(r)
+	if bucket != "" {
+		files, err := wa.media.getDateBucketFiles(bucket)
 		if err != nil {
-			http.Error(w, "Get files: "+err.Error(), http.StatusNotFound)
+			respondError(w, http.StatusNotFound, "By date: "+err.Error())
 			return
 		}
-		http.ServeFile(w, r, fullPath)
+		toJSON(w, slices.DeleteFunc(files, func(file File) bool { return !permitted(file.Path) }))
+		return
+	}
+	granularity := r.URL.Query().Get("granularity")
+	if granularity == "" {
+		granularity = "month"
+	}
+	buckets, err := wa.media.getDateBuckets(granularity, permitted)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "By date: "+err.Error())
+		return
 	}
+	toJSON(w, buckets)
 }
 
-// serveHTTPThumbnail opens the media thumbnail or the default thumbnail
-// if no thumbnail exist.
-func (wa *WebAPI) serveHTTPThumbnail(w http.ResponseWriter, r *http.Request) {
+// serveHTTPDownload provides a folder (including sub folders) as a zip
+// archive. The optional since query parameter (Unix time in seconds or
+// RFC 3339) excludes files modified before it, e.g. for incremental
+// backups. The zip is generated while sent, so HTTP range requests (i.e.
+// resuming an interrupted download) are not supported. Instead the entries
+// are ordered on path and have the modification times of the files.
+func (wa *WebAPI) serveHTTPDownload(w http.ResponseWriter, r *http.Request) {
 	relativePath := r.URL.Path
-	err := wa.media.writeThumbnail(w, relativePath)
-	if err == nil {
-		w.Header().Set("Content-Type", "image/jpeg")
-	} else {
-		// No thumbnail. Use the default
-		w.Header().Set("Content-Type", "image/png")
-		fileType := getFileType(relativePath)
-		if fileType == "image" {
-			w.Write(embedImageIconBytes)
-			//http.ServeFile(w, r, wa.templatePath+"/icon_image.png")
-		} else if fileType == "video" {
-			w.Write(embedVideoIconBytes)
-			//http.ServeFile(w, r, wa.templatePath+"/icon_video.png")
-		} else {
-			// Folder
-			w.Write(embedFolderIconBytes)
-			//http.ServeFile(w, r, wa.templatePath+"/icon_folder.png")
+	if len(relativePath) > 0 {
+		relativePath = relativePath[1:] // Remove '/'
+	}
+	if !wa.isPermitted(r, relativePath) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+relativePath)
+		return
+	}
+	fullPath, err := wa.media.getFullMediaPath(relativePath)
+	if err == nil && !isDir(fullPath) {
+		err = fmt.Errorf("not a folder: %s", relativePath)
+	}
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Download: "+err.Error())
+		return
+	}
+	var since time.Time
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		if seconds, err := strconv.ParseInt(sinceStr, 10, 64); err == nil {
+			since = time.Unix(seconds, 0)
+		} else if since, err = time.Parse(time.RFC3339, sinceStr); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid since: "+sinceStr)
+			return
 		}
 	}
+	name := filepath.Base(fullPath)
+	if relativePath == "" || name == "." || name == "/" {
+		name = "media"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name+".zip"))
+	w.Header().Set("Accept-Ranges", "none")
+	err = wa.media.writeZip(w, relativePath, since, wa.permittedFunc(r))
+	if err != nil {
+		// Too late to report an error, the headers are already sent
+		log.Warnf("Unable to send zip of %s. Reason: %s", relativePath, err)
+	}
 }
 
-// toJSON converts the v object to JSON and writes result to the response
-func toJSON(w http.ResponseWriter, v interface{}) {
-	js, err := json.Marshal(v)
+// serveHTTPRecent provides the most recently added (modified) media
+// files, newest first. Query parameters: limit (default 50), days
+// (default 30) and type (image or video, default both).
+func (wa *WebAPI) serveHTTPRecent(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > 1000 {
+			respondError(w, http.StatusBadRequest, "Invalid limit: "+limitStr)
+			return
+		}
+	}
+	days := 30
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		var err error
+		days, err = strconv.Atoi(daysStr)
+		if err != nil || days < 1 {
+			respondError(w, http.StatusBadRequest, "Invalid days: "+daysStr)
+			return
+		}
+	}
+	fileType := r.URL.Query().Get("type")
+	if fileType != "" && fileType != "image" && fileType != "video" {
+		respondError(w, http.StatusBadRequest, "Invalid type: "+fileType)
+		return
+	}
+	toJSON(w, wa.media.getRecent(limit, days, fileType, wa.permittedFunc(r)))
+}
+
+// serveHTTPThumbSheet provides a page of the thumbnail sheet of a
+// folder, i.e. all thumbnails in a single JPEG image. If onlyMap is
+// true the position of each thumbnail in the image is provided instead.
+func (wa *WebAPI) serveHTTPThumbSheet(w http.ResponseWriter, r *http.Request, onlyMap bool) {
+	relativePath := r.URL.Path
+	if len(relativePath) > 0 {
+		relativePath = relativePath[1:] // Remove '/'
+	}
+	if !wa.isPermitted(r, relativePath) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+relativePath)
+		return
+	}
+	page := 0
+	if pageStr := r.URL.Query().Get("page"); pageStr != "" {
+		var err error
+		page, err = strconv.Atoi(pageStr)
+		if err != nil || page < 0 {
+			respondError(w, http.StatusBadRequest, "Invalid page: "+pageStr)
+			return
+		}
+	}
+	sheet, err := wa.media.getThumbSheet(relativePath, page, wa.spriteMaxTiles)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		respondError(w, http.StatusNotFound, "Thumbnail sheet: "+err.Error())
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	if onlyMap {
+		toJSON(w, sheet)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	if err = wa.media.writeThumbSheet(w, sheet); err != nil {
+		log.Errorf("Unable to write thumbnail sheet of %s. Reason: %s", relativePath, err)
+	}
+}
+
+// serveHTTPClearErrors removes the error indication files in a folder,
+// and in its sub folders if ?recursive=true, so that failed thumbnails
+// and previews are generated again. Provides the number of removed files.
+// Only POST is allowed (it changes the cache) and only for the admin
+// user, i.e. not without authentication.
+func (wa *WebAPI) serveHTTPClearErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		respondError(w, http.StatusMethodNotAllowed, "Clear errors: only POST is allowed")
+		return
+	}
+	if wa.userName == "" {
+		respondError(w, http.StatusForbidden, "Clear errors not allowed without authentication")
+		return
+	}
+	relativePath := r.URL.Path
+	if len(relativePath) > 0 {
+		relativePath = relativePath[1:] // Remove '/'
+	}
+	if !wa.isPermitted(r, relativePath) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+relativePath)
+		return
+	}
+	recursive := r.URL.Query().Get("recursive") == "true"
+	cleared, err := wa.media.clearErrors(relativePath, recursive)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Clear errors: "+err.Error())
+		return
+	}
+	toJSON(w, cleared)
+}
+
+// serveHTTPColor provides the dominant color and a color palette of an
+// image, e.g. for theming of the client
+func (wa *WebAPI) serveHTTPColor(w http.ResponseWriter, r *http.Request) {
+	relativePath := r.URL.Path
+	if len(relativePath) > 0 {
+		relativePath = relativePath[1:] // Remove '/'
+	}
+	if !wa.isPermitted(r, relativePath) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+relativePath)
+		return
+	}
+	colors, err := wa.media.getColors(relativePath)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Color: "+err.Error())
+		return
+	}
+	toJSON(w, colors)
+}
+
+// serveHTTPDimensions provides the width and height of an image or
+// video, e.g. for layout of a grid before the media is loaded
+func (wa *WebAPI) serveHTTPDimensions(w http.ResponseWriter, r *http.Request) {
+	relativePath := r.URL.Path
+	if len(relativePath) > 0 {
+		relativePath = relativePath[1:] // Remove '/'
+	}
+	if !wa.isPermitted(r, relativePath) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+relativePath)
+		return
+	}
+	dimensions, err := wa.media.getDimensions(relativePath)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Dimensions: "+err.Error())
+		return
+	}
+	toJSON(w, dimensions)
+}
+
+// serveHTTPCacheStats provides the number of cache entries and the
+// slowest thumbnail generations
+func (wa *WebAPI) serveHTTPCacheStats(w http.ResponseWriter) {
+	if wa.media.cache == nil {
+		respondError(w, http.StatusNotFound, "Cache stats: no cache")
+		return
+	}
+	toJSON(w, wa.media.cache.getCacheStats())
+}
+
+// serveHTTPReady responds 200 OK when the server is ready to serve all
+// requests and 503 Service Unavailable while the thumbnail/preview
+// generation on startup is in progress. Unlike /healthz (liveness) it is
+// intended as readiness probe, e.g. in Kubernetes.
+func (wa *WebAPI) serveHTTPReady(w http.ResponseWriter) {
+	if !wa.media.isReady() {
+		respondError(w, http.StatusServiceUnavailable, "Not ready, generating thumbnails/previews")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveHTTPPrune removes the orphaned files and empty directories of the
+// whole cache and provides the number of removed files and directories.
+// Only allowed for the admin user, i.e. not without authentication.
+func (wa *WebAPI) serveHTTPPrune(w http.ResponseWriter) {
+	if wa.userName == "" {
+		respondError(w, http.StatusForbidden, "Prune not allowed without authentication")
+		return
+	}
+	result, err := wa.media.pruneCache()
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Prune: "+err.Error())
+		return
+	}
+	toJSON(w, result)
+}
+
+// logLevel is the JSON body of log level requests and responses
+type logLevel struct {
+	Level string // E.g. "debug", see parseLogLevel
+}
+
+// serveHTTPLogLevel provides the current log level. With PUT the log level
+// is changed first, e.g. to trace when investigating an issue without
+// restarting. The change is not persisted in the configuration and is
+// only allowed for the admin user, i.e. not without authentication.
+func (wa *WebAPI) serveHTTPLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		if wa.userName == "" {
+			respondError(w, http.StatusForbidden, "Changing log level not allowed without authentication")
+			return
+		}
+		var request logLevel
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid log level request")
+			return
+		}
+		level, err := parseLogLevel(request.Level)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Log level: "+err.Error())
+			return
+		}
+		log.Info("Changing log level to ", level)
+		log.SetLevel(level)
+	}
+	toJSON(w, logLevel{Level: log.GetLevel().String()})
+}
+
+// serveHTTPMedia opens the media. With ?download=true the original file
+// is provided as an attachment, i.e. the browser saves it instead of
+// displaying or playing it.
+func (wa *WebAPI) serveHTTPMedia(w http.ResponseWriter, r *http.Request) {
+	relativePath := r.URL.Path
+	// Only accept media files of security reasons
+	if wa.media.getFileType(relativePath) == "" {
+		respondError(w, http.StatusNotFound, "Not a valid media file: "+relativePath)
+		return
+	}
+	if !wa.isPermitted(r, relativePath) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+relativePath)
+		return
+	}
+	download := r.URL.Query().Get("download") == "true"
+	if download {
+		// Set before writing anything, also works with range requests
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", path.Base(relativePath)))
+	}
+	videoPreview, hasVideoPreviewQuery := r.URL.Query()["video-preview"]
+	if !download && wa.media.isVideo(relativePath) && hasVideoPreviewQuery && videoPreview[0] == "true" {
+		// Write animated preview of video
+		w.Header().Set("Content-Type", "image/gif")
+		err := wa.media.writeVideoPreview(w, relativePath)
+		if err != nil {
+			// Use the (static) thumbnail instead
+			w.Header().Del("Content-Type")
+			wa.serveHTTPThumbnail(w, r)
+		}
+		return
+	}
+	maxSide := 0
+	if maxSideStr := r.URL.Query().Get("maxside"); maxSideStr != "" {
+		var err error
+		maxSide, err = strconv.Atoi(maxSideStr)
+		if err != nil || maxSide < 1 {
+			respondError(w, http.StatusBadRequest, "Invalid maxside: "+maxSideStr)
+			return
+		}
+	}
+	originalImage, hasOriginalImageQuery := r.URL.Query()["original-image"]
+	// Write preview file if possible and allowed (there are no previews of
+	// videos)
+	if !download && !wa.media.isVideo(relativePath) &&
+		(!hasOriginalImageQuery || originalImage[0] != "true") {
+		format := wa.media.previewFormat(relativePath, r.Header.Get("Accept"))
+		w.Header().Set("Vary", "Accept")
+		w.Header().Set("Content-Type", "image/"+format)
+		err := wa.media.writePreviewSize(w, relativePath, format, maxSide)
+		if err == nil {
+			return
+		}
+		w.Header().Del("Content-Type")
+	}
+	if wa.media.isRotationNeeded(relativePath) {
+		// This is a JPEG file which requires rotation.
+		w.Header().Set("Content-Type", "image/jpeg")
+		err := wa.media.rotateAndWrite(w, relativePath)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Rotate file: "+err.Error())
+			return
+		}
+	} else {
+		// This is any other media file
+		fullPath, err := wa.media.getFullMediaPath(relativePath)
+		if err != nil {
+			respondError(w, http.StatusNotFound, "Get files: "+err.Error())
+			return
+		}
+		if wa.media.isVideo(relativePath) {
+			setVideoContentType(w, relativePath)
+		}
+		http.ServeFile(w, r, fullPath)
+	}
+}
+
+// serveHTTPProgressive provides a low quality image placeholder (as a
+// data URI) together with the preview URL in one JSON object, so that the
+// client can show the placeholder while loading the preview.
+func (wa *WebAPI) serveHTTPProgressive(w http.ResponseWriter, r *http.Request) {
+	relativePath := r.URL.Path
+	if len(relativePath) > 0 {
+		relativePath = relativePath[1:] // Remove '/'
+	}
+	if !wa.isPermitted(r, relativePath) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+relativePath)
+		return
+	}
+	var placeholder bytes.Buffer
+	err := wa.media.writeLQIP(&placeholder, relativePath)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Placeholder: "+err.Error())
+		return
+	}
+	previewURL := url.URL{Path: "media/" + relativePath}
+	toJSON(w, ProgressiveImage{
+		Placeholder: "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(placeholder.Bytes()),
+		Preview:     previewURL.String()})
+}
+
+// serveHTTPLive serves the video (motion component) of a Live Photo
+func (wa *WebAPI) serveHTTPLive(w http.ResponseWriter, r *http.Request) {
+	relativePath := r.URL.Path
+	if len(relativePath) > 0 {
+		relativePath = relativePath[1:] // Remove '/'
+	}
+	if !wa.isPermitted(r, relativePath) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+relativePath)
+		return
+	}
+	relativeVideoPath, err := wa.media.getLiveVideo(relativePath)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Live video: "+err.Error())
+		return
+	}
+	fullPath, err := wa.media.getFullMediaPath(relativeVideoPath)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Live video: "+err.Error())
+		return
+	}
+	setVideoContentType(w, relativeVideoPath)
+	http.ServeFile(w, r, fullPath)
+}
+
+// setVideoContentType sets the content type of a video, if known, before
+// it is served by http.ServeFile (which keeps it)
+func setVideoContentType(w http.ResponseWriter, relativePath string) {
+	if contentType, ok := videoContentTypes[strings.ToLower(path.Ext(relativePath))]; ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+}
+
+// Capabilities describes what the server supports, so that clients can
+// adapt their UI
+type Capabilities struct {
+	VideoThumbnails bool              // Thumbnails of videos (requires ffmpeg)
+	Previews        bool              // Downscaled previews of images (and videos if VideoThumbnails)
+	AlbumThumbnails bool              // Folder thumbnails
+	Formats         CapabilityFormats // Supported file formats
+	AuthRequired    bool              // True if login is required
+	DefaultFolder   string            // Folder to start in, relative media path ("" means media path)
+}
+
+// CapabilityFormats lists the supported file formats
+type CapabilityFormats struct {
+	Images  []string // File extensions of images
+	Videos  []string // File extensions of videos
+	Preview string   // Format of image previews, jpeg or avif ("" if no previews)
+}
+
+// serveHTTPCapabilities provides the capabilities of the server. No
+// authentication is required (see isPublic).
+func (wa *WebAPI) serveHTTPCapabilities(w http.ResponseWriter) {
+	m := wa.media
+	capabilities := Capabilities{
+		VideoThumbnails: m.enableThumbCache && m.cache.hasVideoThumbnailSupport(),
+		Previews:        m.enablePreview,
+		AlbumThumbnails: m.enableThumbCache && m.cache != nil && m.cache.genAlbumThumbs,
+		Formats: CapabilityFormats{
+			Images: m.imgExtensions,
+			Videos: m.vidExtensions},
+		AuthRequired: wa.userName != ""}
+	if m.enablePreview && m.cache != nil {
+		capabilities.Formats.Preview = m.cache.previewFormat
+	}
+	if wa.defaultFolder != "" {
+		// The folder might have been removed or renamed since startup
+		if fullPath, err := m.getFullMediaPath(wa.defaultFolder); err == nil && isDir(fullPath) {
+			capabilities.DefaultFolder = wa.defaultFolder
+		} else {
+			log.Warnf("Default folder %s does not exist. Using the media path.", wa.defaultFolder)
+		}
+	}
+	toJSON(w, capabilities)
+}
+
+// moveRequest is the JSON body of a move request
+type moveRequest struct {
+	From string // Relative path of media file or folder to move
+	To   string // New relative path
+}
+
+// serveHTTPMove moves (renames) a media file or folder including
+// its cache files. It has the same restrictions as deleting media files.
+func (wa *WebAPI) serveHTTPMove(w http.ResponseWriter, r *http.Request) {
+	if wa.userName == "" && !wa.allowDelete {
+		respondError(w, http.StatusForbidden, "Move not allowed without authentication")
+		return
+	}
+	var request moveRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.From == "" || request.To == "" {
+		respondError(w, http.StatusBadRequest, "Invalid move request")
+		return
+	}
+	err = wa.media.moveMedia(request.From, request.To)
+	if os.IsNotExist(err) {
+		respondError(w, http.StatusNotFound, "Not found: "+request.From)
+		return
+	} else if os.IsExist(err) {
+		respondError(w, http.StatusConflict, "Already exist: "+request.To)
+		return
+	} else if err != nil {
+		respondError(w, http.StatusBadRequest, "Move: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreRequest is the JSON body of a restore request
+type restoreRequest struct {
+	Path string // Relative path of the deleted media file
+}
+
+// serveHTTPRestore moves a deleted media file, and its cache files, back
+// from the trash. It has the same restrictions as deleting media files.
+func (wa *WebAPI) serveHTTPRestore(w http.ResponseWriter, r *http.Request) {
+	if wa.userName == "" && !wa.allowDelete {
+		respondError(w, http.StatusForbidden, "Restore not allowed without authentication")
+		return
+	}
+	var request restoreRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Path == "" {
+		respondError(w, http.StatusBadRequest, "Invalid restore request")
+		return
+	}
+	err = wa.media.restoreFromTrash(request.Path)
+	if os.IsNotExist(err) {
+		respondError(w, http.StatusNotFound, "Not in trash: "+request.Path)
+		return
+	} else if os.IsExist(err) {
+		respondError(w, http.StatusConflict, "Already exist: "+request.Path)
+		return
+	} else if err != nil {
+		respondError(w, http.StatusBadRequest, "Restore: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveHTTPBatchMeta provides the meta data of the media files given as
+// a JSON array of relative paths in the request body
+func (wa *WebAPI) serveHTTPBatchMeta(w http.ResponseWriter, r *http.Request) {
+	var paths []string
+	err := json.NewDecoder(r.Body).Decode(&paths)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid batch meta request")
+		return
+	}
+	permitted := wa.permittedFunc(r)
+	for _, relativePath := range paths {
+		if !permitted(relativePath) {
+			respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+relativePath)
+			return
+		}
+	}
+	metaData, err := wa.media.getBatchMeta(paths)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Batch meta: "+err.Error())
+		return
+	}
+	toJSON(w, metaData)
+}
+
+// serveHTTPDeleteMedia deletes the media file and its cache files, or
+// moves them to the trash if configured. Since this is destructive it is
+// only allowed if authentication is enabled, or if explicitly allowed in
+// the configuration.
+func (wa *WebAPI) serveHTTPDeleteMedia(w http.ResponseWriter, r *http.Request) {
+	if wa.userName == "" && !wa.allowDelete {
+		respondError(w, http.StatusForbidden, "Delete not allowed without authentication")
+		return
+	}
+	relativePath := r.URL.Path
+	if len(relativePath) > 0 {
+		relativePath = relativePath[1:] // Remove '/'
+	}
+	err := wa.media.deleteMedia(relativePath)
+	if os.IsNotExist(err) {
+		respondError(w, http.StatusNotFound, "Not found: "+relativePath)
+		return
+	} else if err != nil {
+		respondError(w, http.StatusBadRequest, "Delete file: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveHTTPUploadMedia stores the request body as a media file and
+// provides its meta data. An existing file is only replaced if the
+// overwrite query is true. Uploading requires authentication and must be
+// allowed in the configuration.
+func (wa *WebAPI) serveHTTPUploadMedia(w http.ResponseWriter, r *http.Request) {
+	if wa.userName == "" || !wa.allowUpload {
+		respondError(w, http.StatusForbidden, "Upload not allowed")
+		return
+	}
+	relativePath := r.URL.Path
+	if len(relativePath) > 0 {
+		relativePath = relativePath[1:] // Remove '/'
+	}
+	body := r.Body
+	if wa.maxUploadSize > 0 {
+		if r.ContentLength > wa.maxUploadSize {
+			respondError(w, http.StatusRequestEntityTooLarge, "Upload too large: "+relativePath)
+			return
+		}
+		body = http.MaxBytesReader(w, r.Body, wa.maxUploadSize)
+	}
+	status := http.StatusCreated
+	if fullPath, err := wa.media.getFullMediaPath(relativePath); err == nil {
+		if _, err = os.Stat(fullPath); err == nil {
+			status = http.StatusOK // Replaced
+		}
+	}
+	err := wa.media.storeMedia(relativePath, body, r.URL.Query().Get("overwrite") == "true")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondError(w, http.StatusRequestEntityTooLarge, "Upload too large: "+relativePath)
+		return
+	} else if os.IsExist(err) {
+		respondError(w, http.StatusConflict, "Already exist: "+relativePath)
+		return
+	} else if err != nil {
+		respondError(w, http.StatusBadRequest, "Upload: "+err.Error())
+		return
+	}
+	metaData, err := wa.media.getBatchMeta([]string{relativePath})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Upload: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(metaData[0])
+}
+
+// UploadResult is the result of one of the files in a multipart upload
+type UploadResult struct {
+	Name  string // File name provided by the client
+	Path  string // Relative path of the stored media file
+	Error string `json:",omitempty"` // Why the file wasn't stored ("" means success)
+}
+
+// serveHTTPUploadFiles stores the files of a multipart/form-data request
+// in the folder given by the path, e.g. from a browser drag and drop.
+// Each file is handled as an upload with PUT /media, and the result of
+// each file is provided as a JSON array. Files are stored also if other
+// files are rejected.
+func (wa *WebAPI) serveHTTPUploadFiles(w http.ResponseWriter, r *http.Request) {
+	if wa.userName == "" || !wa.allowUpload {
+		respondError(w, http.StatusForbidden, "Upload not allowed")
+		return
+	}
+	folder := ""
+	if len(r.URL.Path) > 0 {
+		folder = r.URL.Path[1:] // Remove '/'
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Upload: "+err.Error())
+		return
+	}
+	overwrite := r.URL.Query().Get("overwrite") == "true"
+	results := []UploadResult{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			respondError(w, http.StatusBadRequest, "Upload: "+err.Error())
+			return
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue // Not a file
+		}
+		result := UploadResult{Name: part.FileName(), Path: path.Join(folder, part.FileName())}
+		var body io.Reader = part
+		if wa.maxUploadSize > 0 {
+			body = http.MaxBytesReader(nil, part, wa.maxUploadSize)
+		}
+		err = wa.media.storeMedia(result.Path, body, overwrite)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			result.Error = "too large"
+		} else if os.IsExist(err) {
+			result.Error = "already exist"
+		} else if err != nil {
+			result.Error = err.Error()
+		}
+		part.Close()
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		respondError(w, http.StatusBadRequest, "Upload: no files")
+		return
+	}
+	toJSON(w, results)
+}
+
+// serveHTTPThumbnail opens the media thumbnail or the default thumbnail
+// if no thumbnail exist.
+func (wa *WebAPI) serveHTTPThumbnail(w http.ResponseWriter, r *http.Request) {
+	relativePath := r.URL.Path
+	if !wa.isPermitted(r, relativePath) {
+		respondError(w, http.StatusForbidden, "Forbidden. Not allowed to access "+relativePath)
+		return
+	}
+	fileType := wa.media.getFileType(relativePath)
+	if fileType == "" {
+		if cover, ok := wa.media.getAlbumCover(relativePath); ok {
+			relativePath = cover // Use the thumbnail of the cover as album thumbnail
+			fileType = wa.media.getFileType(relativePath)
+		}
+	}
+	if orientation := wa.media.getEXIFThumbnailOrientation(relativePath); orientation > 0 {
+		w.Header().Set("X-Exif-Orientation", strconv.Itoa(orientation))
+	}
+	var err error
+	if fileType == "" {
+		w.Header().Set("Content-Type", "image/jpeg")
+		err = wa.media.writeAlbumThumbnail(w, relativePath)
+	} else if fileType == "video" && r.URL.Query().Get("contactsheet") == "true" {
+		w.Header().Set("Content-Type", "image/jpeg")
+		if err = wa.media.writeVideoContactSheet(w, relativePath); err != nil {
+			// Use the ordinary thumbnail instead, e.g. if ffmpeg is missing
+			err = wa.media.writeThumbnail(w, relativePath)
+		}
+	} else {
+		w.Header().Set("Content-Type", wa.media.thumbnailContentType(relativePath))
+		err = wa.media.writeThumbnail(w, relativePath)
+	}
+	if err != nil {
+		// No thumbnail. Use the default
+		w.Header().Set("Content-Type", "image/png")
+		if fileType == "image" {
+			w.Write(embedImageIconBytes)
+			//http.ServeFile(w, r, wa.templatePath+"/icon_image.png")
+		} else if fileType == "video" {
+			w.Write(embedVideoIconBytes)
+			//http.ServeFile(w, r, wa.templatePath+"/icon_video.png")
+		} else {
+			// Folder
+			w.Write(embedFolderIconBytes)
+			//http.ServeFile(w, r, wa.templatePath+"/icon_folder.png")
+		}
+	}
+}
+
+// serveHTTPProgress streams the progress of an ongoing thumbnail/preview
+// generation as Server-Sent Events. A progress event is sent for each
+// update and a done event is sent when the generation is finished (or
+// immediately if no generation is in progress).
+func (wa *WebAPI) serveHTTPProgress(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	listener, inProgress := wa.media.subscribeProgress()
+	if inProgress {
+		defer wa.media.unsubscribeProgress(listener)
+		for running := true; running; {
+			select {
+			case progress, ok := <-listener:
+				if ok {
+					writeEvent(w, "progress", progress)
+					flusher.Flush()
+				} else {
+					running = false
+				}
+			case <-r.Context().Done():
+				return // Client has disconnected
+			}
+		}
+	}
+	writeEvent(w, "done", struct{}{})
+	flusher.Flush()
+}
+
+// loggingResponseWriter records the status code and the number of
+// bytes written for the access log
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int   // Status code (0 means not written yet)
+	size   int64 // Number of body bytes written
+}
+
+func (lw *loggingResponseWriter) WriteHeader(status int) {
+	if lw.status == 0 {
+		lw.status = status
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *loggingResponseWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(b)
+	lw.size += int64(n)
+	return n, err
+}
+
+// Flush is needed for Server-Sent Events (/progress)
+func (lw *loggingResponseWriter) Flush() {
+	if flusher, ok := lw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the original writer
+func (lw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// headResponseWriter discards the body of a response to a HEAD request,
+// but counts its size so that Content-Length can be provided. The status
+// code and headers are written when the handler is done, see finish.
+type headResponseWriter struct {
+	http.ResponseWriter
+	status int   // Status code (0 means not written yet)
+	size   int64 // Number of body bytes discarded
+}
+
+func (hw *headResponseWriter) WriteHeader(status int) {
+	if hw.status == 0 {
+		hw.status = status
+	}
+}
+
+func (hw *headResponseWriter) Write(b []byte) (int, error) {
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	hw.size += int64(len(b))
+	return len(b), nil
+}
+
+// finish writes the status code and headers, including Content-Length
+// unless already set by the handler (e.g. http.ServeFile)
+func (hw *headResponseWriter) finish() {
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	if hw.Header().Get("Content-Length") == "" {
+		hw.Header().Set("Content-Length", strconv.FormatInt(hw.size, 10))
+	}
+	hw.ResponseWriter.WriteHeader(hw.status)
+}
+
+// Unwrap gives http.ResponseController access to the original writer
+func (hw *headResponseWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// serveHTTPHead handles a HEAD request with the same handler as the GET
+// request, i.e. with the same headers, but without body. The handlers
+// writing thumbnails and previews don't know the size in advance, so the
+// body is generated anyway to get Content-Length.
+func serveHTTPHead(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	hw := &headResponseWriter{ResponseWriter: w}
+	handler(hw, r)
+	hw.finish()
+}
+
+// disableReadTimeout removes the server read timeout for the request,
+// e.g. when receiving large files
+func disableReadTimeout(w http.ResponseWriter) {
+	err := http.NewResponseController(w).SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Debug("Unable to disable read timeout: ", err)
+	}
+}
+
+// disableWriteTimeout removes the server write timeout for the request,
+// e.g. when streaming large files. A video player typically uses range
+// requests, and each of them would otherwise have its own write timeout.
+func disableWriteTimeout(w http.ResponseWriter) {
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil {
+		log.Debug("Unable to disable write timeout: ", err)
+	}
+}
+
+// isPublic returns true for requests that don't require authentication
+func isPublic(r *http.Request) bool {
+	return (r.URL.Path == "/login" && r.Method == "POST") ||
+		(r.URL.Path == "/capabilities" && r.Method == "GET") ||
+		(r.URL.Path == "/healthz" && r.Method == "GET") ||
+		(r.URL.Path == "/readyz" && r.Method == "GET")
+}
+
+// isAdminOnly returns true for requests that change the media or the
+// cache, i.e. that viewers are not allowed to do
+func isAdminOnly(r *http.Request) bool {
+	head, _ := shiftPath(r.URL.Path)
+	switch head {
+	case "media":
+		return r.Method == "DELETE" || r.Method == "PUT"
+	case "move", "prune", "trash", "upload", "cancel-precache", "shutdown":
+		return r.Method == "POST"
+	case "clearerrors", "loglevel":
+		return true
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client (without port)
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr // E.g. Unix domain socket
+	}
+	return host
+}
+
+// writeEvent writes a Server-Sent Event with the v object as JSON data
+func writeEvent(w io.Writer, event string, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		log.Warn("Unable to encode event: ", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, js)
+}
+
+// contentDisposition returns a Content-Disposition header value for the
+// provided file name. disposition is typically "attachment" or "inline".
+// Since file names may contain non-ASCII characters the name is provided
+// both as an ASCII fallback (filename) and RFC 5987 encoded (filename*).
+func contentDisposition(disposition, fileName string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range fileName {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteRune('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(fileName) {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') ||
+			strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, fallback.String(), encoded.String())
+}
+
+// toJSON converts the v object to JSON and writes result to the response
+func toJSON(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// errorResponse is the JSON body of API error responses
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// respondError responds with an error as JSON, i.e. {"error": msg,
+// "code": code}, and code as HTTP status. Used instead of http.Error by
+// the API, since JSON clients expect JSON also on errors.
+func respondError(w http.ResponseWriter, code int, msg string) {
+	js, _ := json.Marshal(errorResponse{Error: msg, Code: code})
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(js)
+}
+
+// cleanBasePath returns the base path with a leading slash and without
+// a trailing slash, e.g. /gallery. Returns "" if there is no base path.
+func cleanBasePath(basePath string) string {
+	basePath = strings.Trim(path.Clean("/"+basePath), "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// stripBasePath removes basePath (as returned by cleanBasePath) from p.
+// Returns false if p is not within the base path.
+func stripBasePath(p, basePath string) (string, bool) {
+	if p == basePath {
+		return "/", true
+	}
+	if strings.HasPrefix(p, basePath+"/") {
+		return p[len(basePath):], true
+	}
+	return p, false
+}
+
+// insertBaseHref inserts a <base href> tag first in the head of the
+// HTML page
+func insertBaseHref(page []byte, href string) []byte {
+	baseTag := []byte("<head>\n<base href=\"" + html.EscapeString(href) + "\">")
+	return bytes.Replace(page, []byte("<head>"), baseTag, 1)
 }
 
 // shiftPath splits off the first component of p, which will be cleaned of
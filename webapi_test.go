@@ -1,15 +1,31 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/disintegration/imaging"
+	log "github.com/sirupsen/logrus"
 )
 
 var baseURL = "http://localhost:9834"
@@ -32,6 +48,17 @@ func getHTML(t *testing.T, path string) string {
 	return respToString(resp.Body)
 }
 
+// assertErrorBody checks that the body of resp is a JSON error response,
+// i.e. {"error": "...", "code": code}
+func assertErrorBody(t *testing.T, resp *http.Response, code int) {
+	t.Helper()
+	assertEqualsStr(t, "", "application/json", resp.Header.Get("Content-Type"))
+	var errResp errorResponse
+	assertExpectNoErr(t, "", json.NewDecoder(resp.Body).Decode(&errResp))
+	assertEqualsInt(t, "", code, errResp.Code)
+	assertTrue(t, "", errResp.Error != "")
+}
+
 func getHTMLAuthenticate(t *testing.T, path, user, pass string, expectFail bool) string {
 	t.Helper()
 	client := &http.Client{}
@@ -42,6 +69,8 @@ func getHTMLAuthenticate(t *testing.T, path, user, pass string, expectFail bool)
 	assertExpectNoErr(t, "", err)
 	if expectFail {
 		assertEqualsInt(t, "", int(http.StatusUnauthorized), int(resp.StatusCode))
+		assertErrorBody(t, resp, http.StatusUnauthorized)
+		resp.Body.Close()
 		return ""
 	}
 	assertEqualsInt(t, "", int(http.StatusOK), int(resp.StatusCode))
@@ -100,6 +129,7 @@ func waitserver(t *testing.T) {
 			// Up and running :-)
 			return
 		}
+		time.Sleep(20 * time.Millisecond) // Not listening yet
 	}
 	t.Fatalf("Server never started")
 }
@@ -116,6 +146,43 @@ func shutdown(t *testing.T) {
 	http.DefaultServeMux = new(http.ServeMux)
 }
 
+// logBuffer holds captured log output (written by the server goroutines)
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *logBuffer) String() string {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.buf.String()
+}
+
+// waitFor waits for s to be logged. Returns false if it never is.
+func (lb *logBuffer) waitFor(s string) bool {
+	for i := 0; i < 100; i++ {
+		if strings.Contains(lb.String(), s) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// captureLog redirects the log output to a buffer until the test is done
+func captureLog(t *testing.T) *logBuffer {
+	lb := &logBuffer{}
+	log.SetOutput(lb)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return lb
+}
+
 func TestStatic(t *testing.T) {
 	startserver(t)
 	defer shutdown(t)
@@ -188,6 +255,195 @@ func TestGetMedia(t *testing.T) {
 	assertEqualsInt(t, "", int(http.StatusNotFound), int(resp.StatusCode))
 }
 
+func TestGetMediaDownload(t *testing.T) {
+	startserver(t)
+	defer shutdown(t)
+
+	// Inline by default
+	resp, err := http.Get(baseURL + "/media/video.mp4")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsStr(t, "", "", resp.Header.Get("Content-Disposition"))
+
+	resp, err = http.Get(baseURL + "/media/exif_rotate/no_exif.jpg?download=true")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	assertEqualsStr(t, "", "attachment; filename=\"no_exif.jpg\"; filename*=UTF-8''no_exif.jpg",
+		resp.Header.Get("Content-Disposition"))
+
+	// Range requests of videos
+	req, _ := http.NewRequest("GET", baseURL+"/media/video.mp4?download=true", nil)
+	req.Header.Set("Range", "bytes=0-99")
+	resp, err = http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusPartialContent, resp.StatusCode)
+	assertEqualsInt(t, "", 100, len(body))
+	assertEqualsStr(t, "", "video/mp4", resp.Header.Get("Content-Type"))
+	assertEqualsStr(t, "", "attachment; filename=\"video.mp4\"; filename*=UTF-8''video.mp4",
+		resp.Header.Get("Content-Disposition"))
+}
+
+func TestGetMediaDownloadFileName(t *testing.T) {
+	mediaPath := "tmpout/TestGetMediaDownloadFileName"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/Sommar 2024", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/Sommar 2024/Smörgåsbord på ön.jpg")
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	// The base name of the file, not the (escaped) URL path
+	resp, err := http.Get(baseURL + "/media/" + url.PathEscape("Sommar 2024") + "/" +
+		url.PathEscape("Smörgåsbord på ön.jpg") + "?download=true")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	assertEqualsStr(t, "", "attachment; filename=\"Sm_rg_sbord p_ _n.jpg\"; "+
+		"filename*=UTF-8''Sm%C3%B6rg%C3%A5sbord%20p%C3%A5%20%C3%B6n.jpg",
+		resp.Header.Get("Content-Disposition"))
+}
+
+func TestGetMediaMaxSide(t *testing.T) {
+	media := createMedia("testmedia", "tmpcache/TestGetMediaMaxSide", true, false, false, false, true, true, true, 1280, true, false, false, false,
+		mediaOptions{previewSizes: []int{200}})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	image := getBinary(t, "media/png.png?maxside=100", "image/jpeg")
+	img, err := imaging.Decode(bytes.NewReader(image))
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 200, max(img.Bounds().Dx(), img.Bounds().Dy()))
+
+	// Not an allowed size, the closest larger is used
+	image = getBinary(t, "media/png.png?maxside=201", "image/jpeg")
+	img, err = imaging.Decode(bytes.NewReader(image))
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 1280, max(img.Bounds().Dx(), img.Bounds().Dy()))
+
+	resp, err := http.Get(baseURL + "/media/png.png?maxside=big")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGetMediaVideoContentType(t *testing.T) {
+	mediaPath := "tmpout/TestGetMediaVideoContentType"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	contentTypes := map[string]string{
+		"video.mp4":  "video/mp4",
+		"video.webm": "video/webm",
+		"video.M4V":  "video/x-m4v",
+		"video.flv":  "video/x-flv",
+		"video.wmv":  "video/x-ms-wmv",
+		"video.mpg":  "video/mpeg"}
+	for name := range contentTypes {
+		copyFile(t, "testmedia/video.mp4", mediaPath+"/"+name)
+	}
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var files []File
+	getObject(t, "folder", &files)
+	assertEqualsInt(t, "", len(contentTypes), len(files))
+	for name, contentType := range contentTypes {
+		assertTrue(t, name, media.isVideo(name))
+		body := getBinary(t, "media/"+name, contentType)
+		assertTrue(t, name, len(body) > 1000)
+	}
+}
+
+func TestGetMediaKeepFormat(t *testing.T) {
+	media := createMedia("testmedia", "tmpcache/TestGetMediaKeepFormat", true, false, false, false, true, true, true, 200, true, false, false, false,
+		mediaOptions{previewKeepFormat: true})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	image := getBinary(t, "media/png.png", "image/png")
+	img, err := imaging.Decode(bytes.NewReader(image))
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 200, max(img.Bounds().Dx(), img.Bounds().Dy()))
+
+	getBinary(t, "media/jpeg.jpg", "image/jpeg")
+}
+
+func TestErrorResponse(t *testing.T) {
+	startserver(t)
+	defer shutdown(t)
+
+	for path, status := range map[string]int{
+		"folder/dont_exist":  http.StatusNotFound,
+		"media/txt.txt":      http.StatusNotFound,
+		"recent?limit=hello": http.StatusBadRequest} {
+		resp, err := http.Get(baseURL + "/" + path)
+		assertExpectNoErr(t, path, err)
+		assertEqualsInt(t, path, status, resp.StatusCode)
+		assertEqualsStr(t, path, "application/json", resp.Header.Get("Content-Type"))
+		var errResp errorResponse
+		assertExpectNoErr(t, path, json.NewDecoder(resp.Body).Decode(&errResp))
+		resp.Body.Close()
+		assertEqualsInt(t, path, status, errResp.Code)
+		assertTrue(t, path, errResp.Error != "")
+	}
+
+	// Not for static files
+	resp, err := http.Get(baseURL + "/dont_exist.html")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusNotFound, resp.StatusCode)
+	assertFalse(t, "", resp.Header.Get("Content-Type") == "application/json")
+}
+
+func TestHead(t *testing.T) {
+	media := createMedia("testmedia", "tmpcache/TestHead", true, false, false, false, true, true, true, 200, true, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	for _, tc := range []struct {
+		path        string
+		contentType string
+	}{
+		{"media/png.png", "image/jpeg"}, // Preview
+		{"media/png.png?original-image=true", "image/png"},
+		{"media/jpeg.jpg?download=true", "image/jpeg"},
+		{"thumb/png.png", "image/jpeg"},
+		{"thumb/jpeg.jpg", "image/jpeg"},   // EXIF thumbnail
+		{"thumb/invalid.jpg", "image/png"}, // Icon
+		{"folder/", "application/json"},
+		{"folder/exif_rotate", "application/json"}} {
+		body := getBinary(t, tc.path, tc.contentType)
+		resp, err := http.Head(baseURL + "/" + tc.path)
+		assertExpectNoErr(t, tc.path, err)
+		headBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assertEqualsInt(t, tc.path, http.StatusOK, resp.StatusCode)
+		assertEqualsStr(t, tc.path, tc.contentType, resp.Header.Get("Content-Type"))
+		assertEqualsInt(t, tc.path, len(body), int(resp.ContentLength))
+		assertEqualsInt(t, tc.path, 0, len(headBody))
+	}
+
+	for _, path := range []string{"media/dont_exist.jpg", "folder/dont_exist"} {
+		resp, err := http.Head(baseURL + "/" + path)
+		assertExpectNoErr(t, path, err)
+		resp.Body.Close()
+		assertEqualsInt(t, path, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
 func TestGetThumbnail(t *testing.T) {
 	startserver(t)
 	defer shutdown(t)
@@ -216,9 +472,36 @@ func TestGetThumbnail(t *testing.T) {
 	*/
 }
 
+func TestGetAlbumThumbnail(t *testing.T) {
+	mediaPath := "tmpout/TestGetAlbumThumbnail"
+	cache := "tmpcache/TestGetAlbumThumbnail"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cache)
+	os.MkdirAll(mediaPath+"/album", os.ModePerm)
+	os.MkdirAll(mediaPath+"/empty", os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/album/png.png")
+	copyFile(t, "testmedia/gif.gif", mediaPath+"/album/gif.gif")
+
+	media := createMedia(mediaPath, cache, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	media.generateCache("", true, true, false)
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	image := getBinary(t, "thumb/album", "image/jpeg")
+	assertTrue(t, "", bytes.HasPrefix(image, []byte{0xff, 0xd8})) // JPEG
+	getBinary(t, "thumb/album/", "image/jpeg")
+
+	// No album thumbnail
+	image = getBinary(t, "thumb/empty", "image/png")
+	assertTrue(t, "", bytes.Equal(embedFolderIconBytes, image))
+	getBinary(t, "thumb/dont_exist", "image/png")
+}
+
 func TestGetThumbnailNoCache(t *testing.T) {
-	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false)
-	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "")
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
 	webAPI.Start()
 	waitserver(t)
 	defer shutdown(t)
@@ -248,8 +531,8 @@ func TestGetThumbnailNoCache(t *testing.T) {
 }
 
 func TestGetPreview(t *testing.T) {
-	media := createMedia("testmedia", "tmpcache/TestGetPreview", true, false, false, false, true, true, true, 1280, false, false, false, false)
-	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "")
+	media := createMedia("testmedia", "tmpcache/TestGetPreview", true, false, false, false, true, true, true, 1280, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
 	webAPI.Start()
 	waitserver(t)
 	defer shutdown(t)
@@ -262,6 +545,15 @@ func TestGetPreview(t *testing.T) {
 
 	assertTrue(t, "Preview shall be smaller than original", len(previewImage) >= len(fullImage))
 
+	// Animated video preview requires ffmpeg, otherwise the video icon is provided
+	if hasVideoThumbnailSupport() {
+		videoPreview := getBinary(t, "media/video.mp4?video-preview=true", "image/gif")
+		assertTrue(t, "", len(videoPreview) > 100)
+	} else {
+		videoPreview := getBinary(t, "media/video.mp4?video-preview=true", "image/png")
+		assertTrue(t, "", len(videoPreview) > 100)
+	}
+
 }
 
 func TestInvalidPath(t *testing.T) {
@@ -270,12 +562,14 @@ func TestInvalidPath(t *testing.T) {
 
 	resp, err := http.Post(fmt.Sprintf("%s/invalid", baseURL), "", nil)
 	assertExpectNoErr(t, "", err)
+	defer resp.Body.Close()
 	assertEqualsInt(t, "", int(http.StatusNotFound), int(resp.StatusCode))
+	assertErrorBody(t, resp, http.StatusNotFound)
 }
 
 func TestAuthentication(t *testing.T) {
-	media := createMedia("testmedia", "", true, false, false, false, true, true, false, 0, false, false, false, false)
-	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "")
+	media := createMedia("testmedia", "", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{})
 	webAPI.Start()
 	waitserver(t)
 	defer shutdown(t)
@@ -284,6 +578,9 @@ func TestAuthentication(t *testing.T) {
 	resp, err := http.Get(baseURL)
 	assertExpectNoErr(t, "", err)
 	assertEqualsInt(t, "", int(http.StatusUnauthorized), int(resp.StatusCode))
+	assertTrue(t, "", resp.Header.Get("WWW-Authenticate") != "")
+	assertErrorBody(t, resp, http.StatusUnauthorized)
+	resp.Body.Close()
 
 	// Try to get with a valid user and password
 	index := getHTMLAuthenticate(t, "index.html", "myuser", "mypass", false)
@@ -305,9 +602,179 @@ func TestAuthentication(t *testing.T) {
 
 }
 
+func TestLoginFailureLog(t *testing.T) {
+	logs := captureLog(t)
+	media := createMedia("testmedia", "", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	// Basic authentication
+	getHTMLAuthenticate(t, "index.html", "myuser", "secretBasicAttempt", true)
+	assertTrue(t, "", logs.waitFor("Invalid user login attempt. user: myuser, client: "))
+
+	// Login form
+	resp, err := http.PostForm(baseURL+"/login", url.Values{"username": {"otheruser"}, "password": {"secretFormAttempt"}})
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusUnauthorized, resp.StatusCode)
+	assertTrue(t, "", logs.waitFor("Invalid user login attempt. user: otheruser, client: "))
+
+	// Repeated failures from the same client IP
+	for i := 0; i < loginFailureWarnLimit-2; i++ {
+		getHTMLAuthenticate(t, "index.html", "myuser", "secretBasicAttempt", true)
+	}
+	assertTrue(t, "", logs.waitFor(fmt.Sprintf("%d failed login attempts from ", loginFailureWarnLimit)))
+
+	// The passwords shall never be logged
+	assertFalse(t, "", strings.Contains(logs.String(), "secretBasicAttempt"))
+	assertFalse(t, "", strings.Contains(logs.String(), "secretFormAttempt"))
+
+	// Successful login resets the counter
+	getHTMLAuthenticate(t, "index.html", "myuser", "mypass", false)
+	webAPI.failureMutex.Lock()
+	assertEqualsInt(t, "", 0, len(webAPI.loginFailures))
+	webAPI.failureMutex.Unlock()
+}
+
+func TestSessionLogin(t *testing.T) {
+	media := createMedia("testmedia", "", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	jar, err := cookiejar.New(nil)
+	assertExpectNoErr(t, "", err)
+	client := &http.Client{Jar: jar}
+
+	// Invalid login
+	resp, err := client.PostForm(baseURL+"/login", url.Values{"username": {"myuser"}, "password": {"invalid"}})
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", http.StatusUnauthorized, resp.StatusCode)
+	assertEqualsStr(t, "No basic auth prompt expected", "", resp.Header.Get("WWW-Authenticate"))
+
+	// Valid login, the session cookie is used instead of basic authentication
+	resp, err = client.PostForm(baseURL+"/login", url.Values{"username": {"myuser"}, "password": {"mypass"}})
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", http.StatusNoContent, resp.StatusCode)
+	resp, err = client.Get(baseURL + "/index.html")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+
+	// Logout
+	resp, err = client.Post(baseURL+"/logout", "", nil)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", http.StatusNoContent, resp.StatusCode)
+	resp, err = client.Get(baseURL + "/index.html")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", http.StatusUnauthorized, resp.StatusCode)
+
+	// Basic authentication still works
+	getHTMLAuthenticate(t, "index.html", "myuser", "mypass", false)
+
+	// Session validation
+	session := webAPI.createSession("myuser", time.Now().Add(time.Hour))
+	assertEqualsStr(t, "", "myuser", webAPI.sessionUser(session))
+	assertEqualsStr(t, "Expired", "", webAPI.sessionUser(webAPI.createSession("myuser", time.Now().Add(-time.Second))))
+	assertEqualsStr(t, "Other user", "", webAPI.sessionUser(webAPI.createSession("other", time.Now().Add(time.Hour))))
+	assertEqualsStr(t, "Tampered", "", webAPI.sessionUser(session[:len(session)-2]+"AA"))
+	assertEqualsStr(t, "Invalid", "", webAPI.sessionUser("invalid"))
+	otherWebAPI := &WebAPI{userName: "myuser", sessionSecret: []byte("other secret")}
+	assertEqualsStr(t, "Other secret", "", otherWebAPI.sessionUser(session))
+}
+
+// loginCookie logs in directly with the handler, i.e. without starting
+// the server, and returns the session cookie
+func loginCookie(t *testing.T, webAPI *WebAPI) *http.Cookie {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/login", strings.NewReader("username=myuser&password=mypass"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	webAPI.serveHTTPLogin(rec, req)
+	assertEqualsInt(t, "", http.StatusNoContent, rec.Code)
+	cookies := rec.Result().Cookies()
+	assertEqualsInt(t, "", 1, len(cookies))
+	return cookies[0]
+}
+
+func TestSessionCookieSecure(t *testing.T) {
+	defer func() { http.DefaultServeMux = new(http.ServeMux) }()
+	media := createMedia("testmedia", "", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{})
+	assertFalse(t, "Plain HTTP", loginCookie(t, webAPI).Secure)
+
+	webAPI.tlsCertFile = "cert.pem"
+	webAPI.tlsKeyFile = "key.pem"
+	assertTrue(t, "Certificate files", loginCookie(t, webAPI).Secure)
+
+	// Let's Encrypt. Set directly since autocert requires a build tag.
+	webAPI.tlsCertFile = ""
+	webAPI.tlsKeyFile = ""
+	webAPI.autocert = true
+	assertTrue(t, "Autocert", loginCookie(t, webAPI).Secure)
+}
+
+// sendCORS sends a request with an Origin header and returns the response
+func sendCORS(t *testing.T, method, path, origin string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/%s", baseURL, path), nil)
+	assertExpectNoErr(t, "", err)
+	req.Header.Set("Origin", origin)
+	resp, err := http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORS(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	// Disabled by default
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	resp := sendCORS(t, "OPTIONS", "folder", "https://a.example.com")
+	assertEqualsInt(t, "", http.StatusUnauthorized, resp.StatusCode)
+	assertEqualsStr(t, "", "", resp.Header.Get("Access-Control-Allow-Origin"))
+	shutdown(t)
+
+	webAPI = CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "",
+		webAPIOptions{corsOrigins: []string{"https://a.example.com"}})
+	webAPI.Start()
+	waitserver(t)
+
+	// Preflight of allowed origin (no credentials required)
+	resp = sendCORS(t, "OPTIONS", "folder", "https://a.example.com")
+	assertEqualsInt(t, "", http.StatusNoContent, resp.StatusCode)
+	assertEqualsStr(t, "", "https://a.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assertTrue(t, "", strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), "Authorization"))
+	assertTrue(t, "", strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), "GET"))
+
+	// Not allowed origin
+	resp = sendCORS(t, "OPTIONS", "folder", "https://b.example.com")
+	assertEqualsInt(t, "", http.StatusUnauthorized, resp.StatusCode)
+	assertEqualsStr(t, "", "", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	// Headers also on the actual request
+	resp = sendCORS(t, "GET", "folder", "https://a.example.com")
+	assertEqualsStr(t, "", "https://a.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	shutdown(t)
+
+	// Any origin
+	webAPI = CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{corsOrigins: []string{"*"}})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+	resp = sendCORS(t, "GET", "folder", "https://b.example.com")
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	assertEqualsStr(t, "", "*", resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
 func TestIsPreCacheInProgress(t *testing.T) {
-	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false)
-	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "")
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
 	webAPI.Start()
 	waitserver(t)
 	defer shutdown(t)
@@ -322,14 +789,1676 @@ func TestIsPreCacheInProgress(t *testing.T) {
 
 }
 
+func TestCancelPreCacheNotInProgress(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	resp, err := http.Post(fmt.Sprintf("%s/cancel-precache", baseURL), "", nil)
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	assertEqualsStr(t, "", "false", respToString(resp.Body))
+}
+
+func TestProgressEvents(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	// No generation in progress, i.e. done immediately
+	resp, err := http.Get(fmt.Sprintf("%s/progress", baseURL))
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", int(http.StatusOK), int(resp.StatusCode))
+	assertEqualsStr(t, "", "text/event-stream", resp.Header.Get("content-type"))
+	body := respToString(resp.Body)
+	assertEqualsStr(t, "", "event: done\ndata: {}\n\n", body)
+}
+
+func TestProgressive(t *testing.T) {
+	media := createMedia("testmedia", "tmpcache/TestProgressive", true, false, false, false, true, true, true, 970, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var progressive ProgressiveImage
+	getObject(t, "progressive/exif_rotate/normal.jpg", &progressive)
+	assertEqualsStr(t, "", "media/exif_rotate/normal.jpg", progressive.Preview)
+	prefix := "data:image/jpeg;base64,"
+	assertTrue(t, "Invalid placeholder prefix", strings.HasPrefix(progressive.Placeholder, prefix))
+	placeholder, err := base64.StdEncoding.DecodeString(progressive.Placeholder[len(prefix):])
+	assertExpectNoErr(t, "", err)
+	img, err := imaging.Decode(bytes.NewReader(placeholder))
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "Placeholder too large", img.Bounds().Dx() <= lqipMaxSide && img.Bounds().Dy() <= lqipMaxSide)
+
+	// Only images are supported
+	resp, err := http.Get(fmt.Sprintf("%s/progressive/video.mp4", baseURL))
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", http.StatusNotFound, resp.StatusCode)
+	resp, err = http.Get(fmt.Sprintf("%s/progressive/dont_exist.jpg", baseURL))
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", http.StatusNotFound, resp.StatusCode)
+}
+
+func TestLive(t *testing.T) {
+	mediaPath := "tmpout/TestLive"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/live.jpg")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/live.mov")
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{livePhotos: true})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	video := getBinary(t, "live/live.jpg", "video/quicktime")
+	assertTrue(t, "", len(video) > 1000)
+
+	resp, err := http.Get(fmt.Sprintf("%s/live/dont_exist.jpg", baseURL))
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", http.StatusNotFound, resp.StatusCode)
+}
+
+// sendMove sends a move request and returns the status code
+func sendMove(t *testing.T, from, to string) int {
+	t.Helper()
+	body, err := json.Marshal(moveRequest{From: from, To: to})
+	assertExpectNoErr(t, "", err)
+	resp, err := http.Post(fmt.Sprintf("%s/move", baseURL), "application/json", bytes.NewReader(body))
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestCacheStats(t *testing.T) {
+	cachePath := "tmpcache/TestCacheStats"
+	os.RemoveAll(cachePath)
+	media := createMedia("testmedia", cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	getBinary(t, "thumb/png.png", "image/jpeg")
+	var stats CacheStats
+	getObject(t, "cachestats", &stats)
+	assertEqualsInt(t, "", 1, stats.NbrOfThumbnails)
+	assertEqualsInt(t, "", 0, stats.NbrOfPreviews)
+	assertEqualsInt(t, "", 1, len(stats.SlowGenerations))
+	assertEqualsStr(t, "", "png.png", stats.SlowGenerations[0].Path)
+}
+
+func TestPrune(t *testing.T) {
+	mediaPath := "tmpout/TestPruneWebAPI"
+	cachePath := "tmpcache/TestPruneWebAPI"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{
+		viewers: passwords{"anna": "secret"}})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	prune := func(method, user, pass string) *http.Response {
+		req, err := http.NewRequest(method, baseURL+"/prune", nil)
+		assertExpectNoErr(t, "", err)
+		req.SetBasicAuth(user, pass)
+		resp, err := http.DefaultClient.Do(req)
+		assertExpectNoErr(t, "", err)
+		return resp
+	}
+
+	req, _ := http.NewRequest("GET", baseURL+"/thumb/png.png", nil)
+	req.SetBasicAuth("myuser", "mypass")
+	resp, err := http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	os.Remove(mediaPath + "/png.png")
+
+	// Only the admin user
+	resp = prune("POST", "anna", "secret")
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusForbidden, resp.StatusCode)
+	assertFileExist(t, "", cachePath+"/png.png.thumb.jpg")
+
+	resp = prune("POST", "myuser", "mypass")
+	defer resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	var result PruneResult
+	assertExpectNoErr(t, "", json.NewDecoder(resp.Body).Decode(&result))
+	assertEqualsInt(t, "", 1, result.NbrRemovedFiles)
+	assertFileNotExist(t, "", cachePath+"/png.png.thumb.jpg")
+
+	// Only POST
+	resp = prune("GET", "myuser", "mypass")
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusNotFound, resp.StatusCode)
+}
+
+func TestPruneWithoutAuthentication(t *testing.T) {
+	mediaPath := "tmpout/TestPruneWithoutAuthentication"
+	cachePath := "tmpcache/TestPruneWithoutAuthentication"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	getBinary(t, "thumb/png.png", "image/jpeg")
+	os.Remove(mediaPath + "/png.png")
+	resp, err := http.Post(baseURL+"/prune", "", nil)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusForbidden, resp.StatusCode)
+	assertFileExist(t, "", cachePath+"/png.png.thumb.jpg")
+}
+
+func TestLogLevel(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.InfoLevel)
+	mediaPath := "tmpout/TestLogLevel"
+	cachePath := "tmpcache/TestLogLevel"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{
+		viewers: passwords{"anna": "secret"}})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	send := func(method, body, user, pass string) (int, logLevel) {
+		req, err := http.NewRequest(method, baseURL+"/loglevel", strings.NewReader(body))
+		assertExpectNoErr(t, "", err)
+		req.SetBasicAuth(user, pass)
+		resp, err := http.DefaultClient.Do(req)
+		assertExpectNoErr(t, "", err)
+		defer resp.Body.Close()
+		var result logLevel
+		if resp.StatusCode == http.StatusOK {
+			assertExpectNoErr(t, "", json.NewDecoder(resp.Body).Decode(&result))
+		}
+		return resp.StatusCode, result
+	}
+
+	status, result := send("GET", "", "myuser", "mypass")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertEqualsStr(t, "", "info", result.Level)
+
+	status, result = send("PUT", `{"level":"debug"}`, "myuser", "mypass")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertEqualsStr(t, "", "debug", result.Level)
+	assertEqualsStr(t, "", "debug", log.GetLevel().String())
+
+	// Invalid levels are rejected, not defaulted to info
+	for _, body := range []string{`{"level":"verbose"}`, `{"level":""}`, "debug"} {
+		status, _ = send("PUT", body, "myuser", "mypass")
+		assertEqualsInt(t, body, http.StatusBadRequest, status)
+	}
+	assertEqualsStr(t, "", "debug", log.GetLevel().String())
+
+	// Only the admin user
+	status, _ = send("GET", "", "anna", "secret")
+	assertEqualsInt(t, "", http.StatusForbidden, status)
+	status, _ = send("PUT", `{"level":"trace"}`, "anna", "secret")
+	assertEqualsInt(t, "", http.StatusForbidden, status)
+	assertEqualsStr(t, "", "debug", log.GetLevel().String())
+}
+
+func TestLogLevelWithoutAuthentication(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.InfoLevel)
+	mediaPath := "tmpout/TestLogLevelWithoutAuthentication"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var result logLevel
+	getObject(t, "loglevel", &result)
+	assertEqualsStr(t, "", "info", result.Level)
+
+	req, err := http.NewRequest("PUT", baseURL+"/loglevel", strings.NewReader(`{"level":"trace"}`))
+	assertExpectNoErr(t, "", err)
+	resp, err := http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusForbidden, resp.StatusCode)
+	assertEqualsStr(t, "", "info", log.GetLevel().String())
+}
+
+func TestBatchMeta(t *testing.T) {
+	startserver(t)
+	defer shutdown(t)
+
+	post := func(body string) *http.Response {
+		resp, err := http.Post(baseURL+"/batchmeta", "application/json", strings.NewReader(body))
+		assertExpectNoErr(t, "", err)
+		return resp
+	}
+	resp := post(`["jpeg.jpg", "exif_rotate/no_exif.jpg", "dont_exist.jpg"]`)
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	var metaData []MetaData
+	assertExpectNoErr(t, "", json.NewDecoder(resp.Body).Decode(&metaData))
+	resp.Body.Close()
+	assertEqualsInt(t, "", 3, len(metaData))
+	assertEqualsInt(t, "", 4128, metaData[0].Width)
+	assertEqualsStr(t, "", "exif_rotate/no_exif.jpg", metaData[1].Path)
+	assertTrue(t, "", metaData[1].Width > 0)
+	assertTrue(t, "", metaData[2].Error != "")
+
+	for _, body := range []string{`["../secret.jpg"]`, `{"From": "jpeg.jpg"}`, `not json`} {
+		resp = post(body)
+		resp.Body.Close()
+		assertEqualsInt(t, body, http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// Only POST
+	resp, err := http.Get(baseURL + "/batchmeta")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusNotFound, resp.StatusCode)
+}
+
+func TestMove(t *testing.T) {
+	mediaPath := "tmpout/TestMove"
+	cachePath := "tmpcache/TestMove"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/folder", os.ModePerm)
+	os.RemoveAll(cachePath)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/tiff.tiff", mediaPath+"/folder/tiff.tiff")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/jpeg.jpg")
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{allowDelete: true})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	getBinary(t, "thumb/png.png", "image/jpeg")
+	getBinary(t, "thumb/folder/tiff.tiff", "image/jpeg")
+	thumbInfo, err := os.Stat(cachePath + "/png.png.thumb.jpg")
+	assertExpectNoErr(t, "", err)
+
+	// Move file, the thumbnail shall be moved (not regenerated)
+	assertEqualsInt(t, "", http.StatusNoContent, sendMove(t, "png.png", "sub/renamed.png"))
+	assertFileNotExist(t, "", mediaPath+"/png.png")
+	assertFileExist(t, "", mediaPath+"/sub/renamed.png")
+	assertFileNotExist(t, "", cachePath+"/png.png.thumb.jpg")
+	assertTrue(t, "", media.cache.hasThumbnail("sub/renamed.png"))
+	assertFalse(t, "", media.cache.hasThumbnail("png.png"))
+	getBinary(t, "thumb/sub/renamed.png", "image/jpeg")
+	movedThumbInfo, err := os.Stat(cachePath + "/sub/renamed.png.thumb.jpg")
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "Thumbnail regenerated", thumbInfo.ModTime().Equal(movedThumbInfo.ModTime()))
+
+	// Move folder
+	assertEqualsInt(t, "", http.StatusNoContent, sendMove(t, "folder", "renamedfolder"))
+	assertFileExist(t, "", mediaPath+"/renamedfolder/tiff.tiff")
+	assertFileExist(t, "", cachePath+"/renamedfolder/tiff.tiff.thumb.jpg")
+	assertTrue(t, "", media.cache.hasThumbnail("renamedfolder/tiff.tiff"))
+	assertFalse(t, "", media.cache.hasThumbnail("folder/tiff.tiff"))
+
+	// No cache files (embedded EXIF thumbnail)
+	assertEqualsInt(t, "", http.StatusNoContent, sendMove(t, "jpeg.jpg", "jpeg2.jpg"))
+	assertFileExist(t, "", mediaPath+"/jpeg2.jpg")
+
+	// Errors
+	assertEqualsInt(t, "", http.StatusNotFound, sendMove(t, "png.png", "png2.png"))
+	assertEqualsInt(t, "", http.StatusConflict, sendMove(t, "jpeg2.jpg", "sub/renamed.png"))
+	assertEqualsInt(t, "", http.StatusBadRequest, sendMove(t, "jpeg2.jpg", "../../jpeg.jpg"))
+	assertEqualsInt(t, "", http.StatusBadRequest, sendMove(t, "jpeg2.jpg", "jpeg2.txt"))
+	assertEqualsInt(t, "", http.StatusBadRequest, sendMove(t, "jpeg2.jpg", ""))
+	assertFileExist(t, "", mediaPath+"/jpeg2.jpg")
+}
+
+func TestMoveWithoutAuthentication(t *testing.T) {
+	mediaPath := "tmpout/TestMoveWithoutAuthentication"
+	cachePath := "tmpcache/TestMoveWithoutAuthentication"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	// Not allowed unless allowdelete is set, same as delete
+	assertEqualsInt(t, "", http.StatusForbidden, sendMove(t, "png.png", "renamed.png"))
+	assertFileExist(t, "", mediaPath+"/png.png")
+	assertFileNotExist(t, "", mediaPath+"/renamed.png")
+}
+
+func TestDuplicates(t *testing.T) {
+	mediaPath := "tmpout/TestDuplicates"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/sub/a.jpg")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/sub/b.jpg")
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var duplicates [][]string
+	getObject(t, "duplicates/sub", &duplicates)
+	assertEqualsInt(t, "", 1, len(duplicates))
+	getObject(t, "duplicates?recursive=true", &duplicates)
+	assertEqualsInt(t, "", 1, len(duplicates))
+	assertEqualsStr(t, "", "sub/a.jpg,sub/b.jpg", strings.Join(duplicates[0], ","))
+	getObject(t, "duplicates", &duplicates)
+	assertEqualsInt(t, "", 0, len(duplicates))
+}
+
+func TestBasePath(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{basePath: "gallery/"})
+	done := webAPI.Start()
+	waitserver(t)
+	defer func() {
+		// shutdown can't be used since it is outside the base path
+		webAPI.Stop()
+		<-done
+		http.DefaultServeMux = new(http.ServeMux)
+	}()
+
+	index := getHTML(t, "gallery/")
+	assertTrue(t, "", strings.Contains(index, "<base href=\"/gallery/\">"))
+	index = getHTML(t, "gallery")
+	assertTrue(t, "", strings.Contains(index, "<base href=\"/gallery/\">"))
+	getBinary(t, "gallery/logo.ico", "image/x-icon")
+
+	var files []File
+	getObject(t, "gallery/folder", &files)
+	assertTrue(t, "", len(files) > 0)
+
+	// Outside base path
+	for _, path := range []string{"folder", "galleryfolder", "other/gallery/folder"} {
+		resp, err := http.Get(baseURL + "/" + path)
+		assertExpectNoErr(t, "", err)
+		resp.Body.Close()
+		assertEqualsInt(t, path, http.StatusNotFound, resp.StatusCode)
+	}
+
+	assertEqualsStr(t, "", "", cleanBasePath(""))
+	assertEqualsStr(t, "", "", cleanBasePath("/"))
+	assertEqualsStr(t, "", "/a/b", cleanBasePath("a/b/"))
+	assertEqualsStr(t, "", "/a", cleanBasePath("/a"))
+}
+
+func TestAccessLog(t *testing.T) {
+	logs := captureLog(t)
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{accessLog: true})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	ico := getBinary(t, "logo.ico", "image/x-icon")
+	assertTrue(t, "", logs.waitFor(fmt.Sprintf("method=GET path=/logo.ico size=%d status=200", len(ico))))
+
+	resp, err := http.Get(baseURL + "/folder/dont_exist")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertTrue(t, "", logs.waitFor("method=GET path=/folder/dont_exist"))
+	assertTrue(t, "", logs.waitFor(fmt.Sprintf("status=%d", resp.StatusCode)))
+	assertTrue(t, "", strings.Contains(logs.String(), "client="))
+
+	// Server-Sent Events shall still be flushed
+	resp, err = http.Get(baseURL + "/progress")
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "", strings.Contains(respToString(resp.Body), "event: done"))
+}
+
+func TestHTTPTimeouts(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	// Own port to not be served by a server from another test
+	timeoutURL := "http://localhost:9836"
+	webAPI := CreateWebAPI(9836, "", "templates", media, "", "", "", "", webAPIOptions{
+		readHeaderTimeout: 200 * time.Millisecond,
+		writeTimeout:      time.Nanosecond})
+	webAPI.Start()
+	defer func() {
+		webAPI.Stop()
+		http.DefaultServeMux = new(http.ServeMux)
+	}()
+	// Can't use waitserver since all requests except media time out
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", "localhost:9836"); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	resp, err := http.Get(timeoutURL + "/media/jpeg.jpg?original-image=true")
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	// Slow client that never completes the request headers
+	conn, err := net.Dial("tcp", "localhost:9836")
+	assertExpectNoErr(t, "", err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	assertExpectNoErr(t, "", err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	io.ReadAll(conn) // Until the server closes the connection
+	assertTrue(t, "", time.Since(start) < 4*time.Second)
+
+	// Write timeout has expired before the response is written
+	_, err = http.Get(timeoutURL + "/folder")
+	assertExpectErr(t, "", err)
+}
+
+func TestSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets not tested on Windows")
+	}
+	socket := "tmpout/TestSocket/mediaweb.sock"
+	os.RemoveAll("tmpout/TestSocket")
+	os.MkdirAll("tmpout/TestSocket", os.ModePerm)
+
+	// Stale socket file
+	listener, err := net.Listen("unix", socket)
+	assertExpectNoErr(t, "", err)
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	assertFileExist(t, "", socket)
+
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{socket: socket})
+	done := webAPI.Start()
+	defer func() { http.DefaultServeMux = new(http.ServeMux) }()
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get("http://mediaweb/folder")
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+
+	webAPI.Stop()
+	<-done
+	assertFileNotExist(t, "", socket)
+}
+
+func TestSearchAPI(t *testing.T) {
+	mediaPath := "tmpout/TestSearchAPI"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/sub/jpeg.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var results []SearchResult
+	getObject(t, "search?q=jpeg", &results)
+	assertEqualsInt(t, "", 0, len(results))
+	getObject(t, "search?q=jpeg&recursive=true", &results)
+	assertEqualsInt(t, "", 1, len(results))
+	assertEqualsStr(t, "", "sub/jpeg.jpg", results[0].Path)
+	assertEqualsStr(t, "", "image", results[0].Type)
+	assertEqualsStr(t, "", "name", results[0].Reason)
+	getObject(t, "search/sub?q=SM-N9005&exif=true", &results)
+	assertEqualsInt(t, "", 1, len(results))
+	assertEqualsStr(t, "", "camera", results[0].Reason)
+	getObject(t, "search?q=g", &results)
+	assertEqualsInt(t, "", 1, len(results))
+
+	resp, err := http.Get(baseURL + "/search")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.Get(baseURL + "/search/dont_exist?q=a")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusNotFound, resp.StatusCode)
+}
+
+func TestSimilar(t *testing.T) {
+	mediaPath := "tmpout/TestSimilar"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/a.jpg")
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/b.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var similar []SimilarImage
+	getObject(t, "similar/a.jpg?threshold=0", &similar)
+	assertEqualsInt(t, "", 1, len(similar))
+	assertEqualsStr(t, "", "b.jpg", similar[0].Path)
+	getObject(t, "similar/a.jpg?threshold=64", &similar)
+	assertEqualsInt(t, "", 2, len(similar))
+
+	resp, err := http.Get(baseURL + "/similar/a.jpg?threshold=65")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.Get(baseURL + "/similar/dont_exist.jpg")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusNotFound, resp.StatusCode)
+}
+
+func TestByDate(t *testing.T) {
+	media := createMedia("testmedia/exif_rotate", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var buckets []DateBucket
+	getObject(t, "bydate?granularity=day", &buckets)
+	assertTrue(t, "", len(buckets) > 0)
+	assertEqualsStr(t, "", "2018-04-06", buckets[len(buckets)-1].Name)
+
+	var files []File
+	getObject(t, "bydate/2018-04", &files)
+	assertEqualsInt(t, "", buckets[len(buckets)-1].Count, len(files))
+	assertEqualsStr(t, "", "image", files[0].Type)
+
+	resp, err := http.Get(baseURL + "/bydate?granularity=week")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.Get(baseURL + "/bydate/2018-13")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDownload(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	resp, err := http.Get(baseURL + "/download/exif_rotate")
+	assertExpectNoErr(t, "", err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	assertEqualsStr(t, "", "application/zip", resp.Header.Get("Content-Type"))
+	assertEqualsStr(t, "", "none", resp.Header.Get("Accept-Ranges"))
+	assertEqualsStr(t, "", "attachment; filename=\"exif_rotate.zip\"; filename*=UTF-8''exif_rotate.zip",
+		resp.Header.Get("Content-Disposition"))
+	reader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "", len(reader.File) > 0)
+
+	// No files modified in the future
+	future := time.Now().Add(time.Hour)
+	for _, since := range []string{strconv.FormatInt(future.Unix(), 10), future.Format(time.RFC3339)} {
+		resp, err = http.Get(baseURL + "/download/exif_rotate?since=" + url.QueryEscape(since))
+		assertExpectNoErr(t, "", err)
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		reader, err = zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		assertExpectNoErr(t, since, err)
+		assertEqualsInt(t, since, 0, len(reader.File))
+	}
+
+	resp, err = http.Get(baseURL + "/download/exif_rotate?since=yesterday")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusBadRequest, resp.StatusCode)
+	for _, path := range []string{"dont_exist", "jpeg.jpg"} {
+		resp, err = http.Get(baseURL + "/download/" + path)
+		assertExpectNoErr(t, "", err)
+		resp.Body.Close()
+		assertEqualsInt(t, path, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestThumbSheetAPI(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{spriteMaxTiles: 4})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var sheet ThumbSheet
+	getObject(t, "thumbsheetmap/exif_rotate?page=1", &sheet)
+	assertEqualsInt(t, "", 1, sheet.Page)
+	assertEqualsInt(t, "", 3, sheet.Pages)
+	assertEqualsInt(t, "", 4, len(sheet.Tiles))
+	assertEqualsInt(t, "", 256, sheet.Tiles["exif_rotate/no_exif.jpg"].W)
+
+	resp, err := http.Get(baseURL + "/thumbsheet/exif_rotate?page=2")
+	assertExpectNoErr(t, "", err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	assertEqualsStr(t, "", "image/jpeg", resp.Header.Get("Content-Type"))
+	img, err := imaging.Decode(bytes.NewReader(body))
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "", 256, img.Bounds().Dx())
+
+	for path, status := range map[string]int{
+		"/thumbsheet/exif_rotate?page=x":     http.StatusBadRequest,
+		"/thumbsheet/exif_rotate?page=3":     http.StatusNotFound,
+		"/thumbsheetmap/dont_exist":          http.StatusNotFound,
+		"/thumbsheetmap/exif_rotate?page=-1": http.StatusBadRequest} {
+		resp, err = http.Get(baseURL + path)
+		assertExpectNoErr(t, path, err)
+		resp.Body.Close()
+		assertEqualsInt(t, path, status, resp.StatusCode)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	media := createMedia("testmedia", "tmpcache/TestMetrics", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{metrics: true})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	getBinary(t, "thumb/png.png", "image/jpeg")
+	resp, err := http.Get(baseURL + "/metrics")
+	assertExpectNoErr(t, "", err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	assertTrue(t, "", strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+	assertTrue(t, "", strings.Contains(string(body), `mediaweb_http_requests_total{route="thumb",method="GET",status="200"}`))
+	assertTrue(t, "", strings.Contains(string(body), `mediaweb_cache_requests_total{kind="thumbnail",result=`))
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	startserver(t)
+	defer shutdown(t)
+
+	resp, err := http.Get(baseURL + "/metrics")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusNotFound, resp.StatusCode)
+}
+
+func TestListenAddresses(t *testing.T) {
+	assertEqualsStr(t, "", ":9834", strings.Join(listenAddresses("", 9834), " "))
+	assertEqualsStr(t, "", "127.0.0.1:9834", strings.Join(listenAddresses("127.0.0.1", 9834), " "))
+	assertEqualsStr(t, "", "[::1]:9834", strings.Join(listenAddresses("::1", 9834), " "))
+	assertEqualsStr(t, "", "127.0.0.1:80 [::1]:80 [fe80::1]:80",
+		strings.Join(listenAddresses("127.0.0.1, ::1 ,[fe80::1],", 80), " "))
+}
+
+func TestMultipleAddresses(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "127.0.0.1,::1", "templates", media, "", "", "", "", webAPIOptions{})
+	done := webAPI.Start()
+	waitserver(t)
+
+	for _, url := range []string{"http://127.0.0.1:9834/capabilities", "http://[::1]:9834/capabilities"} {
+		resp, err := http.Get(url)
+		assertExpectNoErr(t, url, err)
+		resp.Body.Close()
+		assertEqualsInt(t, url, http.StatusOK, resp.StatusCode)
+	}
+
+	// Start returns when all listeners are stopped
+	shutdown(t)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server not stopped")
+	}
+}
+
+func TestClearErrorsAPI(t *testing.T) {
+	cachePath := "tmpcache/TestClearErrorsAPI"
+	os.RemoveAll(cachePath)
+	os.MkdirAll(cachePath+"/exif_rotate", os.ModePerm)
+	os.WriteFile(cachePath+"/invalid.thumb.err.txt", []byte("1"), 0666)
+	os.WriteFile(cachePath+"/exif_rotate/normal.thumb.err.txt", []byte("1"), 0666)
+	media := createMedia("testmedia", cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	// Authentication required
+	resp, err := http.Post(baseURL+"/clearerrors/?recursive=true", "", nil)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusUnauthorized, resp.StatusCode)
+
+	// Only POST, e.g. not by an <img> tag on another site
+	req, _ := http.NewRequest("GET", baseURL+"/clearerrors/?recursive=true", nil)
+	req.SetBasicAuth("myuser", "mypass")
+	resp, err = http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusMethodNotAllowed, resp.StatusCode)
+	assertEqualsStr(t, "", "POST", resp.Header.Get("Allow"))
+	assertFileExist(t, "", cachePath+"/exif_rotate/normal.thumb.err.txt")
+
+	req, _ = http.NewRequest("POST", baseURL+"/clearerrors/?recursive=true", nil)
+	req.SetBasicAuth("myuser", "mypass")
+	resp, err = http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	var cleared ClearedErrors
+	json.NewDecoder(resp.Body).Decode(&cleared)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	assertEqualsInt(t, "", 2, cleared.NbrOfClearedErrors)
+	assertFileNotExist(t, "", cachePath+"/exif_rotate/normal.thumb.err.txt")
+
+	req, _ = http.NewRequest("POST", baseURL+"/clearerrors/dont_exist", nil)
+	req.SetBasicAuth("myuser", "mypass")
+	resp, err = http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusNotFound, resp.StatusCode)
+}
+
+func TestClearErrorsWithoutAuthentication(t *testing.T) {
+	cachePath := "tmpcache/TestClearErrorsWithoutAuthentication"
+	os.RemoveAll(cachePath)
+	os.MkdirAll(cachePath, os.ModePerm)
+	os.WriteFile(cachePath+"/invalid.thumb.err.txt", []byte("1"), 0666)
+	media := createMedia("testmedia", cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	resp, err := http.Post(baseURL+"/clearerrors/?recursive=true", "", nil)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusForbidden, resp.StatusCode)
+	assertFileExist(t, "", cachePath+"/invalid.thumb.err.txt")
+}
+
+func TestColor(t *testing.T) {
+	startserver(t)
+	defer shutdown(t)
+
+	var colors Colors
+	getObject(t, "color/png.png", &colors)
+	assertEqualsInt(t, "", 7, len(colors.Dominant))
+	assertTrue(t, "", len(colors.Palette) > 0)
+	assertEqualsStr(t, "", colors.Dominant, colors.Palette[0])
+
+	for _, path := range []string{"video.mp4", "dont_exist.jpg", "exif_rotate"} {
+		resp, err := http.Get(baseURL + "/color/" + path)
+		assertExpectNoErr(t, path, err)
+		resp.Body.Close()
+		assertEqualsInt(t, path, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	assertTrue(t, "Ready without generation on startup", media.isReady())
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	status := func(path string) int {
+		resp, err := http.Get(baseURL + path)
+		assertExpectNoErr(t, "", err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// No authentication required
+	assertEqualsInt(t, "", http.StatusOK, status("/healthz"))
+	assertEqualsInt(t, "", http.StatusOK, status("/readyz"))
+	assertEqualsInt(t, "", http.StatusUnauthorized, status("/folder"))
+
+	media.progressMutex.Lock()
+	media.ready = false
+	media.progressMutex.Unlock()
+	assertEqualsInt(t, "", http.StatusOK, status("/healthz"))
+	assertEqualsInt(t, "", http.StatusServiceUnavailable, status("/readyz"))
+
+	media.setReady()
+	assertEqualsInt(t, "", http.StatusOK, status("/readyz"))
+}
+
+func TestCapabilities(t *testing.T) {
+	media := createMedia("testmedia", "tmpcache/TestCapabilities", true, false, false, false, true, true, true, 1280, false, false, false, false,
+		mediaOptions{videoExtensions: []string{".mp4"}})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	// No authentication required
+	var capabilities Capabilities
+	getObject(t, "capabilities", &capabilities)
+	assertEqualsBool(t, "", true, capabilities.AuthRequired)
+	assertEqualsBool(t, "", true, capabilities.Previews)
+	assertEqualsBool(t, "", true, capabilities.AlbumThumbnails)
+	assertEqualsBool(t, "", hasVideoThumbnailSupport(), capabilities.VideoThumbnails)
+	assertEqualsStr(t, "", strings.Join(defaultImgExtensions, ","), strings.Join(capabilities.Formats.Images, ","))
+	assertEqualsStr(t, "", ".mp4", strings.Join(capabilities.Formats.Videos, ","))
+	assertEqualsStr(t, "", "jpeg", capabilities.Formats.Preview)
+
+	// Other requests still require authentication
+	resp, err := http.Get(baseURL + "/recent")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestCapabilitiesDefaultFolder(t *testing.T) {
+	mediaPath := "tmpout/TestCapabilitiesDefaultFolder"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/2024", os.ModePerm)
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{defaultFolder: "2024"})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var capabilities Capabilities
+	getObject(t, "capabilities", &capabilities)
+	assertEqualsStr(t, "", "2024", capabilities.DefaultFolder)
+
+	// Not provided if removed after startup
+	os.RemoveAll(mediaPath + "/2024")
+	capabilities = Capabilities{}
+	getObject(t, "capabilities", &capabilities)
+	assertEqualsStr(t, "", "", capabilities.DefaultFolder)
+}
+
+func TestFolderConfig(t *testing.T) {
+	mediaPath := "tmpout/TestFolderConfig"
+	cachePath := "tmpcache/TestFolderConfig"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/sub/a.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/sub/b.png")
+	content := `{"order": "desc", "cover": "b.png"}`
+	err := os.WriteFile(mediaPath+"/sub/"+folderConfigFileName, []byte(content), 0644)
+	assertExpectNoErr(t, "", err)
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var files []File
+	getObject(t, "folder/sub", &files)
+	assertEqualsInt(t, "", 2, len(files))
+	assertEqualsStr(t, "", "b.png", files[0].Name)
+	assertEqualsStr(t, "", "a.jpg", files[1].Name)
+
+	// The cover thumbnail is used as album thumbnail
+	coverThumb := getBinary(t, "thumb/sub/b.png", "image/jpeg")
+	albumThumb := getBinary(t, "thumb/sub", "image/jpeg")
+	assertTrue(t, "", bytes.Equal(coverThumb, albumThumb))
+}
+
+func TestFolderCounts(t *testing.T) {
+	mediaPath := "tmpout/TestFolderCounts"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/album/sub", os.ModePerm)
+	os.MkdirAll(mediaPath+"/empty", os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/album/jpeg.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/album/png.png")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/album/video.mp4")
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	// Not included by default
+	var files []File
+	getObject(t, "folder", &files)
+	assertEqualsInt(t, "", 3, len(files))
+	assertEqualsInt(t, "", 0, files[0].ImageCount)
+
+	files = nil
+	getObject(t, "folder?counts=true", &files)
+	assertEqualsInt(t, "", 3, len(files))
+	assertEqualsStr(t, "", "album", files[0].Name)
+	assertEqualsInt(t, "", 2, files[0].ImageCount)
+	assertEqualsInt(t, "", 1, files[0].VideoCount)
+	assertEqualsInt(t, "", 1, files[0].FolderCount)
+	assertEqualsStr(t, "", "empty", files[1].Name)
+	assertEqualsInt(t, "", 0, files[1].ImageCount)
+	assertEqualsInt(t, "", 0, files[1].FolderCount)
+	assertEqualsStr(t, "", "png.png", files[2].Name)
+	assertEqualsInt(t, "Not a folder", 0, files[2].ImageCount)
+}
+
+func TestAnimatedThumbnailContentType(t *testing.T) {
+	media := createMedia("testmedia", "tmpcache/TestAnimatedThumbnailContentType", true, true, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{gifAnimatedThumbs: true})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	thumb := getBinary(t, "thumb/gif.gif", "image/gif")
+	assertEqualsStr(t, "", "GIF8", string(thumb[:4]))
+	getBinary(t, "thumb/png.png", "image/jpeg")
+}
+
+func TestVideoContactSheetThumbnail(t *testing.T) {
+	mediaPath := "tmpout/TestVideoContactSheetThumbnail"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/video.mp4")
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	ffmpegPath := createFakeFFmpeg(t, "tmpout/TestVideoContactSheetThumbnailBin")
+	media := createMedia(mediaPath, "tmpcache/TestVideoContactSheetThumbnail", true, true, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{videoContactSheet: true, ffmpegPath: ffmpegPath})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	sheet, err := imaging.Decode(bytes.NewReader(getBinary(t, "thumb/video.mp4?contactsheet=true", "image/jpeg")))
+	assertExpectNoErr(t, "", err)
+	assertEqualsInt(t, "4x3 frames", 4*contactTileWidth, sheet.Bounds().Dx())
+	assertEqualsInt(t, "4x3 frames", 3*contactTileHeight, sheet.Bounds().Dy())
+
+	// Ordinary thumbnail without the parameter and for images
+	thumb, err := imaging.Decode(bytes.NewReader(getBinary(t, "thumb/video.mp4", "image/jpeg")))
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "", thumb.Bounds().Dx() <= 256)
+	thumb, err = imaging.Decode(bytes.NewReader(getBinary(t, "thumb/png.png?contactsheet=true", "image/jpeg")))
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "", thumb.Bounds().Dx() <= 256)
+}
+
+func TestFolderBlurHash(t *testing.T) {
+	mediaPath := "tmpout/TestFolderBlurHash"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath+"/sub", os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/txt.txt", mediaPath+"/txt.txt")
+	media := createMedia(mediaPath, "tmpcache/TestFolderBlurHash", true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	// Not included by default
+	var files []File
+	getObject(t, "folder", &files)
+	assertEqualsInt(t, "", 2, len(files))
+	assertEqualsStr(t, "", "", files[0].BlurHash+files[1].BlurHash)
+
+	files = nil
+	getObject(t, "folder?blurhash=true", &files)
+	assertEqualsInt(t, "", 2, len(files))
+	for _, file := range files {
+		if file.Type == "image" {
+			assertEqualsInt(t, file.Name, 28, len(file.BlurHash))
+		} else {
+			assertEqualsStr(t, file.Name, "", file.BlurHash)
+		}
+	}
+}
+
+func TestFolderTag(t *testing.T) {
+	startserver(t)
+	defer shutdown(t)
+
+	var files []File
+	getObject(t, "folder?tag=samsung", &files)
+	assertEqualsInt(t, "", 2, len(files))
+	for _, file := range files {
+		assertEqualsStr(t, "", "image", file.Type)
+	}
+	files = nil
+	getObject(t, "folder/exif_rotate?tag=2018", &files)
+	assertTrue(t, "", len(files) > 0)
+	files = nil
+	getObject(t, "folder?tag=Canon", &files)
+	assertEqualsInt(t, "", 0, len(files))
+}
+
+func TestRecent(t *testing.T) {
+	mediaPath := "tmpout/TestRecentWebAPI"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/jpeg.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/video.mp4", mediaPath+"/video.mp4")
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(mediaPath+"/jpeg.jpg", old, old)
+	media := createMedia(mediaPath, "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var files []RecentFile
+	getObject(t, "recent?limit=1&days=1&type=image", &files)
+	assertEqualsInt(t, "", 1, len(files))
+	assertEqualsStr(t, "", "png.png", files[0].Path)
+	assertEqualsStr(t, "", "image", files[0].Type)
+
+	for _, query := range []string{"limit=0", "limit=abc", "limit=1001", "days=0", "type=folder"} {
+		resp, err := http.Get(baseURL + "/recent?" + query)
+		assertExpectNoErr(t, "", err)
+		resp.Body.Close()
+		assertEqualsInt(t, query, http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestDimensions(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var dimensions Dimensions
+	getObject(t, "dimensions/exif_rotate/rotate_90deg_cw.jpg", &dimensions)
+	assertEqualsInt(t, "", 2322, dimensions.Width)
+	assertEqualsInt(t, "", 4128, dimensions.Height)
+
+	for _, path := range []string{"dont_exist.jpg", "txt.txt", "../main.go"} {
+		resp, err := http.Get(baseURL + "/dimensions/" + path)
+		assertExpectNoErr(t, "", err)
+		resp.Body.Close()
+		assertEqualsInt(t, path, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestThumbnailEXIFOrientation(t *testing.T) {
+	media := createMedia("testmedia", "", false, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{exifThumbNoRotate: true})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	resp, err := http.Get(baseURL + "/thumb/exif_rotate/rotate_90deg_cw.jpg")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsStr(t, "", "6", resp.Header.Get("X-Exif-Orientation"))
+
+	resp, err = http.Get(baseURL + "/thumb/exif_rotate/normal.jpg")
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsStr(t, "", "", resp.Header.Get("X-Exif-Orientation"))
+}
+
+// sendDelete sends a DELETE request and returns the status code
+func sendDelete(t *testing.T, path, user, pass string) int {
+	t.Helper()
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/%s", baseURL, path), nil)
+	assertExpectNoErr(t, "", err)
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestDeleteMedia(t *testing.T) {
+	mediaPath := "tmpout/TestDeleteMedia"
+	cachePath := "tmpcache/TestDeleteMedia"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	os.RemoveAll(cachePath)
+	copyFile(t, "testmedia/jpeg.jpg", mediaPath+"/jpeg.jpg")
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+
+	// Not allowed without authentication
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, true, 970, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	assertEqualsInt(t, "", http.StatusForbidden, sendDelete(t, "media/jpeg.jpg", "", ""))
+	assertFileExist(t, "", mediaPath+"/jpeg.jpg")
+	shutdown(t)
+
+	// Allowed when explicitly enabled
+	webAPI = CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{allowDelete: true})
+	webAPI.Start()
+	waitserver(t)
+	_, err := media.cache.generateThumbnail(media, "jpeg.jpg")
+	assertExpectNoErr(t, "", err)
+	getBinary(t, "media/jpeg.jpg", "image/jpeg")
+	assertFileExist(t, "", cachePath+"/jpeg.jpg.thumb.jpg")
+	assertFileExist(t, "", cachePath+"/jpeg.jpg.preview.jpg")
+	assertEqualsInt(t, "", http.StatusNoContent, sendDelete(t, "media/jpeg.jpg", "", ""))
+	assertFileNotExist(t, "", mediaPath+"/jpeg.jpg")
+	assertFileNotExist(t, "", cachePath+"/jpeg.jpg.thumb.jpg")
+	assertFileNotExist(t, "", cachePath+"/jpeg.jpg.preview.jpg")
+	assertFalse(t, "", media.cache.hasThumbnail("jpeg.jpg"))
+
+	// Already removed
+	assertEqualsInt(t, "", http.StatusNotFound, sendDelete(t, "media/jpeg.jpg", "", ""))
+	shutdown(t)
+
+	// Allowed when authenticated
+	webAPI = CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	assertEqualsInt(t, "", http.StatusUnauthorized, sendDelete(t, "media/png.png", "", ""))
+	assertEqualsInt(t, "", http.StatusNoContent, sendDelete(t, "media/png.png", "myuser", "mypass"))
+	assertFileNotExist(t, "", mediaPath+"/png.png")
+	shutdown(t)
+
+	// Path traversal
+	err = media.deleteMedia("../../testmedia/jpeg.jpg")
+	assertExpectErr(t, "", err)
+	assertFileExist(t, "", "testmedia/jpeg.jpg")
+}
+
+// sendUpload sends a PUT request and returns the response
+func sendUpload(t *testing.T, path, user, pass string, content []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/%s", baseURL, path), bytes.NewReader(content))
+	assertExpectNoErr(t, "", err)
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	return resp
+}
+
+func TestUploadMedia(t *testing.T) {
+	mediaPath := "tmpout/TestUploadMedia"
+	cachePath := "tmpcache/TestUploadMedia"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	os.RemoveAll(cachePath)
+	content, err := os.ReadFile("testmedia/png.png")
+	assertExpectNoErr(t, "", err)
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+
+	// Not allowed unless enabled
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	resp := sendUpload(t, "media/png.png", "myuser", "mypass", content)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusForbidden, resp.StatusCode)
+	shutdown(t)
+
+	webAPI = CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{
+		allowUpload: true, maxUploadSize: int64(len(content)), viewers: passwords{"anna": "secret"}})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	resp = sendUpload(t, "media/png.png", "", "", content)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusUnauthorized, resp.StatusCode)
+	resp = sendUpload(t, "media/png.png", "anna", "secret", content)
+	resp.Body.Close()
+	assertEqualsInt(t, "Viewer", http.StatusForbidden, resp.StatusCode)
+
+	// Created, with meta data
+	resp = sendUpload(t, "media/sub/png.png", "myuser", "mypass", content)
+	assertEqualsInt(t, "", http.StatusCreated, resp.StatusCode)
+	var metaData MetaData
+	assertExpectNoErr(t, "", json.NewDecoder(resp.Body).Decode(&metaData))
+	resp.Body.Close()
+	assertEqualsStr(t, "", "sub/png.png", metaData.Path)
+	assertEqualsStr(t, "", "image", metaData.Type)
+	assertTrue(t, "", metaData.Width > 0)
+	assertFileExist(t, "", mediaPath+"/sub/png.png")
+
+	// Already exist, unless overwrite
+	resp = sendUpload(t, "media/sub/png.png", "myuser", "mypass", content)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusConflict, resp.StatusCode)
+	resp = sendUpload(t, "media/sub/png.png?overwrite=true", "myuser", "mypass", content)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+
+	// Too large, not media and traversal
+	resp = sendUpload(t, "media/large.png", "myuser", "mypass", append(content, 0))
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assertFileNotExist(t, "", mediaPath+"/large.png")
+	resp = sendUpload(t, "media/text.txt", "myuser", "mypass", []byte("text"))
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusBadRequest, resp.StatusCode)
+	resp = sendUpload(t, "media/../png.png", "myuser", "mypass", content)
+	resp.Body.Close()
+	assertTrue(t, "", resp.StatusCode != http.StatusCreated)
+	assertFileNotExist(t, "", "tmpout/png.png")
+}
+
+func TestUploadFiles(t *testing.T) {
+	mediaPath := "tmpout/TestUploadFiles"
+	cachePath := "tmpcache/TestUploadFiles"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	os.MkdirAll(mediaPath+"/album", os.ModePerm)
+	os.RemoveAll(cachePath)
+	content, err := os.ReadFile("testmedia/png.png")
+	assertExpectNoErr(t, "", err)
+	copyFile(t, "testmedia/png.png", mediaPath+"/album/exist.png")
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{
+		allowUpload: true, maxUploadSize: int64(len(content))})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("comment", "not a file")
+	for name, data := range map[string][]byte{
+		"png.png": content, "exist.png": content, "text.txt": []byte("text"), "large.png": append(content, 0)} {
+		part, err := writer.CreateFormFile("files", name)
+		assertExpectNoErr(t, "", err)
+		part.Write(data)
+	}
+	writer.Close()
+	req, err := http.NewRequest("POST", baseURL+"/upload/album", &body)
+	assertExpectNoErr(t, "", err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.SetBasicAuth("myuser", "mypass")
+	resp, err := http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	defer resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusOK, resp.StatusCode)
+	var results []UploadResult
+	assertExpectNoErr(t, "", json.NewDecoder(resp.Body).Decode(&results))
+	assertEqualsInt(t, "", 4, len(results))
+	for _, result := range results {
+		switch result.Name {
+		case "png.png":
+			assertEqualsStr(t, "", "", result.Error)
+			assertEqualsStr(t, "", "album/png.png", result.Path)
+			assertFileExist(t, "", mediaPath+"/album/png.png")
+		case "exist.png":
+			assertEqualsStr(t, "", "already exist", result.Error)
+		case "large.png":
+			assertEqualsStr(t, "", "too large", result.Error)
+			assertFileNotExist(t, "", mediaPath+"/album/large.png")
+		default:
+			assertTrue(t, "", result.Error != "")
+			assertFileNotExist(t, "", mediaPath+"/album/text.txt")
+		}
+	}
+
+	// Not a multipart request
+	req, err = http.NewRequest("POST", baseURL+"/upload/album", strings.NewReader("data"))
+	assertExpectNoErr(t, "", err)
+	req.SetBasicAuth("myuser", "mypass")
+	resp, err = http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestViewers(t *testing.T) {
+	mediaPath := "tmpout/TestViewers"
+	cachePath := "tmpcache/TestViewers"
+	os.RemoveAll(mediaPath)
+	os.MkdirAll(mediaPath, os.ModePerm)
+	os.RemoveAll(cachePath)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{
+		viewers: passwords{"anna": "secret"}})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	// Viewers may browse but not change anything
+	getHTMLAuthenticate(t, "index.html", "anna", "secret", false)
+	getHTMLAuthenticate(t, "index.html", "anna", "mypass", true)
+	assertEqualsInt(t, "", http.StatusForbidden, sendDelete(t, "media/png.png", "anna", "secret"))
+	assertFileExist(t, "", mediaPath+"/png.png")
+	req, err := http.NewRequest("POST", baseURL+"/prune", nil)
+	assertExpectNoErr(t, "", err)
+	req.SetBasicAuth("anna", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusForbidden, resp.StatusCode)
+
+	// Also when logged in
+	session := webAPI.createSession("anna", time.Now().Add(time.Hour))
+	assertEqualsStr(t, "", "anna", webAPI.sessionUser(session))
+	req, err = http.NewRequest("DELETE", baseURL+"/media/png.png", nil)
+	assertExpectNoErr(t, "", err)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session})
+	resp, err = http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusForbidden, resp.StatusCode)
+
+	// The admin user may
+	assertEqualsInt(t, "", http.StatusNoContent, sendDelete(t, "media/png.png", "myuser", "mypass"))
+	assertFileNotExist(t, "", mediaPath+"/png.png")
+}
+
+func TestFolderACL(t *testing.T) {
+	mediaPath := "tmpout/TestFolderACL"
+	cachePath := "tmpcache/TestFolderACL"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath+"/family/private", os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/family/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/family/private/png.png")
+	os.WriteFile(mediaPath+"/family/"+folderACLFileName, []byte("anna\nbert\n"), 0644)
+	os.WriteFile(mediaPath+"/family/private/"+folderACLFileName, []byte("anna\n"), 0644)
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{
+		viewers: passwords{"anna": "secret", "bert": "secret", "carl": "secret"}})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	get := func(path, user string) (int, []File) {
+		req, err := http.NewRequest("GET", baseURL+"/"+path, nil)
+		assertExpectNoErr(t, "", err)
+		password := "secret"
+		if user == "myuser" {
+			password = "mypass"
+		}
+		req.SetBasicAuth(user, password)
+		resp, err := http.DefaultClient.Do(req)
+		assertExpectNoErr(t, "", err)
+		defer resp.Body.Close()
+		var files []File
+		if strings.HasPrefix(path, "folder") && resp.StatusCode == http.StatusOK {
+			assertExpectNoErr(t, path, json.NewDecoder(resp.Body).Decode(&files))
+		}
+		return resp.StatusCode, files
+	}
+
+	// The folder is hidden and forbidden for others
+	status, files := get("folder", "carl")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertEqualsInt(t, "Only png.png", 1, len(files))
+	for _, path := range []string{"folder/family", "media/family/png.png", "thumb/family/png.png", "thumb/family",
+		"folder/family/private", "media/family/private/png.png"} {
+		status, _ = get(path, "carl")
+		assertEqualsInt(t, path, http.StatusForbidden, status)
+	}
+	status, _ = get("media/png.png", "carl")
+	assertEqualsInt(t, "", http.StatusOK, status)
+
+	// Listed users, also in sub folders unless limited further
+	status, files = get("folder", "bert")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertEqualsInt(t, "", 2, len(files))
+	status, files = get("folder/family", "bert")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertEqualsInt(t, "private is hidden", 1, len(files))
+	status, _ = get("media/family/png.png", "bert")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	status, _ = get("thumb/family/png.png", "bert")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	status, _ = get("media/family/private/png.png", "bert")
+	assertEqualsInt(t, "", http.StatusForbidden, status)
+	status, _ = get("media/family/private/png.png", "anna")
+	assertEqualsInt(t, "", http.StatusOK, status)
+
+	// The admin user may access everything
+	status, files = get("folder/family", "myuser")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertEqualsInt(t, "", 2, len(files))
+	status, _ = get("media/family/private/png.png", "myuser")
+	assertEqualsInt(t, "", http.StatusOK, status)
+}
+
+func TestFolderACLEndpoints(t *testing.T) {
+	mediaPath := "tmpout/TestFolderACLEndpoints"
+	cachePath := "tmpcache/TestFolderACLEndpoints"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.MkdirAll(mediaPath+"/family", os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	copyFile(t, "testmedia/png.png", mediaPath+"/family/png.png")
+	os.WriteFile(mediaPath+"/family/"+folderACLFileName, []byte("anna\n"), 0644)
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "myuser", "mypass", "", "", webAPIOptions{
+		viewers: passwords{"anna": "secret", "carl": "secret"}})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	get := func(path, user string) (int, []byte) {
+		req, err := http.NewRequest("GET", baseURL+"/"+path, nil)
+		assertExpectNoErr(t, "", err)
+		req.SetBasicAuth(user, "secret")
+		resp, err := http.DefaultClient.Do(req)
+		assertExpectNoErr(t, "", err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assertExpectNoErr(t, "", err)
+		return resp.StatusCode, body
+	}
+	zipNames := func(body []byte) []string {
+		zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		assertExpectNoErr(t, "", err)
+		names := []string{}
+		for _, file := range zipReader.File {
+			names = append(names, file.Name)
+		}
+		return names
+	}
+	searchPaths := func(body []byte) []string {
+		var results []SearchResult
+		assertExpectNoErr(t, "", json.Unmarshal(body, &results))
+		paths := []string{}
+		for _, result := range results {
+			paths = append(paths, result.Path)
+		}
+		return paths
+	}
+
+	// Forbidden folder and files
+	for _, path := range []string{"download/family", "search/family?q=png", "thumbsheet/family", "color/family/png.png",
+		"dimensions/family/png.png", "progressive/family/png.png", "similar/family/png.png", "duplicates/family"} {
+		status, _ := get(path, "carl")
+		assertEqualsInt(t, path, http.StatusForbidden, status)
+	}
+	req, err := http.NewRequest("POST", baseURL+"/batchmeta", strings.NewReader(`["png.png", "family/png.png"]`))
+	assertExpectNoErr(t, "", err)
+	req.SetBasicAuth("carl", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	assertExpectNoErr(t, "", err)
+	resp.Body.Close()
+	assertEqualsInt(t, "", http.StatusForbidden, resp.StatusCode)
+
+	// The forbidden folder is left out of downloads and results
+	status, body := get("download", "carl")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertEqualsStr(t, "", "png.png", strings.Join(zipNames(body), ","))
+	status, body = get("search?q=png&recursive=true", "carl")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertEqualsStr(t, "", "png.png", strings.Join(searchPaths(body), ","))
+	status, body = get("recent", "carl")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertFalse(t, "", strings.Contains(string(body), "family"))
+	status, body = get("duplicates?recursive=true", "carl")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertEqualsStr(t, "No duplicates left", "[]", strings.TrimSpace(string(body)))
+
+	// Listed users get everything
+	status, body = get("download", "anna")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertEqualsStr(t, "", "family/png.png,png.png", strings.Join(zipNames(body), ","))
+	status, body = get("search?q=png&recursive=true", "anna")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertEqualsInt(t, "", 2, len(searchPaths(body)))
+	status, body = get("duplicates?recursive=true", "anna")
+	assertEqualsInt(t, "", http.StatusOK, status)
+	assertTrue(t, "", strings.Contains(string(body), "family/png.png"))
+}
+
+func TestTrashRestore(t *testing.T) {
+	mediaPath := "tmpout/TestTrashRestore"
+	cachePath := "tmpcache/TestTrashRestore"
+	os.RemoveAll(mediaPath)
+	os.RemoveAll(cachePath)
+	os.RemoveAll("tmpout/TestTrashRestoreTrash")
+	os.MkdirAll(mediaPath, os.ModePerm)
+	copyFile(t, "testmedia/png.png", mediaPath+"/png.png")
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false,
+		mediaOptions{trashPath: "tmpout/TestTrashRestoreTrash"})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{allowDelete: true})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	restore := func(body string) int {
+		resp, err := http.Post(baseURL+"/trash/restore", "application/json", strings.NewReader(body))
+		assertExpectNoErr(t, "", err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assertEqualsInt(t, "", http.StatusNoContent, sendDelete(t, "media/png.png", "", ""))
+	assertFileNotExist(t, "", mediaPath+"/png.png")
+	assertEqualsInt(t, "", http.StatusNoContent, restore(`{"Path": "png.png"}`))
+	assertFileExist(t, "", mediaPath+"/png.png")
+	assertEqualsInt(t, "", http.StatusConflict, restore(`{"Path": "png.png"}`))
+	assertEqualsInt(t, "", http.StatusNotFound, restore(`{"Path": "dont_exist.png"}`))
+	assertEqualsInt(t, "", http.StatusBadRequest, restore(`{}`))
+	assertEqualsInt(t, "", http.StatusBadRequest, restore(`{"Path": "../png.png"}`))
+}
+
+func TestRootFolder(t *testing.T) {
+	mediaPath, cachePath := rootPaths("testmedia", "tmpcache/TestRootFolder", "exif_rotate")
+	assertEqualsStr(t, "", filepath.Join("testmedia", "exif_rotate"), mediaPath)
+	assertEqualsStr(t, "", filepath.Join("tmpcache", "TestRootFolder", "exif_rotate"), cachePath)
+	media := createMedia(mediaPath, cachePath, true, false, false, false, true, true, false, 0, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9834, "", "templates", media, "", "", "", "", webAPIOptions{})
+	webAPI.Start()
+	waitserver(t)
+	defer shutdown(t)
+
+	var files []File
+	getObject(t, "folder", &files)
+	assertEqualsInt(t, "", 9, len(files))
+	for _, file := range files {
+		assertEqualsStr(t, "", file.Name, file.Path)
+	}
+	getBinary(t, "media/normal.jpg", "image/jpeg")
+
+	// Not possible to reach the media path above the root folder
+	for _, path := range []string{"media/jpeg.jpg", "media/../jpeg.jpg", "thumb/../jpeg.jpg"} {
+		resp, err := http.Get(fmt.Sprintf("%s/%s", baseURL, path))
+		assertExpectNoErr(t, "", err)
+		resp.Body.Close()
+		assertEqualsInt(t, path, http.StatusNotFound, resp.StatusCode)
+	}
+	_, err := media.getFullMediaPath("../jpeg.jpg")
+	assertExpectErr(t, "", err)
+
+	mediaPath, cachePath = rootPaths("testmedia", "tmpcache", "")
+	assertEqualsStr(t, "", "testmedia", mediaPath)
+	assertEqualsStr(t, "", "tmpcache", cachePath)
+}
+
+func TestLogFileOpenWhileServing(t *testing.T) {
+	os.RemoveAll("tmpout/TestLogFileOpenWhileServing")
+	os.MkdirAll("tmpout/TestLogFileOpenWhileServing", os.ModePerm)
+	logPath := "tmpout/TestLogFileOpenWhileServing/mediaweb.log"
+	contents := "port = 9834\nmediapath = testmedia\nenablethumbcache = off\nlogfile = " + logPath + "\n"
+	confPaths = []string{createConfigFile(t, "TestLogFileOpenWhileServing.conf", contents)}
+	formatter, level := log.StandardLogger().Formatter, log.GetLevel()
+	defer func() {
+		confPaths = defaultConfPaths
+		log.SetOutput(os.Stderr)
+		log.SetFormatter(formatter)
+		log.SetLevel(level)
+	}()
+
+	webAPI := mainCommon()
+	log.Info("Logged after mainCommon returned")
+	done := webAPI.Start()
+	waitserver(t)
+	getHTML(t, "index.html")
+	webAPI.Stop()
+	<-done
+	http.DefaultServeMux = new(http.ServeMux)
+
+	content, err := os.ReadFile(logPath)
+	assertExpectNoErr(t, "", err)
+	assertTrue(t, "", strings.Contains(string(content), "Logged after mainCommon returned"))
+	assertTrue(t, "", strings.Contains(string(content), "Starting Web API"))
+	assertTrue(t, "", strings.Contains(string(content), "Closing log file"))
+
+	// Closed when the server has stopped, later logging is on stderr
+	log.Info("Logged after the server stopped")
+	content, _ = os.ReadFile(logPath)
+	assertFalse(t, "", strings.Contains(string(content), "Logged after the server stopped"))
+}
+
+func TestContentDisposition(t *testing.T) {
+	assertEqualsStr(t, "", "attachment; filename=\"photos.zip\"; filename*=UTF-8''photos.zip",
+		contentDisposition("attachment", "photos.zip"))
+	assertEqualsStr(t, "", "attachment; filename=\"Sm_rg_sbord 2024.zip\"; filename*=UTF-8''Sm%C3%B6rg%C3%A5sbord%202024.zip",
+		contentDisposition("attachment", "Smörgåsbord 2024.zip"))
+	assertEqualsStr(t, "", "inline; filename=\"__.jpg\"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.jpg",
+		contentDisposition("inline", "日本.jpg"))
+	assertEqualsStr(t, "", "attachment; filename=\"a_b_.jpg\"; filename*=UTF-8''a%22b%5C.jpg",
+		contentDisposition("attachment", "a\"b\\.jpg"))
+}
+
 func TestTLS(t *testing.T) {
-	media := createMedia("testmedia", "tmpcache/TestTLS", true, false, false, false, true, true, true, 1280, false, false, false, false)
-	webAPI := CreateWebAPI(9835, "", "templates", media, "", "", "configs/example.crt", "configs/example.key")
+	media := createMedia("testmedia", "tmpcache/TestTLS", true, false, false, false, true, true, true, 1280, false, false, false, false, mediaOptions{})
+	webAPI := CreateWebAPI(9835, "", "templates", media, "", "", "configs/example.crt", "configs/example.key", webAPIOptions{})
 	webAPI.Start()
 
 	// Create the client
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
 	}
 	httpsClient := &http.Client{Transport: tr, Timeout: 100 * time.Millisecond}
 
@@ -351,6 +2480,14 @@ func TestTLS(t *testing.T) {
 	defer resp.Body.Close()
 	assertEqualsInt(t, "", int(http.StatusOK), int(resp.StatusCode))
 	assertEqualsStr(t, "", "text/html", resp.Header.Get("content-type"))
+	assertEqualsStr(t, "", "HTTP/2.0", resp.Proto)
+	assertEqualsInt(t, "", tls.VersionTLS13, int(resp.TLS.Version))
+
+	// TLS 1.1 shall not be allowed
+	oldTLSClient := &http.Client{Timeout: 1 * time.Second, Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11}}}
+	_, err = oldTLSClient.Get(baseHttpsURL)
+	assertExpectErr(t, "TLS 1.1 shall not be allowed", err)
 
 	// Shutdown the server
 	// No answer expected on POST shutdown (short timeout)